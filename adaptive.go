@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"time"
+)
+
+// minAdaptiveChunkSize is the smallest size WithAdaptiveChunkSize shrinks
+// chunks to, unless the op started out smaller.
+const minAdaptiveChunkSize = 16 * 1024
+
+// WithAdaptiveChunkSize makes ChunkingApply and ChunkingApplyReader size each
+// chunk by how long the ones before it took to apply, so that large writes
+// don't trip apply timeouts on slow clusters. Chunks start out at the chunk
+// size; the size is halved, down to 16KiB, after a chunk that took longer
+// than target to apply, and doubled after one that took less than half of
+// it, up to the starting size or the limit given with WithMaxChunkSize. Each
+// chunk is waited on before the next is sent, as with WithSequentialApply.
+// Since the number of chunks isn't known until the last one, ops are sent as
+// streamed ops are, so all nodes must understand streaming, and can't be
+// resumed. It is ignored by ChunkingApplyWithLogs, SplitIntoLogs and the FSM.
+func WithAdaptiveChunkSize(target time.Duration) Option {
+	return func(c *config) {
+		c.adaptiveTarget = target
+	}
+}
+
+// applyAdaptive applies cmd as a streamed op whose chunks are sized as they
+// go.
+func applyAdaptive(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config, op *opParams) ChunkingFuture {
+	cmd, err := op.compress(conf, cmd)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	return applyStream(bytes.NewReader(cmd), extensions, timeout, applyFunc, conf, op)
+}
+
+// adapt resizes the chunks that follow one that took latency to apply. The
+// chunk already read ahead keeps its size.
+func (st *stream) adapt(latency time.Duration) {
+	target := st.conf.adaptiveTarget
+	switch {
+	case latency > target:
+		floor := minAdaptiveChunkSize
+		if st.op.chunkSize < floor {
+			floor = st.op.chunkSize
+		}
+		size := st.chunkSize / 2
+		if size < floor {
+			size = floor
+		}
+		prev := st.chunkSize
+		st.chunkSize = size
+		if _, err := st.budget(st.seq); err != nil {
+			// Too small to hold the headers
+			st.chunkSize = prev
+		}
+	case latency < target/2:
+		st.chunkSize *= 2
+		if st.chunkSize > st.maxChunkSize {
+			st.chunkSize = st.maxChunkSize
+		}
+	}
+}
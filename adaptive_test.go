@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestApplyChunking_AdaptiveChunkSize(t *testing.T) {
+	data := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		opts []Option
+
+		// perChunk is how long a chunk of 64KiB takes to apply
+		perChunk time.Duration
+		check    func(first, last, largest int) bool
+	}{
+		"shrinks": {
+			opts:     []Option{WithAdaptiveChunkSize(10 * time.Millisecond)},
+			perChunk: 4 * time.Millisecond,
+			check: func(first, last, largest int) bool {
+				return last <= first/2 && largest <= ChunkSize
+			},
+		},
+		"grows": {
+			opts: []Option{WithAdaptiveChunkSize(time.Second), WithChunkSize(64 * 1024), WithMaxChunkSize(1024 * 1024)},
+			check: func(first, last, largest int) bool {
+				return first <= 64*1024 && largest > 512*1024 && largest <= 1024*1024
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil)
+			var sizes []int
+			applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+				sizes = append(sizes, len(l.Data)+len(l.Extensions))
+				time.Sleep(tc.perChunk * time.Duration(len(l.Data)) / (64 * 1024))
+				return appliedFuture{resp: f.Apply(&l)}
+			}
+			if err := ChunkingApply(data, []byte("ext"), time.Second, applyFunc, tc.opts...).Error(); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.logs) != 1 || !bytes.Equal(data, m.logs[0]) {
+				t.Fatalf("expected op to be applied, got %d logs", len(m.logs))
+			}
+
+			// The last chunk holds whatever is left, so judge by the one
+			// before it
+			largest := 0
+			for _, size := range sizes {
+				if size > largest {
+					largest = size
+				}
+			}
+			if len(sizes) < 3 || !tc.check(sizes[0], sizes[len(sizes)-2], largest) {
+				t.Fatalf("unexpected chunk sizes %v", sizes)
+			}
+		})
+	}
+}
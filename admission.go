@@ -0,0 +1,69 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import "fmt"
+
+// Admission is the answer from AdmissionCheck.
+type Admission int
+
+const (
+	// AdmitNow means the op fits within the backlog limits and can be
+	// started.
+	AdmitNow Admission = iota
+
+	// AdmitDefer means the op would take the backlog over its limits as it
+	// stands, and should be retried once other ops have completed.
+	AdmitDefer
+
+	// AdmitReject means the op could never fit within the limits, even with
+	// an empty backlog.
+	AdmitReject
+)
+
+func (a Admission) String() string {
+	switch a {
+	case AdmitNow:
+		return "admit"
+	case AdmitDefer:
+		return "defer"
+	case AdmitReject:
+		return "reject"
+	default:
+		return fmt.Sprintf("Admission(%d)", int(a))
+	}
+}
+
+// WithBacklogLimits sets the limits on the FSM's backlog of incomplete ops
+// that AdmissionCheck enforces: at most maxOps ops and maxBytes bytes of
+// chunk data pending at once. Zero means no limit. The limits are advisory;
+// the FSM never refuses chunks because of them, since all nodes must apply
+// the same logs alike. It is ignored by ChunkingApply.
+func WithBacklogLimits(maxOps, maxBytes uint64) Option {
+	return func(c *config) {
+		c.maxPendingOps = maxOps
+		c.maxPendingBytes = maxBytes
+	}
+}
+
+// AdmissionCheck reports whether a new chunked op with a payload of size
+// bytes should be started now given the FSM's current backlog and the limits
+// set with WithBacklogLimits, so that applications can shed load before an
+// op is started that would saturate raft. It is meant to be called on the
+// leader before ChunkingApply and, like PendingOps, is cheap and safe to call
+// concurrently with Apply. The answer is only a snapshot: concurrent callers
+// may each be admitted and together exceed the limits.
+func (c *ChunkingFSM) AdmissionCheck(size uint64) Admission {
+	maxOps, maxBytes := c.conf.maxPendingOps, c.conf.maxPendingBytes
+	if maxBytes != 0 && size > maxBytes {
+		return AdmitReject
+	}
+	if maxOps != 0 && c.PendingOps() >= maxOps {
+		return AdmitDefer
+	}
+	if maxBytes != 0 && c.PendingBytes() > maxBytes-size {
+		return AdmitDefer
+	}
+	return AdmitNow
+}
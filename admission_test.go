@@ -0,0 +1,48 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFSM_AdmissionCheck(t *testing.T) {
+	logs := auditLogs(t, time.Now())
+	chunkBytes := uint64(len(logs[0].Data))
+
+	f := NewChunkingFSM(new(MockFSM), nil)
+	f.Apply(logs[0])
+	if a := f.AdmissionCheck(1 << 40); a != AdmitNow {
+		t.Fatalf("expected no limits to admit, got %s", a)
+	}
+
+	f = NewChunkingFSM(new(MockFSM), nil, WithBacklogLimits(0, 3*chunkBytes))
+	if a := f.AdmissionCheck(4 * chunkBytes); a != AdmitReject {
+		t.Fatalf("expected oversized op to be rejected, got %s", a)
+	}
+	f.Apply(logs[0])
+	f.Apply(logs[1])
+	if a := f.AdmissionCheck(chunkBytes); a != AdmitNow {
+		t.Fatalf("expected op that fits to be admitted, got %s", a)
+	}
+	if a := f.AdmissionCheck(2 * chunkBytes); a != AdmitDefer {
+		t.Fatalf("expected op that doesn't fit yet to be deferred, got %s", a)
+	}
+
+	f = NewChunkingFSM(new(MockFSM), nil, WithBacklogLimits(1, 0))
+	if a := f.AdmissionCheck(chunkBytes); a != AdmitNow {
+		t.Fatalf("expected op to be admitted, got %s", a)
+	}
+	f.Apply(logs[0])
+	if a := f.AdmissionCheck(chunkBytes); a != AdmitDefer {
+		t.Fatalf("expected op to be deferred at the op limit, got %s", a)
+	}
+	for _, l := range logs[1:] {
+		f.Apply(l)
+	}
+	if a := f.AdmissionCheck(chunkBytes); a != AdmitNow {
+		t.Fatalf("expected op to be admitted once the backlog cleared, got %s", a)
+	}
+}
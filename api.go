@@ -4,21 +4,24 @@
 package raftchunking
 
 import (
-	"bytes"
-	"crypto/rand"
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-raftchunking/types"
 	"github.com/hashicorp/raft"
-	proto "google.golang.org/protobuf/proto"
 )
 
 var (
-	// ChunkSize is the threshold used for breaking a large value into chunks.
-	// Defaults to the suggested max data size for the raft library.
+	// ChunkSize is the threshold used for breaking a large value into chunks,
+	// unless overridden for an op with WithChunkSize. Defaults to the
+	// suggested max data size for the raft library, which is also the largest
+	// size allowed unless WithMaxChunkSize raises it.
 	ChunkSize = raft.SuggestedMaxDataSize
 )
 
@@ -39,21 +42,73 @@ func (e errorFuture) Index() uint64 {
 	return 0
 }
 
+// MultiFuture is implemented by the futures returned from ChunkingApply,
+// ChunkingResume and ChunkingApplyWithLogs.
+type MultiFuture interface {
+	raft.ApplyFuture
+
+	// Futures returns the futures of the op's chunks in the order they were
+	// submitted, so that the chunk that failed, and its index and
+	// response, can be found. Chunks that weren't submitted because the op
+	// had already failed have futures returning that error. For ops from
+	// ChunkingResume only the resent chunks are included. It is nil if
+	// the op failed before any chunks were submitted.
+	Futures() []raft.ApplyFuture
+}
+
+var (
+	_ MultiFuture = errorFuture{}
+	_ MultiFuture = multiFuture(nil)
+)
+
+// Futures returns nil since nothing was submitted.
+func (e errorFuture) Futures() []raft.ApplyFuture {
+	return nil
+}
+
 // multiFuture is a future specialized for the chunking case. It contains some
 // number of other futures in the order in which data was chunked and sent to
 // apply.
 type multiFuture []raft.ApplyFuture
 
+func (m multiFuture) Futures() []raft.ApplyFuture {
+	return append([]raft.ApplyFuture(nil), m...)
+}
+
 // Error will return only when all Error functions in the contained futures
-// return, in order.
+// return, in order. If any fail it returns a *ChunkErrors holding all of
+// their errors.
 func (m multiFuture) Error() error {
-	for _, v := range m {
-		if err := v.Error(); err != nil {
-			return err
+	var errs ChunkErrors
+	for i, v := range m {
+		err := v.Error()
+		switch {
+		case err == nil:
+			errs.Submitted++
+			errs.Committed++
+		case isUnsent(v):
+			errs.Unsent++
+			errs.UnsentErr = err
+		default:
+			errs.Submitted++
+			errs.Errors = append(errs.Errors, &ChunkError{Chunk: i, Err: err})
 		}
 	}
+	if len(errs.Errors) == 0 && errs.Unsent == 0 {
+		return nil
+	}
+	return &errs
+}
 
-	return nil
+// submitted returns the number of the futures' chunks that were submitted.
+func (m multiFuture) submitted() int {
+	var n int
+	for _, f := range m {
+		if !isUnsent(f) {
+			n++
+		}
+	}
+	return n
 }
 
 // Index returns the index of the last chunk. Since required behavior is to not
@@ -80,89 +135,1119 @@ func (m multiFuture) Response() interface{} {
 
 type ApplyFunc func(raft.Log, time.Duration) raft.ApplyFuture
 
-// ChunkingApply takes in a byte slice and chunks into ChunkSize (or less if
-// EOF) chunks, calling Apply on each. It requires a corresponding wrapper
-// around the FSM to handle reconstructing on the other end. Timeout will be the
-// timeout for each individual operation, not total. The return value is a
-// future whose Error() will return only when all underlying Apply futures have
-// had Error() return. Note that any error indicates that the entire operation
-// will not be applied, assuming the correct FSM wrapper is used. If extensions
-// is passed in, it will be set as the Extensions value on the Apply once all
-// chunks are received.
-func ChunkingApply(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc) raft.ApplyFuture {
-	// Generate a random op num via 64 random bits. These only have to be
-	// unique across _in flight_ chunk operations until a Term changes so
-	// should be fine.
-	rb := make([]byte, 8)
-	n, err := rand.Read(rb)
+// WithChunkRetries makes ChunkingApply resubmit a chunk whose future fails
+// with raft.ErrEnqueueTimeout up to n times before failing the op. Such a
+// timeout means the node was still leader but couldn't take the chunk in
+// time, so resending just that chunk is usually enough to carry on; the FSM
+// accepts chunks out of order and ignores ones it already has. Since the
+// resent chunk lands after later ones, a reorder window set with
+// WithReorderWindow should allow for that. It is ignored by the FSM.
+func WithChunkRetries(n int) Option {
+	return func(c *config) {
+		c.chunkRetries = n
+	}
+}
+
+// WithSequentialApply makes ChunkingApply wait for each chunk to be committed
+// before submitting the next, rather than submitting all of them at once. This
+// keeps at most one chunk of the op queued on the leader, at the cost of a
+// round trip per chunk, for clusters where enqueuing whole ops overflows the
+// apply queue or uses too much memory. ChunkingApply then doesn't return
+// until the op has been applied or has failed; once a chunk fails the rest
+// are not sent and their futures return the same error. It is ignored by the
+// FSM.
+func WithSequentialApply() Option {
+	return WithSequentialBatches(1)
+}
+
+// WithSequentialBatches is like WithSequentialApply, but submits chunks in
+// batches of n, waiting for each batch to be committed before submitting the
+// next. This trades some of the throughput of submitting the whole op at once
+// for a bound on how much of it is queued on the leader, and notices failures
+// after at most one batch. It is ignored by the FSM.
+func WithSequentialBatches(n int) Option {
+	return func(c *config) {
+		c.sequential = n
+	}
+}
+
+// WithMaxOutstanding makes ChunkingApply keep at most n chunks of the op
+// pending at once, waiting for the oldest to be committed before submitting
+// another, so that large ops don't flood the leader's apply pipeline. Unlike
+// WithSequentialApply chunks are still pipelined, and ChunkingApply returns
+// once the last chunk is submitted, leaving up to n pending. Once a chunk
+// fails the rest are not sent and their futures return the same error. Zero
+// means no limit. It is ignored by the FSM.
+func WithMaxOutstanding(n int) Option {
+	return func(c *config) {
+		c.outstanding = n
+	}
+}
+
+// WithZeroCopy makes ChunkingApply and SplitIntoLogs slice chunk data directly
+// out of the payload instead of copying it, halving the memory needed for
+// large payloads. The caller must then not modify the payload until the op's
+// future has returned, or for as long as logs from SplitIntoLogs are in use.
+// Encrypted chunks are always written to new buffers, so it has no effect
+// with WithKeyProvider. It is ignored by the FSM.
+func WithZeroCopy() Option {
+	return func(c *config) {
+		c.zeroCopy = true
+	}
+}
+
+// ErrOpTimeout is returned, wrapped, from the future of an op that did not
+// finish within the time set with WithOpTimeout.
+var ErrOpTimeout = errors.New("chunked op timed out")
+
+// WithOpTimeout bounds the time taken by a whole op, from when ChunkingApply is
+// called until all of its chunks are committed, where the timeout given to
+// ChunkingApply applies to each chunk separately. Chunks not yet submitted
+// when it runs out are not sent, and each chunk is given no more than the
+// time remaining. Once it runs out the future fails with ErrOpTimeout, but
+// chunks already submitted may still be committed, and if they were all
+// submitted the op may still be applied; combine it with WithDeadline to have
+// the FSM drop ops that took too long. It is ignored by the FSM.
+func WithOpTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.opTimeout = d
+	}
+}
+
+// deadlineFuture fails a chunk's future if it hasn't returned by the op's
+// deadline, as configured with WithOpTimeout.
+type deadlineFuture struct {
+	raft.ApplyFuture
+	deadline time.Time
+	once     sync.Once
+	err      error
+}
+
+func (d *deadlineFuture) wait() {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- d.ApplyFuture.Error()
+	}()
+	timer := time.NewTimer(time.Until(d.deadline))
+	defer timer.Stop()
+	select {
+	case d.err = <-ch:
+	case <-timer.C:
+		d.err = ErrOpTimeout
+	}
+}
+
+func (d *deadlineFuture) Error() error {
+	d.once.Do(d.wait)
+	return d.err
+}
+
+// retryFuture is the future for a chunk that is resubmitted on enqueue
+// timeouts, as configured with WithChunkRetries. Resubmissions are given no
+// more than the time left before the op's deadline, if it has one, and stop
+// once it has passed.
+type retryFuture struct {
+	once      sync.Once
+	f         raft.ApplyFuture
+	err       error
+	log       raft.Log
+	timeout   time.Duration
+	deadline  time.Time
+	applyFunc ApplyFunc
+	retries   int
+}
+
+func (r *retryFuture) wait() {
+	for {
+		r.err = r.f.Error()
+		if r.retries <= 0 || !errors.Is(r.err, raft.ErrEnqueueTimeout) {
+			return
+		}
+		timeout := r.timeout
+		if !r.deadline.IsZero() {
+			remaining := time.Until(r.deadline)
+			if remaining <= 0 {
+				r.err = ErrOpTimeout
+				return
+			}
+			if timeout == 0 || remaining < timeout {
+				timeout = remaining
+			}
+		}
+		r.retries--
+		r.f = r.applyFunc(r.log, timeout)
+	}
+}
+
+func (r *retryFuture) Error() error {
+	r.once.Do(r.wait)
+	return r.err
+}
+
+func (r *retryFuture) Index() uint64 {
+	r.once.Do(r.wait)
+	return r.f.Index()
+}
+
+func (r *retryFuture) Response() interface{} {
+	r.once.Do(r.wait)
+	return r.f.Response()
+}
+
+// WithMaxChunkSize acknowledges that every node in the cluster, including its
+// transport and MaxAppendEntries settings, accepts log entries of up to n
+// bytes, allowing ChunkSize to be set above raft.SuggestedMaxDataSize. Without
+// it, larger chunk sizes are rejected. It is ignored by the FSM.
+func WithMaxChunkSize(n int) Option {
+	return func(c *config) {
+		c.maxChunkSize = n
+	}
+}
+
+// checkChunkSize validates a chunk size against the configured limit.
+func checkChunkSize(chunkSize int, conf *config) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("%w: %d is not positive", ErrInvalidChunkSize, chunkSize)
+	}
+	limit := raft.SuggestedMaxDataSize
+	if conf.maxChunkSize > limit {
+		limit = conf.maxChunkSize
+	}
+	if chunkSize > limit {
+		return fmt.Errorf("%w: %d exceeds the limit of %d; use WithMaxChunkSize if the cluster accepts larger log entries", ErrInvalidChunkSize, chunkSize, limit)
+	}
+	return nil
+}
+
+// WithMaxPayloadSize makes ChunkingApply and SplitIntoLogs reject payloads
+// larger than n bytes with ErrPayloadTooLarge before any chunks are built, so
+// that applications can bound the size of ops without measuring them first.
+// The limit applies to the payload as given, before any compression, and not
+// to its extensions. Zero means no limit. On the FSM it limits the size that
+// compressed payloads may decompress to, failing larger ops with
+// ErrPayloadTooLarge before they are decompressed.
+func WithMaxPayloadSize(n int) Option {
+	return func(c *config) {
+		c.maxPayloadSize = n
+	}
+}
+
+// checkPayloadSize validates a payload size against the configured limit.
+func checkPayloadSize(size int, conf *config) error {
+	if conf.maxPayloadSize > 0 && size > conf.maxPayloadSize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d", ErrPayloadTooLarge, size, conf.maxPayloadSize)
+	}
+	return nil
+}
+
+// WithTotalSize makes ChunkingApply send the size of the payload in every
+// chunk header, so that the FSM can size the buffer it reassembles the
+// payload in exactly and check the reassembled payload's length before
+// applying it. It is ignored by the FSM.
+func WithTotalSize() Option {
+	return func(c *config) {
+		c.totalSize = true
+	}
+}
+
+// WithChunkSize sets the chunk size for an op in place of ChunkSize, for
+// applications with custom transports or tuned MaxAppendEntries settings.
+// Sizes above raft.SuggestedMaxDataSize also need WithMaxChunkSize. It is
+// ignored by the FSM.
+func WithChunkSize(n int) Option {
+	return func(c *config) {
+		c.chunkSize = n
+	}
+}
+
+// WithDeadline sets a time by which all of an op's chunks must have been
+// appended to the raft log. The FSM discards the op if a log appended after
+// the deadline arrives before the op completes, so that an op abandoned by a
+// client that went away midway doesn't hold on to its chunks until the next
+// term change. The deadline is compared against the leader's append times,
+// so all nodes make the same decision. It is ignored by the FSM.
+func WithDeadline(deadline time.Time) Option {
+	return func(c *config) {
+		c.deadline = deadline
+	}
+}
+
+// WithContentType records a hint describing the payload's format, such as a
+// MIME type, with the op. The FSM passes it to the underlying FSM if it
+// implements OpApplier, and the Reassembler reports it in ReassembledOp. It
+// is ignored by the FSM itself.
+func WithContentType(contentType string) Option {
+	return func(c *config) {
+		c.contentType = contentType
+	}
+}
+
+// ChunkingApply takes in a byte slice and chunks it such that each resulting
+// log entry, including the chunking information carried in its Extensions, is
+// no larger than the chunk size, calling Apply on each. It requires a
+// corresponding wrapper around the FSM to handle reconstructing on the other
+// end. Timeout will be the timeout for each individual operation, not total.
+// The return value is a future whose Error() will return only when all
+// underlying Apply futures have had Error() return. Note that any error
+// indicates that the entire operation will not be applied, assuming the correct
+// FSM wrapper is used. If extensions is passed in, it will be set as the
+// Extensions value on the Apply once all chunks are received. Extensions too
+// large to fit in the final chunk are carried in the data of chunks of their
+// own at the end of the op, which FSMs that predate this would mistake for
+// payload. Options can be used to further configure the chunking; the FSM must
+// be configured compatibly.
+//
+// The returned future also implements ChunkingFuture, which can be used to
+// resume a failed op with ChunkingResume, and MultiFuture, which gives the
+// futures of the individual chunks.
+func ChunkingApply(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	return chunkingApplyConf(cmd, extensions, timeout, applyFunc, newConfig(opts))
+}
+
+// ChunkingApplyWithOptions applies cmd as ChunkingApply does, taking the
+// extensions from WithExtensions and the timeout for each chunk from
+// WithApplyTimeout, so that everything but the payload and where it is
+// applied is given as options.
+func ChunkingApplyWithOptions(cmd []byte, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	conf := newConfig(opts)
+	return chunkingApplyConf(cmd, conf.extensions, conf.applyTimeout, applyFunc, conf)
+}
+
+// WithExtensions sets the extensions for ChunkingApplyWithOptions and
+// NewChunkedWriter, which are set as the Extensions value on the Apply once
+// all chunks are received. It is ignored by ChunkingApply, which is given them
+// directly, and by the FSM.
+func WithExtensions(extensions []byte) Option {
+	return func(c *config) {
+		c.extensions = extensions
+	}
+}
+
+// chunkingApplyConf does the work of ChunkingApply with parsed options.
+func chunkingApplyConf(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config) raft.ApplyFuture {
+	if conf.leadershipAttempts > 1 && conf.reservedOp == 0 {
+		return conf.withBarrier(applyWithLeadershipRetry(cmd, extensions, timeout, applyFunc, conf), timeout)
+	}
+	return conf.withBarrier(chunkingApply(cmd, extensions, timeout, applyFunc, conf), timeout)
+}
+
+// ChunkingApplyMulti applies each of cmds as its own op, as ChunkingApply
+// does, returning a future for each. The ops are submitted one after another
+// from the calling goroutine with the options parsed once, for applications
+// that apply many large values at a time, such as bulk restores. extensions,
+// if not nil, holds the extensions for each command and must be as long as
+// cmds. Each op succeeds or fails on its own. Since every op needs its own op
+// num, WithReservedOp can't be used.
+func ChunkingApplyMulti(cmds, extensions [][]byte, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) []raft.ApplyFuture {
+	conf := newConfig(opts)
+	futures := make([]raft.ApplyFuture, len(cmds))
+	var err error
+	switch {
+	case extensions != nil && len(extensions) != len(cmds):
+		err = fmt.Errorf("got extensions for %d commands, expected %d", len(extensions), len(cmds))
+	case conf.reservedOp != 0:
+		err = errors.New("WithReservedOp can't be used to apply several commands")
+	}
+	if err != nil {
+		for i := range futures {
+			futures[i] = errorFuture{err: err}
+		}
+		return futures
+	}
+
+	for i, cmd := range cmds {
+		var ext []byte
+		if extensions != nil {
+			ext = extensions[i]
+		}
+		if conf.leadershipAttempts > 1 {
+			futures[i] = conf.withBarrier(applyWithLeadershipRetry(cmd, ext, timeout, applyFunc, conf), timeout)
+		} else {
+			futures[i] = conf.withBarrier(chunkingApply(cmd, ext, timeout, applyFunc, conf), timeout)
+		}
+	}
+	return futures
+}
+
+// chunkingApply makes a single attempt at an op.
+func chunkingApply(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config) ChunkingFuture {
+	op, err := newOpParams(conf, cmd, extensions)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	if f, ok := passThrough(cmd, extensions, timeout, applyFunc, conf, op); ok {
+		return f
+	}
+	if conf.adaptiveTarget > 0 {
+		return applyAdaptive(cmd, extensions, timeout, applyFunc, conf, op)
+	}
+	if conf.bufferPool {
+		op.buffers = &bufferSet{chunkSize: op.chunkSize}
+	}
+	logs, err := splitIntoLogs(cmd, extensions, conf, op)
+	if err != nil {
+		op.buffers.release()
+		return errorFuture{err: err}
+	}
+	return applyOpLogs(logs, len(cmd), timeout, applyFunc, conf, op)
+}
+
+// applyOpLogs submits the logs built for an op of payloadSize bytes.
+func applyOpLogs(logs []raft.Log, payloadSize int, timeout time.Duration, applyFunc ApplyFunc, conf *config, op *opParams) ChunkingFuture {
+	mf, err := applyLogs(logs, op.opNum, timeout, applyFunc, conf)
+	if err != nil {
+		// Nothing was submitted
+		op.buffers.release()
+		return errorFuture{err: err}
+	}
+	op.buffers.releaseWhenApplied(mf)
+
+	seqs := make([]uint32, len(logs))
+	for i := range logs {
+		seqs[i] = uint32(i)
+	}
+	return &chunkingFuture{
+		multiFuture: mf,
+		submitted:   mf.submitted(),
+		seqs:        seqs,
+		token:       op.resumeToken(conf, payloadSize, len(logs)),
+	}
+}
+
+// ChunkingApplyWithLogs submits chunk logs previously built by SplitIntoLogs,
+// in order, and returns a future that behaves like the one returned from
+// ChunkingApply, implementing MultiFuture. This allows the logs for an op to
+// be prepared ahead of time, persisted or transformed, and applied later. The
+// logs are checked to form a complete op before any of them are applied. Note
+// that an op must be applied within a single term, and that applying the same
+// logs twice will apply the op twice.
+func ChunkingApplyWithLogs(logs []raft.Log, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	conf := newConfig(opts)
+	opNum, err := validateChunkLogs(logs, conf)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	mf, err := applyLogs(logs, opNum, timeout, applyFunc, conf)
 	if err != nil {
 		return errorFuture{err: err}
 	}
-	if n != 8 {
-		return errorFuture{err: fmt.Errorf("expected to read %d bytes for op num, read %d", 8, n)}
+	return mf
+}
+
+// applyLogs submits an op's logs, holding a slot from the client limiter, if
+// any, until all of their futures have returned.
+func applyLogs(logs []raft.Log, opNum uint64, timeout time.Duration, applyFunc ApplyFunc, conf *config) (multiFuture, error) {
+	var largest int
+	for _, log := range logs {
+		if n := len(log.Data) + len(log.Extensions); n > largest {
+			largest = n
+		}
+	}
+	s, err := newSubmitter(opNum, len(logs), largest, timeout, applyFunc, conf)
+	if err != nil {
+		return nil, err
+	}
+	for _, log := range logs {
+		if !s.submit(log) {
+			break
+		}
+	}
+	return s.finish(len(logs) - len(s.mf)), nil
+}
+
+// submitter submits an op's logs one at a time, as configured.
+type submitter struct {
+	conf      *config
+	timeout   time.Duration
+	applyFunc ApplyFunc
+	mf        multiFuture
+	deadline  time.Time
+	bucket    *tokenBucket
+
+	// turn tracks the op's turns with the scheduler set with WithScheduler,
+	// and active the op's listing in the registry set with WithOpRegistry
+	turn   schedTurn
+	active *ActiveOp
+
+	// err is why the op stopped being submitted, if it did
+	err error
+}
+
+// newSubmitter checks that the op can be submitted, taking a slot from the
+// client limiter if there is one and listing op opNum in the registry.
+// numLogs is the number of logs expected and largest the size of the largest
+// of them, as far as they are known.
+func newSubmitter(opNum uint64, numLogs, largest int, timeout time.Duration, applyFunc ApplyFunc, conf *config) (*submitter, error) {
+	if conf.leaderCheck != nil {
+		if err := conf.leaderCheck(); err != nil {
+			return nil, err
+		}
+	}
+
+	if limiter := conf.clientLimiter; limiter != nil && !limiter.acquire(conf.clientID) {
+		return nil, fmt.Errorf("client %q: %w", conf.clientID, ErrClientLimit)
+	}
+
+	s := &submitter{
+		conf:      conf,
+		timeout:   timeout,
+		applyFunc: applyFunc,
+		mf:        make(multiFuture, 0, numLogs),
+	}
+	if conf.opTimeout > 0 {
+		s.deadline = time.Now().Add(conf.opTimeout)
+	}
+	if conf.rateLimit > 0 {
+		s.bucket = newTokenBucket(conf.rateLimit, largest, time.Now())
+	}
+	if conf.opRegistry != nil {
+		s.active = conf.opRegistry.add(opNum)
+	}
+	return s, nil
+}
+
+// submit submits the next log, returning false if the op has failed and no
+// more logs should be submitted, in which case the log may not have been.
+func (s *submitter) submit(log raft.Log) bool {
+	conf, mf := s.conf, s.mf
+	if s.active != nil && conf.opRegistry.cancelled(s.active) {
+		s.err = ErrOpCancelled
+		return false
+	}
+	if conf.outstanding > 0 && len(mf) >= conf.outstanding {
+		if err := mf[len(mf)-conf.outstanding].Error(); err != nil {
+			s.err = err
+			return false
+		}
+	}
+
+	if s.bucket != nil {
+		wait := s.bucket.take(len(log.Data)+len(log.Extensions), time.Now())
+		if !s.deadline.IsZero() && time.Now().Add(wait).After(s.deadline) {
+			// Waiting would only run out the op's time
+			s.err = ErrOpTimeout
+			return false
+		}
+		time.Sleep(wait)
+	}
+
+	chunkTimeout := s.timeout
+	if !s.deadline.IsZero() {
+		remaining := time.Until(s.deadline)
+		if remaining <= 0 {
+			s.err = ErrOpTimeout
+			return false
+		}
+		if s.timeout == 0 || remaining < s.timeout {
+			chunkTimeout = remaining
+		}
+	}
+	if err := conf.waitForLag(chunkTimeout); err != nil {
+		s.err = err
+		return false
+	}
+
+	if conf.scheduler != nil {
+		if err := conf.scheduler.acquire(&s.turn, chunkTimeout); err != nil {
+			s.err = err
+			return false
+		}
+	}
+	f := s.applyFunc(log, chunkTimeout)
+	if conf.scheduler != nil {
+		conf.scheduler.release(&s.turn)
+	}
+	if s.active != nil {
+		conf.opRegistry.submitted(s.active, len(log.Data))
+	}
+	if conf.chunkRetries > 0 {
+		f = &retryFuture{
+			f:         f,
+			log:       log,
+			timeout:   s.timeout,
+			deadline:  s.deadline,
+			applyFunc: s.applyFunc,
+			retries:   conf.chunkRetries,
+		}
+	}
+	if !s.deadline.IsZero() {
+		f = &deadlineFuture{ApplyFuture: f, deadline: s.deadline}
+	} else if conf.chunkRetries == 0 {
+		// The futures may be waited on from several goroutines
+		f = &onceFuture{ApplyFuture: f}
+	}
+	s.mf = append(mf, f)
+
+	if conf.sequential > 0 && len(s.mf)%conf.sequential == 0 {
+		if err := waitBatch(s.mf, conf.sequential); err != nil {
+			s.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// finish completes the submission, adding futures for the unsent logs if the
+// op failed, and returns the op's futures. The client limiter's slot is held
+// until they have all returned.
+func (s *submitter) finish(unsent int) multiFuture {
+	mf := s.mf
+	if s.err == nil && s.conf.sequential > 0 && len(mf)%s.conf.sequential != 0 {
+		// Wait for the last, partial batch as for the others
+		if err := waitBatch(mf, s.conf.sequential); err != nil {
+			s.err = err
+		}
+	}
+	if s.err != nil {
+		for i := 0; i < unsent; i++ {
+			mf = append(mf, unsentFuture{errorFuture{err: s.err}})
+		}
+	}
+	if limiter := s.conf.clientLimiter; limiter != nil {
+		go func() {
+			mf.Error()
+			limiter.release(s.conf.clientID)
+		}()
+	}
+	if registry := s.conf.opRegistry; s.active != nil {
+		registry.committing(s.active)
+		go func() {
+			mf.Error()
+			registry.remove(s.active)
+		}()
+	}
+	return mf
+}
+
+// waitBatch waits for the futures of the last batch of chunks submitted, in
+// order, returning the first error.
+func waitBatch(mf multiFuture, batch int) error {
+	start := (len(mf) - 1) / batch * batch
+	for _, f := range mf[start:] {
+		if err := f.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateChunkLogs checks that logs hold all chunks of a single op, in
+// order, returning its op num.
+func validateChunkLogs(logs []raft.Log, conf *config) (uint64, error) {
+	var opNum uint64
+	for i, l := range logs {
+		if !conf.isChunk(&l) {
+			return 0, fmt.Errorf("log %d: %w", i, ErrNotChunk)
+		}
+		var ci types.ChunkInfo
+		if err := conf.unmarshalChunkInfo(l.Extensions, &ci); err != nil {
+			return 0, fmt.Errorf("log %d: %w", i, err)
+		}
+		if i == 0 {
+			opNum = ci.OpNum
+		}
+		switch {
+		case ci.OpNum != opNum:
+			return 0, fmt.Errorf("log %d belongs to op %d, expected op %d", i, ci.OpNum, opNum)
+		case ci.SequenceNum != uint32(i):
+			return 0, fmt.Errorf("log %d has sequence number %d", i, ci.SequenceNum)
+		case ci.NumChunks != uint32(len(logs)):
+			return 0, fmt.Errorf("log %d is from an op of %d chunks, got %d logs", i, ci.NumChunks, len(logs))
+		}
+	}
+	return opNum, nil
+}
+
+// SplitIntoLogs chunks cmd exactly as ChunkingApply does, returning the logs
+// instead of applying them. The logs can be applied with
+// ChunkingApplyWithLogs.
+func SplitIntoLogs(cmd, extensions []byte, opts ...Option) ([]raft.Log, error) {
+	conf := newConfig(opts)
+	op, err := newOpParams(conf, cmd, extensions)
+	if err != nil {
+		return nil, err
+	}
+	return splitIntoLogs(cmd, extensions, conf, op)
+}
+
+// EstimateChunks predicts how ChunkingApply would split a payload of
+// payloadLen bytes with extensions of extensionsLen bytes, without needing the
+// payload, returning the number of chunks and the total size of their logs'
+// data and extensions. This lets quota and admission checks account for the
+// overhead of chunking before an op is applied. Since op nums vary in encoded
+// size the total may be off by a few bytes per chunk. With WithKeyProvider a
+// data key is generated and wrapped to size the chunk headers. With
+// WithCompression, payloadLen should be the compressed size, if known.
+func EstimateChunks(payloadLen, extensionsLen int, opts ...Option) (int, int, error) {
+	conf := newConfig(opts)
+	if err := checkPayloadSize(payloadLen, conf); err != nil {
+		return 0, 0, err
+	}
+	op, err := newOpParams(conf, nil, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	op.compression = conf.compression
+	if conf.totalSize {
+		op.totalSize = payloadLen
+	}
+	var overhead int
+	if op.aead != nil {
+		overhead = op.aead.Overhead()
+	}
+	if conf.encryptFunc != nil {
+		overhead += conf.encryptOverhead
+	}
+
+	// With an extensions namespace the caller's extensions are copied into
+	// every chunk's envelope, adding their size as they are
+	var extensions []byte
+	var extra int
+	if conf.extensionsNamespace == 0 {
+		extensions = make([]byte, extensionsLen)
+	} else {
+		extra = extensionsLen
+	}
+	_, size := op.chunkHeaders(conf, extensions, nil)
+	headerSize := func(seq, numChunks int) (int, int) {
+		n, extLen := size(seq, numChunks)
+		return n + extra, extLen + extra
+	}
+
+	sizes, err := op.chunkLayout(conf, payloadLen, overhead, extensions, headerSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int
+	for i, n := range sizes {
+		header, _ := headerSize(i, len(sizes))
+		total += header + n
+		if i < len(sizes)-op.extChunks {
+			total += overhead
+		}
+	}
+	return len(sizes), total, nil
+}
+
+// opParams holds the per-op values that determine how a payload is split.
+// Given the same parameters, payload and options, splitIntoLogs always
+// produces the same logs, which is what allows ops to be resumed.
+type opParams struct {
+	opNum      uint64
+	chunkSize  int
+	wrappedKey []byte
+	keyID      string
+	aead       cipher.AEAD
+
+	// compression is the algorithm the payload was compressed with,
+	// extChunks the number of trailing chunks carrying the extensions and
+	// totalSize the size of the payload before compression, if it is to be
+	// sent, all of which splitIntoLogs decides on
+	compression Compression
+	extChunks   int
+	totalSize   int
+
+	// layout holds the amount of data placed in each chunk, as decided by
+	// splitIntoLogs, and payloadDigest the digest of the data it split, for
+	// resume tokens
+	layout        []int
+	payloadDigest []byte
+
+	// buffers, if set, supplies the buffers for the logs, as configured
+	// with WithBufferPool
+	buffers *bufferSet
+}
+
+// newOpParams sets up the parameters for a new op of cmd and extensions.
+func newOpParams(conf *config, cmd, extensions []byte) (*opParams, error) {
+	chunkSize := ChunkSize
+	if conf.chunkSize != 0 {
+		chunkSize = conf.chunkSize
+	}
+	if err := checkChunkSize(chunkSize, conf); err != nil {
+		return nil, err
+	}
+	if err := checkPayloadSize(len(cmd), conf); err != nil {
+		return nil, err
+	}
+
+	opNum := conf.reservedOp
+	if opNum == 0 && conf.contentOpNum {
+		opNum = contentOpNum(conf.opNumSalt, cmd, extensions)
+	}
+	if opNum == 0 && conf.origin != "" {
+		opNum = originOpNum(conf.origin)
+	}
+	if opNum == 0 {
+		var err error
+		if opNum, err = newOpNum(conf.random()); err != nil {
+			return nil, err
+		}
+	}
+	op := &opParams{
+		opNum:     opNum,
+		chunkSize: chunkSize,
+	}
+
+	// If encryption is enabled, set up a data key for this op
+	if conf.keyProvider != nil {
+		var err error
+		op.aead, op.wrappedKey, err = newDataKey(conf.random(), conf.keyProvider)
+		if err != nil {
+			return nil, err
+		}
+		op.keyID = conf.keyID
+	}
+	return op, nil
+}
+
+// newOpNum generates a random op num via 64 random bits read from r. These
+// only have to be unique across _in flight_ chunk operations until a Term
+// changes so should be fine.
+func newOpNum(r io.Reader) (uint64, error) {
+	rb := make([]byte, 8)
+	n, err := io.ReadFull(r, rb)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		return 0, fmt.Errorf("%w: expected to read %d bytes for op num, read %d", ErrShortRead, 8, n)
+	default:
+		return 0, fmt.Errorf("%w: %v", ErrOpIDGeneration, err)
+	}
+	return binary.BigEndian.Uint64(rb), nil
+}
+
+func splitIntoLogs(cmd, extensions []byte, conf *config, op *opParams) ([]raft.Log, error) {
+	cmd, err := op.compress(conf, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return splitSegmentsIntoLogs([][]byte{cmd}, len(cmd), extensions, conf, op)
+}
+
+// splitSegmentsIntoLogs splits a payload of dataLen bytes, given as the
+// concatenation of segments, into the op's logs. The payload is sent as it
+// is; any compression must already have been done.
+func splitSegmentsIntoLogs(segments [][]byte, dataLen int, extensions []byte, conf *config, op *opParams) ([]raft.Log, error) {
+	opNum, aead := op.opNum, op.aead
+	var overhead int
+	if aead != nil {
+		overhead = aead.Overhead()
+	}
+	if conf.encryptFunc != nil {
+		if conf.encryptOverhead < 0 {
+			return nil, fmt.Errorf("encryption overhead must not be negative, got %d", conf.encryptOverhead)
+		}
+		overhead += conf.encryptOverhead
 	}
-	opNum := binary.BigEndian.Uint64(rb)
 
 	var logs []raft.Log
-	var byteChunks [][]byte
-	var mf multiFuture
+
+	// If integrity checking is enabled, hash the chunk data as it is built
+	if err := conf.checkFIPS(conf.hashAlgorithm); err != nil {
+		return nil, err
+	}
+	hasher, err := conf.hashAlgorithm.newHash()
+	if err != nil {
+		return nil, err
+	}
+
+	// With an extensions namespace, the caller's extensions go with every
+	// chunk instead of being forwarded in the final chunk's header
+	others, err := conf.otherExtensions(extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Figure out how much data goes into each chunk
+	chunkHeader, headerSize := op.chunkHeaders(conf, extensions, others)
+	sizes, err := op.chunkLayout(conf, dataLen, overhead, extensions, headerSize)
+	if err != nil {
+		return nil, err
+	}
+	op.layout = sizes
+	op.payloadDigest = op.digestPayload(segments, extensions)
+	payloadChunks := len(sizes) - op.extChunks
 
 	// We break into chunks first so that we know how many chunks there will be
 	// to put in NumChunks in the extensions info. This could probably be a bit
 	// more efficient by just reslicing but doing it this way is a bit easier
 	// for others to follow/track and in this kind of operation this won't be
 	// the slow part anyways.
-	reader := bytes.NewReader(cmd)
-	remain := reader.Len()
-	for {
-		if remain <= 0 {
-			break
+	byteChunks, err := splitSegments(segments, sizes[:payloadChunks], conf.zeroCopy, op.buffers)
+	if err != nil {
+		return nil, err
+	}
+	if op.extChunks > 0 {
+		extChunks, err := splitData(extensions, sizes[payloadChunks:], conf.zeroCopy, op.buffers)
+		if err != nil {
+			return nil, err
 		}
+		byteChunks = append(byteChunks, extChunks...)
+	}
 
-		if remain > ChunkSize {
-			remain = ChunkSize
+	// Create the underlying chunked logs. Chunks carrying extensions are
+	// left as they are, just as extensions in a header would be.
+	for i, chunk := range byteChunks {
+		chunkInfo := chunkHeader(i, len(byteChunks))
+		if aead != nil && i < payloadChunks {
+			chunk = sealChunk(aead, opNum, uint32(i), chunk)
 		}
-
-		b := make([]byte, remain)
-		n, err := reader.Read(b)
-		if err != nil && err != io.EOF {
-			return errorFuture{err: err}
+		if conf.encryptFunc != nil && i < payloadChunks {
+			if chunk, err = conf.encryptChunk(opNum, uint32(i), chunk); err != nil {
+				return nil, err
+			}
+		}
+		if hasher != nil {
+			hasher.Write(chunk)
 		}
-		if n != remain {
-			return errorFuture{err: fmt.Errorf("expected to read %d bytes from buf, read %d", remain, n)}
+		if conf.chunkChecksums {
+			chunkInfo.ChunkChecksum = chunkChecksum(chunk)
+		}
+		if i == len(byteChunks)-1 {
+			chunkInfo.PayloadDigest = nil
+			if hasher != nil {
+				chunkInfo.PayloadDigest = hasher.Sum(nil)
+			}
 		}
 
-		byteChunks = append(byteChunks, b)
-		remain = reader.Len()
+		chunkBytes, err := conf.marshalChunkExtensions(chunkInfo, others, op.buffers)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, conf.newLog(chunk, chunkBytes))
 	}
 
-	// Create the underlying chunked logs
-	for i, chunk := range byteChunks {
-		chunkInfo := &types.ChunkInfo{
-			OpNum:       opNum,
-			SequenceNum: uint32(i),
-			NumChunks:   uint32(len(byteChunks)),
+	return logs, nil
+}
+
+// splitData cuts data into pieces of the given sizes, which must add up to its
+// length. With zeroCopy the pieces share data's memory rather than being
+// copied, and otherwise they are copied into buffers from bufs.
+func splitData(data []byte, sizes []int, zeroCopy bool, bufs *bufferSet) ([][]byte, error) {
+	return splitSegments([][]byte{data}, sizes, zeroCopy, bufs)
+}
+
+// splitSegments cuts the concatenation of segments into pieces of the given
+// sizes, as splitData does. With zeroCopy only pieces lying within a single
+// segment can share its memory; the rest are copied.
+func splitSegments(segments [][]byte, sizes []int, zeroCopy bool, bufs *bufferSet) ([][]byte, error) {
+	pieces := make([][]byte, 0, len(sizes))
+
+	// seg and off give the position reached in the segments
+	var seg, off int
+	for _, size := range sizes {
+		for seg < len(segments) && off == len(segments[seg]) {
+			seg, off = seg+1, 0
+		}
+		if zeroCopy && seg < len(segments) && len(segments[seg])-off >= size {
+			// Limit the capacity so that appending to a chunk can't
+			// overwrite the next one
+			pieces = append(pieces, segments[seg][off:off+size:off+size])
+			off += size
+			continue
 		}
 
-		// If extensions were passed in attach them to the last chunk so it
-		// will go through Apply at the end.
-		if i == len(byteChunks)-1 {
-			chunkInfo.NextExtensions = extensions
+		b := bufs.data(size)
+		var n int
+		for n < size && seg < len(segments) {
+			c := copy(b[n:], segments[seg][off:])
+			n, off = n+c, off+c
+			if off == len(segments[seg]) {
+				seg, off = seg+1, 0
+			}
+		}
+		if n != size {
+			return nil, fmt.Errorf("%w: expected to read %d bytes from buf, read %d", ErrShortRead, size, n)
 		}
 
-		chunkBytes, err := proto.Marshal(chunkInfo)
+		pieces = append(pieces, b)
+	}
+	return pieces, nil
+}
+
+// maxLayoutPasses bounds the attempts chunkLayout makes to settle the number
+// of chunks carrying extensions. Header sizes only change when chunk counts
+// cross a varint boundary, so it normally settles on the second pass.
+const maxLayoutPasses = 8
+
+// chunkLayout returns the amount of data to place in each chunk of a payload
+// of dataLen bytes, as chunkSizes does, and sets op.extChunks. Extensions too
+// large to fit in the final chunk's header are instead carried in the data of
+// op.extChunks trailing chunks of their own, listed after the payload's
+// chunks. This isn't done with an extensions namespace, as the extensions then
+// go with every chunk.
+func (op *opParams) chunkLayout(conf *config, dataLen, overhead int, extensions []byte, headerSize func(seq, numChunks int) (int, int)) ([]int, error) {
+	op.extChunks = 0
+	sizes, err := chunkSizes(dataLen, op.chunkSize, overhead, headerSize)
+	if err == nil || !errors.Is(err, ErrInvalidChunkSize) || len(extensions) == 0 || conf.extensionsNamespace != 0 {
+		return sizes, err
+	}
+
+	numExt := 1
+	for pass := 0; pass < maxLayoutPasses; pass++ {
+		op.extChunks = numExt
+		payload, err := chunkSizes(dataLen, op.chunkSize, overhead, func(seq, numChunks int) (int, int) {
+			return headerSize(seq, numChunks+numExt)
+		})
 		if err != nil {
-			return errorFuture{err: fmt.Errorf("error marshaling chunk info: %w", err)}
+			return nil, err
 		}
-		logs = append(logs, raft.Log{
-			Data:       chunk,
-			Extensions: chunkBytes,
+		numPayload := len(payload)
+		ext, err := chunkSizes(len(extensions), op.chunkSize, 0, func(seq, numChunks int) (int, int) {
+			return headerSize(numPayload+seq, numPayload+numChunks)
 		})
+		if err != nil {
+			return nil, err
+		}
+		if len(ext) == numExt {
+			return append(payload, ext...), nil
+		}
+		numExt = len(ext)
 	}
+	return nil, fmt.Errorf("%w: could not settle the layout of %d bytes of extensions", ErrInvalidChunkSize, len(extensions))
+}
 
-	for _, log := range logs {
-		mf = append(mf, applyFunc(log, timeout))
+// chunkHeaders returns functions that build the header for each chunk of the
+// op and give the encoded size of a chunk's extensions, along with how much of
+// that is caller-supplied extensions.
+func (op *opParams) chunkHeaders(conf *config, extensions []byte, others Extensions) (func(seq, numChunks int) *types.ChunkInfo, func(seq, numChunks int) (int, int)) {
+	hashAlgorithm := types.HashAlgorithm(conf.hashAlgorithm)
+
+	// chunkHeader builds the header for a chunk. Op-level metadata travels
+	// with the first chunk, while the extensions, payload digest and content
+	// type travel with the final one so that they are available once all
+	// chunks have arrived. Until the digest is known a placeholder of the
+	// right size is used, as it is for chunk checksums. The deadline goes on
+	// every chunk so that the FSM can enforce it whichever chunks it has
+	// seen, and so do the compression, total size, trace context,
+	// idempotency key and origin, so that they are known whichever chunk
+	// completes the op, and the chunk extensions, which are meant for every
+	// entry.
+	digestSize := conf.hashAlgorithm.digestSize()
+	chunkHeader := func(seq, numChunks int) *types.ChunkInfo {
+		ci := &types.ChunkInfo{
+			OpNum:            op.opNum,
+			SequenceNum:      uint32(seq),
+			NumChunks:        uint32(numChunks),
+			WrappedKey:       op.wrappedKey,
+			KeyId:            op.keyID,
+			HashAlgorithm:    hashAlgorithm,
+			Compression:      types.Compression(op.compression),
+			Encrypted:        conf.encryptFunc != nil,
+			TraceContext:     conf.traceContext,
+			ChunkExtensions:  conf.chunkExtensions,
+			ExtensionsChunks: uint32(op.extChunks),
+			IdempotencyKey:   conf.idempotencyKey,
+			TotalSize:        uint64(op.totalSize),
+			Origin:           conf.origin,
+		}
+		if !conf.deadline.IsZero() {
+			ci.Deadline = conf.deadline.UnixNano()
+		}
+		if conf.chunkChecksums {
+			ci.ChunkChecksum = make([]byte, chunkChecksumSize)
+		}
+		if seq == 0 {
+			ci.Metadata = conf.metadata
+		}
+		if seq == numChunks-1 {
+			if conf.extensionsNamespace == 0 && op.extChunks == 0 {
+				ci.NextExtensions = extensions
+			}
+			ci.PayloadDigest = make([]byte, digestSize)
+			ci.ContentType = conf.contentType
+		}
+		return ci
 	}
 
-	return mf
+	// The size of each chunk's extensions, including the marshaled
+	// ChunkInfo, is taken into account so that the full log entry stays
+	// within the chunk size
+	headerSize := func(seq, numChunks int) (int, int) {
+		ci := chunkHeader(seq, numChunks)
+		extLen := len(ci.NextExtensions)
+		if conf.extensionsNamespace != 0 {
+			extLen = len(extensions)
+		}
+		return conf.chunkExtensionsSize(ci, others), extLen
+	}
+	return chunkHeader, headerSize
+}
+
+// chunkSizes returns the amount of data to place in each chunk of a payload of
+// dataLen bytes. The encoded extensions of each chunk, whose size is given by
+// header along with how much of that is caller-supplied extensions, are taken
+// into account so that the extensions plus the data of every chunk, grown by
+// overhead bytes (e.g. for encryption), fit within chunkSize.
+func chunkSizes(dataLen, chunkSize, overhead int, header func(seq, numChunks int) (size, extLen int)) ([]int, error) {
+	if dataLen <= 0 {
+		return nil, nil
+	}
+
+	budget := func(seq, numChunks int) int {
+		size, _ := header(seq, numChunks)
+		return chunkSize - size - overhead
+	}
+
+	// capacity is computed in 64 bits so that it can't overflow on 32-bit
+	// platforms for payloads near the maximum slice size
+	capacity := func(numChunks int) (int64, error) {
+		var total int64
+		for i := 0; i < numChunks; i++ {
+			b := budget(i, numChunks)
+			if b <= 0 {
+				if _, extLen := header(i, numChunks); extLen > 0 {
+					return 0, fmt.Errorf("%w: extensions of %d bytes do not fit in a chunk of size %d", ErrInvalidChunkSize, extLen, chunkSize)
+				}
+				return 0, fmt.Errorf("%w: %d is too small to hold chunk header", ErrInvalidChunkSize, chunkSize)
+			}
+			total += int64(b)
+		}
+		return total, nil
+	}
+
+	// Start from the number of chunks we'd need with no overhead at all and
+	// add chunks until everything fits. Each step adds roughly as many chunks
+	// as the remaining data needs, so this converges in a few iterations.
+	numChunks := dataLen / chunkSize
+	if dataLen%chunkSize != 0 {
+		numChunks++
+	}
+	for {
+		// Sequence numbers and chunk counts are 32 bits on the wire
+		if uint64(numChunks) > math.MaxUint32 {
+			return nil, fmt.Errorf("payload of %d bytes needs more than %d chunks of size %d", dataLen, uint64(math.MaxUint32), chunkSize)
+		}
+		total, err := capacity(numChunks)
+		if err != nil {
+			return nil, err
+		}
+		if total >= int64(dataLen) {
+			break
+		}
+		// The chunks still to be added have headers at least as large as
+		// the last one's, so if it has no room for data neither do they
+		b := budget(numChunks, numChunks+2)
+		if b <= 0 {
+			return nil, fmt.Errorf("%w: %d is too small to hold chunk header", ErrInvalidChunkSize, chunkSize)
+		}
+		numChunks += int((int64(dataLen)-total)/int64(b)) + 1
+	}
+
+	// Fill the chunks in order, always leaving at least one byte for the
+	// final chunk since chunks without data are not considered received.
+	sizes := make([]int, numChunks)
+	remain := dataLen
+	for i := 0; i < numChunks-1; i++ {
+		size := budget(i, numChunks)
+		if size > remain-(numChunks-1-i) {
+			size = remain - (numChunks - 1 - i)
+		}
+		sizes[i] = size
+		remain -= size
+	}
+	sizes[numChunks-1] = remain
+
+	return sizes, nil
 }
@@ -4,8 +4,14 @@
 package raftchunking
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -70,3 +76,745 @@ func TestApplyChunking(t *testing.T) {
 		t.Fatal(diff)
 	}
 }
+
+func TestApplyChunking_HeaderOverhead(t *testing.T) {
+	origChunkSize := ChunkSize
+	defer func() { ChunkSize = origChunkSize }()
+	ChunkSize = 256
+
+	for _, tc := range []struct {
+		name    string
+		dataLen int
+		extLen  int
+	}{
+		{"single", 10, 0},
+		{"exact multiple", 256 * 4, 0},
+		{"many", 100000, 0},
+		{"extensions", 5000, 100},
+		{"large extensions", 10, 200},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := make([]byte, tc.dataLen)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			ext := make([]byte, tc.extLen)
+			if _, err := rand.Read(ext); err != nil {
+				t.Fatal(err)
+			}
+
+			var logs []raft.Log
+			applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+				logs = append(logs, l)
+				return errorFuture{}
+			}
+			if err := ChunkingApply(data, ext, time.Second, applyFunc).Error(); err != nil {
+				t.Fatal(err)
+			}
+
+			var finalData []byte
+			for _, l := range logs {
+				if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+					t.Fatalf("log entry of %d bytes exceeds chunk size %d", size, ChunkSize)
+				}
+				if len(l.Data) == 0 {
+					t.Fatal("got chunk with no data")
+				}
+				finalData = append(finalData, l.Data...)
+			}
+			if diff := deep.Equal(data, finalData); diff != nil {
+				t.Fatal(diff)
+			}
+
+			var ci types.ChunkInfo
+			if err := proto.Unmarshal(logs[len(logs)-1].Extensions, &ci); err != nil {
+				t.Fatal(err)
+			}
+			if int(ci.NumChunks) != len(logs) {
+				t.Fatalf("expected %d chunks, got %d", len(logs), ci.NumChunks)
+			}
+			if tc.extLen > 0 {
+				if diff := deep.Equal(ext, ci.NextExtensions); diff != nil {
+					t.Fatal(diff)
+				}
+			}
+		})
+	}
+
+	// Extensions that can never fit in a header are carried in chunks of
+	// their own, unless every chunk must carry them
+	ext := make([]byte, ChunkSize)
+	logs, err := SplitIntoLogs([]byte("foo"), ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(logs[len(logs)-1].Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if ci.ExtensionsChunks != 2 || len(logs) != 3 {
+		t.Fatalf("expected extensions in 2 of 3 chunks, got %d of %d", ci.ExtensionsChunks, len(logs))
+	}
+	nsExt, err := Extensions{7: ext}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		t.Fatal("unexpected apply")
+		return nil
+	}
+	if err := ChunkingApply([]byte("foo"), nsExt, time.Second, applyFunc, WithExtensionsNamespace(3)).Error(); err == nil {
+		t.Fatal("expected error for oversized extensions")
+	}
+}
+
+func TestChunkingApplyWithOptions(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	m := new(extensionsFSM)
+	f := NewChunkingFSM(m, nil)
+	applyFunc := func(l raft.Log, timeout time.Duration) raft.ApplyFuture {
+		if timeout != 5*time.Second {
+			t.Fatalf("expected the configured timeout, got %v", timeout)
+		}
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+	future := ChunkingApplyWithOptions(data, applyFunc, WithExtensions([]byte("ext")), WithApplyTimeout(5*time.Second), WithHashAlgorithm(HashSHA256))
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 1 || !bytes.Equal(m.logs[0].Data, data) || string(m.logs[0].Extensions) != "ext" {
+		t.Fatalf("expected op to be applied with its extensions, got %d logs", len(m.logs))
+	}
+}
+
+func TestChunkingApplyWithLogs(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := SplitIntoLogs(data, []byte("ext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var resp interface{}
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		resp = f.Apply(&l)
+		return errorFuture{}
+	}
+	if err := ChunkingApplyWithLogs(logs, time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if diff := deep.Equal(data, m.logs[0]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Incomplete or reordered sets of logs are rejected before anything is
+	// applied
+	applyFunc = func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		t.Fatal("unexpected apply")
+		return nil
+	}
+	for name, bad := range map[string][]raft.Log{
+		"missing":   logs[1:],
+		"reordered": {logs[0], logs[2], logs[1], logs[3]},
+		"not chunk": {{Data: []byte("foo")}},
+	} {
+		if err := ChunkingApplyWithLogs(bad, time.Second, applyFunc).Error(); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestChunkSizes_Limits(t *testing.T) {
+	if _, err := checkedInt(math.MaxUint64); err == nil {
+		t.Fatal("expected error converting oversized length")
+	}
+	if n, err := checkedInt(1 << 20); err != nil || n != 1<<20 {
+		t.Fatalf("unexpected result %d, %v", n, err)
+	}
+
+	if strconv.IntSize < 64 {
+		t.Skip("payload too large to describe on this platform")
+	}
+	header := func(seq, numChunks int) (int, int) {
+		return proto.Size(&types.ChunkInfo{SequenceNum: uint32(seq), NumChunks: uint32(numChunks)}), 0
+	}
+	if _, err := chunkSizes(maxInt, 64, 0, header); err == nil || !strings.Contains(err.Error(), "chunks") {
+		t.Fatalf("expected error for too many chunks, got %v", err)
+	}
+}
+
+func TestApplyChunking_MaxChunkSize(t *testing.T) {
+	origChunkSize := ChunkSize
+	defer func() { ChunkSize = origChunkSize }()
+	ChunkSize = 2 * raft.SuggestedMaxDataSize
+
+	data := make([]byte, 3*raft.SuggestedMaxDataSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var logs []raft.Log
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		logs = append(logs, l)
+		return errorFuture{}
+	}
+
+	if err := ChunkingApply(data, nil, time.Second, applyFunc).Error(); err == nil || !strings.Contains(err.Error(), "WithMaxChunkSize") {
+		t.Fatalf("expected chunk size error, got %v", err)
+	}
+	if len(logs) != 0 {
+		t.Fatalf("expected nothing to be applied, got %d logs", len(logs))
+	}
+
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithMaxChunkSize(ChunkSize)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(logs))
+	}
+	for _, l := range logs {
+		if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+			t.Fatalf("log of %d bytes exceeds chunk size", size)
+		}
+	}
+}
+
+func TestApplyChunking_ChunkRetries(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second chunk times out twice before going through
+	var applied []uint32
+	timeouts := 2
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		var ci types.ChunkInfo
+		if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+			t.Fatal(err)
+		}
+		applied = append(applied, ci.SequenceNum)
+		if ci.SequenceNum == 1 && timeouts > 0 {
+			timeouts--
+			return errorFuture{err: raft.ErrEnqueueTimeout}
+		}
+		return errorFuture{}
+	}
+
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithChunkRetries(1)).Error(); !errors.Is(err, raft.ErrEnqueueTimeout) {
+		t.Fatalf("expected enqueue timeout once retries ran out, got %v", err)
+	}
+
+	applied, timeouts = nil, 2
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithChunkRetries(2)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if d := deep.Equal(applied, []uint32{0, 1, 2, 3, 1, 1}); d != nil {
+		t.Fatal(d)
+	}
+}
+
+func TestApplyChunking_ChunkRetriesOpTimeout(t *testing.T) {
+	// Every submission times out after a while, so the op's time runs out
+	// while the chunk is being retried
+	var l sync.Mutex
+	var given []time.Duration
+	applyFunc := func(_ raft.Log, d time.Duration) raft.ApplyFuture {
+		l.Lock()
+		given = append(given, d)
+		l.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return errorFuture{err: raft.ErrEnqueueTimeout}
+	}
+
+	opTimeout := 200 * time.Millisecond
+	err := ChunkingApply([]byte("data"), nil, time.Minute, applyFunc, WithChunkRetries(100), WithOpTimeout(opTimeout)).Error()
+	if !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected op timeout, got %v", err)
+	}
+
+	// Resubmissions stop at the deadline, and are given only the time left
+	time.Sleep(opTimeout)
+	l.Lock()
+	defer l.Unlock()
+	if len(given) > 6 {
+		t.Fatalf("expected retries to stop at the deadline, got %d submissions", len(given))
+	}
+	for i, d := range given {
+		if d > opTimeout {
+			t.Fatalf("submission %d was given %v, past the op's deadline", i, d)
+		}
+		if i > 0 && d >= given[i-1] {
+			t.Fatalf("expected submission %d to be given less time than %v, got %v", i, given[i-1], d)
+		}
+	}
+}
+
+func TestApplyChunking_Sequential(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each chunk must have been waited on before the next is submitted
+	var outstanding, submitted int
+	failAt := -1
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		if outstanding != 0 {
+			t.Fatal("chunk submitted before the previous one completed")
+		}
+		outstanding++
+		submitted++
+		var err error
+		if submitted-1 == failAt {
+			err = raft.ErrEnqueueTimeout
+		}
+		return &countingFuture{outstanding: &outstanding, err: err}
+	}
+
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithSequentialApply()).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if submitted != 4 {
+		t.Fatalf("expected 4 chunks, got %d", submitted)
+	}
+
+	submitted, failAt = 0, 1
+	f := ChunkingApply(data, nil, time.Second, applyFunc, WithSequentialApply())
+	if err := f.Error(); !errors.Is(err, raft.ErrEnqueueTimeout) {
+		t.Fatalf("expected enqueue timeout, got %v", err)
+	}
+	if submitted != 2 {
+		t.Fatalf("expected sending to stop after the failed chunk, got %d chunks", submitted)
+	}
+	if f.(ChunkingFuture).ResumeToken() == nil {
+		t.Fatal("expected resume token for partially applied op")
+	}
+}
+
+func TestApplyChunking_SequentialBatches(t *testing.T) {
+	data := make([]byte, 4*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each batch must have been waited on before the next starts
+	var outstanding, submitted int
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		if submitted%2 == 0 && outstanding != 0 {
+			t.Fatalf("chunk %d submitted before the previous batch completed", submitted)
+		}
+		outstanding++
+		submitted++
+		return &countingFuture{outstanding: &outstanding}
+	}
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithSequentialBatches(2)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if submitted != 5 {
+		t.Fatalf("expected 5 chunks, got %d", submitted)
+	}
+	if outstanding != 0 {
+		t.Fatalf("expected the final batch to be waited on, have %d outstanding", outstanding)
+	}
+}
+
+func TestApplyChunking_MaxOutstanding(t *testing.T) {
+	data := make([]byte, 5*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var outstanding, submitted int
+	failAt := -1
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		if outstanding >= 2 {
+			t.Fatalf("chunk submitted with %d outstanding", outstanding)
+		}
+		outstanding++
+		submitted++
+		var err error
+		if submitted-1 == failAt {
+			err = raft.ErrEnqueueTimeout
+		}
+		return &countingFuture{outstanding: &outstanding, err: err}
+	}
+
+	f := ChunkingApply(data, nil, time.Second, applyFunc, WithMaxOutstanding(2))
+	if submitted != 6 || outstanding != 2 {
+		t.Fatalf("expected 6 chunks with the last 2 outstanding, got %d and %d", submitted, outstanding)
+	}
+	if err := f.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	outstanding, submitted, failAt = 0, 0, 1
+	f = ChunkingApply(data, nil, time.Second, applyFunc, WithMaxOutstanding(2))
+	if err := f.Error(); !errors.Is(err, raft.ErrEnqueueTimeout) {
+		t.Fatalf("expected enqueue timeout, got %v", err)
+	}
+	if submitted != 3 {
+		t.Fatalf("expected sending to stop once the failed chunk was seen, got %d chunks", submitted)
+	}
+}
+
+// countingFuture decrements outstanding when it is first waited on.
+type countingFuture struct {
+	outstanding *int
+	waited      bool
+	err         error
+}
+
+func (c *countingFuture) Error() error {
+	if !c.waited {
+		c.waited = true
+		*c.outstanding--
+	}
+	return c.err
+}
+
+func (c *countingFuture) Response() interface{} { return nil }
+
+func (c *countingFuture) Index() uint64 { return 0 }
+
+func TestApplyChunking_ChunkSize(t *testing.T) {
+	data := make([]byte, 3*raft.SuggestedMaxDataSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{64 * 1024, 2 * raft.SuggestedMaxDataSize, -1} {
+		logs, err := SplitIntoLogs(data, nil, WithChunkSize(size), WithMaxChunkSize(2*raft.SuggestedMaxDataSize))
+		if size < 0 {
+			if err == nil {
+				t.Fatal("expected error for negative chunk size")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := len(data)/size + 1; len(logs) != expected {
+			t.Fatalf("expected %d chunks of size %d, got %d", expected, size, len(logs))
+		}
+		for _, l := range logs {
+			if total := len(l.Data) + len(l.Extensions); total > size {
+				t.Fatalf("log of %d bytes exceeds chunk size %d", total, size)
+			}
+		}
+	}
+
+	// Sizes above the suggestion still need WithMaxChunkSize
+	if _, err := SplitIntoLogs(data, nil, WithChunkSize(2*raft.SuggestedMaxDataSize)); err == nil || !strings.Contains(err.Error(), "WithMaxChunkSize") {
+		t.Fatalf("expected chunk size error, got %v", err)
+	}
+}
+
+func TestApplyChunking_TinyChunkSize(t *testing.T) {
+	for _, tc := range []struct {
+		size, chunkSize int
+		opts            []Option
+	}{
+		{size: 1, chunkSize: 1},
+		{size: 2, chunkSize: 5},
+		{size: 3, chunkSize: 6, opts: []Option{WithReservedOp(1)}},
+		{size: 10, chunkSize: 8},
+		{size: 100, chunkSize: 12, opts: []Option{WithMetadata(map[string]string{"k": "v"})}},
+		{size: 1000, chunkSize: 16, opts: []Option{WithTotalSize()}},
+		{size: 3, chunkSize: 32, opts: []Option{WithReservedOp(1)}},
+		{size: 50, chunkSize: 40},
+	} {
+		opts := append([]Option{WithChunkSize(tc.chunkSize)}, tc.opts...)
+		done := make(chan struct{})
+		var logs []raft.Log
+		var err error
+		go func() {
+			defer close(done)
+			logs, err = SplitIntoLogs(make([]byte, tc.size), nil, opts...)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d bytes in chunks of %d: split did not return", tc.size, tc.chunkSize)
+		}
+
+		// Sizes either give chunks that fit or are refused outright
+		if err != nil {
+			if !errors.Is(err, ErrInvalidChunkSize) {
+				t.Fatalf("%d bytes in chunks of %d: expected invalid chunk size, got %v", tc.size, tc.chunkSize, err)
+			}
+			continue
+		}
+		var total int
+		for _, l := range logs {
+			if n := len(l.Data) + len(l.Extensions); n > tc.chunkSize {
+				t.Fatalf("%d bytes in chunks of %d: log of %d bytes", tc.size, tc.chunkSize, n)
+			}
+			total += len(l.Data)
+		}
+		if total != tc.size {
+			t.Fatalf("%d bytes in chunks of %d: split into %d bytes", tc.size, tc.chunkSize, total)
+		}
+	}
+}
+
+func TestApplyChunking_OpTimeout(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks that never commit fail the op once the timeout runs out
+	var timeouts []time.Duration
+	done := make(chan struct{})
+	defer close(done)
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		timeouts = append(timeouts, d)
+		return pendingFuture{done: done}
+	}
+	start := time.Now()
+	err := ChunkingApply(data, nil, time.Hour, applyFunc, WithOpTimeout(50*time.Millisecond)).Error()
+	if !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected op timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("op took %s to time out", elapsed)
+	}
+	for _, d := range timeouts {
+		if d > 50*time.Millisecond {
+			t.Fatalf("chunk given timeout of %s, beyond the op's", d)
+		}
+	}
+
+	// Submission stops once the timeout has run out
+	var submitted int
+	slowApply := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		submitted++
+		time.Sleep(30 * time.Millisecond)
+		return errorFuture{}
+	}
+	err = ChunkingApply(data, nil, time.Hour, slowApply, WithOpTimeout(50*time.Millisecond)).Error()
+	if !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected op timeout, got %v", err)
+	}
+	if submitted == 0 || submitted > 2 {
+		t.Fatalf("expected at most 2 chunks to be submitted, got %d", submitted)
+	}
+
+	if err := ChunkingApply(data, nil, time.Hour, func(raft.Log, time.Duration) raft.ApplyFuture {
+		return errorFuture{}
+	}, WithOpTimeout(time.Minute)).Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyChunking_ZeroCopy(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	copied, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sliced, err := SplitIntoLogs(data, nil, WithZeroCopy())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined []byte
+	for i := range sliced {
+		if cap(sliced[i].Data) != len(sliced[i].Data) {
+			t.Fatalf("chunk %d has spare capacity into the next chunk", i)
+		}
+		joined = append(joined, sliced[i].Data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("chunks do not make up the payload")
+	}
+
+	// Only the zero-copy chunks share the payload's memory
+	data[0] ^= 0xff
+	if sliced[0].Data[0] != data[0] {
+		t.Fatal("expected zero-copy chunk to share the payload")
+	}
+	if copied[0].Data[0] == data[0] {
+		t.Fatal("expected copied chunk not to share the payload")
+	}
+}
+
+func TestApplyChunking_Futures(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var index uint64
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		index++
+		if index == 3 {
+			return errorFuture{err: errors.New("failed")}
+		}
+		return &indexFuture{index: index}
+	}
+
+	futures := ChunkingApply(data, nil, time.Second, applyFunc).(MultiFuture).Futures()
+	if len(futures) != 4 {
+		t.Fatalf("expected 4 futures, got %d", len(futures))
+	}
+	for i, f := range futures {
+		if i == 2 {
+			if err := f.Error(); err == nil || err.Error() != "failed" {
+				t.Fatalf("expected chunk 2 to fail, got %v", err)
+			}
+			continue
+		}
+		if err := f.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if f.Index() != uint64(i+1) {
+			t.Fatalf("expected chunk %d at index %d, got %d", i, i+1, f.Index())
+		}
+	}
+
+	if futures := ChunkingApply(data, nil, time.Second, applyFunc, WithChunkSize(-1)).(MultiFuture).Futures(); futures != nil {
+		t.Fatalf("expected no futures for a failed op, got %d", len(futures))
+	}
+}
+
+// indexFuture is a successful future for a log at index.
+type indexFuture struct {
+	index uint64
+}
+
+func (i *indexFuture) Error() error { return nil }
+
+func (i *indexFuture) Response() interface{} { return nil }
+
+func (i *indexFuture) Index() uint64 { return i.index }
+
+func TestChunkingApplyMulti(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var index uint64
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		index++
+		l.Index, l.Term = index, 1
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	cmds := make([][]byte, 3)
+	for i := range cmds {
+		cmds[i] = make([]byte, (i+1)*ChunkSize)
+		if _, err := rand.Read(cmds[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	futures := ChunkingApplyMulti(cmds, [][]byte{nil, []byte("ext"), nil}, time.Second, applyFunc)
+	if len(futures) != 3 {
+		t.Fatalf("expected 3 futures, got %d", len(futures))
+	}
+	for i, future := range futures {
+		if err := future.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.logs[i], cmds[i]) {
+			t.Fatalf("op %d was not applied", i)
+		}
+	}
+	for _, futures := range [][]raft.ApplyFuture{
+		ChunkingApplyMulti(cmds, [][]byte{nil}, time.Second, applyFunc),
+		ChunkingApplyMulti(cmds, nil, time.Second, applyFunc, WithReservedOp(1)),
+	} {
+		for _, future := range futures {
+			if future.Error() == nil {
+				t.Fatal("expected invalid arguments to fail every op")
+			}
+		}
+	}
+}
+
+func TestApplyChunking_MaxPayloadSize(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	var sent int
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		sent++
+		return errorFuture{}
+	}
+
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithMaxPayloadSize(len(data))).Error(); err != nil {
+		t.Fatal(err)
+	}
+	sent = 0
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithMaxPayloadSize(len(data)-1)).Error(); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	if sent != 0 {
+		t.Fatalf("expected no chunks to be sent, got %d", sent)
+	}
+
+	// The limit is on the payload as given, even if it compresses well
+	if _, err := SplitIntoLogs(data, nil, WithMaxPayloadSize(100), WithCompression(CompressionGzip)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+	if _, _, err := EstimateChunks(len(data), 0, WithMaxPayloadSize(100)); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestEstimateChunks(t *testing.T) {
+	data := make([]byte, 3*ChunkSize+1000)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	ext := []byte("extensions")
+	largeExt := make([]byte, 2*ChunkSize+500)
+	nsExt, err := Extensions{7: []byte("other")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		ext  []byte
+		opts []Option
+	}{
+		"plain":            {},
+		"extensions":       {ext: ext, opts: []Option{WithHashAlgorithm(HashSHA256), WithMetadata(map[string]string{"k": "v"})}},
+		"namespace":        {ext: nsExt, opts: []Option{WithExtensionsNamespace(3)}},
+		"encrypted":        {ext: ext, opts: []Option{WithKeyProvider(newTestKeyProvider(t)), WithChunkSize(64 * 1024)}},
+		"large extensions": {ext: largeExt, opts: []Option{WithKeyProvider(newTestKeyProvider(t))}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// Fix the op num so that headers are the same size
+			opts := append(tc.opts, WithReservedOp(1<<63))
+			logs, err := SplitIntoLogs(data, tc.ext, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var total int
+			for _, l := range logs {
+				total += len(l.Data) + len(l.Extensions)
+			}
+
+			numChunks, estimated, err := EstimateChunks(len(data), len(tc.ext), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if numChunks != len(logs) || estimated != total {
+				t.Fatalf("estimated %d chunks of %d bytes, got %d of %d", numChunks, estimated, len(logs), total)
+			}
+		})
+	}
+
+	if _, _, err := EstimateChunks(len(data), 0, WithChunkSize(10)); !errors.Is(err, ErrInvalidChunkSize) {
+		t.Fatalf("expected invalid chunk size, got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ChunkingApplyAsync applies cmd as ChunkingApply does, but returns straight
+// away, splitting and submitting the op in the background, and calls done
+// with the op's future once all of its chunks' futures have returned, so that
+// Error and Response won't block. The future implements ChunkingFuture as
+// ChunkingApply's does. Since cmd and extensions are used in the background,
+// they must not be modified until done is called. Ops applied this way may be
+// submitted, and so applied, in a different order from the calls. done may be
+// nil if the outcome isn't needed.
+func ChunkingApplyAsync(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, done func(raft.ApplyFuture), opts ...Option) {
+	go func() {
+		f := ChunkingApply(cmd, extensions, timeout, applyFunc, opts...)
+		f.Error()
+		if done != nil {
+			done(f)
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestChunkingApplyAsync(t *testing.T) {
+	// Chunks are held up until released, so the call must not wait for them
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var submitted int
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		<-release
+		lock.Lock()
+		submitted++
+		lock.Unlock()
+		return errorFuture{}
+	}
+
+	data := make([]byte, 3*ChunkSize)
+	done := make(chan raft.ApplyFuture, 1)
+	ChunkingApplyAsync(data, nil, time.Second, applyFunc, func(f raft.ApplyFuture) {
+		done <- f
+	})
+	select {
+	case <-done:
+		t.Fatal("expected op to still be in progress")
+	default:
+	}
+
+	close(release)
+	select {
+	case f := <-done:
+		if err := f.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f.(ChunkingFuture); !ok {
+			t.Fatal("expected a ChunkingFuture")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the op to complete")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if submitted != 4 {
+		t.Fatalf("expected 4 chunks to be submitted, got %d", submitted)
+	}
+
+	// Failures are handed to done
+	failFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		return errorFuture{err: raft.ErrNotLeader}
+	}
+	ChunkingApplyAsync(data, nil, time.Second, failFunc, func(f raft.ApplyFuture) {
+		done <- f
+	})
+	if err := (<-done).Error(); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected not leader error, got %v", err)
+	}
+}
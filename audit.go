@@ -0,0 +1,264 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OpOutcome describes how a chunked op ended.
+type OpOutcome int
+
+const (
+	// OpCompleted means all chunks arrived and the op was passed on to the
+	// underlying FSM.
+	OpCompleted OpOutcome = iota
+
+	// OpFailed means all chunks arrived but the op could not be
+	// reassembled, for example because it failed an integrity check.
+	OpFailed
+
+	// OpAbortedTermChange means the op was discarded because the term
+	// changed before all of its chunks arrived, or, with WithPreservedOps,
+	// because it was invalidated by InvalidatePriorTermOps.
+	OpAbortedTermChange
+
+	// OpAbortedRestore means the op was discarded because the FSM's chunk
+	// state was restored to one that did not include it.
+	OpAbortedRestore
+
+	// OpPruned means the op was dropped by PruneBefore.
+	OpPruned
+
+	// OpStranded means the op was discarded because some of its chunks
+	// were applied before the FSM was restored from a snapshot that did not
+	// include them. Err holds a *StrandedOpError.
+	OpStranded
+
+	// OpExpired means the op was discarded because its deadline passed
+	// before all of its chunks arrived.
+	OpExpired
+
+	// OpCancelled means the op was discarded by CancelChunkingOp before all
+	// of its chunks arrived.
+	OpCancelled
+
+	// OpDuplicate means the op was ignored because an op with the same op
+	// num had already completed, or one with the same idempotency key had
+	// been applied; see WithDedupWindow and WithIdempotencyWindow.
+	OpDuplicate
+
+	// OpEvicted means the op was discarded before all of its chunks arrived
+	// to keep the FSM within its memory budget. Err holds an
+	// *EvictedOpError.
+	OpEvicted
+
+	// OpStale means the op was discarded because no chunks of it arrived
+	// for longer than allowed by WithStaleOpGC. Err wraps ErrStaleOp.
+	OpStale
+)
+
+func (o OpOutcome) String() string {
+	switch o {
+	case OpCompleted:
+		return "completed"
+	case OpFailed:
+		return "failed"
+	case OpAbortedTermChange:
+		return "aborted (term change)"
+	case OpAbortedRestore:
+		return "aborted (restore)"
+	case OpPruned:
+		return "pruned"
+	case OpStranded:
+		return "stranded"
+	case OpExpired:
+		return "expired"
+	case OpCancelled:
+		return "cancelled"
+	case OpDuplicate:
+		return "duplicate"
+	case OpEvicted:
+		return "evicted"
+	case OpStale:
+		return "stale"
+	default:
+		return fmt.Sprintf("OpOutcome(%d)", int(o))
+	}
+}
+
+// OpRecord is the audit record for a single chunked op.
+type OpRecord struct {
+	// OpNum is the op's ID
+	OpNum uint64
+
+	// Outcome is how the op ended, with Err holding the error for failed
+	// ops
+	Outcome OpOutcome
+	Err     error
+
+	// Size is the number of bytes of chunk data received for the op, as
+	// carried in the logs
+	Size uint64
+
+	// NumChunks is the number of chunks in the op and ChunksReceived how
+	// many of them had arrived
+	NumChunks      uint32
+	ChunksReceived int
+
+	// Started is when the leader appended the op's first chunk, and
+	// Duration the time from then until the leader appended the log that
+	// ended the op. They are zero if the times aren't known, e.g. for ops
+	// restored from a snapshot taken by an older version.
+	Started  time.Time
+	Duration time.Duration
+
+	// Index and Term identify the log that ended the op; they are zero if
+	// the op was not ended by a log, e.g. when pruned.
+	Index uint64
+	Term  uint64
+
+	// Metadata holds the metadata given to ChunkingApply via WithMetadata
+	Metadata map[string]string
+
+	// TraceContext is the trace context given to ChunkingApply via
+	// WithTraceContext, if any
+	TraceContext string
+}
+
+// AuditSink receives a record for every chunked op the FSM finishes with,
+// whether or not it completed. Records are delivered synchronously from the
+// FSM, so implementations should be quick and must not call back into it.
+type AuditSink interface {
+	RecordOp(OpRecord)
+}
+
+// WithAuditSink sets a sink that the FSM or Reassembler sends a record to for
+// every op it completes or discards, including partial ops dropped when the
+// term changes. It is ignored by ChunkingApply.
+func WithAuditSink(sink AuditSink) Option {
+	return func(c *config) {
+		c.auditSink = sink
+	}
+}
+
+// WithMetadata attaches key/value pairs, such as correlation IDs, to an op.
+// They are sent with the first chunk and reported along with the op in its
+// audit record, ChunkingSuccess, OpInfo, OpCheckpoint and ReassembledOp. It
+// is ignored by the FSM.
+func WithMetadata(md map[string]string) Option {
+	return func(c *config) {
+		c.metadata = md
+	}
+}
+
+// WithTraceContext attaches a distributed tracing context, such as a W3C
+// traceparent header value or any other trace ID, to an op. It is sent with
+// every chunk and reported in the op's audit record and OpInfo, and by the
+// Reassembler, so that an apply can be correlated with its reassembly on each
+// node. It is ignored by the FSM.
+func WithTraceContext(tc string) Option {
+	return func(c *config) {
+		c.traceContext = tc
+	}
+}
+
+// WithRecentOps makes the FSM keep the audit records of the last n ops it
+// finished with, so that RecentOps can answer whether an op was processed
+// after the fact. Only the records are kept, not the ops' data. It is ignored
+// by ChunkingApply.
+func WithRecentOps(n int) Option {
+	return func(c *config) {
+		c.recentOps = n
+	}
+}
+
+// recentOps is a fixed-size ring of the most recent op records.
+type recentOps struct {
+	l       sync.Mutex
+	records []OpRecord
+	next    int
+	full    bool
+}
+
+func newRecentOps(n int) *recentOps {
+	if n <= 0 {
+		return nil
+	}
+	return &recentOps{records: make([]OpRecord, n)}
+}
+
+func (r *recentOps) add(rec OpRecord) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.records[r.next] = rec
+	r.next++
+	if r.next == len(r.records) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// list returns the records, oldest first.
+func (r *recentOps) list() []OpRecord {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if !r.full {
+		return append([]OpRecord(nil), r.records[:r.next]...)
+	}
+	ret := make([]OpRecord, 0, len(r.records))
+	ret = append(ret, r.records[r.next:]...)
+	return append(ret, r.records[:r.next]...)
+}
+
+// RecentOps returns the records of the ops the FSM most recently completed or
+// discarded, oldest first, up to the number given to WithRecentOps. It returns
+// nil if WithRecentOps was not given. It is safe to call concurrently with
+// Apply and does not wait for a batch to finish.
+func (c *ChunkingFSM) RecentOps() []OpRecord {
+	if c.recent == nil {
+		return nil
+	}
+	return c.recent.list()
+}
+
+// audit sends the record for an op to the audit sink, if there is one, and
+// keeps it among the recent ops if enabled. at is the time the log that ended
+// the op was appended, if any.
+func (c *ChunkingFSM) audit(opNum uint64, op *opState, outcome OpOutcome, err error, index, term uint64, at time.Time) {
+	if (c.conf.auditSink == nil && c.recent == nil) || op == nil {
+		return
+	}
+	rec := opRecord(opNum, op, outcome, err, index, term, at)
+	if c.recent != nil {
+		c.recent.add(rec)
+	}
+	if c.conf.auditSink != nil {
+		c.conf.auditSink.RecordOp(rec)
+	}
+}
+
+// opRecord returns the record of an op that ended with outcome, as of the
+// log with the given index, term and append time.
+func opRecord(opNum uint64, op *opState, outcome OpOutcome, err error, index, term uint64, at time.Time) OpRecord {
+	rec := OpRecord{
+		OpNum:          opNum,
+		Outcome:        outcome,
+		Err:            err,
+		Size:           op.bytes,
+		NumChunks:      op.numChunks,
+		ChunksReceived: len(op.sizes),
+		Started:        op.started,
+		Index:          index,
+		Term:           term,
+		Metadata:       op.metadata,
+		TraceContext:   op.traceContext,
+	}
+	if !op.started.IsZero() && !at.IsZero() {
+		rec.Duration = at.Sub(op.started)
+	}
+	return rec
+}
@@ -0,0 +1,245 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/raft"
+)
+
+type recordingSink struct {
+	records []OpRecord
+}
+
+func (r *recordingSink) RecordOp(rec OpRecord) {
+	r.records = append(r.records, rec)
+}
+
+func auditLogs(t *testing.T, start time.Time, opts ...Option) []*raft.Log {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := SplitIntoLogs(data, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := make([]*raft.Log, len(logs))
+	for i := range logs {
+		l := logs[i]
+		l.Index = uint64(i + 1)
+		l.Term = 1
+		l.AppendedAt = start.Add(time.Duration(i) * time.Second)
+		ret[i] = &l
+	}
+	return ret
+}
+
+func TestAudit(t *testing.T) {
+	sink := new(recordingSink)
+	f := NewChunkingFSM(new(MockFSM), nil, WithAuditSink(sink))
+	start := time.Now()
+	md := map[string]string{"request-id": "abc"}
+
+	// A completed op
+	logs := auditLogs(t, start, WithMetadata(md))
+	for _, l := range logs {
+		f.Apply(l)
+	}
+	if len(sink.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(sink.records))
+	}
+	var size uint64
+	for _, l := range logs {
+		size += uint64(len(l.Data))
+	}
+	expected := OpRecord{
+		OpNum:          logOpNum(t, logs[0]),
+		Outcome:        OpCompleted,
+		Size:           size,
+		NumChunks:      uint32(len(logs)),
+		ChunksReceived: len(logs),
+		Started:        start,
+		Duration:       time.Duration(len(logs)-1) * time.Second,
+		Index:          uint64(len(logs)),
+		Term:           1,
+		Metadata:       md,
+	}
+	if diff := deep.Equal(expected, sink.records[0]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// An op that fails its integrity check
+	logs = auditLogs(t, start, WithHashAlgorithm(HashSHA256))
+	logs[0].Data[0] ^= 0xff
+	for _, l := range logs {
+		f.Apply(l)
+	}
+	if rec := sink.records[1]; rec.Outcome != OpFailed || !errors.Is(rec.Err, ErrChecksumMismatch) {
+		t.Fatalf("expected failed record, got %#v", rec)
+	}
+
+	// Ops that are pruned or aborted by a term change
+	f.Apply(auditLogs(t, start)[0])
+	if _, err := f.PruneBefore(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if rec := sink.records[2]; rec.Outcome != OpPruned || rec.ChunksReceived != 1 {
+		t.Fatalf("expected pruned record, got %#v", rec)
+	}
+
+	f.Apply(auditLogs(t, start)[0])
+	next := auditLogs(t, start.Add(time.Minute))[0]
+	next.Term = 2
+	f.Apply(next)
+	rec := sink.records[3]
+	if rec.Outcome != OpAbortedTermChange || rec.Term != 2 || rec.Duration != time.Minute {
+		t.Fatalf("expected term change record, got %#v", rec)
+	}
+
+	// Restoring to an empty state aborts the remaining op
+	if err := f.RestoreState(nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec := sink.records[4]; rec.Outcome != OpAbortedRestore || rec.OpNum != logOpNum(t, next) {
+		t.Fatalf("expected restore record, got %#v", rec)
+	}
+	if len(sink.records) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(sink.records))
+	}
+}
+
+func TestAudit_RecentOps(t *testing.T) {
+	f := NewChunkingFSM(new(MockFSM), nil, WithRecentOps(2))
+	if recent := f.RecentOps(); len(recent) != 0 {
+		t.Fatalf("expected no recent ops, got %d", len(recent))
+	}
+
+	var opNums []uint64
+	for i := 0; i < 3; i++ {
+		logs := auditLogs(t, time.Now())
+		for _, l := range logs {
+			f.Apply(l)
+		}
+		opNums = append(opNums, logOpNum(t, logs[0]))
+	}
+	f.Apply(auditLogs(t, time.Now())[0])
+	if _, err := f.PruneBefore(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	recent := f.RecentOps()
+	if len(recent) != 2 {
+		t.Fatalf("expected 2 recent ops, got %d", len(recent))
+	}
+	if recent[0].OpNum != opNums[2] || recent[0].Outcome != OpCompleted {
+		t.Fatalf("unexpected oldest record %#v", recent[0])
+	}
+	if recent[1].Outcome != OpPruned {
+		t.Fatalf("unexpected newest record %#v", recent[1])
+	}
+
+	if recent := NewChunkingFSM(new(MockFSM), nil).RecentOps(); recent != nil {
+		t.Fatalf("expected nil recent ops when disabled, got %d", len(recent))
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	md := map[string]string{"request-id": "abc", "user": "alice"}
+	logs := auditLogs(t, time.Now(), WithMetadata(md))
+
+	// The metadata shows up in checkpoints while the op is in flight and in
+	// the response once it completes
+	f := NewChunkingFSM(new(MockFSM), nil)
+	f.Apply(logs[0])
+	ops := f.Checkpoint().Ops
+	if len(ops) != 1 {
+		t.Fatalf("expected 1 op in flight, got %d", len(ops))
+	}
+	if diff := deep.Equal(md, ops[0].Metadata); diff != nil {
+		t.Fatal(diff)
+	}
+	var resp interface{}
+	for _, l := range logs[1:] {
+		resp = f.Apply(l)
+	}
+	success, ok := resp.(ChunkingSuccess)
+	if !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if diff := deep.Equal(md, success.Metadata); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Batches report it too
+	bf := NewChunkingBatchingFSM(&MockBatchFSM{MockFSM: new(MockFSM)}, nil)
+	responses := bf.ApplyBatch(logs)
+	success, ok = responses[len(responses)-1].(ChunkingSuccess)
+	if !ok {
+		t.Fatalf("expected success, got %#v", responses[len(responses)-1])
+	}
+	if diff := deep.Equal(md, success.Metadata); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// As does the Reassembler
+	r := NewReassembler(func(uint64) (io.Writer, error) { return io.Discard, nil })
+	var op *ReassembledOp
+	for _, l := range logs {
+		var err error
+		if op, err = r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if op == nil {
+		t.Fatal("expected op to complete")
+	}
+	if diff := deep.Equal(md, op.Metadata); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestTraceContext(t *testing.T) {
+	const tc = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	logs := auditLogs(t, time.Now(), WithTraceContext(tc))
+
+	sink := new(recordingSink)
+	m := &opApplierFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f := NewChunkingFSM(m, nil, WithAuditSink(sink))
+	for _, l := range logs {
+		f.Apply(l)
+	}
+	if len(sink.records) != 1 || sink.records[0].TraceContext != tc {
+		t.Fatalf("expected trace context in audit record, got %#v", sink.records)
+	}
+	if len(m.infos) != 1 || m.infos[0].TraceContext != tc {
+		t.Fatalf("expected trace context in op info, got %#v", m.infos)
+	}
+
+	// Ops discarded after their first chunk still report it
+	sink.records = nil
+	f = NewChunkingFSM(new(MockFSM), nil, WithAuditSink(sink), WithReorderWindow(1))
+	f.Apply(logs[2])
+	if len(sink.records) != 1 || sink.records[0].TraceContext != tc {
+		t.Fatalf("expected trace context in audit record, got %#v", sink.records)
+	}
+
+	r := NewReassembler(func(uint64) (io.Writer, error) { return io.Discard, nil })
+	var op *ReassembledOp
+	for _, l := range logs {
+		var err error
+		if op, err = r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if op == nil || op.TraceContext != tc {
+		t.Fatalf("expected trace context on reassembled op, got %#v", op)
+	}
+}
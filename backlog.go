@@ -0,0 +1,81 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import "sort"
+
+// OpDivergence describes an op whose chunks the nodes compared by
+// CompareBacklogs don't agree on.
+type OpDivergence struct {
+	OpNum     uint64
+	NumChunks uint32
+
+	// Chunks maps each node holding the op to the number of its chunks the
+	// node has received
+	Chunks map[string]int
+
+	// Missing holds the nodes that don't hold the op at all, and Behind
+	// those that hold fewer of its chunks than the node furthest along.
+	// Both are sorted.
+	Missing []string
+	Behind  []string
+}
+
+// CompareBacklogs compares checkpoints of the op bookkeeping of several nodes,
+// keyed by node name, such as ones gathered with ChunkingFSM.Checkpoint. It
+// returns the ops that some nodes hold fewer chunks of than others, sorted by
+// op number, so that followers whose chunk state is drifting from the rest
+// can be spotted before the difference reaches their FSMs.
+//
+// Nodes that have applied fewer logs than others naturally lag behind them,
+// and an op one node has completed is missing there while others are still
+// collecting it, so divergences are only conclusive between checkpoints with
+// the same Index. Comparing checkpoints at different indexes is still useful
+// for spotting ops that stay divergent over time.
+func CompareBacklogs(checkpoints map[string]Checkpoint) []OpDivergence {
+	ops := make(map[uint64]*OpDivergence)
+	for node, cp := range checkpoints {
+		for _, op := range cp.Ops {
+			d, ok := ops[op.OpNum]
+			if !ok {
+				d = &OpDivergence{
+					OpNum:  op.OpNum,
+					Chunks: make(map[string]int),
+				}
+				ops[op.OpNum] = d
+			}
+			if op.NumChunks > d.NumChunks {
+				d.NumChunks = op.NumChunks
+			}
+			d.Chunks[node] = op.ChunksReceived
+		}
+	}
+
+	var ret []OpDivergence
+	for _, d := range ops {
+		most := 0
+		for _, n := range d.Chunks {
+			if n > most {
+				most = n
+			}
+		}
+		for node := range checkpoints {
+			n, ok := d.Chunks[node]
+			switch {
+			case !ok:
+				d.Missing = append(d.Missing, node)
+			case n < most:
+				d.Behind = append(d.Behind, node)
+			}
+		}
+		if len(d.Missing) == 0 && len(d.Behind) == 0 {
+			continue
+		}
+		sort.Strings(d.Missing)
+		sort.Strings(d.Behind)
+		ret = append(ret, *d)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].OpNum < ret[j].OpNum })
+	return ret
+}
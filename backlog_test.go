@@ -0,0 +1,56 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+)
+
+func TestCompareBacklogs(t *testing.T) {
+	logs := auditLogs(t, time.Now())
+	opNum := logOpNum(t, logs[0])
+
+	leader := NewChunkingFSM(new(MockFSM), nil)
+	lagging := NewChunkingFSM(new(MockFSM), nil)
+	empty := NewChunkingFSM(new(MockFSM), nil)
+	for _, l := range logs[:3] {
+		leader.Apply(l)
+	}
+	lagging.Apply(logs[0])
+
+	checkpoints := map[string]Checkpoint{
+		"leader":  leader.Checkpoint(),
+		"lagging": lagging.Checkpoint(),
+		"empty":   empty.Checkpoint(),
+	}
+	if cp := checkpoints["leader"]; cp.Index != logs[2].Index || cp.Term != logs[2].Term {
+		t.Fatalf("unexpected checkpoint position %d/%d", cp.Index, cp.Term)
+	}
+
+	expected := []OpDivergence{{
+		OpNum:     opNum,
+		NumChunks: uint32(len(logs)),
+		Chunks:    map[string]int{"leader": 3, "lagging": 1},
+		Missing:   []string{"empty"},
+		Behind:    []string{"lagging"},
+	}}
+	if d := deep.Equal(expected, CompareBacklogs(checkpoints)); d != nil {
+		t.Fatal(d)
+	}
+
+	// Nodes that agree have no divergences
+	for _, l := range logs[1:3] {
+		lagging.Apply(l)
+	}
+	agreed := map[string]Checkpoint{
+		"leader":  leader.Checkpoint(),
+		"lagging": lagging.Checkpoint(),
+	}
+	if d := CompareBacklogs(agreed); len(d) != 0 {
+		t.Fatalf("expected no divergences, got %#v", d)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package bench measures the end-to-end throughput and latency of chunked
+// applies against any ApplyFunc, such as the ApplyLog method of a running
+// raft node. The raftchunking-bench command uses it against a local cluster.
+package bench
+
+import (
+	"crypto/rand"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+)
+
+// Config configures a benchmark run.
+type Config struct {
+	// Ops is the total number of chunked applies to perform
+	Ops int
+
+	// Concurrency is the number of applies in flight at once. Defaults to 1.
+	Concurrency int
+
+	// PayloadSize is the size of each applied payload in bytes
+	PayloadSize int
+
+	// Timeout is the per-chunk apply timeout. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// Options are passed to every ChunkingApply call
+	Options []raftchunking.Option
+}
+
+// Result holds the measurements of a benchmark run.
+type Result struct {
+	Ops     int
+	Failed  int
+	Bytes   uint64
+	Elapsed time.Duration
+
+	// Latency percentiles of successful applies, measured from the call to
+	// ChunkingApply until its future's Error returns
+	P50, P90, P99, Max time.Duration
+}
+
+// BytesPerSecond returns the payload throughput of successful applies.
+func (r *Result) BytesPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Elapsed.Seconds()
+}
+
+// OpsPerSecond returns the rate of successful applies.
+func (r *Result) OpsPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops-r.Failed) / r.Elapsed.Seconds()
+}
+
+// Run performs the configured number of chunked applies through applyFunc and
+// reports the results. Errors from individual applies are counted rather than
+// returned.
+func Run(conf Config, applyFunc raftchunking.ApplyFunc) (*Result, error) {
+	if conf.Ops <= 0 {
+		return nil, errors.New("number of ops must be positive")
+	}
+	if conf.PayloadSize <= 0 {
+		return nil, errors.New("payload size must be positive")
+	}
+	if conf.Concurrency <= 0 {
+		conf.Concurrency = 1
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 10 * time.Second
+	}
+
+	// All workers share one payload; its content doesn't matter much to
+	// raft, but random data keeps any compression honest
+	payload := make([]byte, conf.PayloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		return nil, err
+	}
+
+	ops := make(chan struct{}, conf.Ops)
+	for i := 0; i < conf.Ops; i++ {
+		ops <- struct{}{}
+	}
+	close(ops)
+
+	var l sync.Mutex
+	var latencies []time.Duration
+	res := &Result{Ops: conf.Ops}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < conf.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range ops {
+				opStart := time.Now()
+				err := raftchunking.ChunkingApply(payload, nil, conf.Timeout, applyFunc, conf.Options...).Error()
+				latency := time.Since(opStart)
+
+				l.Lock()
+				if err != nil {
+					res.Failed++
+				} else {
+					res.Bytes += uint64(len(payload))
+					latencies = append(latencies, latency)
+				}
+				l.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	res.Elapsed = time.Since(start)
+
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		res.P50 = percentile(latencies, 50)
+		res.P90 = percentile(latencies, 90)
+		res.P99 = percentile(latencies, 99)
+		res.Max = latencies[len(latencies)-1]
+	}
+	return res, nil
+}
+
+// percentile returns the p-th percentile of sorted latencies using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,67 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package bench
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type testFuture struct {
+	err error
+}
+
+func (f testFuture) Error() error          { return f.err }
+func (f testFuture) Index() uint64         { return 0 }
+func (f testFuture) Response() interface{} { return nil }
+
+func TestRun(t *testing.T) {
+	var applies uint64
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		n := atomic.AddUint64(&applies, 1)
+		// Fail one chunk partway through to check failures are counted
+		if n == 7 {
+			return testFuture{err: errors.New("failed")}
+		}
+		return testFuture{}
+	}
+
+	res, err := Run(Config{
+		Ops:         10,
+		Concurrency: 3,
+		PayloadSize: 3 * raft.SuggestedMaxDataSize,
+	}, applyFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ops != 10 || res.Failed != 1 {
+		t.Fatalf("unexpected counts: %d ops, %d failed", res.Ops, res.Failed)
+	}
+	if res.Bytes != 9*3*raft.SuggestedMaxDataSize {
+		t.Fatalf("unexpected bytes: %d", res.Bytes)
+	}
+	if res.P50 > res.P90 || res.P90 > res.P99 || res.P99 > res.Max {
+		t.Fatalf("percentiles out of order: %v %v %v %v", res.P50, res.P90, res.P99, res.Max)
+	}
+
+	if _, err := Run(Config{}, applyFunc); err == nil {
+		t.Fatal("expected error for empty config")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	for p, exp := range map[int]time.Duration{50: 50, 90: 90, 99: 99, 100: 100} {
+		if got := percentile(sorted, p); got != exp {
+			t.Fatalf("p%d: expected %d, got %d", p, exp, got)
+		}
+	}
+}
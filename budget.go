@@ -0,0 +1,128 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/raft"
+)
+
+// EvictionPolicy chooses which op the FSM drops when its memory budget, set
+// with WithMemoryBudget, is exceeded.
+type EvictionPolicy int
+
+const (
+	// EvictOldest drops the op whose first chunk was applied earliest.
+	EvictOldest EvictionPolicy = iota
+
+	// EvictLargest drops the op holding the most chunk data.
+	EvictLargest
+
+	// EvictIncoming drops the op whose chunk took the FSM over budget,
+	// leaving the ops already under way alone.
+	EvictIncoming
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictOldest:
+		return "oldest"
+	case EvictLargest:
+		return "largest"
+	case EvictIncoming:
+		return "incoming"
+	default:
+		return fmt.Sprintf("EvictionPolicy(%d)", int(p))
+	}
+}
+
+// EvictedOpError is the error recorded, with the OpEvicted outcome, for an op
+// dropped to keep the FSM within its memory budget, and returned from Apply
+// for the op's final chunk.
+type EvictedOpError struct {
+	OpNum uint64
+
+	// Bytes is how much of the op's chunk data was held when it was
+	// evicted, and Policy the policy that chose it
+	Bytes  uint64
+	Policy EvictionPolicy
+}
+
+func (e *EvictedOpError) Error() string {
+	return fmt.Sprintf("op %d was evicted with %d bytes held to stay within the memory budget (%v policy)", e.OpNum, e.Bytes, e.Policy)
+}
+
+// WithMemoryBudget caps the FSM's incomplete ops at maxOps ops and maxBytes
+// bytes of chunk data. Zero means no limit. When a chunk takes the FSM over
+// either limit, ops chosen by policy are dropped until it is back within
+// them; their remaining chunks are ignored, and the final one returns an
+// *EvictedOpError from Apply. Unlike WithBacklogLimits the limits are
+// enforced, so every node must be given the same ones or their states will
+// diverge. It is ignored by ChunkingApply.
+func WithMemoryBudget(maxOps, maxBytes uint64, policy EvictionPolicy) Option {
+	return func(c *config) {
+		c.budgetOps = maxOps
+		c.budgetBytes = maxBytes
+		c.evictionPolicy = policy
+	}
+}
+
+// enforceBudget evicts ops until the FSM is within its memory budget, as of
+// log l, which carried a chunk of op current.
+func (c *ChunkingFSM) enforceBudget(l *raft.Log, current opKey) error {
+	maxOps, maxBytes := c.conf.budgetOps, c.conf.budgetBytes
+	for len(c.ops) > 0 && (maxOps != 0 && c.PendingOps() > maxOps || maxBytes != 0 && c.PendingBytes() > maxBytes) {
+		if err := c.evictOp(l, c.evictionVictim(current)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evictionVictim returns the op to evict under the configured policy. Ties
+// go to the lowest op num, so that every node picks the same op.
+func (c *ChunkingFSM) evictionVictim(current opKey) opKey {
+	if _, ok := c.ops[current]; ok && c.conf.evictionPolicy == EvictIncoming {
+		return current
+	}
+	var victim opKey
+	var best *opState
+	for key, op := range c.ops {
+		var better bool
+		switch {
+		case best == nil:
+			better = true
+		case c.conf.evictionPolicy == EvictLargest && op.bytes != best.bytes:
+			better = op.bytes > best.bytes
+		case c.conf.evictionPolicy != EvictLargest && op.first != best.first:
+			better = op.first < best.first
+		default:
+			better = key.less(victim)
+		}
+		if better {
+			victim, best = key, op
+		}
+	}
+	return victim
+}
+
+// evictOp drops an op to stay within the memory budget, leaving its remaining
+// chunks to be ignored.
+func (c *ChunkingFSM) evictOp(l *raft.Log, key opKey) error {
+	if _, err := c.store.FinalizeOp(c.ops[key].storeNum); err != nil {
+		return err
+	}
+	op := c.untrackOp(key)
+	err := &EvictedOpError{
+		OpNum:  key.opNum,
+		Bytes:  op.bytes,
+		Policy: c.conf.evictionPolicy,
+	}
+	c.discardOp(key)
+	c.discarded[key] = err
+	c.abortStream(key.opNum, op, OpEvicted, err)
+	c.audit(key.opNum, op, OpEvicted, err, l.Index, l.Term, l.AppendedAt)
+	return nil
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	// Three ops, where b holds the most data and c arrives last
+	var ops [][]raft.Log
+	for i := 0; i < 3; i++ {
+		logs, err := SplitIntoLogs(make([]byte, 3*ChunkSize), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, logs)
+	}
+	var index uint64
+	apply := func(f *ChunkingFSM, l raft.Log) interface{} {
+		index++
+		l.Index = index
+		return f.Apply(&l)
+	}
+
+	for _, tc := range []struct {
+		policy EvictionPolicy
+		victim int
+	}{
+		{EvictOldest, 0},
+		{EvictLargest, 1},
+		{EvictIncoming, 2},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil, WithMemoryBudget(2, 0, tc.policy), WithRecentOps(3))
+			apply(f, ops[0][0])
+			apply(f, ops[1][0])
+			apply(f, ops[1][1])
+			apply(f, ops[2][0])
+			if f.PendingOps() != 2 {
+				t.Fatalf("expected 2 ops to be kept, got %d", f.PendingOps())
+			}
+
+			// The victim's remaining chunks are ignored, with the final
+			// one reporting the eviction
+			for i, logs := range ops {
+				var resp interface{}
+				for seq, l := range logs {
+					if seq == 0 || i == 1 && seq == 1 {
+						continue
+					}
+					resp = apply(f, l)
+				}
+				var evicted *EvictedOpError
+				if err, _ := resp.(error); errors.As(err, &evicted) != (i == tc.victim) {
+					t.Fatalf("op %d: unexpected response %#v", i, resp)
+				}
+				if i == tc.victim && (evicted.OpNum != logOpNum(t, &logs[0]) || evicted.Policy != tc.policy || evicted.Bytes == 0) {
+					t.Fatalf("unexpected eviction %#v", evicted)
+				}
+			}
+			if len(m.logs) != 2 || f.PendingOps() != 0 || f.PendingBytes() != 0 {
+				t.Fatalf("expected the other ops to complete, got %d applied and %d pending", len(m.logs), f.PendingOps())
+			}
+			if recent := f.RecentOps(); recent[0].Outcome != OpEvicted || recent[0].OpNum != logOpNum(t, &ops[tc.victim][0]) {
+				t.Fatalf("expected the eviction to be recorded first, got %#v", recent[0])
+			}
+		})
+	}
+
+	// An op too large for the byte budget evicts itself
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithMemoryBudget(0, uint64(ChunkSize+ChunkSize/2), EvictOldest))
+	var resp interface{}
+	for _, l := range ops[0] {
+		resp = apply(f, l)
+	}
+	var evicted *EvictedOpError
+	if err, _ := resp.(error); !errors.As(err, &evicted) {
+		t.Fatalf("expected the op to be evicted, got %#v", resp)
+	}
+	if len(m.logs) != 0 || f.PendingBytes() != 0 {
+		t.Fatalf("expected nothing to be applied or held, got %d applied and %d bytes", len(m.logs), f.PendingBytes())
+	}
+
+	// Ops within the budget are unaffected
+	f = NewChunkingFSM(m, nil, WithMemoryBudget(1, uint64(4*ChunkSize), EvictOldest))
+	for _, l := range ops[1] {
+		resp = apply(f, l)
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+}
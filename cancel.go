@@ -0,0 +1,61 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// CancelChunkingOp applies a log through applyFunc that makes FSMs drop the
+// chunks of op opNum received so far, and ignore any that follow, so that an
+// abandoned op doesn't hold memory on every node until the term changes. The
+// op number can be had from ChunkingFuture.OpNum. It returns a future whose
+// Error returns any error applying the log. Cancelling doesn't stop
+// ChunkingApply from submitting the op's remaining chunks, and an op that
+// has already completed is unaffected. The options should include any
+// WithExtensionsNamespace and WithOrigin given to ChunkingApply. All nodes
+// must understand cancellations before they are used.
+func CancelChunkingOp(opNum uint64, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	conf := newConfig(opts)
+	if opNum == 0 {
+		return errorFuture{err: errors.New("no op to cancel")}
+	}
+	others, err := conf.otherExtensions(nil)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	ext, err := conf.marshalChunkExtensions(&types.ChunkInfo{
+		OpNum:  opNum,
+		Cancel: true,
+		Origin: conf.origin,
+	}, others, nil)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	return responseFuture{applyFunc(conf.newLog(nil, ext), timeout)}
+}
+
+// cancelOp handles a cancellation log.
+func (c *ChunkingFSM) cancelOp(l *raft.Log, key opKey) error {
+	if key.opNum == 0 {
+		return c.invalidatePriorTermOps(l)
+	}
+	c.releaseReservation(key.opNum)
+	op, ok := c.ops[key]
+	if !ok {
+		return nil
+	}
+	if _, err := c.store.FinalizeOp(op.storeNum); err != nil {
+		return err
+	}
+	c.untrackOp(key)
+	c.discardOp(key)
+	c.abortStream(key.opNum, op, OpCancelled, nil)
+	c.audit(key.opNum, op, OpCancelled, nil, l.Index, l.Term, l.AppendedAt)
+	return nil
+}
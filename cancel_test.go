@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestCancelChunkingOp(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := new(recordingSink)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithAuditSink(sink))
+	r := NewReassembler(func(uint64) (io.Writer, error) { return ioutil.Discard, nil }, WithAuditSink(sink))
+	var index uint64
+	var cancel func(opNum uint64)
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		index++
+		l.Index, l.Term = index, 1
+		resp := f.Apply(&l)
+		if _, err := r.Add(&l); err != nil {
+			t.Fatal(err)
+		}
+		if index == 2 {
+			cancel(logOpNum(t, &l))
+		}
+		return appliedFuture{resp: resp}
+	}
+	cancel = func(opNum uint64) {
+		if f.PendingOps() != 1 {
+			t.Fatalf("expected a pending op, got %d", f.PendingOps())
+		}
+		if err := CancelChunkingOp(opNum, time.Second, applyFunc).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The op is cancelled after its second chunk, and the rest are ignored
+	future := ChunkingApply(data, nil, time.Second, applyFunc)
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 0 || f.PendingOps() != 0 {
+		t.Fatalf("expected cancelled op to be dropped, have %d applied and %d pending", len(m.logs), f.PendingOps())
+	}
+	if len(sink.records) != 2 {
+		t.Fatalf("expected an audit record from the FSM and the reassembler, got %d", len(sink.records))
+	}
+	for _, rec := range sink.records {
+		if rec.Outcome != OpCancelled || rec.OpNum != future.(ChunkingFuture).OpNum() || rec.ChunksReceived != 2 {
+			t.Fatalf("unexpected audit record %#v", rec)
+		}
+	}
+
+	// Later ops are unaffected
+	cancel = func(uint64) {}
+	if err := ChunkingApply(data, nil, time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected op to be applied, got %d", len(m.logs))
+	}
+
+	if err := CancelChunkingOp(0, time.Second, applyFunc).Error(); err == nil {
+		t.Fatal("expected error cancelling op 0")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Checkpoint is a snapshot of the FSM's op bookkeeping at a point in time. It
+// holds no chunk data, so it is small enough to be kept for a while for
+// post-incident analysis of how the backlog of partial ops evolved.
+type Checkpoint struct {
+	// Time is when the checkpoint was taken
+	Time time.Time
+
+	// Index and Term are those of the last chunk log applied
+	Index uint64
+	Term  uint64
+
+	PendingOps   uint64
+	PendingBytes uint64
+
+	// Ops holds the ops in progress, sorted by op number
+	Ops []OpCheckpoint
+}
+
+// OpCheckpoint is the state of a single op in a Checkpoint.
+type OpCheckpoint struct {
+	OpNum          uint64
+	NumChunks      uint32
+	ChunksReceived int
+	Bytes          uint64
+
+	// Started is when the leader appended the op's first chunk, if known
+	Started time.Time
+
+	// Metadata is the op's metadata, once its first chunk has arrived
+	Metadata map[string]string
+}
+
+// CheckpointSink receives the FSM's periodic checkpoints. Like AuditSink it
+// is called synchronously from the FSM, so implementations should be quick
+// and must not call back into it.
+type CheckpointSink interface {
+	WriteCheckpoint(Checkpoint)
+}
+
+// WithCheckpoints makes the FSM send a checkpoint of its op bookkeeping to
+// sink after applying a chunk log, at most once per interval. Since
+// checkpoints are only taken as chunks are applied, none are sent while the
+// FSM is idle and its bookkeeping isn't changing. A zero interval sends one
+// after every chunk log. It is ignored by ChunkingApply.
+func WithCheckpoints(sink CheckpointSink, interval time.Duration) Option {
+	return func(c *config) {
+		c.checkpointSink = sink
+		c.checkpointInterval = interval
+	}
+}
+
+// maybeCheckpoint sends a checkpoint to the sink if one is due. l is the chunk
+// log that was just applied.
+func (c *ChunkingFSM) maybeCheckpoint(l *raft.Log) {
+	if c.conf.checkpointSink == nil {
+		return
+	}
+	now := time.Now()
+	if !c.lastCheckpoint.IsZero() && now.Sub(c.lastCheckpoint) < c.conf.checkpointInterval {
+		return
+	}
+	c.lastCheckpoint = now
+	c.conf.checkpointSink.WriteCheckpoint(c.checkpoint(now, l.Index, l.Term))
+}
+
+// Checkpoint returns a checkpoint of the FSM's current op bookkeeping, whether
+// or not WithCheckpoints is in use. Its Index and Term are those of the last
+// chunk log applied.
+func (c *ChunkingFSM) Checkpoint() Checkpoint {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.checkpoint(time.Now(), c.lastIndex, c.lastTerm)
+}
+
+// checkpoint builds a checkpoint from the op bookkeeping.
+func (c *ChunkingFSM) checkpoint(now time.Time, index, term uint64) Checkpoint {
+	cp := Checkpoint{
+		Time:         now,
+		Index:        index,
+		Term:         term,
+		PendingOps:   c.PendingOps(),
+		PendingBytes: c.PendingBytes(),
+		Ops:          make([]OpCheckpoint, 0, len(c.ops)),
+	}
+	keys := make([]opKey, 0, len(c.ops))
+	for key := range c.ops {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	for _, key := range keys {
+		op := c.ops[key]
+		cp.Ops = append(cp.Ops, OpCheckpoint{
+			OpNum:          key.opNum,
+			NumChunks:      op.numChunks,
+			ChunksReceived: len(op.sizes),
+			Bytes:          op.bytes,
+			Started:        op.started,
+			Metadata:       op.metadata,
+		})
+	}
+	return cp
+}
@@ -0,0 +1,54 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingCheckpointSink struct {
+	checkpoints []Checkpoint
+}
+
+func (r *recordingCheckpointSink) WriteCheckpoint(cp Checkpoint) {
+	r.checkpoints = append(r.checkpoints, cp)
+}
+
+func TestFSM_Checkpoints(t *testing.T) {
+	sink := new(recordingCheckpointSink)
+	f := NewChunkingFSM(new(MockFSM), nil, WithCheckpoints(sink, 0))
+
+	start := time.Now()
+	logs := auditLogs(t, start)
+	for _, l := range logs {
+		f.Apply(l)
+	}
+	if len(sink.checkpoints) != len(logs) {
+		t.Fatalf("expected %d checkpoints, got %d", len(logs), len(sink.checkpoints))
+	}
+
+	cp := sink.checkpoints[1]
+	if cp.Index != logs[1].Index || cp.PendingOps != 1 || len(cp.Ops) != 1 {
+		t.Fatalf("unexpected checkpoint %#v", cp)
+	}
+	op := cp.Ops[0]
+	if op.OpNum != logOpNum(t, logs[0]) || op.ChunksReceived != 2 || op.NumChunks != uint32(len(logs)) ||
+		op.Bytes != uint64(len(logs[0].Data)+len(logs[1].Data)) || !op.Started.Equal(start) {
+		t.Fatalf("unexpected op checkpoint %#v", op)
+	}
+	if last := sink.checkpoints[len(logs)-1]; last.PendingOps != 0 || len(last.Ops) != 0 {
+		t.Fatalf("expected empty final checkpoint, got %#v", last)
+	}
+
+	// With a long interval only the first log is checkpointed
+	sink = new(recordingCheckpointSink)
+	f = NewChunkingFSM(new(MockFSM), nil, WithCheckpoints(sink, time.Hour))
+	for _, l := range auditLogs(t, start) {
+		f.Apply(l)
+	}
+	if len(sink.checkpoints) != 1 {
+		t.Fatalf("expected 1 checkpoint, got %d", len(sink.checkpoints))
+	}
+}
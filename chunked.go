@@ -0,0 +1,259 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// ChunkedApplier may be implemented by the FSM wrapped by ChunkingFSM to take
+// the payload of each op a piece at a time rather than as one reassembled
+// log, so that the FSM never has to hold a whole large payload in a single
+// buffer. When implemented it is used in place of Apply and OpApplier for
+// chunked ops; logs that were not chunked still go to Apply.
+//
+// An op is begun when its first chunk is stored, and each chunk's share of
+// the payload, decrypted, is handed over as soon as it is stored if the
+// chunks before it have been, so that the underlying FSM can work on the
+// payload while the rest of it arrives. Chunks that arrive ahead of an
+// earlier one wait in the FSM's ChunkStorage, which can keep them on disk,
+// until the op completes, as do all the chunks of compressed payloads, which
+// can only be decompressed in one pass; those are handed over decompressed,
+// in pieces of the default chunk size. A chunk that arrives again after it
+// was handed over is not handed over again.
+//
+// The underlying FSM must therefore hold what it is given aside until
+// CompleteOp, and drop it on AbortOp, which is called for a begun op that is
+// dropped for any reason: the term changing, the op being cancelled,
+// discarded, evicted, expiring or going stale, the FSM's state being restored
+// or pruned, or the payload failing its digest once it is complete.
+//
+// BeginOp, ApplyChunk and AbortOp are called with the FSM's state locked, so
+// they must not call back into the ChunkingFSM. It is not used by
+// ChunkingBatchingFSM, which hands the underlying FSM whole batches.
+type ChunkedApplier interface {
+	// BeginOp starts an op. l is the log of its first chunk to arrive, with
+	// no data or extensions, and info what is known of the op from that
+	// chunk; the content type is only known once the op completes.
+	BeginOp(l *raft.Log, info OpInfo)
+
+	// ApplyChunk hands over the next piece of an op's payload. data is only
+	// valid for the duration of the call. An error aborts the op.
+	ApplyChunk(opNum uint64, data []byte) error
+
+	// CompleteOp is called once all of an op's payload has been handed
+	// over and checked. l is the log that completed the op, with its
+	// extensions but no data. Its return value is the response to the op,
+	// as from Apply.
+	CompleteOp(l *raft.Log, info OpInfo) interface{}
+
+	// AbortOp is called in place of CompleteOp if the op is dropped after it
+	// was begun. err is the op's error, such as from a chunk that failed to
+	// decrypt or from ApplyChunk, which is returned from Apply, or else
+	// wraps ErrOpAborted.
+	AbortOp(opNum uint64, err error)
+}
+
+// ErrOpAborted is passed, wrapped, to ChunkedApplier.AbortOp for an op that
+// was dropped without an error of its own, such as on a term change or when
+// it was cancelled.
+var ErrOpAborted = errors.New("op aborted")
+
+// beginStream begins an op on the underlying ChunkedApplier if it hasn't
+// been already.
+func (c *ChunkingFSM) beginStream(l *raft.Log, ci *types.ChunkInfo, op *opState) {
+	if op.begun {
+		return
+	}
+	op.begun = true
+	c.chunked.BeginOp(&raft.Log{Index: l.Index, Term: l.Term, Type: l.Type}, OpInfo{
+		OpNum:          ci.OpNum,
+		Metadata:       op.metadata,
+		TraceContext:   ci.TraceContext,
+		IdempotencyKey: ci.IdempotencyKey,
+	})
+}
+
+// streamChunk hands a newly stored chunk to the underlying ChunkedApplier if
+// it is the next one the op needs, beginning the op first.
+func (c *ChunkingFSM) streamChunk(l *raft.Log, ci *types.ChunkInfo, op *opState) error {
+	c.beginStream(l, ci, op)
+	if ci.Compression != types.Compression_COMPRESSION_UNSPECIFIED ||
+		ci.SequenceNum != op.streamed || uint64(ci.SequenceNum)+uint64(ci.ExtensionsChunks) >= uint64(ci.NumChunks) {
+		return nil
+	}
+	aead, err := c.streamAEAD(ci, op)
+	if err != nil {
+		return err
+	}
+	return c.streamChunks(ci, op, aead, []*ChunkInfo{{SequenceNum: ci.SequenceNum, Data: l.Data}})
+}
+
+// streamAEAD returns the AEAD that opens the op's chunks, if its data is
+// encrypted, unwrapping its key once.
+func (c *ChunkingFSM) streamAEAD(ci *types.ChunkInfo, op *opState) (cipher.AEAD, error) {
+	if op.aead != nil || len(ci.WrappedKey) == 0 {
+		return op.aead, nil
+	}
+	var err error
+	op.aead, err = unwrapDataKey(c.conf, ci.KeyId, ci.WrappedKey)
+	return op.aead, err
+}
+
+// abortStream aborts an op that was dropped after it was begun on the
+// underlying ChunkedApplier, with err or, if the op was dropped without an
+// error, one wrapping ErrOpAborted.
+func (c *ChunkingFSM) abortStream(opNum uint64, op *opState, outcome OpOutcome, err error) {
+	if c.chunked == nil || op == nil || !op.begun {
+		return
+	}
+	op.begun = false
+	if err == nil {
+		err = fmt.Errorf("op %d %v: %w", opNum, outcome, ErrOpAborted)
+	}
+	c.chunked.AbortOp(opNum, err)
+}
+
+// streamOp hands what is left of the payload of a completed op to the
+// underlying ChunkedApplier, returning the log to complete it with.
+func (c *ChunkingFSM) streamOp(l *raft.Log, ci *types.ChunkInfo, op *opState, extensions []byte, chunks []*ChunkInfo) (*raft.Log, error) {
+	// Ops restored from a snapshot, and compressed ones, may not have been
+	// begun yet
+	c.beginStream(l, ci, op)
+	if int(op.streamed) > len(chunks) {
+		return nil, fmt.Errorf("op %d has %d chunks but %d were handed over", ci.OpNum, len(chunks), op.streamed)
+	}
+	aead, err := c.streamAEAD(ci, op)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.streamChunks(ci, op, aead, chunks[op.streamed:]); err != nil {
+		return nil, err
+	}
+	if ci.TotalSize != 0 && op.streamedBytes != ci.TotalSize {
+		return nil, fmt.Errorf("op %d reassembled to %d bytes but %d were sent", ci.OpNum, op.streamedBytes, ci.TotalSize)
+	}
+	return &raft.Log{
+		Index:      l.Index,
+		Term:       l.Term,
+		Type:       l.Type,
+		Extensions: extensions,
+	}, nil
+}
+
+// streamChunks hands each piece of the given chunks of an op's payload to the
+// underlying ChunkedApplier, recording how much of it has been handed over.
+// The chunks of a compressed payload must be all of them.
+func (c *ChunkingFSM) streamChunks(ci *types.ChunkInfo, op *opState, aead cipher.AEAD, chunks []*ChunkInfo) error {
+	if ci.Compression == types.Compression_COMPRESSION_UNSPECIFIED {
+		for _, chunk := range chunks {
+			data, err := c.chunkPayload(ci, aead, chunk)
+			if err != nil {
+				return err
+			}
+			if err := c.chunked.ApplyChunk(ci.OpNum, data); err != nil {
+				return err
+			}
+			op.streamed++
+			op.streamedBytes += uint64(len(data))
+		}
+		return nil
+	}
+
+	// Compressed payloads are decompressed as the chunks are read, and
+	// handed over in pieces of the default chunk size
+	cr := &chunkReader{chunks: chunks, open: func(chunk *ChunkInfo) ([]byte, error) {
+		return c.chunkPayload(ci, aead, chunk)
+	}}
+	zr, err := Compression(ci.Compression).newReader(cr, ci.TotalSize)
+	if err != nil {
+		return cr.wrap(ci.OpNum, err)
+	}
+	buf := make([]byte, ChunkSize)
+	for err == nil {
+		// Fill the buffer, telling the end of the data apart from a
+		// truncated stream, which io.ReadFull would not
+		var n int
+		for n < len(buf) && err == nil {
+			var read int
+			read, err = zr.Read(buf[n:])
+			n += read
+		}
+		if err != nil && err != io.EOF {
+			return cr.wrap(ci.OpNum, err)
+		}
+		if n > 0 {
+			if err := c.chunked.ApplyChunk(ci.OpNum, buf[:n]); err != nil {
+				return err
+			}
+			op.streamedBytes += uint64(n)
+		}
+	}
+	op.streamed = uint32(len(chunks))
+	return nil
+}
+
+// chunkPayload returns a chunk's share of its op's payload, decrypting it if
+// needed.
+func (c *ChunkingFSM) chunkPayload(ci *types.ChunkInfo, aead cipher.AEAD, chunk *ChunkInfo) ([]byte, error) {
+	data := chunk.Data
+	var err error
+	if ci.Encrypted {
+		data, err = c.conf.decryptChunk(ci.OpNum, chunk.SequenceNum, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if aead != nil {
+		data, err = openChunk(aead, ci.OpNum, chunk.SequenceNum, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// chunkReader reads an op's payload from its chunks, opening each one as it
+// is reached. err records a failure to open a chunk.
+type chunkReader struct {
+	chunks []*ChunkInfo
+	open   func(*ChunkInfo) ([]byte, error)
+	data   []byte
+	err    error
+}
+
+// wrap returns the error from decompressing an op's payload, which is the
+// reader's own if a chunk failed to open.
+func (r *chunkReader) wrap(opNum uint64, err error) error {
+	switch {
+	case r.err != nil:
+		return r.err
+	case errors.Is(err, ErrDecompression):
+		return fmt.Errorf("op %d: %w", opNum, err)
+	default:
+		return fmt.Errorf("op %d: %w: %v", opNum, ErrDecompression, err)
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if len(r.chunks) == 0 {
+			return 0, io.EOF
+		}
+		r.data, r.err = r.open(r.chunks[0])
+		r.chunks = r.chunks[1:]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
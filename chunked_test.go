@@ -0,0 +1,284 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// chunkedFSM is a ChunkedApplier that records the payloads streamed to it.
+type chunkedFSM struct {
+	*MockBatchFSM
+
+	infos    []OpInfo
+	pieces   int
+	current  bytes.Buffer
+	payloads [][]byte
+	aborted  []error
+	failWith error
+
+	extensions  []byte
+	contentType string
+}
+
+func (c *chunkedFSM) BeginOp(l *raft.Log, info OpInfo) {
+	if l.Data != nil || l.Index == 0 {
+		panic("unexpected log to begin op with")
+	}
+	c.infos = append(c.infos, info)
+	c.current.Reset()
+}
+
+func (c *chunkedFSM) ApplyChunk(opNum uint64, data []byte) error {
+	if c.failWith != nil {
+		return c.failWith
+	}
+	c.pieces++
+	c.current.Write(data)
+	return nil
+}
+
+func (c *chunkedFSM) CompleteOp(l *raft.Log, info OpInfo) interface{} {
+	if l.Data != nil || l.Index == 0 {
+		panic("unexpected log to complete op with")
+	}
+	c.payloads = append(c.payloads, append([]byte(nil), c.current.Bytes()...))
+	c.extensions, c.contentType = l.Extensions, info.ContentType
+	return info.OpNum
+}
+
+func (c *chunkedFSM) AbortOp(opNum uint64, err error) {
+	c.aborted = append(c.aborted, err)
+}
+
+func TestFSM_ChunkedApplier(t *testing.T) {
+	random := make([]byte, 3*ChunkSize+100)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	kp := newTestKeyProvider(t)
+
+	for name, tc := range map[string]struct {
+		data []byte
+		opts []Option
+	}{
+		"plain":      {data: random},
+		"encrypted":  {data: random, opts: []Option{WithKeyProvider(kp), WithHashAlgorithm(anyHash())}},
+		"gzip":       {data: compressibleData(4 * ChunkSize), opts: []Option{WithCompression(CompressionGzip), WithTotalSize()}},
+		"snappy":     {data: compressibleData(4 * ChunkSize), opts: []Option{WithCompression(CompressionSnappy), WithKeyProvider(kp)}},
+		"total size": {data: random, opts: []Option{WithTotalSize(), WithContentType("application/octet-stream")}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			logs, err := SplitIntoLogs(tc.data, []byte("ext"), tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+			f := NewChunkingFSM(m, nil, tc.opts...)
+			var resp interface{}
+			for i := range logs {
+				logs[i].Index = uint64(i + 1)
+				resp = f.Apply(&logs[i])
+			}
+			opNum := logOpNum(t, &logs[0])
+			if s, ok := resp.(ChunkingSuccess); !ok || s.Response != opNum {
+				t.Fatalf("expected the response from CompleteOp, got %#v", resp)
+			}
+			if len(m.payloads) != 1 || !bytes.Equal(m.payloads[0], tc.data) {
+				t.Fatalf("expected the payload to be streamed, got %d payloads", len(m.payloads))
+			}
+			if len(m.infos) != 1 || m.infos[0].OpNum != opNum {
+				t.Fatalf("unexpected op info %#v", m.infos)
+			}
+			if m.pieces < 2 || len(m.logs) != 0 {
+				t.Fatalf("expected the payload in pieces and nothing applied, got %d pieces and %d logs", m.pieces, len(m.logs))
+			}
+			if want := newConfig(tc.opts).contentType; string(m.extensions) != "ext" || m.contentType != want {
+				t.Fatalf("expected the extensions and content type %q, got %q and %q", want, m.extensions, m.contentType)
+			}
+		})
+	}
+
+	// Logs that weren't chunked are applied as usual
+	m := &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f := NewChunkingFSM(m, nil)
+	if resp := f.Apply(&raft.Log{Index: 1, Data: []byte("plain")}); resp != 1 || len(m.payloads) != 0 {
+		t.Fatalf("expected the log to be applied, got %#v", resp)
+	}
+
+	// Batching FSMs get reassembled logs
+	logs, err := SplitIntoLogs(random, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := make([]*raft.Log, len(logs))
+	for i := range logs {
+		logs[i].Index = uint64(i + 2)
+		batch[i] = &logs[i]
+	}
+	NewChunkingBatchingFSM(m, nil).ApplyBatch(batch)
+	if len(m.logs) != 2 || !bytes.Equal(m.logs[1], random) || len(m.payloads) != 0 {
+		t.Fatalf("expected a reassembled log in the batch, got %d logs and %d streamed", len(m.logs), len(m.payloads))
+	}
+}
+
+func TestFSM_ChunkedApplierStreams(t *testing.T) {
+	data := make([]byte, 3*ChunkSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range logs {
+		logs[i].Index, logs[i].Term = uint64(i+1), 1
+	}
+
+	// Each chunk reaches the applier as it arrives, before the op completes
+	m := &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f := NewChunkingFSM(m, nil)
+	last := len(logs) - 1
+	for i := range logs[:last] {
+		if resp := f.Apply(&logs[i]); resp != nil {
+			t.Fatalf("unexpected response %#v", resp)
+		}
+		if len(m.infos) != 1 || m.pieces != i+1 || !bytes.HasPrefix(data, m.current.Bytes()) {
+			t.Fatalf("expected %d chunks handed over, got %d", i+1, m.pieces)
+		}
+	}
+	if len(m.payloads) != 0 {
+		t.Fatal("expected the op to be incomplete")
+	}
+	f.Apply(&logs[last])
+	if len(m.payloads) != 1 || !bytes.Equal(m.payloads[0], data) || m.pieces != len(logs) {
+		t.Fatalf("expected the payload to complete, got %d pieces", m.pieces)
+	}
+
+	// A chunk that arrives early waits for the ones before it
+	m = &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f = NewChunkingFSM(m, nil)
+	f.Apply(&logs[1])
+	if len(m.infos) != 1 || m.pieces != 0 {
+		t.Fatalf("expected the op begun with nothing handed over, got %d pieces", m.pieces)
+	}
+	f.Apply(&logs[0])
+	if m.pieces != 1 {
+		t.Fatalf("expected only the first chunk handed over, got %d pieces", m.pieces)
+	}
+	for i := range logs[2:] {
+		f.Apply(&logs[2+i])
+	}
+	if len(m.payloads) != 1 || !bytes.Equal(m.payloads[0], data) {
+		t.Fatal("expected the payload to complete in order")
+	}
+
+	// A term change aborts a begun op
+	next, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next[0].Index, next[0].Term = 10, 2
+	m = &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f = NewChunkingFSM(m, nil)
+	f.Apply(&logs[0])
+	f.Apply(&next[0])
+	if len(m.aborted) != 1 || !errors.Is(m.aborted[0], ErrOpAborted) {
+		t.Fatalf("expected the op to be aborted, got %v", m.aborted)
+	}
+	if len(m.infos) != 2 || m.infos[1].OpNum != logOpNum(t, &next[0]) {
+		t.Fatalf("expected the new op to be begun, got %d begun", len(m.infos))
+	}
+
+	// As does cancelling it
+	m = &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f = NewChunkingFSM(m, nil)
+	f.Apply(&logs[0])
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		l.Index, l.Term = 10, 1
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+	if err := CancelChunkingOp(logOpNum(t, &logs[0]), time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.aborted) != 1 || !errors.Is(m.aborted[0], ErrOpAborted) {
+		t.Fatalf("expected the op to be aborted, got %v", m.aborted)
+	}
+	for i := range logs[1:] {
+		f.Apply(&logs[1+i])
+	}
+	if len(m.infos) != 1 || len(m.payloads) != 0 {
+		t.Fatalf("expected the op's remaining chunks to be ignored, got %d payloads", len(m.payloads))
+	}
+}
+
+func TestFSM_ChunkedApplierAbort(t *testing.T) {
+	// apply returns the first error from applying the logs, since the rest
+	// of a failed op's chunks are ignored, or else the last response
+	apply := func(f *ChunkingFSM, logs []raft.Log) interface{} {
+		var resp interface{}
+		for i := range logs {
+			logs[i].Index = uint64(i + 1)
+			resp = f.Apply(&logs[i])
+			if _, ok := resp.(error); ok {
+				return resp
+			}
+		}
+		return resp
+	}
+
+	// A failed ApplyChunk aborts the op
+	errApply := errors.New("apply failed")
+	logs, err := SplitIntoLogs(make([]byte, 2*ChunkSize), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}, failWith: errApply}
+	f := NewChunkingFSM(m, nil)
+	if err, ok := apply(f, logs).(error); !ok || !errors.Is(err, errApply) {
+		t.Fatalf("expected the apply error, got %#v", err)
+	}
+	if len(m.aborted) != 1 || !errors.Is(m.aborted[0], errApply) || len(m.payloads) != 0 {
+		t.Fatalf("expected the op to be aborted, got %v", m.aborted)
+	}
+
+	// As does a payload that fails to decompress partway through
+	for _, alg := range compressions {
+		logs, err := SplitIntoLogs(compressibleData(4*ChunkSize), nil, WithCompression(alg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := &logs[len(logs)-1]
+		last.Data = last.Data[:len(last.Data)/2]
+		m := &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+		f := NewChunkingFSM(m, nil)
+		if err, ok := apply(f, logs).(error); !ok || !errors.Is(err, ErrDecompression) {
+			t.Fatalf("%v: expected decompression error, got %#v", alg, err)
+		}
+		if len(m.aborted) != 1 || len(m.payloads) != 0 {
+			t.Fatalf("%v: expected the op to be aborted, got %v", alg, m.aborted)
+		}
+	}
+
+	// A digest mismatch, only caught once the op is complete, aborts it
+	logs, err = SplitIntoLogs(make([]byte, 2*ChunkSize), nil, WithHashAlgorithm(anyHash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs[0].Data[0] ^= 1
+	m = &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f = NewChunkingFSM(m, nil)
+	if err, ok := apply(f, logs).(error); !ok || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %#v", err)
+	}
+	if len(m.infos) != 1 || len(m.aborted) != 1 || !errors.Is(m.aborted[0], ErrChecksumMismatch) || len(m.payloads) != 0 {
+		t.Fatalf("expected the op to be aborted, got %v", m.aborted)
+	}
+}
@@ -3,12 +3,19 @@
 
 package raftchunking
 
-import "github.com/mitchellh/copystructure"
+import (
+	"fmt"
+	"time"
+
+	"github.com/mitchellh/copystructure"
+)
 
 type ChunkStorage interface {
 	// StoreChunk stores Data from ChunkInfo according to the other metadata
 	// (OpNum, SeqNum). The bool returns whether or not all chunks have been
 	// received, as in, the number of non-nil chunks is the same as NumChunks.
+	// The NumChunks of a streamed op's chunks grows as they arrive, and the
+	// op's chunks must grow with it.
 	StoreChunk(*ChunkInfo) (bool, error)
 
 	// FinalizeOp gets all chunks for an op number and then removes the chunk
@@ -27,6 +34,29 @@ type ChunkStorage interface {
 
 type State struct {
 	ChunkMap ChunkMap
+
+	// Reservations holds the sizes reserved for ops with Reserve, and
+	// ReservationLogs the log that made each reservation
+	Reservations    map[uint64]uint64
+	ReservationLogs map[uint64]ReservationLog
+
+	// Completed holds the op nums of the ops most recently completed, oldest
+	// first, when WithDedupWindow is used, and CompletedOrigins the origin
+	// of each of them, if any had one
+	Completed        []uint64
+	CompletedOrigins []string
+
+	// IdempotencyKeys holds the keys of the ops most recently applied with
+	// WithIdempotencyKey, oldest first, when WithIdempotencyWindow is used
+	IdempotencyKeys []string
+}
+
+// ReservationLog identifies the log that made a reservation, so that it can
+// be dropped with the ops of its term or once it goes stale.
+type ReservationLog struct {
+	Term       uint64
+	Index      uint64
+	AppendedAt time.Time
 }
 
 // ChunkInfo holds chunk information
@@ -36,6 +66,40 @@ type ChunkInfo struct {
 	NumChunks   uint32
 	Term        uint64
 	Data        []byte
+
+	// Index is the raft index of the log the chunk arrived in. It is zero
+	// for chunks stored before this field was introduced.
+	Index uint64
+
+	// Origin is the server the op was sent from, if it was sent with
+	// WithOrigin
+	Origin string
+
+	// SentOpNum is the op num the op was sent with, when its chunks are
+	// stored under a different OpNum because an op from another origin is
+	// stored under its own. It is zero otherwise.
+	SentOpNum uint64
+
+	// AppendedAt is when the leader appended the log the chunk arrived in
+	AppendedAt time.Time
+
+	// Metadata is the op's metadata; it is only set on the first chunk
+	Metadata map[string]string
+
+	// Deadline is the op's deadline, if it has one
+	Deadline time.Time
+}
+
+// maxInt is the largest value of an int on this platform.
+const maxInt = int(^uint(0) >> 1)
+
+// checkedInt converts a 64-bit size to an int, failing if it doesn't fit, as
+// can happen on 32-bit platforms.
+func checkedInt(n uint64) (int, error) {
+	if n > uint64(maxInt) {
+		return 0, fmt.Errorf("size of %d bytes exceeds the maximum of %d on this platform", n, maxInt)
+	}
+	return int(n), nil
 }
 
 // ChunkMap represents a set of data chunks. We use ChunkInfo with Data instead
@@ -58,8 +122,11 @@ func (i *InmemChunkStorage) StoreChunk(chunk *ChunkInfo) (bool, error) {
 	chunks, ok := i.chunks[chunk.OpNum]
 	if !ok {
 		chunks = make([]*ChunkInfo, chunk.NumChunks)
-		i.chunks[chunk.OpNum] = chunks
 	}
+	if n := int(chunk.NumChunks); n > len(chunks) {
+		chunks = append(chunks, make([]*ChunkInfo, n-len(chunks))...)
+	}
+	i.chunks[chunk.OpNum] = chunks
 
 	chunks[chunk.SequenceNum] = chunk
 
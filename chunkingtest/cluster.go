@@ -0,0 +1,355 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package chunkingtest provides helpers for testing applications that use
+// ChunkingFSM against a real in-process raft cluster:
+//
+//	func TestLargeWrites(t *testing.T) {
+//		c := chunkingtest.MakeChunkedCluster(t, chunkingtest.ClusterConfig{})
+//		defer c.Close()
+//		if err := c.Apply(payload); err != nil {
+//			t.Fatal(err)
+//		}
+//		c.Kill(c.Followers()[0])
+//		c.EnsureSame(t)
+//	}
+package chunkingtest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+	"github.com/hashicorp/raft"
+)
+
+// ClusterConfig configures a cluster. Zero values are replaced with defaults.
+type ClusterConfig struct {
+	// Peers is the number of nodes in the cluster. Defaults to 3.
+	Peers int
+
+	// NewFSM, if set, is called to create the application FSM that each
+	// node's ChunkingFSM wraps. Equal must then be set as well. Defaults to
+	// a DigestFSM.
+	NewFSM func() raft.FSM
+
+	// Equal reports whether two application FSMs hold the same state. It is
+	// called while logs may still be being applied, so it must synchronize
+	// with the FSMs' Apply. Defaults to comparing DigestFSMs.
+	Equal func(a, b raft.FSM) bool
+
+	// NewStore, if set, is called to create the chunk storage for each
+	// node. Defaults to in-memory storage.
+	NewStore func() raftchunking.ChunkStorage
+
+	// Options are passed to both ChunkingApply and the FSMs.
+	Options []raftchunking.Option
+
+	// Timeout bounds each chunk apply and the waits for a leader and for
+	// the nodes to agree. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+func (c *ClusterConfig) setDefaults(t testing.TB) {
+	if c.Peers <= 0 {
+		c.Peers = 3
+	}
+	if c.NewFSM == nil {
+		c.NewFSM = func() raft.FSM { return new(DigestFSM) }
+		if c.Equal == nil {
+			c.Equal = digestsEqual
+		}
+	}
+	if c.Equal == nil {
+		t.Fatal("chunkingtest: Equal must be set along with NewFSM")
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+}
+
+// Cluster is an in-process raft cluster whose nodes use ChunkingFSM.
+type Cluster struct {
+	t     testing.TB
+	conf  ClusterConfig
+	l     sync.Mutex
+	nodes []*Node
+}
+
+// Node is a single member of a Cluster.
+type Node struct {
+	ID   raft.ServerID
+	Raft *raft.Raft
+
+	// FSM is the node's ChunkingFSM and Underlying the application FSM it
+	// wraps
+	FSM        *raftchunking.ChunkingFSM
+	Underlying raft.FSM
+
+	trans  *raft.InmemTransport
+	killed bool
+}
+
+// MakeChunkedCluster boots a cluster as described by conf and waits for it to
+// elect a leader, failing t if anything goes wrong. Close must be called
+// when done with it.
+func MakeChunkedCluster(t testing.TB, conf ClusterConfig) *Cluster {
+	t.Helper()
+	conf.setDefaults(t)
+	c := &Cluster{
+		t:    t,
+		conf: conf,
+	}
+
+	var configuration raft.Configuration
+	for i := 0; i < conf.Peers; i++ {
+		addr, trans := raft.NewInmemTransport("")
+		id := raft.ServerID(fmt.Sprintf("node%d", i))
+		c.nodes = append(c.nodes, &Node{ID: id, trans: trans})
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       id,
+			Address:  addr,
+		})
+	}
+	for _, n1 := range c.nodes {
+		for _, n2 := range c.nodes {
+			n1.trans.Connect(n2.trans.LocalAddr(), n2.trans)
+		}
+	}
+
+	for _, n := range c.nodes {
+		rc := raft.DefaultConfig()
+		rc.LocalID = n.ID
+		rc.HeartbeatTimeout = 50 * time.Millisecond
+		rc.ElectionTimeout = 50 * time.Millisecond
+		rc.LeaderLeaseTimeout = 50 * time.Millisecond
+		rc.CommitTimeout = 5 * time.Millisecond
+		rc.LogOutput = ioutil.Discard
+		rc.LogLevel = "ERROR"
+
+		logs := raft.NewInmemStore()
+		snaps := raft.NewInmemSnapshotStore()
+		if err := raft.BootstrapCluster(rc, logs, logs, snaps, n.trans, configuration); err != nil {
+			c.Close()
+			t.Fatalf("chunkingtest: error bootstrapping %s: %v", n.ID, err)
+		}
+
+		n.Underlying = conf.NewFSM()
+		var store raftchunking.ChunkStorage
+		if conf.NewStore != nil {
+			store = conf.NewStore()
+		}
+		n.FSM = raftchunking.NewChunkingFSM(n.Underlying, store, conf.Options...)
+
+		r, err := raft.NewRaft(rc, n.FSM, logs, logs, snaps, n.trans)
+		if err != nil {
+			c.Close()
+			t.Fatalf("chunkingtest: error starting %s: %v", n.ID, err)
+		}
+		n.Raft = r
+	}
+
+	c.Leader()
+	return c
+}
+
+// Nodes returns all of the cluster's nodes, including killed ones.
+func (c *Cluster) Nodes() []*Node {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return append([]*Node(nil), c.nodes...)
+}
+
+// live returns the nodes that haven't been killed.
+func (c *Cluster) live() []*Node {
+	c.l.Lock()
+	defer c.l.Unlock()
+	var ret []*Node
+	for _, n := range c.nodes {
+		if !n.killed {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// Leader waits for a live node to become leader and returns it, failing the
+// test if none does within the timeout.
+func (c *Cluster) Leader() *Node {
+	c.t.Helper()
+	limit := time.Now().Add(c.conf.Timeout)
+	for time.Now().Before(limit) {
+		for _, n := range c.live() {
+			if n.Raft.State() == raft.Leader {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("chunkingtest: timed out waiting for a leader")
+	return nil
+}
+
+// Followers returns the live nodes other than the current leader.
+func (c *Cluster) Followers() []*Node {
+	c.t.Helper()
+	leader := c.Leader()
+	var ret []*Node
+	for _, n := range c.live() {
+		if n != leader {
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// Apply applies data through the current leader with ChunkingApply and waits
+// for it to be committed, returning the future's error. Any options are used
+// in addition to those the cluster was configured with.
+func (c *Cluster) Apply(data []byte, opts ...raftchunking.Option) error {
+	c.t.Helper()
+	leader := c.Leader()
+	allOpts := append(append([]raftchunking.Option(nil), c.conf.Options...), opts...)
+	return raftchunking.ChunkingApply(data, nil, c.conf.Timeout, leader.Raft.ApplyLog, allOpts...).Error()
+}
+
+// Kill shuts a node down and cuts it off from the rest of the cluster. It
+// stays in the cluster's configuration, so the remaining nodes carry on only
+// as long as they have a quorum.
+func (c *Cluster) Kill(n *Node) {
+	c.t.Helper()
+	c.l.Lock()
+	if n.killed {
+		c.l.Unlock()
+		return
+	}
+	n.killed = true
+	c.l.Unlock()
+
+	if err := n.Raft.Shutdown().Error(); err != nil {
+		c.t.Errorf("chunkingtest: error shutting down %s: %v", n.ID, err)
+	}
+	n.trans.DisconnectAll()
+	for _, other := range c.live() {
+		other.trans.Disconnect(n.trans.LocalAddr())
+	}
+}
+
+// EnsureSame waits for every live node's application FSM to hold the same
+// state as the leader's, failing t if they still differ after the timeout.
+func (c *Cluster) EnsureSame(t testing.TB) {
+	t.Helper()
+	leader := c.Leader()
+	if err := leader.Raft.Barrier(c.conf.Timeout).Error(); err != nil {
+		t.Fatalf("chunkingtest: barrier failed: %v", err)
+	}
+
+	limit := time.Now().Add(c.conf.Timeout)
+	for {
+		var differ []raft.ServerID
+		for _, n := range c.live() {
+			if n != leader && !c.conf.Equal(leader.Underlying, n.Underlying) {
+				differ = append(differ, n.ID)
+			}
+		}
+		if len(differ) == 0 {
+			return
+		}
+		if time.Now().After(limit) {
+			t.Fatalf("chunkingtest: FSMs of %v differ from leader %s", differ, leader.ID)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Close shuts down all live nodes.
+func (c *Cluster) Close() {
+	for _, n := range c.live() {
+		if n.Raft != nil {
+			n.Raft.Shutdown().Error()
+		}
+		c.l.Lock()
+		n.killed = true
+		c.l.Unlock()
+	}
+}
+
+// DigestFSM is the default application FSM for a cluster. Rather than keeping
+// every payload it keeps a running SHA-256 digest over all of them, so that
+// nodes can be compared cheaply however much data is applied.
+type DigestFSM struct {
+	l      sync.Mutex
+	n      uint64
+	digest [sha256.Size]byte
+}
+
+// Apply folds the log's data into the digest and returns the number of
+// payloads applied.
+func (d *DigestFSM) Apply(l *raft.Log) interface{} {
+	d.l.Lock()
+	defer d.l.Unlock()
+	h := sha256.New()
+	h.Write(d.digest[:])
+	h.Write(l.Data)
+	copy(d.digest[:], h.Sum(nil))
+	d.n++
+	return d.n
+}
+
+// State returns the number of payloads applied and the digest over them.
+func (d *DigestFSM) State() (uint64, [sha256.Size]byte) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return d.n, d.digest
+}
+
+func (d *DigestFSM) Snapshot() (raft.FSMSnapshot, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	buf := make([]byte, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buf, d.n)
+	copy(buf[8:], d.digest[:])
+	return digestSnapshot(buf), nil
+}
+
+func (d *DigestFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if len(buf) != 8+sha256.Size {
+		return io.ErrUnexpectedEOF
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.n = binary.BigEndian.Uint64(buf)
+	copy(d.digest[:], buf[8:])
+	return nil
+}
+
+// digestsEqual compares two DigestFSMs.
+func digestsEqual(a, b raft.FSM) bool {
+	an, ad := a.(*DigestFSM).State()
+	bn, bd := b.(*DigestFSM).State()
+	return an == bn && ad == bd
+}
+
+type digestSnapshot []byte
+
+func (s digestSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s digestSnapshot) Release() {}
@@ -0,0 +1,43 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chunkingtest
+
+import (
+	"crypto/rand"
+	"testing"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+)
+
+func TestMakeChunkedCluster(t *testing.T) {
+	c := MakeChunkedCluster(t, ClusterConfig{})
+	defer c.Close()
+
+	apply := func(n int) {
+		for i := 0; i < n; i++ {
+			data := make([]byte, 3*raftchunking.ChunkSize)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Apply(data); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	apply(3)
+	c.EnsureSame(t)
+
+	c.Kill(c.Followers()[0])
+	apply(2)
+	c.EnsureSame(t)
+
+	count, _ := c.Leader().Underlying.(*DigestFSM).State()
+	if count != 5 {
+		t.Fatalf("expected 5 payloads to be applied, got %d", count)
+	}
+	if len(c.Nodes()) != 3 || len(c.Followers()) != 1 {
+		t.Fatalf("expected 3 nodes with 1 live follower, got %d and %d", len(c.Nodes()), len(c.Followers()))
+	}
+}
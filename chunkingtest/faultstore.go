@@ -0,0 +1,221 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chunkingtest
+
+import (
+	"sync"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+)
+
+// Method identifies a ChunkStorage method for fault injection.
+type Method int
+
+const (
+	StoreChunk Method = iota + 1
+	FinalizeOp
+	GetChunks
+	RestoreChunks
+)
+
+func (m Method) String() string {
+	switch m {
+	case StoreChunk:
+		return "StoreChunk"
+	case FinalizeOp:
+		return "FinalizeOp"
+	case GetChunks:
+		return "GetChunks"
+	case RestoreChunks:
+		return "RestoreChunks"
+	default:
+		return "unknown"
+	}
+}
+
+// Fault describes a failure for a FaultyStore to inject into calls of a
+// method. A fault may combine a delay, an error and corruption.
+type Fault struct {
+	// Method is the method the fault applies to
+	Method Method
+
+	// Call is the 1-based count of the call to the method the fault applies
+	// to. Zero applies it to every call.
+	Call int
+
+	// Delay is how long to sleep before the call
+	Delay time.Duration
+
+	// Err, if set, is returned instead of calling the wrapped store, which
+	// is left untouched
+	Err error
+
+	// Corrupt flips the first byte of the first chunk with data passing
+	// through the call: the chunk given to StoreChunk or RestoreChunks, or
+	// returned from FinalizeOp or GetChunks. Chunks are copied before being
+	// corrupted so that the caller's and the wrapped store's are not
+	// modified.
+	Corrupt bool
+}
+
+// FaultyStore is a ChunkStorage that wraps another and makes its calls fail,
+// stall or return corrupted data as scripted with Inject. It is meant for
+// verifying how an application reacts to store errors, for instance whether
+// it surfaces them, retries, or recovers from a snapshot.
+type FaultyStore struct {
+	l      sync.Mutex
+	store  raftchunking.ChunkStorage
+	faults []Fault
+	calls  map[Method]int
+}
+
+var _ raftchunking.ChunkStorage = (*FaultyStore)(nil)
+
+// NewFaultyStore returns a FaultyStore wrapping store, or in-memory storage if
+// store is nil. No faults are injected until Inject is called.
+func NewFaultyStore(store raftchunking.ChunkStorage) *FaultyStore {
+	if store == nil {
+		store = raftchunking.NewInmemChunkStorage()
+	}
+	return &FaultyStore{
+		store: store,
+		calls: make(map[Method]int),
+	}
+}
+
+// Inject adds faults to be applied to future calls. Calls are counted from
+// when the store was created or last Reset, not from when the fault is
+// injected.
+func (f *FaultyStore) Inject(faults ...Fault) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.faults = append(f.faults, faults...)
+}
+
+// Reset removes all faults and zeroes the call counts.
+func (f *FaultyStore) Reset() {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.faults = nil
+	f.calls = make(map[Method]int)
+}
+
+// Calls returns how many times a method has been called, including calls that
+// failed.
+func (f *FaultyStore) Calls(m Method) int {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.calls[m]
+}
+
+// call counts a call to m and returns the combined fault to apply to it,
+// sleeping for its delay first.
+func (f *FaultyStore) call(m Method) Fault {
+	f.l.Lock()
+	f.calls[m]++
+	n := f.calls[m]
+	ret := Fault{Method: m, Call: n}
+	for _, fault := range f.faults {
+		if fault.Method != m || (fault.Call != 0 && fault.Call != n) {
+			continue
+		}
+		ret.Delay += fault.Delay
+		if ret.Err == nil {
+			ret.Err = fault.Err
+		}
+		ret.Corrupt = ret.Corrupt || fault.Corrupt
+	}
+	f.l.Unlock()
+
+	if ret.Delay > 0 {
+		time.Sleep(ret.Delay)
+	}
+	return ret
+}
+
+func (f *FaultyStore) StoreChunk(chunk *raftchunking.ChunkInfo) (bool, error) {
+	fault := f.call(StoreChunk)
+	if fault.Err != nil {
+		return false, fault.Err
+	}
+	if fault.Corrupt {
+		chunks := corrupt([]*raftchunking.ChunkInfo{chunk})
+		chunk = chunks[0]
+	}
+	return f.store.StoreChunk(chunk)
+}
+
+func (f *FaultyStore) FinalizeOp(opNum uint64) ([]*raftchunking.ChunkInfo, error) {
+	fault := f.call(FinalizeOp)
+	if fault.Err != nil {
+		return nil, fault.Err
+	}
+	chunks, err := f.store.FinalizeOp(opNum)
+	if err != nil || !fault.Corrupt {
+		return chunks, err
+	}
+	return corrupt(chunks), nil
+}
+
+func (f *FaultyStore) GetChunks() (raftchunking.ChunkMap, error) {
+	fault := f.call(GetChunks)
+	if fault.Err != nil {
+		return nil, fault.Err
+	}
+	chunks, err := f.store.GetChunks()
+	if err != nil || !fault.Corrupt {
+		return chunks, err
+	}
+	return corruptMap(chunks), nil
+}
+
+func (f *FaultyStore) RestoreChunks(chunks raftchunking.ChunkMap) error {
+	fault := f.call(RestoreChunks)
+	if fault.Err != nil {
+		return fault.Err
+	}
+	if fault.Corrupt {
+		chunks = corruptMap(chunks)
+	}
+	return f.store.RestoreChunks(chunks)
+}
+
+// corrupt returns a copy of chunks with the first byte of the first chunk
+// that has data flipped.
+func corrupt(chunks []*raftchunking.ChunkInfo) []*raftchunking.ChunkInfo {
+	ret := append([]*raftchunking.ChunkInfo(nil), chunks...)
+	for i, chunk := range ret {
+		if chunk == nil || len(chunk.Data) == 0 {
+			continue
+		}
+		c := *chunk
+		c.Data = append([]byte(nil), chunk.Data...)
+		c.Data[0] ^= 0xff
+		ret[i] = &c
+		break
+	}
+	return ret
+}
+
+// corruptMap returns a copy of chunks with the lowest-numbered op that has
+// data corrupted as by corrupt.
+func corruptMap(chunks raftchunking.ChunkMap) raftchunking.ChunkMap {
+	ret := make(raftchunking.ChunkMap, len(chunks))
+	var target uint64
+	found := false
+	for opNum, opChunks := range chunks {
+		ret[opNum] = opChunks
+		for _, chunk := range opChunks {
+			if chunk != nil && len(chunk.Data) > 0 && (!found || opNum < target) {
+				target, found = opNum, true
+				break
+			}
+		}
+	}
+	if found {
+		ret[target] = corrupt(ret[target])
+	}
+	return ret
+}
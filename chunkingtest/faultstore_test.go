@@ -0,0 +1,133 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chunkingtest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+	"github.com/hashicorp/raft"
+)
+
+// chunkLogs splits data into chunk logs as ChunkingApply would send them.
+func chunkLogs(t *testing.T, data []byte, opts ...raftchunking.Option) []*raft.Log {
+	t.Helper()
+	var logs []*raft.Log
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		l.Index = uint64(len(logs) + 1)
+		l.Term = 1
+		logs = append(logs, &l)
+		return nil
+	}
+	raftchunking.ChunkingApply(data, nil, time.Second, applyFunc, opts...)
+	return logs
+}
+
+func TestFaultyStore(t *testing.T) {
+	data := make([]byte, 3*raftchunking.ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	hash := raftchunking.WithHashAlgorithm(raftchunking.HashSHA256)
+	logs := chunkLogs(t, data, hash)
+
+	t.Run("error", func(t *testing.T) {
+		store := NewFaultyStore(nil)
+		injected := errors.New("disk on fire")
+		store.Inject(Fault{Method: StoreChunk, Call: 2, Err: injected})
+		fsm := raftchunking.NewChunkingFSM(new(DigestFSM), store)
+
+		if resp := fsm.Apply(logs[0]); resp != nil {
+			t.Fatalf("unexpected response %v", resp)
+		}
+		err, ok := fsm.Apply(logs[1]).(error)
+		if !ok || !errors.Is(err, injected) {
+			t.Fatalf("expected injected error, got %v", err)
+		}
+		if n := store.Calls(StoreChunk); n != 2 {
+			t.Fatalf("expected 2 calls, got %d", n)
+		}
+
+		// The fault only applies to the second call, so retrying succeeds
+		for _, l := range logs[1:] {
+			if err, ok := fsm.Apply(l).(error); ok {
+				t.Fatal(err)
+			}
+		}
+		if n, _ := fsm.Underlying().(*DigestFSM).State(); n != 1 {
+			t.Fatalf("expected op to be applied, got %d", n)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		apply := func(store raftchunking.ChunkStorage) (uint64, [32]byte) {
+			fsm := raftchunking.NewChunkingFSM(new(DigestFSM), store)
+			for _, l := range logs {
+				if err, ok := fsm.Apply(l).(error); ok {
+					t.Fatal(err)
+				}
+			}
+			return fsm.Underlying().(*DigestFSM).State()
+		}
+
+		store := NewFaultyStore(nil)
+		store.Inject(Fault{Method: FinalizeOp, Corrupt: true})
+		n, digest := apply(store)
+		cleanN, cleanDigest := apply(nil)
+		if n != 1 || cleanN != 1 {
+			t.Fatalf("expected op to be applied, got %d and %d", n, cleanN)
+		}
+		if digest == cleanDigest {
+			t.Fatal("expected corrupted data to be applied")
+		}
+	})
+
+	t.Run("corrupt copies", func(t *testing.T) {
+		store := NewFaultyStore(nil)
+		chunk := &raftchunking.ChunkInfo{OpNum: 1, NumChunks: 2, Data: []byte("abc")}
+		store.Inject(Fault{Method: GetChunks, Call: 1, Corrupt: true})
+		if _, err := store.StoreChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		chunks, err := store.GetChunks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(chunks[1][0].Data, chunk.Data) {
+			t.Fatal("expected corrupted data")
+		}
+		if !bytes.Equal(chunk.Data, []byte("abc")) {
+			t.Fatal("caller's chunk was modified")
+		}
+		chunks, err = store.GetChunks()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(chunks[1][0].Data, chunk.Data) {
+			t.Fatal("expected stored data to be intact")
+		}
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		store := NewFaultyStore(nil)
+		store.Inject(Fault{Method: GetChunks, Delay: 20 * time.Millisecond})
+		start := time.Now()
+		if _, err := store.GetChunks(); err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) < 20*time.Millisecond {
+			t.Fatal("expected call to be delayed")
+		}
+
+		store.Reset()
+		if n := store.Calls(GetChunks); n != 0 {
+			t.Fatalf("expected calls to be reset, got %d", n)
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chunkingtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+)
+
+// markerMagic starts the marker at the beginning of each block of a generated
+// payload.
+var markerMagic = []byte("RCHK")
+
+// markerSize is the size of a block marker: the magic, the block number and
+// the low 32 bits of the seed.
+const markerSize = 16
+
+// runSize is the size of the runs of bytes that are either random or repeated
+// according to Payload.Compressibility.
+const runSize = 64
+
+// Payload describes a deterministic test payload, so that large payloads can be
+// generated when needed and checked after reassembly rather than stored as
+// fixtures. The same Payload always generates the same bytes.
+//
+// A payload is made of blocks of BlockSize bytes, each starting with a marker
+// recording its block number, so that misplaced data can be recognized when
+// verification fails.
+type Payload struct {
+	// Seed selects the payload's contents
+	Seed int64
+
+	// Size is the payload's length in bytes
+	Size int64
+
+	// Compressibility is roughly the fraction of the payload, from 0 to 1,
+	// that is made of repeated bytes rather than random ones
+	Compressibility float64
+
+	// BlockSize is the distance between markers. Defaults to
+	// raftchunking.ChunkSize.
+	BlockSize int
+}
+
+func (p Payload) blockSize() int {
+	if p.BlockSize < markerSize {
+		if raftchunking.ChunkSize < markerSize {
+			return markerSize
+		}
+		return raftchunking.ChunkSize
+	}
+	return p.BlockSize
+}
+
+// block generates block n of the payload into buf, which must be blockSize
+// long, returning the part of it within the payload.
+func (p Payload) block(n int64, buf []byte) []byte {
+	bs := int64(len(buf))
+	if rem := p.Size - n*bs; rem < bs {
+		buf = buf[:rem]
+	}
+
+	rng := rand.New(rand.NewSource(p.Seed ^ (n+1)*0x5851f42d4c957f2d))
+	var marker [markerSize]byte
+	copy(marker[:], markerMagic)
+	binary.BigEndian.PutUint64(marker[4:], uint64(n))
+	binary.BigEndian.PutUint32(marker[12:], uint32(p.Seed))
+	copy(buf, marker[:])
+
+	for off := markerSize; off < len(buf); off += runSize {
+		run := buf[off:]
+		if len(run) > runSize {
+			run = run[:runSize]
+		}
+		if rng.Float64() < p.Compressibility {
+			b := byte(rng.Intn(256))
+			for i := range run {
+				run[i] = b
+			}
+		} else {
+			rng.Read(run)
+		}
+	}
+	return buf
+}
+
+func (p Payload) numBlocks() int64 {
+	bs := int64(p.blockSize())
+	return (p.Size + bs - 1) / bs
+}
+
+// Bytes generates the whole payload in memory.
+func (p Payload) Bytes() []byte {
+	ret := make([]byte, 0, p.Size)
+	buf := make([]byte, p.blockSize())
+	for n := int64(0); n < p.numBlocks(); n++ {
+		ret = append(ret, p.block(n, buf)...)
+	}
+	return ret
+}
+
+// Reader returns a reader that generates the payload as it is read, for
+// payloads too large to hold in memory more than once.
+func (p Payload) Reader() io.Reader {
+	return &payloadReader{p: p, buf: make([]byte, p.blockSize())}
+}
+
+type payloadReader struct {
+	p       Payload
+	buf     []byte
+	pending []byte
+	next    int64
+}
+
+func (r *payloadReader) Read(b []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.next >= r.p.numBlocks() {
+			return 0, io.EOF
+		}
+		r.pending = r.p.block(r.next, r.buf)
+		r.next++
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Verify checks that data is exactly the payload, such as after it has been
+// chunked and reassembled. The error for a mismatch gives the offset of the
+// first differing byte and, when the block there starts with another block's
+// marker, which block's data was found instead.
+func (p Payload) Verify(data []byte) error {
+	return p.VerifyReader(bytes.NewReader(data))
+}
+
+// VerifyReader is like Verify for data read from r.
+func (p Payload) VerifyReader(r io.Reader) error {
+	expected := make([]byte, p.blockSize())
+	actual := make([]byte, p.blockSize())
+	for n := int64(0); n < p.numBlocks(); n++ {
+		want := p.block(n, expected)
+		got := actual[:len(want)]
+		read, err := io.ReadFull(r, got)
+		got = got[:read]
+		off := n * int64(len(expected))
+
+		for i := range got {
+			if got[i] != want[i] {
+				return p.mismatch(n, off+int64(i), got)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("payload is %d bytes, expected %d", off+int64(read), p.Size)
+		}
+	}
+	if read, _ := io.ReadFull(r, actual[:1]); read != 0 {
+		return fmt.Errorf("payload is longer than the expected %d bytes", p.Size)
+	}
+	return nil
+}
+
+// mismatch describes a difference at off, within block n whose data is got.
+func (p Payload) mismatch(n, off int64, got []byte) error {
+	if len(got) >= markerSize && bytes.Equal(got[:len(markerMagic)], markerMagic) &&
+		binary.BigEndian.Uint32(got[12:]) == uint32(p.Seed) {
+		if found := int64(binary.BigEndian.Uint64(got[4:])); found != n {
+			return fmt.Errorf("payload differs at offset %d: block %d holds the data of block %d", off, n, found)
+		}
+	}
+	return fmt.Errorf("payload differs at offset %d in block %d", off, n)
+}
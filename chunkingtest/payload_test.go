@@ -0,0 +1,81 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package chunkingtest
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPayload(t *testing.T) {
+	p := Payload{Seed: 42, Size: 10000, BlockSize: 1024}
+	data := p.Bytes()
+	if len(data) != 10000 {
+		t.Fatalf("expected 10000 bytes, got %d", len(data))
+	}
+	if !bytes.Equal(data, p.Bytes()) {
+		t.Fatal("payload is not deterministic")
+	}
+	other := p
+	other.Seed++
+	if bytes.Equal(data, other.Bytes()) {
+		t.Fatal("expected different seeds to give different payloads")
+	}
+	streamed, err := ioutil.ReadAll(p.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, streamed) {
+		t.Fatal("reader does not match bytes")
+	}
+
+	if err := p.Verify(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.VerifyReader(p.Reader()); err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[5000] ^= 1
+	if err := p.Verify(corrupted); err == nil || !strings.Contains(err.Error(), "offset 5000 ") {
+		t.Fatalf("expected mismatch at offset 5000, got %v", err)
+	}
+
+	swapped := append([]byte(nil), data...)
+	copy(swapped[1024:2048], data[2048:3072])
+	if err := p.Verify(swapped); err == nil || !strings.Contains(err.Error(), "block 1 holds the data of block 2") {
+		t.Fatalf("expected misplaced block, got %v", err)
+	}
+
+	if err := p.Verify(data[:9000]); err == nil || !strings.Contains(err.Error(), "9000 bytes") {
+		t.Fatalf("expected short payload, got %v", err)
+	}
+	if err := p.Verify(append(data, 0)); err == nil {
+		t.Fatal("expected long payload to fail")
+	}
+}
+
+func TestPayload_Compressibility(t *testing.T) {
+	compressed := func(c float64) int {
+		var buf bytes.Buffer
+		w, err := flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(Payload{Seed: 1, Size: 1 << 20, Compressibility: c}.Bytes())
+		w.Close()
+		return buf.Len()
+	}
+	random, half, repetitive := compressed(0), compressed(0.5), compressed(0.95)
+	if !(random > half && half > repetitive) {
+		t.Fatalf("expected compressed sizes to shrink with compressibility, got %d, %d, %d", random, half, repetitive)
+	}
+	if random < 1<<20 {
+		t.Fatalf("expected incompressible payload, compressed to %d", random)
+	}
+}
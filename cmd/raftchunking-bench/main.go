@@ -0,0 +1,180 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Command raftchunking-bench measures chunked apply throughput and latency
+// against a local in-memory raft cluster, across a matrix of chunk sizes and
+// concurrency levels. To benchmark a real deployment, use the bench package
+// directly with that deployment's ApplyFunc.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+	"github.com/hashicorp/go-raftchunking/bench"
+	"github.com/hashicorp/raft"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("raftchunking-bench", flag.ContinueOnError)
+	nodes := flags.Int("nodes", 3, "number of nodes in the local cluster")
+	ops := flags.Int("ops", 20, "number of applies per run")
+	payloadSize := flags.Int("payload-size", 16*1024*1024, "size of each applied payload in bytes")
+	chunkSizes := flags.String("chunk-sizes", strconv.Itoa(raft.SuggestedMaxDataSize), "comma-separated chunk sizes in bytes")
+	concurrency := flags.String("concurrency", "1,4", "comma-separated concurrency levels")
+	timeout := flags.Duration("timeout", 10*time.Second, "per-chunk apply timeout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	sizes, err := parseInts(*chunkSizes)
+	if err != nil {
+		return fmt.Errorf("invalid chunk sizes: %w", err)
+	}
+	levels, err := parseInts(*concurrency)
+	if err != nil {
+		return fmt.Errorf("invalid concurrency levels: %w", err)
+	}
+
+	leader, shutdown, err := localCluster(*nodes)
+	if err != nil {
+		return err
+	}
+	defer shutdown()
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHUNK SIZE\tCONCURRENCY\tOPS\tFAILED\tMB/S\tOPS/S\tP50\tP90\tP99\tMAX")
+	for _, size := range sizes {
+		for _, level := range levels {
+			res, err := bench.Run(bench.Config{
+				Ops:         *ops,
+				Concurrency: level,
+				PayloadSize: *payloadSize,
+				Timeout:     *timeout,
+				Options: []raftchunking.Option{
+					raftchunking.WithChunkSize(size),
+					raftchunking.WithMaxChunkSize(size),
+				},
+			}, leader.ApplyLog)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tw, "%d\t%d\t%d\t%d\t%.1f\t%.1f\t%s\t%s\t%s\t%s\n",
+				size, level, res.Ops, res.Failed, res.BytesPerSecond()/(1024*1024), res.OpsPerSecond(),
+				res.P50.Round(time.Microsecond), res.P90.Round(time.Microsecond),
+				res.P99.Round(time.Microsecond), res.Max.Round(time.Microsecond))
+		}
+	}
+	return tw.Flush()
+}
+
+func parseInts(s string) ([]int, error) {
+	var ret []int
+	for _, field := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("%d is not positive", n)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// localCluster starts an in-memory raft cluster whose nodes use ChunkingFSM
+// and returns the leader along with a function to shut everything down.
+func localCluster(n int) (*raft.Raft, func(), error) {
+	if n <= 0 {
+		return nil, nil, errors.New("number of nodes must be positive")
+	}
+
+	var configuration raft.Configuration
+	var transports []*raft.InmemTransport
+	for i := 0; i < n; i++ {
+		addr, trans := raft.NewInmemTransport("")
+		transports = append(transports, trans)
+		configuration.Servers = append(configuration.Servers, raft.Server{
+			Suffrage: raft.Voter,
+			ID:       raft.ServerID(fmt.Sprintf("node%d", i)),
+			Address:  addr,
+		})
+	}
+	for _, t1 := range transports {
+		for _, t2 := range transports {
+			t1.Connect(t2.LocalAddr(), t2)
+		}
+	}
+
+	var nodes []*raft.Raft
+	shutdown := func() {
+		for _, r := range nodes {
+			r.Shutdown().Error()
+		}
+	}
+	for i, trans := range transports {
+		conf := raft.DefaultConfig()
+		conf.LocalID = configuration.Servers[i].ID
+		conf.LogOutput = ioutil.Discard
+		conf.LogLevel = "ERROR"
+
+		logs := raft.NewInmemStore()
+		snaps := raft.NewInmemSnapshotStore()
+		if err := raft.BootstrapCluster(conf, logs, logs, snaps, trans, configuration); err != nil {
+			shutdown()
+			return nil, nil, err
+		}
+		fsm := raftchunking.NewChunkingFSM(discardFSM{}, nil)
+		r, err := raft.NewRaft(conf, fsm, logs, logs, snaps, trans)
+		if err != nil {
+			shutdown()
+			return nil, nil, err
+		}
+		nodes = append(nodes, r)
+	}
+
+	limit := time.Now().Add(30 * time.Second)
+	for time.Now().Before(limit) {
+		for _, r := range nodes {
+			if r.State() == raft.Leader {
+				return r, shutdown, nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdown()
+	return nil, nil, errors.New("timed out waiting for a leader")
+}
+
+// discardFSM applies nothing, so that the benchmark measures chunking and
+// replication rather than the application.
+type discardFSM struct{}
+
+func (discardFSM) Apply(*raft.Log) interface{} { return nil }
+
+func (discardFSM) Snapshot() (raft.FSMSnapshot, error) { return discardSnapshot{}, nil }
+
+func (discardFSM) Restore(rc io.ReadCloser) error { return rc.Close() }
+
+type discardSnapshot struct{}
+
+func (discardSnapshot) Persist(sink raft.SnapshotSink) error { return sink.Close() }
+
+func (discardSnapshot) Release() {}
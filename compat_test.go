@@ -0,0 +1,317 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The compatibility harness replays chunk streams recorded from earlier
+// releases (testdata/compat) through the current FSMs, and checks that what
+// the current ChunkingApply produces with default options can still be
+// understood by an FSM that only knows the original wire format. Together
+// these make sure mixed-version clusters keep working during rolling
+// upgrades.
+//
+// The v1 fixtures were produced by the ChunkingApply of the original release,
+// by the generator in testdata/compat/gen, a separate module whose go.mod pins
+// that version. Fixtures for a later wire format should be made the same way,
+// with a generator pinned to the version introducing it. Without network
+// access the pinned version can be resolved from a local checkout:
+//
+//	cd testdata/compat/gen
+//	GOPROXY=file://$(go env GOMODCACHE)/cache/download GOPRIVATE=github.com/hashicorp/go-raftchunking \
+//		GIT_CONFIG_COUNT=1 GIT_CONFIG_KEY_0=url.$(git rev-parse --show-toplevel).insteadOf \
+//		GIT_CONFIG_VALUE_0=https://github.com/hashicorp/go-raftchunking go run . -out ..
+const compatDir = "testdata/compat"
+
+type compatLog struct {
+	Index      uint64 `json:"index"`
+	Term       uint64 `json:"term"`
+	Data       []byte `json:"data"`
+	Extensions []byte `json:"extensions,omitempty"`
+}
+
+type compatOp struct {
+	Payload    []byte `json:"payload"`
+	Extensions []byte `json:"extensions,omitempty"`
+}
+
+type compatFixture struct {
+	Description string      `json:"description"`
+	Format      string      `json:"format"`
+	Logs        []compatLog `json:"logs"`
+	Completed   []compatOp  `json:"completed"`
+}
+
+func (f *compatFixture) raftLogs() []*raft.Log {
+	logs := make([]*raft.Log, 0, len(f.Logs))
+	for _, l := range f.Logs {
+		logs = append(logs, &raft.Log{
+			Index:      l.Index,
+			Term:       l.Term,
+			Type:       raft.LogCommand,
+			Data:       l.Data,
+			Extensions: l.Extensions,
+		})
+	}
+	return logs
+}
+
+func loadCompatFixtures(t *testing.T) map[string]*compatFixture {
+	files, err := filepath.Glob(filepath.Join(compatDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no compatibility fixtures found")
+	}
+
+	ret := make(map[string]*compatFixture, len(files))
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fx := new(compatFixture)
+		if err := json.Unmarshal(b, fx); err != nil {
+			t.Fatalf("error parsing %s: %v", file, err)
+		}
+		ret[filepath.Base(file)] = fx
+	}
+	return ret
+}
+
+// recordingFSM keeps every log passed to it.
+type recordingFSM struct {
+	MockFSM
+	applied []*raft.Log
+}
+
+func (r *recordingFSM) Apply(l *raft.Log) interface{} {
+	r.applied = append(r.applied, l)
+	return r.MockFSM.Apply(l)
+}
+
+func (r *recordingFSM) ApplyBatch(logs []*raft.Log) []interface{} {
+	ret := make([]interface{}, len(logs))
+	for i, l := range logs {
+		ret[i] = r.Apply(l)
+	}
+	return ret
+}
+
+func checkCompleted(t *testing.T, expected []compatOp, applied []*raft.Log) {
+	t.Helper()
+	if len(expected) != len(applied) {
+		t.Fatalf("expected %d completed ops, got %d", len(expected), len(applied))
+	}
+	for i, op := range expected {
+		if diff := deep.Equal(op.Payload, applied[i].Data); diff != nil {
+			t.Fatalf("op %d: %v", i, diff)
+		}
+		if len(op.Extensions) > 0 || len(applied[i].Extensions) > 0 {
+			if diff := deep.Equal(op.Extensions, applied[i].Extensions); diff != nil {
+				t.Fatalf("op %d extensions: %v", i, diff)
+			}
+		}
+	}
+}
+
+func TestCompat_RecordedStreams(t *testing.T) {
+	for name, fx := range loadCompatFixtures(t) {
+		fx := fx
+		t.Run(name, func(t *testing.T) {
+			t.Run("fsm", func(t *testing.T) {
+				r := new(recordingFSM)
+				f := NewChunkingFSM(r, nil)
+				for _, l := range fx.raftLogs() {
+					if err, ok := f.Apply(l).(error); ok {
+						t.Fatal(err)
+					}
+				}
+				checkCompleted(t, fx.Completed, r.applied)
+			})
+
+			t.Run("batching", func(t *testing.T) {
+				r := new(recordingFSM)
+				f := NewChunkingBatchingFSM(r, nil)
+				for _, resp := range f.ApplyBatch(fx.raftLogs()) {
+					if err, ok := resp.(error); ok {
+						t.Fatal(err)
+					}
+				}
+				checkCompleted(t, fx.Completed, r.applied)
+			})
+		})
+	}
+}
+
+// v1Fields are the ChunkInfo fields understood by the original wire format.
+var v1Fields = map[protowire.Number]bool{1: true, 2: true, 3: true, 4: true}
+
+// v1ChunkInfo decodes chunk info the way the original FSM did, ignoring
+// fields it does not know about. It also reports any such ignored fields.
+func v1ChunkInfo(b []byte) (opNum uint64, seq, numChunks uint32, ext []byte, unknown []protowire.Number, err error) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return 0, 0, 0, nil, nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if !v1Fields[num] {
+			unknown = append(unknown, num)
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return 0, 0, 0, nil, nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		switch num {
+		case 4:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, 0, 0, nil, nil, protowire.ParseError(n)
+			}
+			ext = v
+			b = b[n:]
+		default:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return 0, 0, 0, nil, nil, protowire.ParseError(n)
+			}
+			switch num {
+			case 1:
+				opNum = v
+			case 2:
+				seq = uint32(v)
+			case 3:
+				numChunks = uint32(v)
+			}
+			b = b[n:]
+		}
+	}
+	return opNum, seq, numChunks, ext, unknown, nil
+}
+
+// v1Reassemble replays logs the way the original FSM did.
+func v1Reassemble(logs []*raft.Log) ([]*raft.Log, error) {
+	var lastTerm uint64
+	ops := make(map[uint64][][]byte)
+	var ret []*raft.Log
+	for _, l := range logs {
+		if l.Extensions == nil {
+			ret = append(ret, l)
+			continue
+		}
+		if l.Term != lastTerm {
+			ops = make(map[uint64][][]byte)
+			lastTerm = l.Term
+		}
+		opNum, seq, numChunks, ext, unknown, err := v1ChunkInfo(l.Extensions)
+		if err != nil {
+			return nil, err
+		}
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("chunk uses fields %v unknown to the v1 format", unknown)
+		}
+		chunks, ok := ops[opNum]
+		if !ok {
+			chunks = make([][]byte, numChunks)
+			ops[opNum] = chunks
+		}
+		chunks[seq] = l.Data
+
+		done := true
+		for _, c := range chunks {
+			if len(c) == 0 {
+				done = false
+				break
+			}
+		}
+		if !done {
+			continue
+		}
+		delete(ops, opNum)
+		var data []byte
+		for _, c := range chunks {
+			data = append(data, c...)
+		}
+		ret = append(ret, &raft.Log{Index: l.Index, Term: l.Term, Data: data, Extensions: ext})
+	}
+	return ret, nil
+}
+
+// currentCompatStreams produces streams comparable to the recorded fixtures
+// using the current ChunkingApply with default options.
+func currentCompatStreams(t *testing.T) map[string]*compatFixture {
+	origChunkSize := ChunkSize
+	defer func() { ChunkSize = origChunkSize }()
+	ChunkSize = 1024
+
+	r := rand.New(rand.NewSource(1))
+	chunk := func(size int, ext []byte) ([]raft.Log, compatOp) {
+		data := make([]byte, size)
+		r.Read(data)
+		var logs []raft.Log
+		f := ChunkingApply(data, ext, time.Second, func(l raft.Log, d time.Duration) raft.ApplyFuture {
+			logs = append(logs, l)
+			return errorFuture{}
+		})
+		if err := f.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return logs, compatOp{Payload: data, Extensions: ext}
+	}
+	build := func(desc string, logs []raft.Log, ops ...compatOp) *compatFixture {
+		fx := &compatFixture{Description: desc, Format: "current", Completed: ops}
+		for i, l := range logs {
+			fx.Logs = append(fx.Logs, compatLog{Index: uint64(i + 1), Term: 1, Data: l.Data, Extensions: l.Extensions})
+		}
+		return fx
+	}
+
+	ret := make(map[string]*compatFixture)
+	logs, op := chunk(100, nil)
+	ret["single"] = build("single chunk op", logs, op)
+	logs, op = chunk(10000, []byte("compat-ext"))
+	ret["multi"] = build("multi chunk op with extensions", logs, op)
+	return ret
+}
+
+func TestCompat_OriginalFormatDecoding(t *testing.T) {
+	for name, fx := range currentCompatStreams(t) {
+		fx := fx
+		t.Run(name, func(t *testing.T) {
+			applied, err := v1Reassemble(fx.raftLogs())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkCompleted(t, fx.Completed, applied)
+		})
+	}
+
+	// Make sure the decoder itself agrees with the recorded fixtures
+	for name, fx := range loadCompatFixtures(t) {
+		if fx.Format != "v1" {
+			continue
+		}
+		applied, err := v1Reassemble(fx.raftLogs())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkCompleted(t, fx.Completed, applied)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/hashicorp/go-raftchunking/internal/snappy"
+	"github.com/hashicorp/go-raftchunking/types"
+)
+
+// Compression selects the algorithm used to compress payloads before they are
+// chunked. The algorithm is recorded in the chunk headers, so the FSM does not
+// need to be configured with it.
+type Compression int32
+
+const (
+	// CompressionNone sends payloads as they are.
+	CompressionNone Compression = Compression(types.Compression_COMPRESSION_UNSPECIFIED)
+
+	// CompressionGzip uses gzip at the default level. It compresses better
+	// than Snappy but is considerably slower.
+	CompressionGzip Compression = Compression(types.Compression_COMPRESSION_GZIP)
+
+	// CompressionSnappy uses the Snappy block format, which is fast but
+	// compresses less.
+	CompressionSnappy Compression = Compression(types.Compression_COMPRESSION_SNAPPY)
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("Compression(%d)", int32(c))
+	}
+}
+
+// compressionSampleSize is how much of a large payload is compressed first to
+// judge whether compressing all of it is worthwhile.
+const compressionSampleSize = 64 * 1024
+
+// WithCompression makes ChunkingApply compress payloads with alg before
+// splitting them, so that fewer chunks are sent. Compression is skipped for
+// payloads that it would not shrink, judging large payloads by how well their
+// first 64KiB compresses, so that already compressed or encrypted data is not
+// compressed again to no effect. Compressed payloads are sent with their size,
+// as with WithTotalSize, which the FSM requires so that it stops decompressing
+// a payload that would come out larger. The FSM decompresses payloads before
+// handing them to the underlying FSM; since nodes that do not understand compression
+// would pass the compressed data on as it is, all nodes must understand it
+// before it is used. It is ignored by the FSM.
+func WithCompression(alg Compression) Option {
+	return func(c *config) {
+		c.compression = alg
+	}
+}
+
+// compress returns data compressed with the algorithm.
+func (c Compression) compress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(data), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %v", c)
+	}
+}
+
+// NewReader returns a reader of the data read from r decompressed with the
+// algorithm. It is for applications using a Reassembler, which writes out
+// payloads as they were sent; ReassembledOp.Compression gives the algorithm.
+// Snappy data is read in full before any of it is returned.
+func (c Compression) NewReader(r io.Reader) (io.Reader, error) {
+	return c.newReader(r, 0)
+}
+
+// newReader does the work of NewReader, failing reads once the data
+// decompresses to more than limit bytes, if a limit is given.
+func (c Compression) newReader(r io.Reader, limit uint64) (io.Reader, error) {
+	switch c {
+	case CompressionNone:
+		return r, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrDecompression, err)
+		}
+		return limitOutput(zr, limit), nil
+	case CompressionSnappy:
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = c.decompress(data, limit); err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(data), nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported compression %v", ErrDecompression, c)
+	}
+}
+
+// maxDeflateRatio is the most that deflate, and so gzip, can expand data by
+// when decompressing it.
+const maxDeflateRatio = 1032
+
+// decompress returns data decompressed with the algorithm, failing as soon as
+// it decompresses to more than limit bytes, if a limit is given, so that a
+// small payload can't make the FSM allocate far more than it was sent. The
+// output buffer is allocated once at the limit, as far as the compressed data
+// could account for it, rather than grown as it is read.
+func (c Compression) decompress(data []byte, limit uint64) ([]byte, error) {
+	var out []byte
+	var err error
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			sizeHint := limit
+			if max := uint64(len(data)) * maxDeflateRatio; sizeHint > max {
+				sizeHint = max
+			}
+			out, err = readSized(limitOutput(zr, limit), sizeHint)
+		}
+	case CompressionSnappy:
+		// The decoded length is given up front, and decoding allocates it
+		var n int
+		if n, err = snappy.DecodedLen(data); err == nil && limit != 0 && uint64(n) > limit {
+			err = fmt.Errorf("payload decompresses to %d bytes, more than the %d sent", n, limit)
+		}
+		if err == nil {
+			out, err = snappy.Decode(data)
+		}
+	default:
+		err = fmt.Errorf("unsupported compression %v", c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecompression, err)
+	}
+	return out, nil
+}
+
+// limitedOutput is a reader of decompressed data that fails once more than
+// limit bytes have been read from it.
+type limitedOutput struct {
+	r            io.Reader
+	limit, avail uint64
+}
+
+// limitOutput returns r limited to limit bytes, or r itself if limit is zero.
+func limitOutput(r io.Reader, limit uint64) io.Reader {
+	if limit == 0 {
+		return r
+	}
+	return &limitedOutput{r: r, limit: limit, avail: limit}
+}
+
+func (l *limitedOutput) Read(p []byte) (int, error) {
+	// Read a byte past the limit, so that going over it is seen
+	if l.avail < math.MaxUint64 && uint64(len(p)) > l.avail+1 {
+		p = p[:l.avail+1]
+	}
+	n, err := l.r.Read(p)
+	if uint64(n) > l.avail {
+		return 0, fmt.Errorf("payload decompresses to more than the %d bytes sent", l.limit)
+	}
+	l.avail -= uint64(n)
+	return n, err
+}
+
+// readSized reads r to the end into a buffer of size bytes, growing it only
+// if r turns out to hold more.
+func readSized(r io.Reader, size uint64) ([]byte, error) {
+	n, err := checkedInt(size)
+	if err != nil || n == 0 {
+		return ioutil.ReadAll(r)
+	}
+	// io.ReadFull isn't used since it reports an early end of the data as
+	// io.ErrUnexpectedEOF, as gzip reports a truncated stream
+	out := make([]byte, n)
+	var read int
+	for read < len(out) {
+		m, err := r.Read(out[read:])
+		read += m
+		if err == io.EOF {
+			return out[:read], nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Read on to the end, which also checks the data's checksum
+	rest, err := ioutil.ReadAll(r)
+	return append(out, rest...), err
+}
+
+// compress compresses the op's payload as configured, returning the data to
+// send. The size of the payload is recorded to be sent if asked for, and
+// always if it was compressed, since the FSM won't decompress it without
+// knowing how large it should be.
+func (op *opParams) compress(conf *config, cmd []byte) ([]byte, error) {
+	size := len(cmd)
+	cmd, compression, err := compressPayload(conf.compression, cmd)
+	if err != nil {
+		return nil, err
+	}
+	op.compression = compression
+	if conf.totalSize || compression != CompressionNone {
+		op.totalSize = size
+	}
+	return cmd, nil
+}
+
+// compressPayload compresses cmd with alg if that makes it smaller, returning
+// the data to send and the algorithm it was compressed with, if any. Given the
+// same payload the decision is always the same, so resumed ops are split as
+// before.
+func compressPayload(alg Compression, cmd []byte) ([]byte, Compression, error) {
+	if alg == CompressionNone || len(cmd) == 0 {
+		return cmd, CompressionNone, nil
+	}
+
+	// Don't spend time compressing a large payload if a sample of it barely
+	// shrinks
+	if len(cmd) > compressionSampleSize {
+		sample, err := alg.compress(cmd[:compressionSampleSize])
+		if err != nil {
+			return nil, CompressionNone, err
+		}
+		if len(sample) > compressionSampleSize*9/10 {
+			return cmd, CompressionNone, nil
+		}
+	}
+
+	compressed, err := alg.compress(cmd)
+	if err != nil {
+		return nil, CompressionNone, err
+	}
+	if len(compressed) >= len(cmd) {
+		return cmd, CompressionNone, nil
+	}
+	return compressed, alg, nil
+}
@@ -0,0 +1,249 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+var compressions = []Compression{CompressionGzip, CompressionSnappy}
+
+// compressibleData returns a payload of n bytes that compresses well.
+func compressibleData(n int) []byte {
+	return []byte(strings.Repeat("Nobody inspects the spammish repetition. ", n/41+1))[:n]
+}
+
+// chunkCompression returns the compression recorded in each log's chunk info.
+func chunkCompression(t *testing.T, logs []raft.Log) []Compression {
+	var ret []Compression
+	for _, l := range logs {
+		var ci types.ChunkInfo
+		if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, Compression(ci.Compression))
+	}
+	return ret
+}
+
+func TestCompression_FSM(t *testing.T) {
+	data := compressibleData(4 * ChunkSize)
+	plain, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range compressions {
+		t.Run(alg.String(), func(t *testing.T) {
+			kp := newTestKeyProvider(t)
+			logs, err := SplitIntoLogs(data, []byte("ext"), WithCompression(alg), WithKeyProvider(kp), WithHashAlgorithm(anyHash()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) >= len(plain) {
+				t.Fatalf("expected compression to reduce %d chunks, got %d", len(plain), len(logs))
+			}
+			for i, c := range chunkCompression(t, logs) {
+				if c != alg {
+					t.Fatalf("expected compression %v on chunk %d, got %v", alg, i, c)
+				}
+			}
+
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil, WithKeyProvider(kp))
+			var resp interface{}
+			for i := range logs {
+				resp = f.Apply(&logs[i])
+			}
+			if _, ok := resp.(ChunkingSuccess); !ok {
+				t.Fatalf("expected success, got %#v", resp)
+			}
+			if !bytes.Equal(data, m.logs[0]) {
+				t.Fatal("reassembled payload does not match")
+			}
+
+			// Corrupt compressed data fails to decompress
+			logs, err = SplitIntoLogs(data, nil, WithCompression(alg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			last := &logs[len(logs)-1]
+			last.Data = last.Data[:len(last.Data)/2]
+			f = NewChunkingFSM(new(MockFSM), nil)
+			for i := range logs {
+				resp = f.Apply(&logs[i])
+			}
+			if err, ok := resp.(error); !ok || !errors.Is(err, ErrDecompression) {
+				t.Fatalf("expected decompression error, got %#v", resp)
+			}
+		})
+	}
+}
+
+func TestCompression_DecompressionLimit(t *testing.T) {
+	data := make([]byte, 16<<20)
+	for _, alg := range compressions {
+		logs, err := SplitIntoLogs(data, nil, WithCompression(alg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		setTotalSize := func(size uint64) {
+			for i := range logs {
+				var ci types.ChunkInfo
+				if err := proto.Unmarshal(logs[i].Extensions, &ci); err != nil {
+					t.Fatal(err)
+				}
+				ci.TotalSize = size
+				if logs[i].Extensions, err = proto.Marshal(&ci); err != nil {
+					t.Fatal(err)
+				}
+				logs[i].Index = uint64(i + 1)
+			}
+		}
+
+		for name, tc := range map[string]struct {
+			size   uint64
+			opts   []Option
+			target error
+		}{
+			"understated": {size: 1024, target: ErrDecompression},
+			"missing":     {size: 0, target: ErrDecompression},
+			"over limit":  {size: uint64(len(data)), opts: []Option{WithMaxPayloadSize(1 << 20)}, target: ErrPayloadTooLarge},
+		} {
+			setTotalSize(tc.size)
+			for _, chunked := range []bool{false, true} {
+				var underlying raft.FSM = new(MockFSM)
+				m := &chunkedFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+				if chunked {
+					underlying = m
+				}
+				f := NewChunkingFSM(underlying, nil, tc.opts...)
+
+				// The payload is never decompressed in full
+				var before, after runtime.MemStats
+				runtime.ReadMemStats(&before)
+				var resp interface{}
+				for i := range logs {
+					resp = f.Apply(&logs[i])
+				}
+				runtime.ReadMemStats(&after)
+				if err, ok := resp.(error); !ok || !errors.Is(err, tc.target) {
+					t.Fatalf("%v %s: expected %v, got %#v", alg, name, tc.target, resp)
+				}
+				if alloc := after.TotalAlloc - before.TotalAlloc; alloc > uint64(len(data))/2 {
+					t.Fatalf("%v %s: allocated %d bytes for a payload of %d", alg, name, alloc, len(data))
+				}
+				if chunked && len(m.payloads) != 0 {
+					t.Fatalf("%v %s: expected the op not to complete", alg, name)
+				}
+			}
+		}
+	}
+}
+
+func TestCompression_Skipped(t *testing.T) {
+	random := make([]byte, 2*ChunkSize)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	for _, alg := range compressions {
+		// Incompressible payloads, large and small, are sent as they are
+		for _, data := range [][]byte{random, random[:100], nil} {
+			logs, err := SplitIntoLogs(data, nil, WithCompression(alg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var sent []byte
+			for i, c := range chunkCompression(t, logs) {
+				if c != CompressionNone {
+					t.Fatalf("%v: expected %d byte payload to be uncompressed, chunk %d has %v", alg, len(data), i, c)
+				}
+				sent = append(sent, logs[i].Data...)
+			}
+			if !bytes.Equal(sent, data) {
+				t.Fatalf("%v: expected %d byte payload to be sent as is", alg, len(data))
+			}
+		}
+	}
+
+	// Unknown algorithms fail the op
+	if _, err := SplitIntoLogs([]byte("data"), nil, WithCompression(Compression(99))); err == nil {
+		t.Fatal("expected unknown compression to fail")
+	}
+}
+
+func TestCompression_Resume(t *testing.T) {
+	data := compressibleData(4 * ChunkSize)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var sent int
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		sent++
+		if sent == 2 {
+			return errorFuture{err: raft.ErrNotLeader}
+		}
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	future := ChunkingApply(data, nil, time.Second, applyFunc, WithCompression(CompressionSnappy), WithChunkSize(4096)).(ChunkingFuture)
+	if future.Error() == nil {
+		t.Fatal("expected op to fail")
+	}
+	token := future.ResumeToken()
+	if token == nil {
+		t.Fatal("expected a resume token")
+	}
+	if err := ChunkingResume(data, nil, token, time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 1 || !bytes.Equal(data, m.logs[0]) {
+		t.Fatalf("expected resumed op to be applied, got %d logs", len(m.logs))
+	}
+}
+
+func TestCompression_Reassembler(t *testing.T) {
+	data := compressibleData(3 * ChunkSize)
+	for _, alg := range compressions {
+		logs, err := SplitIntoLogs(data, nil, WithCompression(alg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		r := NewReassembler(func(opNum uint64) (io.Writer, error) {
+			return &buf, nil
+		})
+		var op *ReassembledOp
+		for i := range logs {
+			if op, err = r.Add(&logs[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if op == nil || op.Compression != alg || op.Size != uint64(buf.Len()) {
+			t.Fatalf("%v: unexpected completed op %#v", alg, op)
+		}
+		zr, err := op.Compression.NewReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, got) {
+			t.Fatalf("%v: decompressed payload does not match", alg)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// ErrDuplicateOp is returned, wrapped, as the FSM's response to the final
+// chunk of an op that had already completed, when WithDedupWindow is used, or
+// that repeats an op whose response is no longer known, when
+// WithIdempotencyWindow is used.
+var ErrDuplicateOp = errors.New("op has already been applied")
+
+// WithContentOpNum makes ChunkingApply derive the op num from a hash of salt,
+// the payload and the extensions, rather than choosing it at random, so that
+// applying the same payload again uses the same op num. Along with
+// WithDedupWindow on the FSM, this lets a client retry an op after an
+// ambiguous failure, such as a timeout, without it being applied twice. The
+// salt should set apart callers that may legitimately apply the same payload
+// more than once. Since encrypted ops use a fresh data key each time, a retry
+// of an encrypted op should only be made once the earlier attempt's partial
+// chunks are gone, such as after the term changes. It is ignored by the FSM.
+func WithContentOpNum(salt []byte) Option {
+	return func(c *config) {
+		c.contentOpNum = true
+		c.opNumSalt = salt
+	}
+}
+
+// WithDedupWindow makes the FSM remember the op nums of the last n ops it
+// completed and ignore any later op under one of them, responding to its
+// final chunk with an error wrapping ErrDuplicateOp instead of applying it.
+// It is meant for ops sent with WithContentOpNum. The remembered op nums are
+// part of the state captured by CurrentState, and since they decide whether
+// ops are applied every node must be given the same n. It is ignored by
+// ChunkingApply.
+func WithDedupWindow(n int) Option {
+	return func(c *config) {
+		c.dedupWindow = n
+	}
+}
+
+// contentOpNum derives an op num from the contents of an op.
+func contentOpNum(salt, cmd, extensions []byte) uint64 {
+	h := sha256.New()
+	var size [8]byte
+	for _, b := range [][]byte{salt, cmd, extensions} {
+		binary.BigEndian.PutUint64(size[:], uint64(len(b)))
+		h.Write(size[:])
+		h.Write(b)
+	}
+	opNum := binary.BigEndian.Uint64(h.Sum(nil))
+	if opNum == 0 {
+		// Zero means no op num was given
+		opNum = 1
+	}
+	return opNum
+}
+
+// completedOps remembers the most recently completed ops.
+type completedOps struct {
+	size  int
+	order []opKey
+	set   map[opKey]struct{}
+}
+
+// newCompletedOps returns a window of size ops holding those given, as listed
+// by list; origins may be nil if none of them had one.
+func newCompletedOps(size int, opNums []uint64, origins []string) *completedOps {
+	if size <= 0 {
+		return nil
+	}
+	c := &completedOps{
+		size: size,
+		set:  make(map[opKey]struct{}, size),
+	}
+	for i, opNum := range opNums {
+		key := opKey{opNum: opNum}
+		if i < len(origins) {
+			key.origin = origins[i]
+		}
+		c.add(key)
+	}
+	return c
+}
+
+func (c *completedOps) add(key opKey) {
+	if c == nil {
+		return
+	}
+	if _, ok := c.set[key]; ok {
+		return
+	}
+	c.order = append(c.order, key)
+	c.set[key] = struct{}{}
+	if len(c.order) > c.size {
+		delete(c.set, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *completedOps) has(key opKey) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.set[key]
+	return ok
+}
+
+// list returns the op nums of the remembered ops, oldest first, and their
+// origins if any of them had one.
+func (c *completedOps) list() ([]uint64, []string) {
+	if c == nil || len(c.order) == 0 {
+		return nil, nil
+	}
+	opNums := make([]uint64, len(c.order))
+	var origins []string
+	for i, key := range c.order {
+		opNums[i] = key.opNum
+		if key.origin != "" {
+			if origins == nil {
+				origins = make([]string, len(c.order))
+			}
+			origins[i] = key.origin
+		}
+	}
+	return opNums, origins
+}
+
+// checkDuplicate drops a chunk of an op that has already completed, returning
+// an error on its final chunk.
+func (c *ChunkingFSM) checkDuplicate(l *raft.Log, ci *types.ChunkInfo) (bool, error) {
+	if !c.completed.has(chunkKey(ci)) {
+		return false, nil
+	}
+	if ci.SequenceNum+1 < ci.NumChunks {
+		return true, nil
+	}
+	err := fmt.Errorf("op %d: %w", ci.OpNum, ErrDuplicateOp)
+	c.discardChunk(l, ci, OpDuplicate, err)
+	return true, err
+}
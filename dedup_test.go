@@ -0,0 +1,87 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestDedupWindow(t *testing.T) {
+	payload := func() []byte {
+		data := make([]byte, 2*ChunkSize)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	data := payload()
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithDedupWindow(2))
+	var index, term uint64 = 0, 1
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		index++
+		l.Index, l.Term = index, term
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+	apply := func(data []byte, salt string) interface{} {
+		t.Helper()
+		future := ChunkingApply(data, nil, time.Second, applyFunc, WithContentOpNum([]byte(salt)))
+		if err := future.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return future.Response()
+	}
+	isDuplicate := func(resp interface{}) bool {
+		err, ok := resp.(error)
+		return ok && errors.Is(err, ErrDuplicateOp)
+	}
+
+	// Applying the same payload again, even in a later term, is ignored
+	if resp := apply(data, "a"); isDuplicate(resp) {
+		t.Fatal("expected first op to be applied")
+	}
+	term++
+	if resp := apply(data, "a"); !isDuplicate(resp) {
+		t.Fatalf("expected duplicate op, got %#v", resp)
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected 1 applied op, got %d", len(m.logs))
+	}
+
+	// A different salt makes a different op
+	if resp := apply(data, "b"); isDuplicate(resp) {
+		t.Fatal("expected op with another salt to be applied")
+	}
+
+	// The remembered op nums survive capturing and restoring the state
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Completed) != 2 {
+		t.Fatalf("expected 2 completed ops in state, got %d", len(state.Completed))
+	}
+	f = NewChunkingFSM(m, nil, WithDedupWindow(2))
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if resp := apply(data, "a"); !isDuplicate(resp) {
+		t.Fatalf("expected duplicate op after restore, got %#v", resp)
+	}
+
+	// Ops fall out of the window as others complete
+	apply(payload(), "a")
+	if resp := apply(data, "a"); isDuplicate(resp) {
+		t.Fatal("expected op outside the window to be applied")
+	}
+	if len(m.logs) != 4 {
+		t.Fatalf("expected 4 applied ops, got %d", len(m.logs))
+	}
+}
@@ -0,0 +1,237 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	spillFilePrefix = "raftchunking-"
+	spillFileSuffix = ".spill"
+)
+
+// DiskChunkStorage satisfies ChunkStorage by spilling chunk data to one file
+// per op in a directory, keeping only chunk metadata in memory. This bounds
+// the memory used by large in-flight ops. Where supported, spill files are
+// memory-mapped to read the chunks back when an op is finalized.
+//
+// Spill files only live as long as their op: they are unmapped and removed as
+// soon as the op is finalized or cleared, including when the FSM discards
+// partial ops on a term change. Since chunk state is always rebuilt from a
+// snapshot and the raft log after a restart, any spill files found when the
+// store is created are left over from a crash and are removed.
+//
+// Like InmemChunkStorage it is not safe for concurrent use on its own;
+// ChunkingFSM serializes access to its store.
+type DiskChunkStorage struct {
+	dir string
+	ops map[uint64]*spillFile
+}
+
+// spillView provides access to the contents of a spill file while an op's
+// chunks are read back.
+type spillView interface {
+	ReadAt(p []byte, off int64) error
+	Close() error
+}
+
+// spillFile holds the metadata for an op whose data lives in a file.
+type spillFile struct {
+	f      *os.File
+	size   int64
+	chunks []*spillChunk
+}
+
+// spillChunk records where in its op's spill file a chunk's data lives.
+type spillChunk struct {
+	info   ChunkInfo
+	offset int64
+	length int
+}
+
+// NewDiskChunkStorage returns a DiskChunkStorage that spills to files in dir,
+// creating the directory if needed and removing any spill files left behind
+// by a previous process.
+func NewDiskChunkStorage(dir string) (*DiskChunkStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating spill directory: %w", err)
+	}
+	if err := removeOrphanSpillFiles(dir); err != nil {
+		return nil, err
+	}
+	return &DiskChunkStorage{
+		dir: dir,
+		ops: make(map[uint64]*spillFile),
+	}, nil
+}
+
+// removeOrphanSpillFiles deletes spill files in dir. Any other files are left
+// alone so that sharing a directory is harmless.
+func removeOrphanSpillFiles(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading spill directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, spillFilePrefix) || !strings.HasSuffix(name, spillFileSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing orphaned spill file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *DiskChunkStorage) StoreChunk(chunk *ChunkInfo) (bool, error) {
+	op, ok := d.ops[chunk.OpNum]
+	if !ok {
+		f, err := ioutil.TempFile(d.dir, fmt.Sprintf("%s%016x-*%s", spillFilePrefix, chunk.OpNum, spillFileSuffix))
+		if err != nil {
+			return false, fmt.Errorf("error creating spill file: %w", err)
+		}
+		op = &spillFile{
+			f:      f,
+			chunks: make([]*spillChunk, chunk.NumChunks),
+		}
+		d.ops[chunk.OpNum] = op
+	}
+	if n := int(chunk.NumChunks); n > len(op.chunks) {
+		op.chunks = append(op.chunks, make([]*spillChunk, n-len(op.chunks))...)
+	}
+
+	// Data is always appended; if a chunk is stored again the space used by
+	// the earlier copy is simply abandoned until the op is done.
+	if _, err := op.f.WriteAt(chunk.Data, op.size); err != nil {
+		return false, fmt.Errorf("error writing to spill file: %w", err)
+	}
+	sc := &spillChunk{
+		info:   *chunk,
+		offset: op.size,
+		length: len(chunk.Data),
+	}
+	sc.info.Data = nil
+	op.chunks[chunk.SequenceNum] = sc
+	op.size += int64(len(chunk.Data))
+
+	for _, c := range op.chunks {
+		// As with InmemChunkStorage, chunks without data don't count
+		if c == nil || c.length == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (d *DiskChunkStorage) FinalizeOp(opNum uint64) ([]*ChunkInfo, error) {
+	op, ok := d.ops[opNum]
+	if !ok {
+		return nil, nil
+	}
+	delete(d.ops, opNum)
+
+	ret, err := op.read()
+	if closeErr := op.remove(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (d *DiskChunkStorage) GetChunks() (ChunkMap, error) {
+	ret := make(ChunkMap, len(d.ops))
+	for opNum, op := range d.ops {
+		chunks, err := op.read()
+		if err != nil {
+			return nil, err
+		}
+		ret[opNum] = chunks
+	}
+	return ret, nil
+}
+
+func (d *DiskChunkStorage) RestoreChunks(chunks ChunkMap) error {
+	if err := d.Close(); err != nil {
+		return err
+	}
+	for _, opChunks := range chunks {
+		for _, chunk := range opChunks {
+			if chunk == nil {
+				continue
+			}
+			if _, err := d.StoreChunk(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close removes all spill files, discarding any partial ops. The store can
+// continue to be used afterwards.
+func (d *DiskChunkStorage) Close() error {
+	var firstErr error
+	for opNum, op := range d.ops {
+		if err := op.remove(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(d.ops, opNum)
+	}
+	return firstErr
+}
+
+// read returns copies of the op's chunks with their data loaded from the
+// spill file. Missing chunks are left nil, as in InmemChunkStorage.
+func (s *spillFile) read() ([]*ChunkInfo, error) {
+	ret := make([]*ChunkInfo, len(s.chunks))
+	if s.size == 0 {
+		for i, c := range s.chunks {
+			if c != nil {
+				info := c.info
+				ret[i] = &info
+			}
+		}
+		return ret, nil
+	}
+
+	view, err := mapSpillFile(s.f, s.size)
+	if err != nil {
+		return nil, fmt.Errorf("error mapping spill file: %w", err)
+	}
+	defer view.Close()
+
+	for i, c := range s.chunks {
+		if c == nil {
+			continue
+		}
+		info := c.info
+		info.Data = make([]byte, c.length)
+		if err := view.ReadAt(info.Data, c.offset); err != nil {
+			return nil, fmt.Errorf("error reading spill file: %w", err)
+		}
+		ret[i] = &info
+	}
+	return ret, nil
+}
+
+// remove closes and deletes the spill file.
+func (s *spillFile) remove() error {
+	closeErr := s.f.Close()
+	if err := os.Remove(s.f.Name()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing spill file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("error closing spill file: %w", closeErr)
+	}
+	return nil
+}
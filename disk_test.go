@@ -0,0 +1,117 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func spillFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, spillFilePrefix+"*"+spillFileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestDiskChunkStorage_FSM(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskChunkStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, store)
+	data, logs := chunkData(t)
+
+	for i, l := range logs[:len(logs)-1] {
+		if r := f.Apply(l); r != nil {
+			t.Fatalf("unexpected response for log %d: %#v", i, r)
+		}
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected one spill file, got %v", files)
+	}
+
+	// Snapshot the partial state, complete the op, then restore it
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Apply(logs[len(logs)-1]).(ChunkingSuccess); !ok {
+		t.Fatal("expected final apply to succeed")
+	}
+	if diff := deep.Equal(data, m.logs[0]); diff != nil {
+		t.Fatal(diff)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill file to be removed, got %v", files)
+	}
+
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(state, restored); diff != nil {
+		t.Fatal(diff)
+	}
+	if _, ok := f.Apply(logs[len(logs)-1]).(ChunkingSuccess); !ok {
+		t.Fatal("expected final apply to succeed after restore")
+	}
+	if diff := deep.Equal(data, m.logs[1]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// A term change discards the partial op and its file
+	if r := f.Apply(logs[0]); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+	_, other := chunkData(t)
+	other[0].Term = logs[0].Term + 1
+	if r := f.Apply(other[0]); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected only the new op's spill file, got %v", files)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill files to be removed on close, got %v", files)
+	}
+}
+
+func TestDiskChunkStorage_OrphanCleanup(t *testing.T) {
+	dir := t.TempDir()
+	orphan := filepath.Join(dir, spillFilePrefix+"0000000000000001-123"+spillFileSuffix)
+	other := filepath.Join(dir, "unrelated")
+	for _, name := range []string{orphan, other} {
+		if err := ioutil.WriteFile(name, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := NewDiskChunkStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("expected orphaned spill file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("expected unrelated file to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// ErrDuplicateChunk is returned, wrapped, for a chunk that arrives again for
+// an op that already has it, when WithDuplicateChunks refuses it.
+var ErrDuplicateChunk = errors.New("duplicate chunk")
+
+// DuplicatePolicy is how the FSM handles a chunk that arrives again for an op
+// that already has it, as set with WithDuplicateChunks.
+type DuplicatePolicy int
+
+const (
+	// DuplicateReplace stores the chunk over the one already held. This is
+	// the default.
+	DuplicateReplace DuplicatePolicy = iota
+
+	// DuplicateIgnore keeps the chunk already held and drops the new one.
+	DuplicateIgnore
+
+	// DuplicateReject drops the new chunk and returns an error wrapping
+	// ErrDuplicateChunk for it, leaving the op as it was.
+	DuplicateReject
+
+	// DuplicateVerify drops the new chunk if its data matches the one
+	// already held, as chunks resent with WithChunkRetries do, and fails
+	// the op with an error wrapping ErrDuplicateChunk if it doesn't, since
+	// the op's data can then no longer be trusted.
+	DuplicateVerify
+)
+
+func (p DuplicatePolicy) String() string {
+	switch p {
+	case DuplicateReplace:
+		return "replace"
+	case DuplicateIgnore:
+		return "ignore"
+	case DuplicateReject:
+		return "reject"
+	case DuplicateVerify:
+		return "verify"
+	default:
+		return fmt.Sprintf("DuplicatePolicy(%d)", int(p))
+	}
+}
+
+// WithDuplicateChunks sets how the FSM handles a chunk that arrives again for
+// an op that already has it. Whatever the policy, duplicates are counted in
+// DuplicateChunks. Since chunks resent with WithChunkRetries arrive again
+// when the first attempt was in fact committed, DuplicateReject will fail
+// those. It is ignored by ChunkingApply.
+func WithDuplicateChunks(policy DuplicatePolicy) Option {
+	return func(c *config) {
+		c.duplicatePolicy = policy
+	}
+}
+
+// DuplicateChunks returns the number of chunks that arrived for an op that
+// already had them, so that operators can spot misbehaving clients. Like
+// PendingOps it is cheap and safe to call concurrently with Apply.
+func (c *ChunkingFSM) DuplicateChunks() uint64 {
+	return atomic.LoadUint64(&c.duplicateChunks)
+}
+
+// checkDuplicateChunk handles a chunk its op already has under the configured
+// policy, returning true if it is to be dropped along with the error to
+// return for it.
+func (c *ChunkingFSM) checkDuplicateChunk(l *raft.Log, ci *types.ChunkInfo) (bool, error) {
+	op, ok := c.ops[chunkKey(ci)]
+	if !ok {
+		return false, nil
+	}
+	if _, ok := op.sizes[ci.SequenceNum]; !ok {
+		return false, nil
+	}
+	atomic.AddUint64(&c.duplicateChunks, 1)
+
+	switch c.conf.duplicatePolicy {
+	case DuplicateIgnore:
+		return true, nil
+	case DuplicateReject:
+		return true, fmt.Errorf("op %d: chunk %d: %w", ci.OpNum, ci.SequenceNum, ErrDuplicateChunk)
+	case DuplicateVerify:
+		if crc32.Checksum(l.Data, crc32cTable) == op.checksums[ci.SequenceNum] {
+			return true, nil
+		}
+		return true, c.failOp(l, ci, fmt.Errorf("op %d: chunk %d differs from the one already received: %w", ci.OpNum, ci.SequenceNum, ErrDuplicateChunk))
+	default:
+		return false, nil
+	}
+}
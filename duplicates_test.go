@@ -0,0 +1,72 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestDuplicateChunks(t *testing.T) {
+	data := make([]byte, 2*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	same := logs[0]
+	differs := logs[0]
+	differs.Data = append([]byte(nil), logs[0].Data...)
+	differs.Data[0]++
+
+	for _, tc := range []struct {
+		policy      DuplicatePolicy
+		sameErr     bool
+		differsErr  bool
+		wantApplied []byte
+	}{
+		{policy: DuplicateReplace, wantApplied: append(differs.Data, data[len(differs.Data):]...)},
+		{policy: DuplicateIgnore, wantApplied: data},
+		{policy: DuplicateReject, sameErr: true, differsErr: true, wantApplied: data},
+		{policy: DuplicateVerify, differsErr: true},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil, WithDuplicateChunks(tc.policy))
+			f.Apply(&logs[0])
+			for _, l := range []struct {
+				log     raft.Log
+				wantErr bool
+			}{{same, tc.sameErr}, {differs, tc.differsErr}} {
+				err, _ := f.Apply(&l.log).(error)
+				if errors.Is(err, ErrDuplicateChunk) != l.wantErr {
+					t.Fatalf("unexpected response to a duplicate: %v", err)
+				}
+			}
+			if f.DuplicateChunks() != 2 {
+				t.Fatalf("expected 2 duplicates to be counted, got %d", f.DuplicateChunks())
+			}
+			for i := range logs[1:] {
+				f.Apply(&logs[i+1])
+			}
+
+			if tc.wantApplied == nil {
+				// The mismatch failed the op
+				if len(m.logs) != 0 || f.PendingOps() != 0 {
+					t.Fatalf("expected the op to be failed, got %d applied and %d pending", len(m.logs), f.PendingOps())
+				}
+				return
+			}
+			if len(m.logs) != 1 || !bytes.Equal(m.logs[0], tc.wantApplied) {
+				t.Fatalf("expected the op to be applied with the %v policy's data", tc.policy)
+			}
+		})
+	}
+}
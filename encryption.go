@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// dataKeySize is the size of the per-op AES-256 data keys.
+const dataKeySize = 32
+
+// KeyProvider wraps and unwraps the per-op data keys used to encrypt chunk
+// data. It is designed to be backed by something like Vault's seal, so that
+// chunk bodies sitting in the raft log are protected by the cluster's seal
+// rather than stored in the clear.
+type KeyProvider interface {
+	// WrapKey encrypts a freshly generated data key. The result is stored
+	// alongside every chunk of the op.
+	WrapKey(key []byte) ([]byte, error)
+
+	// UnwrapKey recovers a data key previously returned from WrapKey.
+	UnwrapKey(wrapped []byte) ([]byte, error)
+}
+
+// WithKeyProvider enables encryption of chunk data. On the apply side a random
+// data key is generated for each op, each chunk is sealed with it using
+// AES-GCM, and the key, wrapped by the provider, is recorded in the chunk
+// info. On the FSM side the key is unwrapped and the chunks decrypted only
+// once all of them have arrived, so buffered chunks also remain encrypted.
+func WithKeyProvider(kp KeyProvider) Option {
+	return func(c *config) {
+		c.keyProvider = kp
+	}
+}
+
+// KeyRing resolves the key IDs recorded with encrypted ops to the providers
+// able to unwrap their data keys. It lets keys be rotated while ops encrypted
+// under older keys are still in the raft log: senders switch to a new key ID
+// with WithKeyID, and the receiving side keeps every key that may still be
+// needed in its KeyRing.
+type KeyRing interface {
+	// KeyProvider returns the provider for a key ID. Ops sent without a
+	// key ID have the empty one.
+	KeyProvider(keyID string) (KeyProvider, error)
+}
+
+// WithKeyID records keyID with each op encrypted with the provider given in
+// WithKeyProvider, so that an FSM or Reassembler using WithKeyRing can find
+// the key to unwrap it with. It is ignored by the FSM.
+func WithKeyID(keyID string) Option {
+	return func(c *config) {
+		c.keyID = keyID
+	}
+}
+
+// WithKeyRing makes the FSM or Reassembler unwrap data keys with the provider
+// the ring returns for each op's key ID, instead of the one given in
+// WithKeyProvider. ChunkingResume also uses it to unwrap the key of the op
+// being resumed, which may be an older one than the current key ID.
+func WithKeyRing(kr KeyRing) Option {
+	return func(c *config) {
+		c.keyRing = kr
+	}
+}
+
+// EncryptFunc encrypts the data of one chunk of an op before it is sent. It is
+// given the op and sequence numbers so that it can bind them to the result,
+// and must not modify data.
+type EncryptFunc func(opNum uint64, seq uint32, data []byte) ([]byte, error)
+
+// DecryptFunc reverses an EncryptFunc for one chunk of an op.
+type DecryptFunc func(opNum uint64, seq uint32, data []byte) ([]byte, error)
+
+// WithEncryptFunc makes ChunkingApply encrypt the data of every chunk with fn,
+// for applications that manage their own keys, such as a barrier key, rather
+// than using WithKeyProvider. The chunks are marked as encrypted so that the
+// FSM knows to decrypt them. Overhead is the most that fn grows a chunk's data
+// by, which is allowed for when sizing chunks; ops fail if it grows by more.
+// If a key provider is also given, data is sealed with the op's data key
+// before fn is called. With WithHashAlgorithm, a resumed op only passes its
+// integrity check if fn always gives the same result for the same chunk. It
+// is ignored by the FSM.
+func WithEncryptFunc(fn EncryptFunc, overhead int) Option {
+	return func(c *config) {
+		c.encryptFunc = fn
+		c.encryptOverhead = overhead
+	}
+}
+
+// WithDecryptFunc makes the FSM or Reassembler decrypt chunks that were
+// encrypted with an EncryptFunc using fn. Like with WithKeyProvider, the FSM
+// decrypts an op's chunks only once all of them have arrived, so buffered
+// chunks remain encrypted. It is ignored by ChunkingApply.
+func WithDecryptFunc(fn DecryptFunc) Option {
+	return func(c *config) {
+		c.decryptFunc = fn
+	}
+}
+
+// encryptChunk encrypts a chunk's data with the configured EncryptFunc.
+func (c *config) encryptChunk(opNum uint64, seq uint32, data []byte) ([]byte, error) {
+	out, err := c.encryptFunc(opNum, seq, data)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting chunk %d of op %d: %w", seq, opNum, err)
+	}
+	if grown := len(out) - len(data); grown > c.encryptOverhead {
+		return nil, fmt.Errorf("encrypting chunk %d of op %d grew it by %d bytes, more than the overhead of %d",
+			seq, opNum, grown, c.encryptOverhead)
+	}
+	return out, nil
+}
+
+// decryptChunk decrypts a chunk's data with the configured DecryptFunc.
+func (c *config) decryptChunk(opNum uint64, seq uint32, data []byte) ([]byte, error) {
+	if c.decryptFunc == nil {
+		return nil, ErrNoDecryptFunc
+	}
+	out, err := c.decryptFunc(opNum, seq, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w %d of op %d: %v", ErrDecryption, seq, opNum, err)
+	}
+	return out, nil
+}
+
+// newDataKey generates a data key for an op, returning the AEAD to seal chunks
+// with along with the wrapped form of the key, which is read from r.
+func newDataKey(r io.Reader, kp KeyProvider) (cipher.AEAD, []byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, nil, fmt.Errorf("error generating data key: %w", err)
+	}
+	wrapped, err := kp.WrapKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error wrapping data key: %w", err)
+	}
+	if len(wrapped) == 0 {
+		return nil, nil, errors.New("key provider returned an empty wrapped key")
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, wrapped, nil
+}
+
+// unwrapDataKey returns the AEAD for a data key wrapped with the key keyID.
+func unwrapDataKey(conf *config, keyID string, wrapped []byte) (cipher.AEAD, error) {
+	kp := conf.keyProvider
+	if conf.keyRing != nil {
+		var err error
+		if kp, err = conf.keyRing.KeyProvider(keyID); err != nil {
+			return nil, fmt.Errorf("error looking up key %q: %w", keyID, err)
+		}
+	}
+	if kp == nil {
+		return nil, ErrNoKeyProvider
+	}
+	key, err := kp.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+	return newAEAD(key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating data key cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonceAndAAD derives the nonce and additional data for a chunk. Data
+// keys are never reused across ops, so the sequence number alone makes the
+// nonce unique; binding the op and sequence numbers as additional data
+// prevents chunks from being swapped around undetected.
+func chunkNonceAndAAD(aead cipher.AEAD, opNum uint64, seq uint32) ([]byte, []byte) {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce, seq)
+
+	aad := make([]byte, 12)
+	binary.BigEndian.PutUint64(aad, opNum)
+	binary.BigEndian.PutUint32(aad[8:], seq)
+	return nonce, aad
+}
+
+func sealChunk(aead cipher.AEAD, opNum uint64, seq uint32, data []byte) []byte {
+	nonce, aad := chunkNonceAndAAD(aead, opNum, seq)
+	return aead.Seal(nil, nonce, data, aad)
+}
+
+func openChunk(aead cipher.AEAD, opNum uint64, seq uint32, data []byte) ([]byte, error) {
+	nonce, aad := chunkNonceAndAAD(aead, opNum, seq)
+	plaintext, err := aead.Open(nil, nonce, data, aad)
+	if err != nil {
+		return nil, fmt.Errorf("%w %d of op %d: %v", ErrDecryption, seq, opNum, err)
+	}
+	return plaintext, nil
+}
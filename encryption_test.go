@@ -0,0 +1,323 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// testKeyProvider wraps keys by XORing them with a fixed pad; good enough to
+// check that wrapping happens in tests.
+type testKeyProvider struct {
+	pad []byte
+}
+
+func newTestKeyProvider(t *testing.T) *testKeyProvider {
+	pad := make([]byte, dataKeySize)
+	if _, err := rand.Read(pad); err != nil {
+		t.Fatal(err)
+	}
+	return &testKeyProvider{pad: pad}
+}
+
+func (k *testKeyProvider) WrapKey(key []byte) ([]byte, error) {
+	return k.xor(key)
+}
+
+func (k *testKeyProvider) UnwrapKey(wrapped []byte) ([]byte, error) {
+	return k.xor(wrapped)
+}
+
+func (k *testKeyProvider) xor(in []byte) ([]byte, error) {
+	if len(in) != len(k.pad) {
+		return nil, errors.New("bad key length")
+	}
+	out := make([]byte, len(in))
+	for i := range in {
+		out[i] = in[i] ^ k.pad[i]
+	}
+	return out, nil
+}
+
+func encryptedChunkData(t *testing.T, kp KeyProvider, opts ...Option) ([]byte, []*raft.Log) {
+	data := make([]byte, 3*ChunkSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []*raft.Log
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		logs = append(logs, &l)
+		return errorFuture{}
+	}
+	opts = append(opts, WithKeyProvider(kp))
+	if err := ChunkingApply(data, []byte("ext"), time.Second, applyFunc, opts...).Error(); err != nil {
+		t.Fatal(err)
+	}
+	return data, logs
+}
+
+func TestEncryption_FSM(t *testing.T) {
+	kp := newTestKeyProvider(t)
+	data, logs := encryptedChunkData(t, kp)
+
+	var raw []byte
+	for _, l := range logs {
+		if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+			t.Fatalf("log entry of %d bytes exceeds chunk size %d", size, ChunkSize)
+		}
+		var ci types.ChunkInfo
+		if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+			t.Fatal(err)
+		}
+		if len(ci.WrappedKey) == 0 {
+			t.Fatal("expected wrapped key on every chunk")
+		}
+		raw = append(raw, l.Data...)
+	}
+	if bytes.Contains(raw, data[:64]) {
+		t.Fatal("found plaintext in chunk data")
+	}
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithKeyProvider(kp))
+	var resp interface{}
+	for _, l := range logs {
+		resp = f.Apply(l)
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if diff := deep.Equal(data, m.logs[0]); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Without the key provider the op can't be decrypted
+	f = NewChunkingFSM(new(MockFSM), nil)
+	for _, l := range logs {
+		resp = f.Apply(l)
+	}
+	if err, ok := resp.(error); !ok || !errors.Is(err, ErrNoKeyProvider) {
+		t.Fatalf("expected missing key provider, got %#v", resp)
+	}
+
+	// Tampered data must be detected
+	l := *logs[1]
+	l.Data = append([]byte(nil), l.Data...)
+	l.Data[0] ^= 0xff
+	f = NewChunkingFSM(new(MockFSM), nil, WithKeyProvider(kp))
+	for _, log := range append([]*raft.Log{logs[0], &l}, logs[2:]...) {
+		resp = f.Apply(log)
+	}
+	if err, ok := resp.(error); !ok || !errors.Is(err, ErrDecryption) {
+		t.Fatalf("expected decryption error, got %#v", resp)
+	}
+}
+
+func TestEncryption_Reassembler(t *testing.T) {
+	kp := newTestKeyProvider(t)
+	data, logs := encryptedChunkData(t, kp)
+
+	var buf bytes.Buffer
+	r := NewReassembler(func(uint64) (io.Writer, error) {
+		return &buf, nil
+	}, WithKeyProvider(kp))
+	for _, l := range logs {
+		if _, err := r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := deep.Equal(data, buf.Bytes()); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+// testKeyRing maps key IDs to providers.
+type testKeyRing map[string]KeyProvider
+
+func (k testKeyRing) KeyProvider(keyID string) (KeyProvider, error) {
+	kp, ok := k[keyID]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	return kp, nil
+}
+
+func TestEncryption_KeyRing(t *testing.T) {
+	oldKP, newKP := newTestKeyProvider(t), newTestKeyProvider(t)
+	oldData, oldLogs := encryptedChunkData(t, oldKP, WithKeyID("old"))
+	newData, newLogs := encryptedChunkData(t, newKP, WithKeyID("new"))
+
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(newLogs[0].Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if ci.KeyId != "new" {
+		t.Fatalf("expected key ID to be recorded, got %q", ci.KeyId)
+	}
+
+	// An op under the old key can still be reassembled after rotating
+	ring := testKeyRing{"old": oldKP, "new": newKP}
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithKeyRing(ring))
+	for _, logs := range [][]*raft.Log{oldLogs, newLogs} {
+		for _, l := range logs {
+			if err, ok := f.Apply(l).(error); ok {
+				t.Fatal(err)
+			}
+		}
+	}
+	if diff := deep.Equal([][]byte{oldData, newData}, m.logs); diff != nil {
+		t.Fatal(diff)
+	}
+
+	var buf bytes.Buffer
+	r := NewReassembler(func(uint64) (io.Writer, error) { return &buf, nil }, WithKeyRing(ring))
+	for _, l := range oldLogs {
+		if _, err := r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), oldData) {
+		t.Fatal("reassembled data does not match")
+	}
+
+	// Once the old key has been retired its ops can't be decrypted
+	f = NewChunkingFSM(new(MockFSM), nil, WithKeyRing(testKeyRing{"new": newKP}))
+	var resp interface{}
+	for _, l := range oldLogs {
+		resp = f.Apply(l)
+	}
+	if err, ok := resp.(error); !ok || !strings.Contains(err.Error(), `key "old"`) {
+		t.Fatalf("expected unknown key error, got %#v", resp)
+	}
+}
+
+// xorCipher is a toy EncryptFunc/DecryptFunc pair that XORs chunk data with a
+// pad and appends the sequence number, which decryption checks.
+type xorCipher struct {
+	pad byte
+}
+
+func (x xorCipher) encrypt(opNum uint64, seq uint32, data []byte) ([]byte, error) {
+	out := make([]byte, len(data), len(data)+1)
+	for i := range data {
+		out[i] = data[i] ^ x.pad
+	}
+	return append(out, byte(seq)), nil
+}
+
+func (x xorCipher) decrypt(opNum uint64, seq uint32, data []byte) ([]byte, error) {
+	if len(data) == 0 || data[len(data)-1] != byte(seq) {
+		return nil, errors.New("chunk is out of place")
+	}
+	out := make([]byte, len(data)-1)
+	for i := range out {
+		out[i] = data[i] ^ x.pad
+	}
+	return out, nil
+}
+
+func TestEncryption_EncryptFunc(t *testing.T) {
+	if fipsBuild {
+		t.Skip("encrypt funcs not available in FIPS builds")
+	}
+	x := xorCipher{pad: 0x5a}
+	kp := newTestKeyProvider(t)
+	for name, opts := range map[string][]Option{
+		"hooks only":   nil,
+		"key provider": {WithKeyProvider(kp)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, 3*ChunkSize+100)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+			logs, err := SplitIntoLogs(data, nil, append(opts, WithEncryptFunc(x.encrypt, 1))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range logs {
+				if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+					t.Fatalf("log entry of %d bytes exceeds chunk size %d", size, ChunkSize)
+				}
+				var ci types.ChunkInfo
+				if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+					t.Fatal(err)
+				}
+				if !ci.Encrypted {
+					t.Fatal("expected every chunk to be marked encrypted")
+				}
+			}
+
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil, append(opts, WithDecryptFunc(x.decrypt))...)
+			var resp interface{}
+			for i := range logs {
+				resp = f.Apply(&logs[i])
+			}
+			if _, ok := resp.(ChunkingSuccess); !ok {
+				t.Fatalf("expected success, got %#v", resp)
+			}
+			if !bytes.Equal(data, m.logs[0]) {
+				t.Fatal("reassembled data does not match")
+			}
+
+			var buf bytes.Buffer
+			r := NewReassembler(func(uint64) (io.Writer, error) { return &buf, nil }, append(opts, WithDecryptFunc(x.decrypt))...)
+			for i := range logs {
+				if _, err := r.Add(&logs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(buf.Bytes(), data) {
+				t.Fatal("reassembled data does not match")
+			}
+
+			// Without a decrypt func the op can't be decrypted
+			f = NewChunkingFSM(new(MockFSM), nil, opts...)
+			for i := range logs {
+				resp = f.Apply(&logs[i])
+			}
+			if err, ok := resp.(error); !ok || !errors.Is(err, ErrNoDecryptFunc) {
+				t.Fatalf("expected missing decrypt func, got %#v", resp)
+			}
+			r = NewReassembler(func(uint64) (io.Writer, error) { return io.Discard, nil }, opts...)
+			if _, err := r.Add(&logs[0]); !errors.Is(err, ErrNoDecryptFunc) {
+				t.Fatalf("expected missing decrypt func, got %v", err)
+			}
+
+			// Decryption failures fail the op
+			swapped := append([]raft.Log(nil), logs...)
+			swapped[0].Data, swapped[1].Data = logs[1].Data, logs[0].Data
+			f = NewChunkingFSM(new(MockFSM), nil, append(opts, WithDecryptFunc(x.decrypt))...)
+			for i := range swapped {
+				resp = f.Apply(&swapped[i])
+			}
+			if err, ok := resp.(error); !ok || !errors.Is(err, ErrDecryption) {
+				t.Fatalf("expected decryption error, got %#v", resp)
+			}
+		})
+	}
+
+	// Encryption errors, and growth beyond the given overhead, fail the op
+	failing := func(uint64, uint32, []byte) ([]byte, error) { return nil, errors.New("sealed") }
+	if _, err := SplitIntoLogs([]byte("data"), nil, WithEncryptFunc(failing, 0)); err == nil || !strings.Contains(err.Error(), "sealed") {
+		t.Fatalf("expected encryption error, got %v", err)
+	}
+	if _, err := SplitIntoLogs([]byte("data"), nil, WithEncryptFunc(x.encrypt, 0)); err == nil {
+		t.Fatal("expected growth beyond the overhead to fail")
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// WithEntropy makes ChunkingApply, SplitIntoLogs and Reserve read the random
+// bytes for op nums and data keys from r rather than from crypto/rand, so
+// that environments with their own approved random number generator can route
+// generation through it, and tests can be made deterministic. Op nums only
+// have to be unique among ops in flight, but data keys are only as strong as
+// r, so it must be a cryptographically secure source when used with
+// WithKeyProvider. It is ignored by the FSM.
+func WithEntropy(r io.Reader) Option {
+	return func(c *config) {
+		c.entropy = r
+	}
+}
+
+// random returns the source of random bytes, crypto/rand unless set with
+// WithEntropy.
+func (c *config) random() io.Reader {
+	if c.entropy != nil {
+		return c.entropy
+	}
+	return rand.Reader
+}
@@ -0,0 +1,76 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestWithEntropy(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// Op nums are read from the source
+	seed := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	data := make([]byte, 2*ChunkSize)
+	future := ChunkingApply(data, nil, time.Second, applyFunc, WithEntropy(iotest.OneByteReader(bytes.NewReader(seed)))).(ChunkingFuture)
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if future.OpNum() != binary.BigEndian.Uint64(seed) {
+		t.Fatalf("expected op num %d from the entropy source, got %d", binary.BigEndian.Uint64(seed), future.OpNum())
+	}
+	discard := func(raft.Log, time.Duration) raft.ApplyFuture { return appliedFuture{} }
+	if opNum, _ := Reserve(10, time.Second, discard, WithEntropy(bytes.NewReader(seed))); opNum != binary.BigEndian.Uint64(seed) {
+		t.Fatalf("expected reserved op num %d from the entropy source, got %d", binary.BigEndian.Uint64(seed), opNum)
+	}
+
+	// Data keys are read from it too, after the op num
+	kp := newTestKeyProvider(t)
+	entropy := bytes.Repeat(seed, 5)
+	a, err := SplitIntoLogs(data, nil, WithKeyProvider(kp), WithEntropy(bytes.NewReader(entropy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SplitIntoLogs(data, nil, WithKeyProvider(kp), WithEntropy(bytes.NewReader(entropy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range a {
+		if !bytes.Equal(a[i].Data, b[i].Data) {
+			t.Fatalf("expected chunk %d to be sealed alike from the same entropy", i)
+		}
+	}
+	if _, err := SplitIntoLogs(data, nil, WithKeyProvider(kp), WithEntropy(bytes.NewReader(seed))); err == nil {
+		t.Fatal("expected an exhausted source to fail data key generation")
+	}
+
+	// Failing and short sources fail the op
+	for _, tc := range []struct {
+		r   io.Reader
+		err error
+	}{
+		{r: bytes.NewReader(nil), err: ErrShortRead},
+		{r: bytes.NewReader(seed[:3]), err: ErrShortRead},
+		{r: iotest.ErrReader(errors.New("no entropy")), err: ErrOpIDGeneration},
+	} {
+		if err := ChunkingApply(data, nil, time.Second, applyFunc, WithEntropy(tc.r)).Error(); !errors.Is(err, tc.err) {
+			t.Fatalf("expected %v, got %v", tc.err, err)
+		}
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected only the first op to be applied, got %d", len(m.logs))
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// Sentinel errors that failures are wrapped around, so that they can be told
+// apart with errors.Is. Errors particular to a feature, such as
+// ErrChecksumMismatch, are defined alongside it.
+var (
+	// ErrNotChunk is returned when a log that was expected to be a chunk
+	// isn't one.
+	ErrNotChunk = errors.New("log is not a chunk")
+
+	// ErrChunkInfoUnmarshal is returned when a chunk's header can't be read
+	// from its log's extensions.
+	ErrChunkInfoUnmarshal = errors.New("error unmarshaling chunk info")
+
+	// ErrOpIDGeneration is returned when a random op number can't be
+	// generated for a new op.
+	ErrOpIDGeneration = errors.New("error generating op num")
+
+	// ErrShortRead is returned when fewer bytes than expected could be read,
+	// such as from the random source or the payload being split.
+	ErrShortRead = errors.New("short read")
+
+	// ErrInvalidChunkSize is returned when a chunk size is out of range or
+	// too small to hold a chunk.
+	ErrInvalidChunkSize = errors.New("invalid chunk size")
+
+	// ErrPayloadTooLarge is returned when a payload is larger than the
+	// limit set with WithMaxPayloadSize.
+	ErrPayloadTooLarge = errors.New("payload too large")
+
+	// ErrInvalidResumeToken is returned by ChunkingResume when the token
+	// can't be used for the payload it was given.
+	ErrInvalidResumeToken = errors.New("invalid resume token")
+
+	// ErrNoKeyProvider is returned when chunk data is encrypted but no key
+	// provider or key ring is configured to decrypt it.
+	ErrNoKeyProvider = errors.New("chunk data is encrypted but no key provider is configured")
+
+	// ErrNoDecryptFunc is returned when chunk data was encrypted with an
+	// EncryptFunc but no DecryptFunc is configured to decrypt it.
+	ErrNoDecryptFunc = errors.New("chunk data is encrypted but no decrypt func is configured")
+
+	// ErrDecryption is returned when a chunk fails to decrypt, such as when
+	// it was tampered with or encrypted with a different key.
+	ErrDecryption = errors.New("error decrypting chunk")
+
+	// ErrDecompression is returned when a compressed payload fails to
+	// decompress.
+	ErrDecompression = errors.New("error decompressing payload")
+
+	// ErrInvalidSequenceNum is returned for a malformed chunk whose
+	// sequence number isn't below its op's number of chunks.
+	ErrInvalidSequenceNum = errors.New("chunk sequence number out of range")
+
+	// ErrTooManyChunks is returned for a chunk of an op with more chunks
+	// than allowed by WithMaxChunks.
+	ErrTooManyChunks = errors.New("op has too many chunks")
+)
+
+// checkChunkBounds returns an error if a chunk's sequence number is out of
+// range for its op, as only a malformed log could have it, or if the op has
+// more chunks than the configured limit.
+func checkChunkBounds(ci *types.ChunkInfo, conf *config) error {
+	if ci.SequenceNum >= ci.NumChunks {
+		return fmt.Errorf("op %d: chunk %d of %d: %w", ci.OpNum, ci.SequenceNum, ci.NumChunks, ErrInvalidSequenceNum)
+	}
+	if max := conf.chunkLimit(); max > 0 && ci.NumChunks > max {
+		return fmt.Errorf("op %d: %d chunks exceeds the limit of %d: %w", ci.OpNum, ci.NumChunks, max, ErrTooManyChunks)
+	}
+	return nil
+}
+
+// ChunkError is the error from applying a single chunk of an op.
+type ChunkError struct {
+	// Chunk is the position of the chunk's future in MultiFuture.Futures
+	Chunk int
+
+	Err error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d: %v", e.Chunk, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// ChunkErrors is returned from the Error of the futures from ChunkingApply,
+// ChunkingResume and ChunkingApplyWithLogs when an op fails. It holds the
+// error of every failed chunk rather than just the first, so that it can be
+// told whether one chunk failed or many, and for what reasons, and how far
+// the op got before failing. errors.Is and errors.As match against any of the
+// errors it holds.
+type ChunkErrors struct {
+	// OpNum is the op's number, for matching against the FSM's reports of
+	// orphaned ops, or zero if it isn't known
+	OpNum uint64
+
+	// Submitted is the number of chunks handed to the apply function, and
+	// Committed the number of the op's chunks known to be committed,
+	// including those committed before a ChunkingResume
+	Submitted int
+	Committed int
+
+	// Errors holds the errors of the submitted chunks that failed, in order
+	Errors []*ChunkError
+
+	// Unsent is the number of chunks that weren't submitted because the op
+	// had already failed, and UnsentErr the reason, such as ErrOpTimeout
+	Unsent    int
+	UnsentErr error
+}
+
+func (e *ChunkErrors) Error() string {
+	var parts []string
+	for _, err := range e.Errors {
+		parts = append(parts, err.Error())
+	}
+	if e.Unsent > 0 {
+		parts = append(parts, fmt.Sprintf("%d not sent: %v", e.Unsent, e.UnsentErr))
+	}
+	msg := fmt.Sprintf("%d of the op's chunks failed after %d were committed: %s", len(e.Errors)+e.Unsent, e.Committed, strings.Join(parts, "; "))
+	if e.OpNum != 0 {
+		msg = fmt.Sprintf("op %d: %s", e.OpNum, msg)
+	}
+	return msg
+}
+
+// Is returns whether any of the errors is target.
+func (e *ChunkErrors) Is(target error) bool {
+	for _, err := range e.errors() {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target.
+func (e *ChunkErrors) As(target interface{}) bool {
+	for _, err := range e.errors() {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *ChunkErrors) errors() []error {
+	errs := make([]error, 0, len(e.Errors)+1)
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	if e.Unsent > 0 {
+		errs = append(errs, e.UnsentErr)
+	}
+	return errs
+}
+
+// ErrorClass says whether an op that failed with an error is worth retrying,
+// and where, as given by ClassifyError.
+type ErrorClass int
+
+const (
+	// ErrorClassNone is the class of a nil error.
+	ErrorClassNone ErrorClass = iota
+
+	// ErrorClassTransient means the node was too busy to take the op in
+	// time, as with raft.ErrEnqueueTimeout, ErrOpTimeout or ErrClientLimit.
+	// The op can be retried on the same node after backing off.
+	ErrorClassTransient
+
+	// ErrorClassLeadership means the node wasn't, or stopped being, the
+	// leader. The op can be retried, or resumed, on the new leader, as
+	// WithLeadershipRetry does.
+	ErrorClassLeadership
+
+	// ErrorClassShutdown means raft has shut down on the node, so the op
+	// can only be retried elsewhere.
+	ErrorClassShutdown
+
+	// ErrorClassFatal means the op itself was at fault or was rejected by
+	// the FSM, such as with ErrChecksumMismatch or ErrPayloadTooLarge, so
+	// retrying it as it is won't help. Errors that aren't recognized are
+	// taken to be fatal.
+	ErrorClassFatal
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassNone:
+		return "none"
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassLeadership:
+		return "leadership"
+	case ErrorClassShutdown:
+		return "shutdown"
+	case ErrorClassFatal:
+		return "fatal"
+	default:
+		return fmt.Sprintf("ErrorClass(%d)", int(c))
+	}
+}
+
+// Retryable returns whether an op that failed with an error of the class can
+// be retried from the same client.
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorClassLeadership || c == ErrorClassTransient
+}
+
+// ClassifyError returns the class of an error returned from the Error of a
+// chunking future, or given as its Response by the FSM, so that callers can
+// decide whether to retry without matching on raft's error messages. When a
+// *ChunkErrors holds errors of several classes the least retryable wins: fatal
+// over shutdown, shutdown over leadership and leadership over transient.
+func ClassifyError(err error) ErrorClass {
+	var errs *ChunkErrors
+	if errors.As(err, &errs) {
+		class := ErrorClassNone
+		for _, err := range errs.errors() {
+			if c := ClassifyError(err); c > class {
+				class = c
+			}
+		}
+		return class
+	}
+
+	switch {
+	case err == nil:
+		return ErrorClassNone
+	case errors.Is(err, raft.ErrRaftShutdown):
+		return ErrorClassShutdown
+	case isLeadershipError(err):
+		return ErrorClassLeadership
+	case errors.Is(err, raft.ErrEnqueueTimeout), errors.Is(err, ErrOpTimeout), errors.Is(err, ErrClientLimit):
+		return ErrorClassTransient
+	default:
+		return ErrorClassFatal
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestChunkErrors(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every failed chunk is reported, not just the first
+	var applied int
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		applied++
+		switch applied {
+		case 2:
+			return errorFuture{err: raft.ErrEnqueueTimeout}
+		case 4:
+			return errorFuture{err: &NotLeaderError{Err: raft.ErrLeadershipLost}}
+		}
+		return errorFuture{}
+	}
+	future := ChunkingApply(data, nil, time.Second, applyFunc).(ChunkingFuture)
+	err := future.Error()
+	var errs *ChunkErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected chunk errors, got %v", err)
+	}
+	if len(errs.Errors) != 2 || errs.Errors[0].Chunk != 1 || errs.Errors[1].Chunk != 3 || errs.Unsent != 0 {
+		t.Fatalf("unexpected chunk errors %v", err)
+	}
+	if errs.OpNum != future.OpNum() || errs.Submitted != 4 || errs.Committed != 2 {
+		t.Fatalf("expected op %d with 4 chunks submitted and 2 committed, got %d with %d and %d", future.OpNum(), errs.OpNum, errs.Submitted, errs.Committed)
+	}
+	if !errors.Is(err, raft.ErrEnqueueTimeout) || !errors.Is(err, raft.ErrLeadershipLost) {
+		t.Fatalf("expected both chunk errors to match, got %v", err)
+	}
+	var nle *NotLeaderError
+	if !errors.As(err, &nle) {
+		t.Fatalf("expected leadership error, got %v", err)
+	}
+	if errors.Is(err, ErrOpTimeout) {
+		t.Fatal("unexpected match")
+	}
+
+	// Chunks that aren't sent are counted along with the reason
+	applied = 0
+	future = ChunkingApply(data, nil, time.Second, applyFunc, WithSequentialApply()).(ChunkingFuture)
+	err = future.Error()
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected chunk errors, got %v", err)
+	}
+	if len(errs.Errors) != 1 || errs.Unsent != 2 || errs.UnsentErr != raft.ErrEnqueueTimeout {
+		t.Fatalf("unexpected chunk errors %v", err)
+	}
+	if errs.Submitted != 2 || errs.Committed != 1 {
+		t.Fatalf("expected 2 chunks submitted and 1 committed, got %d and %d", errs.Submitted, errs.Committed)
+	}
+	expected := fmt.Sprintf("op %d: 3 of the op's chunks failed after 1 were committed: chunk 1: timed out enqueuing operation; 2 not sent: timed out enqueuing operation", future.OpNum())
+	if err.Error() != expected {
+		t.Fatalf("unexpected message %q", err.Error())
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		return errorFuture{}
+	}
+	logs, err := SplitIntoLogs([]byte("foo"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbled := logs[0]
+	garbled.Extensions = []byte{0xff}
+
+	for _, tc := range []struct {
+		target error
+		err    error
+	}{
+		{ErrNotChunk, ChunkingApplyWithLogs([]raft.Log{{Type: raft.LogCommand}}, time.Second, applyFunc).Error()},
+		{ErrChunkInfoUnmarshal, ChunkingApplyWithLogs([]raft.Log{garbled}, time.Second, applyFunc).Error()},
+		{ErrInvalidChunkSize, ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithChunkSize(-1)).Error()},
+		{ErrPayloadTooLarge, ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithMaxPayloadSize(2)).Error()},
+		{ErrInvalidResumeToken, ChunkingResume([]byte("foo"), nil, []byte("garbage"), time.Second, applyFunc).Error()},
+	} {
+		if !errors.Is(tc.err, tc.target) {
+			t.Fatalf("expected %v, got %v", tc.target, tc.err)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	failWith := func(errs ...error) error {
+		var chunk int
+		applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+			defer func() { chunk++ }()
+			if chunk < len(errs) && errs[chunk] != nil {
+				return errorFuture{err: errs[chunk]}
+			}
+			return errorFuture{}
+		}
+		return ChunkingApply(data, nil, time.Second, applyFunc).Error()
+	}
+
+	for _, tc := range []struct {
+		err       error
+		class     ErrorClass
+		retryable bool
+	}{
+		{nil, ErrorClassNone, false},
+		{failWith(), ErrorClassNone, false},
+		{failWith(nil, raft.ErrEnqueueTimeout), ErrorClassTransient, true},
+		{failWith(&NotLeaderError{Err: raft.ErrNotLeader}), ErrorClassLeadership, true},
+		{failWith(raft.ErrEnqueueTimeout, raft.ErrLeadershipLost), ErrorClassLeadership, true},
+		{failWith(raft.ErrLeadershipLost, raft.ErrRaftShutdown), ErrorClassShutdown, false},
+		{fmt.Errorf("client %q: %w", "c", ErrClientLimit), ErrorClassTransient, true},
+		{ChunkingApply(data, nil, time.Second, nil, WithMaxPayloadSize(1)).Error(), ErrorClassFatal, false},
+		{fmt.Errorf("op 1: %w", ErrChecksumMismatch), ErrorClassFatal, false},
+		{errors.New("something else"), ErrorClassFatal, false},
+	} {
+		class := ClassifyError(tc.err)
+		if class != tc.class || class.Retryable() != tc.retryable {
+			t.Fatalf("%v: expected %v, got %v", tc.err, tc.class, class)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultExtensionsNamespace is the namespace ID suggested for chunk headers
+// when sharing log extensions with WithExtensionsNamespace.
+const DefaultExtensionsNamespace uint32 = 1
+
+// Extensions maps namespace IDs to data, letting several libraries share
+// raft.Log.Extensions without having to understand each other's formats. Each
+// library reads and writes only its own namespace and carries the others
+// through untouched. Use ParseExtensions and Marshal to convert to and from
+// the encoded form.
+type Extensions map[uint32][]byte
+
+// ParseExtensions decodes log extensions written with Extensions.Marshal. Nil
+// or empty input gives empty Extensions.
+func ParseExtensions(b []byte) (Extensions, error) {
+	var env types.ExtensionsEnvelope
+	if err := proto.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("error unmarshaling extensions envelope: %w", err)
+	}
+	if env.Namespaces == nil {
+		return Extensions{}, nil
+	}
+	return Extensions(env.Namespaces), nil
+}
+
+// Marshal encodes the extensions for use in raft.Log.Extensions. The encoding
+// is deterministic. Empty extensions encode to nil.
+func (e Extensions) Marshal() ([]byte, error) {
+	if len(e) == 0 {
+		return nil, nil
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(&types.ExtensionsEnvelope{Namespaces: e})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling extensions envelope: %w", err)
+	}
+	return b, nil
+}
+
+// WithExtensionsNamespace makes chunk headers travel under namespace ns of an
+// Extensions envelope rather than being the whole of each log's extensions,
+// so that chunking can coexist with other libraries that use them. It must
+// be given to both ChunkingApply and the FSM.
+//
+// ChunkingApply then expects the extensions it is given to be an encoded
+// Extensions (or nil) not using ns, and includes the other namespaces in
+// every chunk's extensions. The FSM treats only logs that have ns as chunks;
+// all others are passed through as they are. A reassembled log is given the
+// final chunk's extensions without ns.
+func WithExtensionsNamespace(ns uint32) Option {
+	return func(c *config) {
+		c.extensionsNamespace = ns
+	}
+}
+
+// WithChunkExtensions makes ChunkingApply carry ext in the header of every
+// chunk, separately from the extensions that are handed on with the
+// reassembled op, which only travel with the final chunk. It is for
+// middleware that works on individual log entries and needs context before
+// the op is reassembled; such middleware reads it back with ChunkExtensions.
+// It is ignored by the FSM.
+func WithChunkExtensions(ext []byte) Option {
+	return func(c *config) {
+		c.chunkExtensions = ext
+	}
+}
+
+// ChunkExtensions returns the blob given with WithChunkExtensions from a chunk
+// log, or nil if there is none. It returns an error wrapping ErrNotChunk if
+// the log isn't a chunk. Options are interpreted as for the FSM, so the
+// extensions namespace, if any, must be given.
+func ChunkExtensions(l *raft.Log, opts ...Option) ([]byte, error) {
+	conf := newConfig(opts)
+	if !conf.isChunk(l) {
+		return nil, ErrNotChunk
+	}
+	var ci types.ChunkInfo
+	if err := conf.unmarshalChunkInfo(l.Extensions, &ci); err != nil {
+		return nil, err
+	}
+	return ci.ChunkExtensions, nil
+}
+
+// otherExtensions parses the extensions given to ChunkingApply when an
+// extensions namespace is in use.
+func (c *config) otherExtensions(extensions []byte) (Extensions, error) {
+	if c.extensionsNamespace == 0 {
+		return nil, nil
+	}
+	others, err := ParseExtensions(extensions)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := others[c.extensionsNamespace]; ok {
+		return nil, fmt.Errorf("extensions already use namespace %d", c.extensionsNamespace)
+	}
+	return others, nil
+}
+
+// chunkExtensionsSize returns the encoded size of the extensions for a chunk
+// with the given header, without encoding them.
+func (c *config) chunkExtensionsSize(ci *types.ChunkInfo, others Extensions) int {
+	if c.extensionsNamespace == 0 {
+		return proto.Size(ci)
+	}
+	env := &types.ExtensionsEnvelope{Namespaces: make(map[uint32][]byte, len(others)+1)}
+	for ns, data := range others {
+		env.Namespaces[ns] = data
+	}
+	env.Namespaces[c.extensionsNamespace] = make([]byte, proto.Size(ci))
+	return proto.Size(env)
+}
+
+// marshalChunkExtensions encodes the extensions for a chunk with the given
+// header.
+func (c *config) marshalChunkExtensions(ci *types.ChunkInfo, others Extensions, bufs *bufferSet) ([]byte, error) {
+	var buf []byte
+	if c.extensionsNamespace == 0 {
+		buf = bufs.header(proto.Size(ci))
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.MarshalAppend(buf, ci)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling chunk info: %w", err)
+	}
+	if c.extensionsNamespace == 0 {
+		return b, nil
+	}
+	ext := make(Extensions, len(others)+1)
+	for ns, data := range others {
+		ext[ns] = data
+	}
+	ext[c.extensionsNamespace] = b
+	return ext.Marshal()
+}
+
+// isChunk returns whether a log holds a chunk.
+func (c *config) isChunk(l *raft.Log) bool {
+	if l.Type != raft.LogCommand || l.Extensions == nil {
+		return false
+	}
+	if c.extensionsNamespace == 0 {
+		return true
+	}
+	ext, err := ParseExtensions(l.Extensions)
+	if err != nil {
+		return false
+	}
+	_, ok := ext[c.extensionsNamespace]
+	return ok
+}
+
+// unmarshalChunkInfo reads the chunk header from a chunk log's extensions.
+// When an extensions namespace is in use, the other namespaces are put back
+// together in ci.NextExtensions so that they are handed on with the op.
+func (c *config) unmarshalChunkInfo(extensions []byte, ci *types.ChunkInfo) error {
+	if c.extensionsNamespace == 0 {
+		if err := proto.Unmarshal(extensions, ci); err != nil {
+			return fmt.Errorf("%w: %v", ErrChunkInfoUnmarshal, err)
+		}
+		return nil
+	}
+
+	ext, err := ParseExtensions(extensions)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrChunkInfoUnmarshal, err)
+	}
+	data, ok := ext[c.extensionsNamespace]
+	if !ok {
+		return fmt.Errorf("%w: extensions have no namespace %d", ErrChunkInfoUnmarshal, c.extensionsNamespace)
+	}
+	if err := proto.Unmarshal(data, ci); err != nil {
+		return fmt.Errorf("%w: %v", ErrChunkInfoUnmarshal, err)
+	}
+	delete(ext, c.extensionsNamespace)
+	ci.NextExtensions, err = ext.Marshal()
+	return err
+}
@@ -0,0 +1,238 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// extensionsFSM records the logs it is given.
+type extensionsFSM struct {
+	logs []*raft.Log
+}
+
+func (e *extensionsFSM) Apply(l *raft.Log) interface{} {
+	e.logs = append(e.logs, l)
+	return nil
+}
+
+func (e *extensionsFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return nil, nil
+}
+
+func (e *extensionsFSM) Restore(io.ReadCloser) error {
+	return nil
+}
+
+func TestExtensions_Marshal(t *testing.T) {
+	ext := Extensions{1: []byte("foo"), 7: []byte("bar")}
+	b, err := ext.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseExtensions(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(ext, parsed); diff != nil {
+		t.Fatal(diff)
+	}
+
+	if b, err := (Extensions{}).Marshal(); err != nil || b != nil {
+		t.Fatalf("expected nil encoding of empty extensions, got %v, %v", b, err)
+	}
+	if parsed, err := ParseExtensions(nil); err != nil || len(parsed) != 0 {
+		t.Fatalf("expected empty extensions, got %v, %v", parsed, err)
+	}
+}
+
+func TestExtensions_Namespace(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	const traceNamespace = 7
+	others, err := Extensions{traceNamespace: []byte("trace-id")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := WithExtensionsNamespace(DefaultExtensionsNamespace)
+
+	logs, err := SplitIntoLogs(data, others, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range logs {
+		if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+			t.Fatalf("log entry of %d bytes exceeds chunk size %d", size, ChunkSize)
+		}
+		ext, err := ParseExtensions(l.Extensions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ext[traceNamespace], []byte("trace-id")) || ext[DefaultExtensionsNamespace] == nil {
+			t.Fatalf("unexpected chunk extensions %v", ext)
+		}
+	}
+
+	m := new(extensionsFSM)
+	f := NewChunkingFSM(m, nil, opt)
+
+	// Logs with an envelope that has no chunk header pass straight through
+	plain := &raft.Log{Type: raft.LogCommand, Data: []byte("plain"), Extensions: others}
+	f.Apply(plain)
+
+	var resp interface{}
+	for i := range logs {
+		resp = f.Apply(&logs[i])
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if len(m.logs) != 2 || m.logs[0] != plain {
+		t.Fatalf("expected plain log and reassembled op, got %d logs", len(m.logs))
+	}
+	if diff := deep.Equal(data, m.logs[1].Data); diff != nil {
+		t.Fatal(diff)
+	}
+	if diff := deep.Equal(others, m.logs[1].Extensions); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// Submitting the logs checks them in the same way
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		return errorFuture{}
+	}
+	if err := ChunkingApplyWithLogs(logs, time.Second, applyFunc, opt).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller can't use the chunking namespace itself
+	taken, err := Extensions{DefaultExtensionsNamespace: []byte("x")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SplitIntoLogs(data, taken, opt); err == nil {
+		t.Fatal("expected error for extensions using the chunking namespace")
+	}
+}
+
+func TestChunkExtensions(t *testing.T) {
+	others, err := (Extensions{7: []byte("other")}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tc := range map[string]struct {
+		ext  []byte
+		opts []Option
+	}{
+		"plain":     {[]byte("final"), nil},
+		"namespace": {others, []Option{WithExtensionsNamespace(DefaultExtensionsNamespace)}},
+	} {
+		data := make([]byte, 3*ChunkSize)
+		logs, err := SplitIntoLogs(data, tc.ext, append(tc.opts, WithChunkExtensions([]byte("per-chunk")))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range logs {
+			if size := len(logs[i].Data) + len(logs[i].Extensions); size > ChunkSize {
+				t.Fatalf("%s: log entry of %d bytes exceeds chunk size %d", name, size, ChunkSize)
+			}
+			got, err := ChunkExtensions(&logs[i], tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "per-chunk" {
+				t.Fatalf("%s: expected chunk extensions on chunk %d, got %q", name, i, got)
+			}
+		}
+
+		// They aren't handed on with the op
+		m := new(extensionsFSM)
+		f := NewChunkingFSM(m, nil, tc.opts...)
+		for i := range logs {
+			f.Apply(&logs[i])
+		}
+		if len(m.logs) != 1 || !bytes.Equal(m.logs[0].Extensions, tc.ext) {
+			t.Fatalf("%s: expected only the op's extensions to be handed on, got %#v", name, m.logs)
+		}
+	}
+
+	if _, err := ChunkExtensions(&raft.Log{Type: raft.LogCommand}); !errors.Is(err, ErrNotChunk) {
+		t.Fatalf("expected ErrNotChunk, got %v", err)
+	}
+}
+
+func TestExtensions_Large(t *testing.T) {
+	ext := make([]byte, 2*ChunkSize+100)
+	if _, err := rand.Read(ext); err != nil {
+		t.Fatal(err)
+	}
+	kp := newTestKeyProvider(t)
+	for name, data := range map[string][]byte{
+		"large payload": bytes.Repeat([]byte("data"), ChunkSize),
+		"small payload": []byte("data"),
+	} {
+		opts := append([]Option{WithKeyProvider(kp), WithHashAlgorithm(HashSHA256)}, withChunkChecksums()...)
+		logs, err := SplitIntoLogs(data, ext, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range logs {
+			if size := len(logs[i].Data) + len(logs[i].Extensions); size > ChunkSize {
+				t.Fatalf("%s: log entry of %d bytes exceeds chunk size %d", name, size, ChunkSize)
+			}
+		}
+
+		m := new(extensionsFSM)
+		f := NewChunkingFSM(m, nil, WithKeyProvider(kp))
+		var resp interface{}
+		for i := range logs {
+			resp = f.Apply(&logs[i])
+		}
+		if _, ok := resp.(ChunkingSuccess); !ok {
+			t.Fatalf("%s: expected success, got %#v", name, resp)
+		}
+		if len(m.logs) != 1 || !bytes.Equal(m.logs[0].Data, data) || !bytes.Equal(m.logs[0].Extensions, ext) {
+			t.Fatalf("%s: expected op and its extensions to be reassembled, got %d logs", name, len(m.logs))
+		}
+
+		var buf bytes.Buffer
+		r := NewReassembler(func(uint64) (io.Writer, error) {
+			return &buf, nil
+		}, WithKeyProvider(kp))
+		var op *ReassembledOp
+		for i := range logs {
+			if op, err = r.Add(&logs[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if op == nil || !bytes.Equal(buf.Bytes(), data) || !bytes.Equal(op.Extensions, ext) || op.Size != uint64(len(data)) {
+			t.Fatalf("%s: expected reassembler to separate the extensions, got %#v", name, op)
+		}
+	}
+
+	// Extensions that fit are still carried in the final chunk's header
+	logs, err := SplitIntoLogs(make([]byte, 3*ChunkSize), []byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(logs[len(logs)-1].Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if ci.ExtensionsChunks != 0 || string(ci.NextExtensions) != "small" {
+		t.Fatalf("expected small extensions in the final header, got %d chunks and %q", ci.ExtensionsChunks, ci.NextExtensions)
+	}
+}
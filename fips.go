@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/go-raftchunking/types"
+)
+
+// WithFIPSMode restricts integrity checks and encryption to FIPS-approved
+// algorithms: only HashSHA256 (or no hash at all) is accepted, chunk
+// checksums, which are CRC-32C, are not allowed, and chunk data is only
+// encrypted with AES-GCM, by a KeyProvider's data keys. Since the cipher
+// behind an EncryptFunc or DecryptFunc can't be vetted, they are not allowed
+// either. On the apply side non-compliant options cause ChunkingApply to
+// fail; on the FSM side chunks using a non-compliant algorithm or carrying a
+// checksum, and all chunks if a DecryptFunc is given, are rejected. Building
+// with the fips tag enables this mode unconditionally.
+func WithFIPSMode() Option {
+	return func(c *config) {
+		c.fips = true
+	}
+}
+
+// fipsApproved reports whether the algorithm may be used in FIPS mode.
+func (h HashAlgorithm) fipsApproved() bool {
+	switch h {
+	case HashNone, HashSHA256:
+		return true
+	default:
+		return false
+	}
+}
+
+// checkFIPS returns an error if FIPS mode is enabled and the hash algorithm is
+// not approved, or custom encryption is configured. Data keys always use
+// AES-GCM so they need no checks.
+func (c *config) checkFIPS(alg HashAlgorithm) error {
+	if !c.fips && !fipsBuild {
+		return nil
+	}
+	switch {
+	case !alg.fipsApproved():
+		return fmt.Errorf("hash algorithm %v is not allowed in FIPS mode", alg)
+	case c.encryptFunc != nil:
+		return errors.New("encrypt funcs are not allowed in FIPS mode")
+	case c.decryptFunc != nil:
+		return errors.New("decrypt funcs are not allowed in FIPS mode")
+	case c.chunkChecksums:
+		return errChunkChecksumFIPS
+	}
+	return nil
+}
+
+// errChunkChecksumFIPS is returned for chunk checksums in FIPS mode. They are
+// CRC-32C, which is no more approved for checking chunks than for checking
+// payloads.
+var errChunkChecksumFIPS = errors.New("chunk checksums are not allowed in FIPS mode")
+
+// checkChunkChecksum verifies a received chunk's checksum, if it carries one,
+// rejecting it instead in FIPS mode.
+func (c *config) checkChunkChecksum(ci *types.ChunkInfo, data []byte) error {
+	if len(ci.ChunkChecksum) > 0 && (c.fips || fipsBuild) {
+		return errChunkChecksumFIPS
+	}
+	return verifyChunkChecksum(ci, data)
+}
@@ -0,0 +1,10 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build fips
+// +build fips
+
+package raftchunking
+
+// fipsBuild forces FIPS mode on in builds with the fips tag.
+const fipsBuild = true
@@ -0,0 +1,11 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !fips
+// +build !fips
+
+package raftchunking
+
+// fipsBuild is false unless built with the fips tag; FIPS mode can still be
+// enabled at runtime with WithFIPSMode.
+const fipsBuild = false
@@ -0,0 +1,89 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestFIPSMode(t *testing.T) {
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		return errorFuture{}
+	}
+	for _, alg := range []HashAlgorithm{HashCRC32C, HashXXHash64, HashBLAKE3} {
+		if err := ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithFIPSMode(), WithHashAlgorithm(alg)).Error(); err == nil {
+			t.Fatalf("expected %v to be rejected", alg)
+		}
+	}
+	for _, alg := range []HashAlgorithm{HashNone, HashSHA256} {
+		if err := ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithFIPSMode(), WithHashAlgorithm(alg)).Error(); err != nil {
+			t.Fatalf("expected %v to be allowed: %v", alg, err)
+		}
+	}
+
+	// Custom ciphers can't be vetted, so encrypt funcs are rejected too
+	encrypt := func(opNum uint64, seq uint32, data []byte) ([]byte, error) {
+		return data, nil
+	}
+	if err := ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithFIPSMode(), WithEncryptFunc(encrypt, 0)).Error(); err == nil {
+		t.Fatal("expected an encrypt func to be rejected")
+	}
+	if err := ChunkingApplyReader(bytes.NewReader([]byte("foo")), nil, time.Second, applyFunc, WithFIPSMode(), WithEncryptFunc(encrypt, 0)).Error(); err == nil {
+		t.Fatal("expected an encrypt func to be rejected when streaming")
+	}
+
+	// As are decrypt funcs on the FSM and reassembler
+	decrypt := func(opNum uint64, seq uint32, data []byte) ([]byte, error) {
+		return data, nil
+	}
+	_, plain := hashedChunkData(t, WithHashAlgorithm(HashSHA256))
+	if _, ok := NewChunkingFSM(new(MockFSM), nil, WithFIPSMode(), WithDecryptFunc(decrypt)).Apply(plain[0]).(error); !ok {
+		t.Fatal("expected FSM with a decrypt func to reject chunk")
+	}
+	dr := NewReassembler(func(uint64) (io.Writer, error) {
+		return new(bytes.Buffer), nil
+	}, WithFIPSMode(), WithDecryptFunc(decrypt))
+	if _, err := dr.Add(plain[0]); err == nil {
+		t.Fatal("expected reassembler with a decrypt func to reject chunk")
+	}
+
+	// Chunk checksums are CRC-32C, so they are rejected like the digest
+	if err := ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithFIPSMode(), WithChunkChecksums()).Error(); err == nil {
+		t.Fatal("expected chunk checksums to be rejected")
+	}
+
+	if fipsBuild {
+		return
+	}
+
+	// Chunks carrying them are rejected by the FSM and reassembler
+	_, checksummed := hashedChunkData(t, WithChunkChecksums())
+	if _, ok := NewChunkingFSM(new(MockFSM), nil, WithFIPSMode()).Apply(checksummed[0]).(error); !ok {
+		t.Fatal("expected FSM to reject checksummed chunk")
+	}
+	cr := NewReassembler(func(uint64) (io.Writer, error) {
+		return new(bytes.Buffer), nil
+	}, WithFIPSMode())
+	if _, err := cr.Add(checksummed[0]); err == nil {
+		t.Fatal("expected reassembler to reject checksummed chunk")
+	}
+
+	// Chunks using other algorithms are rejected by the FSM and reassembler
+	_, logs := hashedChunkData(t, WithHashAlgorithm(HashXXHash64))
+	f := NewChunkingFSM(new(MockFSM), nil, WithFIPSMode())
+	if _, ok := f.Apply(logs[0]).(error); !ok {
+		t.Fatal("expected FSM to reject chunk")
+	}
+	r := NewReassembler(func(uint64) (io.Writer, error) {
+		return new(bytes.Buffer), nil
+	}, WithFIPSMode())
+	if _, err := r.Add(logs[0]); err == nil {
+		t.Fatal("expected reassembler to reject chunk")
+	}
+}
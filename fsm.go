@@ -4,12 +4,20 @@
 package raftchunking
 
 import (
+	"crypto/cipher"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-raftchunking/types"
 	"github.com/hashicorp/raft"
-	"google.golang.org/protobuf/proto"
 )
 
 var _ raft.FSM = (*ChunkingFSM)(nil)
@@ -18,6 +26,46 @@ var _ raft.BatchingFSM = (*ChunkingBatchingFSM)(nil)
 
 type ChunkingSuccess struct {
 	Response interface{}
+
+	// Metadata is the metadata the op was sent with via WithMetadata, if any
+	Metadata map[string]string
+}
+
+// OpInfo describes the chunked op that a reassembled log was built from.
+type OpInfo struct {
+	// OpNum is the op's ID
+	OpNum uint64
+
+	// ContentType is the hint given to ChunkingApply with WithContentType,
+	// if any
+	ContentType string
+
+	// Metadata is the metadata given to ChunkingApply with WithMetadata, if
+	// any
+	Metadata map[string]string
+
+	// TraceContext is the trace context given to ChunkingApply with
+	// WithTraceContext, if any
+	TraceContext string
+
+	// IdempotencyKey is the key given to ChunkingApply with
+	// WithIdempotencyKey, if any
+	IdempotencyKey string
+}
+
+// OpApplier may be implemented by the FSM wrapped by ChunkingFSM to learn
+// about the op behind each reassembled log, e.g. to route payloads by content
+// type. When implemented, ApplyOp is called in place of Apply for reassembled
+// logs; logs that were not chunked still go to Apply.
+type OpApplier interface {
+	ApplyOp(l *raft.Log, info OpInfo) interface{}
+}
+
+// OpBatchApplier is the batching counterpart of OpApplier, for FSMs wrapped
+// by ChunkingBatchingFSM. infos has an entry for each log, which is nil for
+// logs that were not chunked.
+type OpBatchApplier interface {
+	ApplyOpBatch(logs []*raft.Log, infos []*OpInfo) []interface{}
 }
 
 // ChunkingFSM is an FSM that implements chunking; it's the sister of
@@ -27,9 +75,344 @@ type ChunkingSuccess struct {
 // nil result and not be passed through to the underlying FSM. To detect this,
 // the final apply to the underlying FSM is wrapped in ChunkingSuccess.
 type ChunkingFSM struct {
+	// pendingOps and pendingBytes are accessed atomically so that they can be
+	// read without synchronizing with Apply; keep them first in the struct to
+	// guarantee 64-bit alignment.
+	pendingOps   uint64
+	pendingBytes uint64
+
+	// deadlineOps is the number of tracked ops with a deadline
+	deadlineOps uint64
+
+	// duplicateChunks counts the chunks that arrived again for their op
+	duplicateChunks uint64
+
 	underlying raft.FSM
 	store      ChunkStorage
 	lastTerm   uint64
+	conf       *config
+
+	// chunked is the underlying FSM if payloads are streamed to it
+	chunked ChunkedApplier
+
+	// stateLock makes chunk state changes atomic with respect to
+	// CurrentState and RestoreState. It is held for a whole log in Apply and
+	// for all of a batch's chunks in ApplyBatch, so captured state always
+	// falls on a log or batch boundary.
+	stateLock sync.RWMutex
+
+	// ops holds bookkeeping for ops that have chunks in the store; it backs
+	// the pending counters. stored maps the op nums their chunks are stored
+	// under back to them.
+	ops    map[opKey]*opState
+	stored map[uint64]opKey
+
+	// recent holds the records of recently finished ops, if enabled
+	recent *recentOps
+
+	// completed holds the op nums of recently completed ops, if
+	// WithDedupWindow is used
+	completed *completedOps
+
+	// applied holds the idempotency keys of recently applied ops and their
+	// responses, if WithIdempotencyWindow is used
+	applied *appliedKeys
+
+	// restored is set when the FSM's state is restored, and firstIndex is
+	// the index of the first chunk log applied since; see StrandedOpError.
+	restored   bool
+	firstIndex uint64
+
+	// discarded holds ops that were dropped before completing, such as
+	// stranded or expired ones, whose remaining chunks are to be ignored,
+	// along with any error to return for the final one, and discardOrder
+	// the order they were discarded in, oldest first
+	discarded    map[opKey]error
+	discardOrder []opKey
+
+	// lastCheckpoint is when the last checkpoint was sent, and lastIndex
+	// the index of the last chunk log applied
+	lastCheckpoint time.Time
+	lastIndex      uint64
+
+	// reservations holds the reservations made for ops with Reserve,
+	// totaling reservedBytes
+	reservations  map[uint64]reservation
+	reservedBytes uint64
+}
+
+// ErrOutOfOrder is returned, wrapped, when a chunk arrives further ahead of
+// the rest of its op than allowed by WithReorderWindow.
+var ErrOutOfOrder = errors.New("chunk out of order")
+
+// WithReorderWindow makes the FSM reject chunks whose sequence number is n or
+// more ahead of the first chunk of their op that hasn't arrived yet. Chunks are
+// normally appended in order, so large gaps point to a corrupted log store or
+// a misbehaving writer; the op is then failed rather than left waiting for
+// chunks that may never come. Chunks that arrive again after the op has moved
+// past them are always allowed. It is ignored by ChunkingApply.
+func WithReorderWindow(n int) Option {
+	return func(c *config) {
+		c.reorderWindow = n
+	}
+}
+
+// DefaultMaxChunks is the most chunks an op may have unless changed with
+// WithMaxChunks, enough for a 512GiB payload at the default chunk size.
+const DefaultMaxChunks = 1 << 20
+
+// WithMaxChunks makes the FSM and the Reassembler reject chunks of ops
+// claiming more than n chunks with ErrTooManyChunks, before anything is
+// allocated for them, so that a single malformed log can't make them set
+// aside room for billions of chunks. It defaults to DefaultMaxChunks; a
+// negative n means no limit. Ops sent with small chunk sizes may need a
+// higher limit. It is ignored by ChunkingApply.
+func WithMaxChunks(n int) Option {
+	return func(c *config) {
+		c.maxChunks = n
+	}
+}
+
+// chunkLimit returns the most chunks an op may have, or zero for no limit.
+func (c *config) chunkLimit() uint32 {
+	switch {
+	case c.maxChunks == 0:
+		return DefaultMaxChunks
+	case c.maxChunks < 0 || uint64(c.maxChunks) > math.MaxUint32:
+		return 0
+	default:
+		return uint32(c.maxChunks)
+	}
+}
+
+// checkOrder enforces the reorder window, if there is one.
+func (c *ChunkingFSM) checkOrder(ci *types.ChunkInfo) error {
+	window := c.conf.reorderWindow
+	if window <= 0 {
+		return nil
+	}
+	var next uint32
+	if op, ok := c.ops[chunkKey(ci)]; ok {
+		next = op.next
+	}
+	if ci.SequenceNum < next || uint64(ci.SequenceNum-next) < uint64(window) {
+		return nil
+	}
+	return fmt.Errorf("chunk %d is %d ahead of the first missing chunk %d, beyond the window of %d: %w", ci.SequenceNum, ci.SequenceNum-next, next, window, ErrOutOfOrder)
+}
+
+// StrandedOpError is the error recorded, with the OpStranded outcome, for an op
+// whose earlier chunks were applied before the FSM's state was restored from a
+// snapshot that did not include them, typically on a follower that was
+// brought up from a snapshot taken while the op was in progress. Such an op
+// can never complete, so rather than holding its remaining chunks until the
+// next term change the FSM discards them as they arrive.
+type StrandedOpError struct {
+	OpNum uint64
+
+	// SequenceNum and Index identify the chunk that revealed the op
+	SequenceNum uint32
+	Index       uint64
+
+	// FirstIndex is the index of the first chunk log applied after the
+	// restore
+	FirstIndex uint64
+}
+
+func (e *StrandedOpError) Error() string {
+	return fmt.Sprintf("op %d is missing chunks from before index %d and cannot complete (chunk %d at index %d)", e.OpNum, e.FirstIndex, e.SequenceNum, e.Index)
+}
+
+// checkStranded reports whether the chunk belongs to an op that is missing
+// chunks from before firstIndex. The op's earlier chunks each need a log of
+// their own after firstIndex, so if fewer logs than that have been applied
+// since then, at least one of them must have come before it. This relies on
+// chunks being appended in sequence order, as ChunkingApply does, so it is
+// only done after a restore. Logs without an index are never considered
+// stranded.
+func (c *ChunkingFSM) checkStranded(l *raft.Log, ci *types.ChunkInfo) *StrandedOpError {
+	if c.firstIndex == 0 || l.Index < c.firstIndex || l.Index-c.firstIndex >= uint64(ci.SequenceNum) {
+		return nil
+	}
+	if _, ok := c.ops[chunkKey(ci)]; ok {
+		return nil
+	}
+	return &StrandedOpError{
+		OpNum:       ci.OpNum,
+		SequenceNum: ci.SequenceNum,
+		Index:       l.Index,
+		FirstIndex:  c.firstIndex,
+	}
+}
+
+// discardChunk drops the chunk of an op that isn't being tracked, along with
+// the op's remaining chunks as they arrive, recording outcome for the op.
+func (c *ChunkingFSM) discardChunk(l *raft.Log, ci *types.ChunkInfo, outcome OpOutcome, err error) {
+	if ci.SequenceNum+1 < ci.NumChunks {
+		c.discardOp(chunkKey(ci))
+	}
+	op := &opState{
+		sizes:        map[uint32]uint64{ci.SequenceNum: uint64(len(l.Data))},
+		bytes:        uint64(len(l.Data)),
+		numChunks:    ci.NumChunks,
+		metadata:     ci.Metadata,
+		traceContext: ci.TraceContext,
+	}
+	c.audit(ci.OpNum, op, outcome, err, l.Index, l.Term, l.AppendedAt)
+}
+
+// failOp discards the op ci belongs to, along with its chunks that have been
+// stored or are still to come, and records it as failed with err. It returns
+// err, or the store's error if the op couldn't be cleared.
+func (c *ChunkingFSM) failOp(l *raft.Log, ci *types.ChunkInfo, err error) error {
+	key := chunkKey(ci)
+	op, ok := c.ops[key]
+	if !ok {
+		c.discardChunk(l, ci, OpFailed, err)
+		return err
+	}
+	if _, ferr := c.store.FinalizeOp(op.storeNum); ferr != nil {
+		return ferr
+	}
+	c.discardOp(key)
+	op = c.untrackOp(key)
+	c.abortStream(ci.OpNum, op, OpFailed, err)
+	c.audit(ci.OpNum, op, OpFailed, err, l.Index, l.Term, l.AppendedAt)
+	return err
+}
+
+// maxDiscarded bounds the number of discarded ops remembered. An op whose
+// final chunk never arrives is otherwise remembered until the term changes,
+// which with WithPreservedOps may be never.
+const maxDiscarded = 1024
+
+// discardOp marks an op's remaining chunks to be ignored. Once more than
+// maxDiscarded ops are marked the oldest are forgotten, so chunks of theirs
+// that arrive much later are taken for a new op.
+func (c *ChunkingFSM) discardOp(key opKey) {
+	c.releaseReservation(key.opNum)
+	if c.discarded == nil {
+		c.discarded = make(map[opKey]error)
+	}
+	if _, ok := c.discarded[key]; !ok {
+		c.discardOrder = append(c.discardOrder, key)
+	}
+	c.discarded[key] = nil
+
+	for len(c.discarded) > maxDiscarded {
+		delete(c.discarded, c.discardOrder[0])
+		c.discardOrder = c.discardOrder[1:]
+	}
+	if len(c.discardOrder) > 2*maxDiscarded {
+		// Drop the ops whose final chunk has since arrived
+		kept := make([]opKey, 0, len(c.discarded))
+		for _, key := range c.discardOrder {
+			if _, ok := c.discarded[key]; ok {
+				kept = append(kept, key)
+			}
+		}
+		c.discardOrder = kept
+	}
+}
+
+// resetDiscarded forgets all discarded ops.
+func (c *ChunkingFSM) resetDiscarded() {
+	c.discarded, c.discardOrder = nil, nil
+}
+
+// expireOps drops the ops whose deadline is before the time l was appended,
+// and those that have gone stale, in op num order so that every node reports
+// them alike.
+func (c *ChunkingFSM) expireOps(l *raft.Log) error {
+	if err := c.collectStaleOps(l); err != nil {
+		return err
+	}
+	if l.AppendedAt.IsZero() || atomic.LoadUint64(&c.deadlineOps) == 0 {
+		return nil
+	}
+	var expired []opKey
+	for key, op := range c.ops {
+		if !op.deadline.IsZero() && l.AppendedAt.After(op.deadline) {
+			expired = append(expired, key)
+		}
+	}
+	sortKeys(expired)
+
+	for _, key := range expired {
+		if _, err := c.store.FinalizeOp(c.ops[key].storeNum); err != nil {
+			return err
+		}
+		op := c.untrackOp(key)
+		c.discardOp(key)
+		c.abortStream(key.opNum, op, OpExpired, nil)
+		c.audit(key.opNum, op, OpExpired, nil, l.Index, l.Term, l.AppendedAt)
+	}
+	return nil
+}
+
+// expirePassThrough expires ops as of a log that isn't a chunk. Errors are
+// ignored, as the log itself is fine; expiry is retried with the next log.
+func (c *ChunkingFSM) expirePassThrough(l *raft.Log) {
+	expiring := !l.AppendedAt.IsZero() && atomic.LoadUint64(&c.deadlineOps) != 0
+	if !expiring && (!c.conf.staleOpGC() || c.PendingOps() == 0) {
+		return
+	}
+	c.stateLock.Lock()
+	c.expireOps(l)
+	c.stateLock.Unlock()
+}
+
+// opState tracks the chunks that have been received for an op.
+type opState struct {
+	// sizes maps sequence numbers to data lengths; duplicate chunks replace
+	// the existing entry, mirroring what the store does.
+	sizes map[uint32]uint64
+	bytes uint64
+
+	// checksums maps sequence numbers to the CRC-32C of their data, kept
+	// to check duplicates against under DuplicateVerify
+	checksums map[uint32]uint32
+
+	numChunks uint32
+	metadata  map[string]string
+
+	// traceContext is the op's trace context, taken from its latest chunk
+	traceContext string
+
+	// storeNum is the op num the op's chunks are stored under
+	storeNum uint64
+
+	// next is the lowest sequence number that hasn't been received
+	next uint32
+
+	// started is the earliest append time seen for the op's chunks, and
+	// first the lowest index of their logs, if known
+	started time.Time
+	first   uint64
+
+	// lastAt is the latest append time seen for the op's chunks, and last
+	// the highest index of their logs, if known
+	lastAt time.Time
+	last   uint64
+
+	// term is the earliest term of the op's chunks, the one it originated
+	// in
+	term uint64
+
+	// hash is the op's running payload hash, if it has a digest
+	hash *payloadHash
+
+	// deadline is the op's deadline, if it has one
+	deadline time.Time
+
+	// begun is whether the op has been begun on the underlying
+	// ChunkedApplier, and streamed and streamedBytes how many of its
+	// leading chunks, and how much payload, have been handed to it. aead is
+	// the op's unwrapped data key, once needed.
+	begun         bool
+	streamed      uint32
+	streamedBytes uint64
+	aead          cipher.AEAD
 }
 
 type ChunkingBatchingFSM struct {
@@ -42,89 +425,322 @@ type ChunkingConfigurationStore struct {
 	underlyingConfigurationStore raft.ConfigurationStore
 }
 
-func NewChunkingFSM(underlying raft.FSM, store ChunkStorage) *ChunkingFSM {
+// NewChunkingFSM wraps the given FSM. If store is nil, chunks are kept in
+// memory. Options must be compatible with those given to ChunkingApply.
+func NewChunkingFSM(underlying raft.FSM, store ChunkStorage, opts ...Option) *ChunkingFSM {
 	ret := &ChunkingFSM{
 		underlying: underlying,
 		store:      store,
+		conf:       newConfig(opts),
 	}
+	ret.recent = newRecentOps(ret.conf.recentOps)
+	ret.completed = newCompletedOps(ret.conf.dedupWindow, nil, nil)
+	ret.applied = newAppliedKeys(ret.conf.idempotencyWindow, nil)
 	if store == nil {
 		ret.store = NewInmemChunkStorage()
 	}
+	ret.chunked, _ = underlying.(ChunkedApplier)
 	return ret
 }
 
-func NewChunkingBatchingFSM(underlying raft.BatchingFSM, store ChunkStorage) *ChunkingBatchingFSM {
+func NewChunkingBatchingFSM(underlying raft.BatchingFSM, store ChunkStorage, opts ...Option) *ChunkingBatchingFSM {
 	ret := &ChunkingBatchingFSM{
-		ChunkingFSM: &ChunkingFSM{
-			underlying: underlying,
-			store:      store,
-		},
+		ChunkingFSM:           NewChunkingFSM(underlying, store, opts...),
 		underlyingBatchingFSM: underlying,
 	}
-	if store == nil {
-		ret.ChunkingFSM.store = NewInmemChunkStorage()
-	}
+	// Batches are handed over whole, so payloads are always reassembled
+	ret.chunked = nil
 	return ret
 }
 
-func NewChunkingConfigurationStore(underlying raft.ConfigurationStore, store ChunkStorage) *ChunkingConfigurationStore {
+func NewChunkingConfigurationStore(underlying raft.ConfigurationStore, store ChunkStorage, opts ...Option) *ChunkingConfigurationStore {
 	ret := &ChunkingConfigurationStore{
-		ChunkingFSM: &ChunkingFSM{
-			underlying: underlying,
-			store:      store,
-		},
+		ChunkingFSM:                  NewChunkingFSM(underlying, store, opts...),
 		underlyingConfigurationStore: underlying,
 	}
-	if store == nil {
-		ret.ChunkingFSM.store = NewInmemChunkStorage()
-	}
 	return ret
 }
 
-func (c *ChunkingFSM) applyChunk(l *raft.Log) (*raft.Log, error) {
-	if l.Term != c.lastTerm {
+// ApplyError is the error returned from Apply and ApplyBatch when a chunk log
+// can't be applied. It records which log and chunk were involved; use
+// errors.As to get at it and errors.Is or errors.As on the wrapped error for
+// the cause.
+type ApplyError struct {
+	// Index and Term are those of the log being applied
+	Index uint64
+	Term  uint64
+
+	// OpNum and SequenceNum identify the chunk; they are zero if the
+	// failure came before the chunk info could be read
+	OpNum       uint64
+	SequenceNum uint32
+
+	Err error
+}
+
+func (e *ApplyError) Error() string {
+	return fmt.Sprintf("error applying chunk %d of op %d at index %d, term %d: %v", e.SequenceNum, e.OpNum, e.Index, e.Term, e.Err)
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// applyChunk handles a chunk log, returning the log to pass to the underlying
+// FSM and its op info if the chunk completed an op. If the op repeats one
+// already applied under its idempotency key, only the op info is returned.
+// Errors are returned as an *ApplyError.
+func (c *ChunkingFSM) applyChunk(l *raft.Log) (*raft.Log, *OpInfo, error) {
+	var ci types.ChunkInfo
+	logToApply, info, err := c.applyChunkInfo(l, &ci)
+	c.lastIndex = l.Index
+	c.maybeCheckpoint(l)
+	if err != nil {
+		return nil, nil, &ApplyError{
+			Index:       l.Index,
+			Term:        l.Term,
+			OpNum:       ci.OpNum,
+			SequenceNum: ci.SequenceNum,
+			Err:         err,
+		}
+	}
+	return logToApply, info, nil
+}
+
+// applyChunkInfo does the work of applyChunk, unmarshaling the log's chunk
+// info into ci.
+func (c *ChunkingFSM) applyChunkInfo(l *raft.Log, ci *types.ChunkInfo) (*raft.Log, *OpInfo, error) {
+	if l.Term != c.lastTerm && !c.conf.preservedOps {
 		// Term has changed. A raft library client that was applying chunks
 		// should get an error that it's no longer the leader and bail, and
 		// then any client of (Consul, Vault, etc.) should then retry the full
 		// chunking operation automatically, which will be under a different
 		// opnum. So it should be safe in this case to clear the map.
 		if err := c.store.RestoreChunks(nil); err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		old := c.resetTracking()
+		for _, key := range opKeys(old) {
+			c.abortStream(key.opNum, old[key], OpAbortedTermChange, nil)
+			c.audit(key.opNum, old[key], OpAbortedTermChange, nil, l.Index, l.Term, l.AppendedAt)
 		}
-		c.lastTerm = l.Term
+		c.resetDiscarded()
+	}
+	c.lastTerm = l.Term
+	if err := c.expireOps(l); err != nil {
+		return nil, nil, err
+	}
+	if c.restored && c.firstIndex == 0 {
+		c.firstIndex = l.Index
 	}
 
 	// Get chunk info from extensions
-	var ci types.ChunkInfo
-	if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
-		return nil, fmt.Errorf("error unmarshaling chunk info: %w", err)
+	if err := c.conf.unmarshalChunkInfo(l.Extensions, ci); err != nil {
+		return nil, nil, err
+	}
+	if err := c.conf.checkFIPS(HashAlgorithm(ci.HashAlgorithm)); err != nil {
+		return nil, nil, err
+	}
+
+	// Logs without chunks are cancellations or reservations
+	if ci.Cancel {
+		return nil, nil, c.cancelOp(l, chunkKey(ci))
+	}
+	if ci.NumChunks == 0 {
+		return nil, nil, c.reserve(l, ci)
+	}
+	if err := checkChunkBounds(ci, c.conf); err != nil {
+		// The chunk can't be placed, so the op it claims is left alone
+		return nil, nil, err
+	}
+	if dup, err := c.checkDuplicate(l, ci); dup {
+		return nil, nil, err
+	}
+
+	// Drop chunks of ops that can never complete
+	key := chunkKey(ci)
+	if err, ok := c.discarded[key]; ok {
+		if ci.SequenceNum+1 == ci.NumChunks {
+			delete(c.discarded, key)
+			return nil, nil, err
+		}
+		return nil, nil, nil
+	}
+	if err := c.checkStranded(l, ci); err != nil {
+		c.discardChunk(l, ci, OpStranded, err)
+		return nil, nil, err
+	}
+	if ci.Deadline != 0 && !l.AppendedAt.IsZero() && l.AppendedAt.After(time.Unix(0, ci.Deadline)) {
+		c.discardChunk(l, ci, OpExpired, nil)
+		return nil, nil, nil
+	}
+	if err := c.conf.checkChunkChecksum(ci, l.Data); err != nil {
+		return nil, nil, c.failOp(l, ci, err)
+	}
+	if ci.IsFinal && ci.SequenceNum+1 != ci.NumChunks {
+		return nil, nil, c.failOp(l, ci, fmt.Errorf("final chunk %d of streamed op %d gives %d chunks", ci.SequenceNum, ci.OpNum, ci.NumChunks))
+	}
+	if dup, err := c.checkDuplicateChunk(l, ci); dup {
+		return nil, nil, err
+	}
+	if err := c.checkOrder(ci); err != nil {
+		return nil, nil, c.failOp(l, ci, err)
+	}
+	if err := c.checkReservation(ci, len(l.Data)); err != nil {
+		return nil, nil, c.failOp(l, ci, err)
 	}
 
 	// Store the current chunk and find out if all chunks have arrived
-	done, err := c.store.StoreChunk(&ChunkInfo{
-		OpNum:       ci.OpNum,
+	chunk := &ChunkInfo{
+		OpNum:       c.storeNum(key),
 		SequenceNum: ci.SequenceNum,
 		NumChunks:   ci.NumChunks,
 		Term:        l.Term,
 		Data:        l.Data,
-	})
+		Index:       l.Index,
+		AppendedAt:  l.AppendedAt,
+		Metadata:    ci.Metadata,
+		Origin:      ci.Origin,
+	}
+	if chunk.OpNum != ci.OpNum {
+		chunk.SentOpNum = ci.OpNum
+	}
+	if ci.Deadline != 0 {
+		chunk.Deadline = time.Unix(0, ci.Deadline)
+	}
+	done, err := c.store.StoreChunk(chunk)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	_, known := c.ops[key]
+	op := c.trackChunk(chunk)
+	op.traceContext = ci.TraceContext
+	if !known {
+		// Ops restored from a snapshot are not hashed incrementally since
+		// their earlier chunks were never seen here
+		op.hash = newPayloadHash(HashAlgorithm(ci.HashAlgorithm))
+	}
+	op.hash.add(ci.SequenceNum, l.Data)
+	if c.chunked != nil && !done {
+		if err := c.streamChunk(l, ci, op); err != nil {
+			return nil, nil, c.failOp(l, ci, err)
+		}
 	}
 	if !done {
-		return nil, nil
+		return nil, nil, c.enforceBudget(l, key)
 	}
 
 	// All chunks are here; get the full set and clear storage of the op
-	chunks, err := c.store.FinalizeOp(ci.OpNum)
+	chunks, err := c.store.FinalizeOp(op.storeNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.untrackOp(key)
+	info := &OpInfo{
+		OpNum:          ci.OpNum,
+		ContentType:    ci.ContentType,
+		Metadata:       op.metadata,
+		TraceContext:   ci.TraceContext,
+		IdempotencyKey: ci.IdempotencyKey,
+	}
+	if c.applied.has(ci.IdempotencyKey) {
+		c.completed.add(key)
+		c.abortStream(ci.OpNum, op, OpDuplicate, nil)
+		c.audit(ci.OpNum, op, OpDuplicate, nil, l.Index, l.Term, l.AppendedAt)
+		return nil, info, nil
+	}
+
+	logToApply, err := c.reassemble(l, ci, op, chunks)
 	if err != nil {
+		c.abortStream(ci.OpNum, op, OpFailed, err)
+		c.audit(ci.OpNum, op, OpFailed, err, l.Index, l.Term, l.AppendedAt)
+		return nil, nil, err
+	}
+	c.completed.add(key)
+	c.applied.add(ci.IdempotencyKey)
+	c.audit(ci.OpNum, op, OpCompleted, nil, l.Index, l.Term, l.AppendedAt)
+	return logToApply, info, nil
+}
+
+// reassemble builds the log to pass to the underlying FSM from the chunks of a
+// completed op; l and ci are the log and chunk info that completed it. If the
+// underlying FSM is a ChunkedApplier the rest of the payload is streamed to
+// it instead, and the log returned has no data.
+func (c *ChunkingFSM) reassemble(l *raft.Log, ci *types.ChunkInfo, op *opState, chunks []*ChunkInfo) (*raft.Log, error) {
+	// Check the chunks against the payload digest, if one was sent
+	if err := op.hash.verify(ci, chunks); err != nil {
+		return nil, err
+	}
+	if err := c.checkDecompressedSize(ci); err != nil {
 		return nil, err
 	}
 
-	finalData := make([]byte, 0, len(chunks)*raft.SuggestedMaxDataSize)
+	// Oversized extensions are carried in the data of the trailing chunks
+	extensions := ci.NextExtensions
+	if ci.ExtensionsChunks > 0 {
+		if int(ci.ExtensionsChunks) > len(chunks) {
+			return nil, fmt.Errorf("op %d has %d chunks but %d of them carry extensions", ci.OpNum, len(chunks), ci.ExtensionsChunks)
+		}
+		split := len(chunks) - int(ci.ExtensionsChunks)
+		extensions = nil
+		for _, chunk := range chunks[split:] {
+			extensions = append(extensions, chunk.Data...)
+		}
+		chunks = chunks[:split]
+	}
+	if c.chunked != nil {
+		return c.streamOp(l, ci, op, extensions, chunks)
+	}
+
+	// If the data is encrypted, unwrap the key once and decrypt as we go
+	var aead cipher.AEAD
+	var overhead uint64
+	if len(ci.WrappedKey) > 0 {
+		var err error
+		aead, err = unwrapDataKey(c.conf, ci.KeyId, ci.WrappedKey)
+		if err != nil {
+			return nil, err
+		}
+		overhead = uint64(aead.Overhead())
+	}
 
+	// Size the buffer from the chunks themselves, less what sealing them
+	// added, in 64 bits so that an op too large to hold in memory on this
+	// platform is caught rather than overflowing. The total size, if sent,
+	// is exact for uncompressed payloads, but it is only trusted as far as
+	// the chunks bear it out.
+	var size uint64
 	for _, chunk := range chunks {
-		finalData = append(finalData, chunk.Data...)
+		if n := uint64(len(chunk.Data)); n > overhead {
+			size += n - overhead
+		}
+	}
+	if ci.TotalSize != 0 && ci.TotalSize < size && ci.Compression == types.Compression_COMPRESSION_UNSPECIFIED {
+		size = ci.TotalSize
+	}
+	capacity, err := checkedInt(size)
+	if err != nil {
+		return nil, fmt.Errorf("op %d: %w", ci.OpNum, err)
+	}
+	finalData := make([]byte, 0, capacity)
+
+	for _, chunk := range chunks {
+		data, err := c.chunkPayload(ci, aead, chunk)
+		if err != nil {
+			return nil, err
+		}
+		finalData = append(finalData, data...)
+	}
+
+	// Decompress the payload if it was compressed before it was split
+	if ci.Compression != types.Compression_COMPRESSION_UNSPECIFIED {
+		finalData, err = Compression(ci.Compression).decompress(finalData, ci.TotalSize)
+		if err != nil {
+			return nil, fmt.Errorf("op %d: %w", ci.OpNum, err)
+		}
+	}
+	if ci.TotalSize != 0 && uint64(len(finalData)) != ci.TotalSize {
+		return nil, fmt.Errorf("op %d reassembled to %d bytes but %d were sent", ci.OpNum, len(finalData), ci.TotalSize)
 	}
 
 	// Use the latest log's values with the final data
@@ -133,37 +749,93 @@ func (c *ChunkingFSM) applyChunk(l *raft.Log) (*raft.Log, error) {
 		Term:       l.Term,
 		Type:       l.Type,
 		Data:       finalData,
-		Extensions: ci.NextExtensions,
+		Extensions: extensions,
 	}
 
 	return logToApply, nil
 }
 
+// checkDecompressedSize checks, before a compressed payload is decompressed,
+// that its op gave the size it decompresses to and that the size is within
+// WithMaxPayloadSize. Decompression stops once the output passes that size.
+func (c *ChunkingFSM) checkDecompressedSize(ci *types.ChunkInfo) error {
+	if ci.Compression == types.Compression_COMPRESSION_UNSPECIFIED {
+		return nil
+	}
+	if ci.TotalSize == 0 {
+		return fmt.Errorf("op %d: %w: compressed payload has no total size", ci.OpNum, ErrDecompression)
+	}
+	if max := c.conf.maxPayloadSize; max > 0 && ci.TotalSize > uint64(max) {
+		return fmt.Errorf("op %d: %w: %d bytes exceeds the limit of %d", ci.OpNum, ErrPayloadTooLarge, ci.TotalSize, max)
+	}
+	return nil
+}
+
 // Apply applies the log, handling chunking as needed. The return value will
 // either be an error or whatever is returned from the underlying Apply.
 func (c *ChunkingFSM) Apply(l *raft.Log) interface{} {
 	// Not chunking or wrong type, pass through
-	if l.Type != raft.LogCommand || l.Extensions == nil {
+	if !c.conf.isChunk(l) {
+		c.expirePassThrough(l)
 		return c.underlying.Apply(l)
 	}
 
-	logToApply, err := c.applyChunk(l)
+	c.stateLock.Lock()
+	logToApply, info, err := c.applyChunk(l)
+	c.stateLock.Unlock()
 	if err != nil {
 		return err
 	}
 
 	if logToApply != nil {
-		return ChunkingSuccess{Response: c.underlying.Apply(logToApply)}
+		var resp interface{}
+		if c.chunked != nil {
+			resp = c.chunked.CompleteOp(logToApply, *info)
+		} else if oa, ok := c.underlying.(OpApplier); ok {
+			resp = oa.ApplyOp(logToApply, *info)
+		} else {
+			resp = c.underlying.Apply(logToApply)
+		}
+		c.recordResponse(info, resp)
+		return ChunkingSuccess{Response: resp, Metadata: info.Metadata}
+	}
+	if info != nil {
+		return c.repeatedResponse(info)
 	}
 
 	return nil
 }
 
+// recordResponse remembers the response to an op with an idempotency key.
+func (c *ChunkingFSM) recordResponse(info *OpInfo, resp interface{}) {
+	if info.IdempotencyKey == "" {
+		return
+	}
+	// RestoreState replaces the keys, so they are only looked at under the
+	// lock
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	c.applied.setResponse(info.IdempotencyKey, resp)
+}
+
+// repeatedResponse returns the response for an op that repeats one already
+// applied under its idempotency key.
+func (c *ChunkingFSM) repeatedResponse(info *OpInfo) interface{} {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	return c.applied.response(info.IdempotencyKey, info)
+}
+
 func (c *ChunkingFSM) Snapshot() (raft.FSMSnapshot, error) {
 	return c.underlying.Snapshot()
 }
 
 func (c *ChunkingFSM) Restore(rc io.ReadCloser) error {
+	c.stateLock.Lock()
+	c.restored = true
+	c.firstIndex = 0
+	c.resetDiscarded()
+	c.stateLock.Unlock()
 	return c.underlying.Restore(rc)
 }
 
@@ -173,28 +845,293 @@ func (c *ChunkingFSM) Underlying() raft.FSM {
 	return c.underlying
 }
 
+// Unwrap returns the wrapped FSM. FSMs that wrap another can implement
+// Unwrap() raft.FSM so that FSMAs can see through them.
+func (c *ChunkingFSM) Unwrap() raft.FSM {
+	return c.underlying
+}
+
+// FSMAs finds the first FSM in the chain starting at fsm that is assignable
+// to the value pointed to by target, and if one is found, sets target to it
+// and returns true. The chain is followed through FSMs with an Unwrap()
+// raft.FSM method, in the same way errors.As follows wrapped errors. For
+// example, to find the ChunkingFSM in a stack of middleware:
+//
+//	var cfsm *ChunkingFSM
+//	if FSMAs(fsm, &cfsm) {
+//		...
+//	}
+//
+// FSMAs panics if target is not a non-nil pointer to an interface or to a
+// type implementing raft.FSM.
+func FSMAs(fsm raft.FSM, target interface{}) bool {
+	if target == nil {
+		panic("raftchunking: target cannot be nil")
+	}
+	val := reflect.ValueOf(target)
+	typ := val.Type()
+	if typ.Kind() != reflect.Ptr || val.IsNil() {
+		panic("raftchunking: target must be a non-nil pointer")
+	}
+	targetType := typ.Elem()
+	if targetType.Kind() != reflect.Interface && !targetType.Implements(fsmType) {
+		panic("raftchunking: *target must be an interface or implement raft.FSM")
+	}
+	for fsm != nil {
+		if reflect.TypeOf(fsm).AssignableTo(targetType) {
+			val.Elem().Set(reflect.ValueOf(fsm))
+			return true
+		}
+		u, ok := fsm.(interface{ Unwrap() raft.FSM })
+		if !ok {
+			return false
+		}
+		fsm = u.Unwrap()
+	}
+	return false
+}
+
+var fsmType = reflect.TypeOf((*raft.FSM)(nil)).Elem()
+
+// CurrentState returns a copy of the currently tracked chunks. It is safe to
+// call while logs are being applied; the returned state never reflects a
+// partially applied batch.
 func (c *ChunkingFSM) CurrentState() (*State, error) {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
 	chunks, err := c.store.GetChunks()
 	if err != nil {
 		return nil, err
 	}
-	return &State{
+	state := &State{
 		ChunkMap: chunks,
-	}, nil
+	}
+	if len(c.reservations) > 0 {
+		state.Reservations = make(map[uint64]uint64, len(c.reservations))
+		state.ReservationLogs = make(map[uint64]ReservationLog, len(c.reservations))
+		for opNum, r := range c.reservations {
+			state.Reservations[opNum] = r.size
+			state.ReservationLogs[opNum] = ReservationLog{Term: r.term, Index: r.index, AppendedAt: r.at}
+		}
+	}
+	state.Completed, state.CompletedOrigins = c.completed.list()
+	state.IdempotencyKeys = c.applied.list()
+	return state, nil
 }
 
+// RestoreState replaces the tracked chunks with those in state, as captured
+// by CurrentState. Like CurrentState it is safe to call while logs are being
+// applied.
 func (c *ChunkingFSM) RestoreState(state *State) error {
 	// If nil we'll restore to blank, so create a new state with a nil map
 	if state == nil {
 		state = new(State)
 	}
-	return c.store.RestoreChunks(state.ChunkMap)
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if err := c.store.RestoreChunks(state.ChunkMap); err != nil {
+		return err
+	}
+	c.restored = true
+	c.firstIndex = 0
+	c.resetDiscarded()
+
+	old := c.resetTracking()
+	c.resetReservations(state.Reservations, state.ReservationLogs)
+	c.completed = newCompletedOps(c.conf.dedupWindow, state.Completed, state.CompletedOrigins)
+	c.applied = newAppliedKeys(c.conf.idempotencyWindow, state.IdempotencyKeys)
+	for _, chunks := range state.ChunkMap {
+		for _, chunk := range chunks {
+			if chunk != nil {
+				c.trackChunk(chunk)
+			}
+		}
+	}
+	for _, key := range opKeys(old) {
+		// The underlying FSM is restored too, so ops it had begun are
+		// aborted even if they carry on from the restored state
+		c.abortStream(key.opNum, old[key], OpAbortedRestore, nil)
+		if _, ok := c.ops[key]; !ok {
+			c.audit(key.opNum, old[key], OpAbortedRestore, nil, 0, 0, time.Time{})
+		}
+	}
+	return nil
+}
+
+// PruneBefore drops every op that has a chunk at or below the given raft
+// index and term, for applications that compact the raft log and no longer
+// want to track ops whose chunks could not be recovered from it. Ops are
+// dropped whole, since an op missing some of its chunks can never complete.
+// Chunks with no recorded index are considered to be at or below any index
+// in their term. It returns the number of ops that were dropped.
+func (c *ChunkingFSM) PruneBefore(index, term uint64) (int, error) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	chunks, err := c.store.GetChunks()
+	if err != nil {
+		return 0, err
+	}
+
+	// Ops are dropped in order, so that every node aborts them alike
+	storeNums := make([]uint64, 0, len(chunks))
+	for storeNum := range chunks {
+		storeNums = append(storeNums, storeNum)
+	}
+	sort.Slice(storeNums, func(i, j int) bool { return storeNums[i] < storeNums[j] })
+
+	var pruned int
+	for _, storeNum := range storeNums {
+		for _, chunk := range chunks[storeNum] {
+			if chunk == nil {
+				continue
+			}
+			if chunk.Term < term || (chunk.Term == term && chunk.Index <= index) {
+				if _, err := c.store.FinalizeOp(storeNum); err != nil {
+					return pruned, err
+				}
+				key := chunk.key()
+				op := c.untrackOp(key)
+				c.abortStream(key.opNum, op, OpPruned, nil)
+				c.audit(key.opNum, op, OpPruned, nil, 0, 0, time.Time{})
+				pruned++
+				break
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// PendingOps returns the number of ops that have received at least one chunk
+// but have not yet been completed. It does not copy any state, so it is
+// suitable for frequent polling, and is safe to call concurrently with Apply.
+func (c *ChunkingFSM) PendingOps() uint64 {
+	return atomic.LoadUint64(&c.pendingOps)
+}
+
+// PendingBytes returns the number of chunk data bytes currently buffered for
+// ops that have not yet been completed. Like PendingOps it is cheap and safe
+// to call concurrently with Apply.
+func (c *ChunkingFSM) PendingBytes() uint64 {
+	return atomic.LoadUint64(&c.pendingBytes)
+}
+
+// trackChunk records a stored chunk in the op bookkeeping and updates the
+// pending counters, returning the op's state.
+func (c *ChunkingFSM) trackChunk(chunk *ChunkInfo) *opState {
+	if c.ops == nil {
+		c.ops = make(map[opKey]*opState)
+		c.stored = make(map[uint64]opKey)
+	}
+	key := chunk.key()
+	op, ok := c.ops[key]
+	if !ok {
+		op = &opState{
+			sizes:    make(map[uint32]uint64),
+			storeNum: chunk.OpNum,
+		}
+		c.ops[key] = op
+		c.stored[chunk.OpNum] = key
+		atomic.AddUint64(&c.pendingOps, 1)
+	}
+
+	op.numChunks = chunk.NumChunks
+	if chunk.Metadata != nil {
+		op.metadata = chunk.Metadata
+	}
+	if !chunk.Deadline.IsZero() {
+		if op.deadline.IsZero() {
+			atomic.AddUint64(&c.deadlineOps, 1)
+		}
+		op.deadline = chunk.Deadline
+	}
+	if !chunk.AppendedAt.IsZero() && (op.started.IsZero() || chunk.AppendedAt.Before(op.started)) {
+		op.started = chunk.AppendedAt
+	}
+	if chunk.Index != 0 && (op.first == 0 || chunk.Index < op.first) {
+		op.first = chunk.Index
+	}
+	if chunk.AppendedAt.After(op.lastAt) {
+		op.lastAt = chunk.AppendedAt
+	}
+	if chunk.Index > op.last {
+		op.last = chunk.Index
+	}
+	if op.term == 0 || chunk.Term < op.term {
+		op.term = chunk.Term
+	}
+
+	size := uint64(len(chunk.Data))
+	if prev, ok := op.sizes[chunk.SequenceNum]; ok {
+		op.bytes -= prev
+		atomic.AddUint64(&c.pendingBytes, ^(prev - 1))
+	}
+	op.sizes[chunk.SequenceNum] = size
+	if c.conf.duplicatePolicy == DuplicateVerify {
+		if op.checksums == nil {
+			op.checksums = make(map[uint32]uint32)
+		}
+		op.checksums[chunk.SequenceNum] = crc32.Checksum(chunk.Data, crc32cTable)
+	}
+	for {
+		if _, ok := op.sizes[op.next]; !ok {
+			break
+		}
+		op.next++
+	}
+	op.bytes += size
+	atomic.AddUint64(&c.pendingBytes, size)
+	return op
+}
+
+// untrackOp removes an op from the bookkeeping once it has been completed or
+// otherwise cleared from the store, returning its state if it was tracked.
+func (c *ChunkingFSM) untrackOp(key opKey) *opState {
+	op, ok := c.ops[key]
+	if !ok {
+		return nil
+	}
+	delete(c.ops, key)
+	delete(c.stored, op.storeNum)
+	c.releaseReservation(key.opNum)
+	atomic.AddUint64(&c.pendingOps, ^uint64(0))
+	if !op.deadline.IsZero() {
+		atomic.AddUint64(&c.deadlineOps, ^uint64(0))
+	}
+	atomic.AddUint64(&c.pendingBytes, ^(op.bytes - 1))
+	return op
+}
+
+// resetTracking clears all op bookkeeping, used when the store is emptied. It
+// returns the ops that were being tracked.
+func (c *ChunkingFSM) resetTracking() map[opKey]*opState {
+	old := c.ops
+	c.ops = make(map[opKey]*opState)
+	c.stored = make(map[uint64]opKey)
+	c.resetReservations(nil, nil)
+	atomic.StoreUint64(&c.pendingOps, 0)
+	atomic.StoreUint64(&c.pendingBytes, 0)
+	atomic.StoreUint64(&c.deadlineOps, 0)
+	return old
+}
+
+// Unwrap returns the embedded ChunkingFSM, so that FSMAs can find it.
+func (c *ChunkingConfigurationStore) Unwrap() raft.FSM {
+	return c.ChunkingFSM
 }
 
 func (c *ChunkingConfigurationStore) StoreConfiguration(index uint64, configuration raft.Configuration) {
 	c.underlyingConfigurationStore.StoreConfiguration(index, configuration)
 }
 
+// Unwrap returns the embedded ChunkingFSM, so that FSMAs can find it.
+func (c *ChunkingBatchingFSM) Unwrap() raft.FSM {
+	return c.ChunkingFSM
+}
+
 // ApplyBatch applies the logs, handling chunking as needed. The return value will
 // be an array containing an error or whatever is returned from the underlying
 // Apply for each log.
@@ -210,16 +1147,27 @@ func (c *ChunkingBatchingFSM) ApplyBatch(logs []*raft.Log) []interface{} {
 	// sendLogs is the subset of logs that we need to pass onto the underlying
 	// FSM.
 	sendLogs := make([]*raft.Log, 0, len(logs))
+	sendInfos := make([]*OpInfo, 0, len(logs))
 
+	// repeats holds the op info of logs completing ops that repeat an
+	// earlier one under its idempotency key, by their index in logs
+	var repeats map[int]*OpInfo
+
+	// Hold the state lock for the whole batch so that CurrentState can't
+	// capture a state with only some of the batch's chunks stored.
+	c.stateLock.Lock()
 	for i, l := range logs {
 		// Not chunking or wrong type, pass through
-		if l.Type != raft.LogCommand || l.Extensions == nil {
+		if !c.conf.isChunk(l) {
+			// As in expirePassThrough, errors are left for the next log
+			c.expireOps(l)
 			sendLogs = append(sendLogs, l)
+			sendInfos = append(sendInfos, nil)
 			sentLogs[l.Index] = false
 			continue
 		}
 
-		logToApply, err := c.applyChunk(l)
+		logToApply, info, err := c.applyChunk(l)
 		if err != nil {
 			responses[i] = err
 			continue
@@ -227,14 +1175,33 @@ func (c *ChunkingBatchingFSM) ApplyBatch(logs []*raft.Log) []interface{} {
 
 		if logToApply != nil {
 			sendLogs = append(sendLogs, logToApply)
+			sendInfos = append(sendInfos, info)
 			sentLogs[l.Index] = true
+		} else if info != nil {
+			// Answered once the batch's responses are known, as the op
+			// it repeats may be in this batch
+			if repeats == nil {
+				repeats = make(map[int]*OpInfo)
+			}
+			repeats[i] = info
 		}
 	}
+	c.stateLock.Unlock()
 
 	// Send remaining logs to the underlying FSM.
 	var sentResponses []interface{}
 	if len(sendLogs) > 0 {
-		sentResponses = c.underlyingBatchingFSM.ApplyBatch(sendLogs)
+		if oa, ok := c.underlyingBatchingFSM.(OpBatchApplier); ok {
+			sentResponses = oa.ApplyOpBatch(sendLogs, sendInfos)
+		} else {
+			sentResponses = c.underlyingBatchingFSM.ApplyBatch(sendLogs)
+		}
+	}
+
+	for j, info := range sendInfos {
+		if info != nil {
+			c.recordResponse(info, sentResponses[j])
+		}
 	}
 
 	var sentCounter int
@@ -244,12 +1211,19 @@ func (c *ChunkingBatchingFSM) ApplyBatch(logs []*raft.Log) []interface{} {
 		if responses[j] != nil {
 			continue
 		}
+		if info, ok := repeats[j]; ok {
+			responses[j] = c.repeatedResponse(info)
+			continue
+		}
 
 		var resp interface{}
 		if chunked, ok := sentLogs[l.Index]; ok {
 			resp = sentResponses[sentCounter]
 			if chunked {
-				resp = ChunkingSuccess{Response: sentResponses[sentCounter]}
+				resp = ChunkingSuccess{
+					Response: sentResponses[sentCounter],
+					Metadata: sendInfos[sentCounter].Metadata,
+				}
 			}
 			sentCounter++
 		}
@@ -4,11 +4,19 @@
 package raftchunking
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/go-test/deep"
+	"github.com/hashicorp/go-raftchunking/types"
 	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
 )
 
 type MockBatchFSM struct {
@@ -267,3 +275,622 @@ func TestBatchingFSM_MixedData(t *testing.T) {
 	}
 
 }
+
+func TestFSM_PendingCounters(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+
+	_, logs := chunkData(t)
+
+	var expBytes uint64
+	for i, l := range logs[:len(logs)-1] {
+		if r := f.Apply(l); r != nil {
+			t.Fatalf("unexpected response for log %d: %#v", i, r)
+		}
+		expBytes += uint64(len(l.Data))
+		if ops := f.PendingOps(); ops != 1 {
+			t.Fatalf("expected 1 pending op, got %d", ops)
+		}
+		if b := f.PendingBytes(); b != expBytes {
+			t.Fatalf("expected %d pending bytes, got %d", expBytes, b)
+		}
+	}
+
+	// Re-applying a chunk should not double count it
+	if r := f.Apply(logs[0]); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+	if b := f.PendingBytes(); b != expBytes {
+		t.Fatalf("expected %d pending bytes after duplicate, got %d", expBytes, b)
+	}
+
+	// Capture the state so we can check the counters are rebuilt on restore
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := f.Apply(logs[len(logs)-1]).(ChunkingSuccess); !ok {
+		t.Fatal("expected final apply to succeed")
+	}
+	if ops, b := f.PendingOps(), f.PendingBytes(); ops != 0 || b != 0 {
+		t.Fatalf("expected empty counters after completion, got %d ops and %d bytes", ops, b)
+	}
+
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if ops, b := f.PendingOps(), f.PendingBytes(); ops != 1 || b != expBytes {
+		t.Fatalf("expected counters to be restored, got %d ops and %d bytes", ops, b)
+	}
+
+	// A term change clears everything
+	l := *logs[0]
+	l.Term++
+	if r := f.Apply(&l); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+	if ops, b := f.PendingOps(), f.PendingBytes(); ops != 1 || b != uint64(len(l.Data)) {
+		t.Fatalf("expected counters to be reset on term change, got %d ops and %d bytes", ops, b)
+	}
+}
+
+func TestFSM_PruneBefore(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+
+	// Interleave the first chunks of two ops so that they land at indexes
+	// 1-2 and 3-4 respectively
+	_, logsA := chunkData(t)
+	_, logsB := chunkData(t)
+	for i, l := range []*raft.Log{logsA[0], logsA[1], logsB[0], logsB[1]} {
+		l.Index = uint64(i + 1)
+		if r := f.Apply(l); r != nil {
+			t.Fatalf("unexpected response for log %d: %#v", i, r)
+		}
+	}
+
+	pruned, err := f.PruneBefore(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("expected 1 pruned op, got %d", pruned)
+	}
+	if ops := f.PendingOps(); ops != 1 {
+		t.Fatalf("expected 1 pending op, got %d", ops)
+	}
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.ChunkMap) != 1 || state.ChunkMap[logOpNum(t, logsB[0])] == nil {
+		t.Fatalf("expected only the second op to remain, got %#v", state.ChunkMap)
+	}
+
+	// Nothing else is at or below the same point
+	if pruned, err := f.PruneBefore(2, 0); err != nil || pruned != 0 {
+		t.Fatalf("expected nothing to be pruned, got %d, %v", pruned, err)
+	}
+
+	// A later term covers every index in earlier terms
+	if pruned, err := f.PruneBefore(0, 1); err != nil || pruned != 1 {
+		t.Fatalf("expected 1 pruned op, got %d, %v", pruned, err)
+	}
+	if ops, b := f.PendingOps(), f.PendingBytes(); ops != 0 || b != 0 {
+		t.Fatalf("expected empty counters, got %d ops and %d bytes", ops, b)
+	}
+}
+
+func logOpNum(t *testing.T, l *raft.Log) uint64 {
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	return ci.OpNum
+}
+
+// slowStorage slows down storing chunks to widen the window in which a torn
+// state could be observed.
+type slowStorage struct {
+	*InmemChunkStorage
+}
+
+func (s slowStorage) StoreChunk(chunk *ChunkInfo) (bool, error) {
+	time.Sleep(time.Millisecond)
+	return s.InmemChunkStorage.StoreChunk(chunk)
+}
+
+func TestBatchingFSM_StateIsolation(t *testing.T) {
+	m := &MockBatchFSM{
+		MockFSM: new(MockFSM),
+	}
+	f := NewChunkingBatchingFSM(m, slowStorage{NewInmemChunkStorage()})
+	_, logs := chunkData(t)
+
+	// Apply everything but the final chunk in batches of three; only chunk
+	// counts that are multiples of three are valid batch boundaries.
+	const batchSize = 3
+	logs = logs[:len(logs)-1]
+	logs = logs[:len(logs)-len(logs)%batchSize]
+
+	stop := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			state, err := f.CurrentState()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			var count int
+			for _, chunks := range state.ChunkMap {
+				for _, c := range chunks {
+					if c != nil {
+						count++
+					}
+				}
+			}
+			if count%batchSize != 0 {
+				errCh <- fmt.Errorf("observed torn state with %d chunks", count)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < len(logs); i += batchSize {
+		for _, r := range f.ApplyBatch(logs[i : i+batchSize]) {
+			if err, ok := r.(error); ok {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(stop)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSM_ConcurrentState(t *testing.T) {
+	f := NewChunkingFSM(new(MockFSM), nil)
+	b := NewChunkingBatchingFSM(&MockBatchFSM{MockFSM: new(MockFSM)}, nil)
+	_, logs := chunkData(t)
+
+	// Capturing and restoring state while logs are being applied must not
+	// race with Apply, as checked when run with the race detector
+	stop := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(errCh)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, fsm := range []*ChunkingFSM{f, b.ChunkingFSM} {
+				state, err := fsm.CurrentState()
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if err := fsm.RestoreState(state); err != nil {
+					errCh <- err
+					return
+				}
+				fsm.PendingOps()
+				fsm.PendingBytes()
+				fsm.Checkpoint()
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		for _, l := range logs {
+			f.Apply(l)
+		}
+		b.ApplyBatch(logs)
+	}
+	close(stop)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSM_InvalidSequenceNum(t *testing.T) {
+	data := make([]byte, 2*ChunkSize)
+	logs, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bad []*raft.Log
+	for _, seq := range []uint32{uint32(len(logs)), 1 << 31} {
+		var ci types.ChunkInfo
+		if err := proto.Unmarshal(logs[0].Extensions, &ci); err != nil {
+			t.Fatal(err)
+		}
+		ci.SequenceNum = seq
+		ext, err := proto.Marshal(&ci)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad = append(bad, &raft.Log{Data: []byte("bad"), Extensions: ext})
+	}
+
+	// Out of range chunks are rejected rather than panicking, leaving the
+	// op they claim to complete
+	m := &MockBatchFSM{MockFSM: new(MockFSM)}
+	f := NewChunkingBatchingFSM(m, nil)
+	r := NewReassembler(func(uint64) (io.Writer, error) { return new(bytes.Buffer), nil })
+	for _, l := range bad {
+		if err, _ := f.Apply(l).(error); !errors.Is(err, ErrInvalidSequenceNum) {
+			t.Fatalf("expected an invalid sequence number, got %v", err)
+		}
+		if err, _ := f.ApplyBatch([]*raft.Log{l})[0].(error); !errors.Is(err, ErrInvalidSequenceNum) {
+			t.Fatalf("expected an invalid sequence number from the batch, got %v", err)
+		}
+		if _, err := r.Add(l); !errors.Is(err, ErrInvalidSequenceNum) {
+			t.Fatalf("expected the reassembler to reject the chunk, got %v", err)
+		}
+	}
+	var resp interface{}
+	for i := range logs {
+		resp = f.Apply(&logs[i])
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok || !bytes.Equal(data, m.logs[0]) {
+		t.Fatalf("expected the op to complete, got %#v", resp)
+	}
+}
+
+func TestFSM_MaxChunks(t *testing.T) {
+	logs, err := SplitIntoLogs(make([]byte, 2*ChunkSize), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(logs[0].Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	ci.NumChunks = math.MaxUint32
+	ext, err := proto.Marshal(&ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	huge := &raft.Log{Data: []byte("huge"), Extensions: ext}
+
+	// A crafted chunk count is rejected before anything is set aside for it
+	f := NewChunkingFSM(new(MockFSM), nil)
+	if err, _ := f.Apply(huge).(error); !errors.Is(err, ErrTooManyChunks) {
+		t.Fatalf("expected too many chunks, got %v", err)
+	}
+	r := NewReassembler(func(uint64) (io.Writer, error) { return new(bytes.Buffer), nil })
+	if _, err := r.Add(huge); !errors.Is(err, ErrTooManyChunks) {
+		t.Fatalf("expected the reassembler to reject the chunk, got %v", err)
+	}
+	if f.PendingOps() != 0 {
+		t.Fatalf("expected nothing to be tracked, got %d ops", f.PendingOps())
+	}
+
+	// The limit can be lowered or lifted
+	f = NewChunkingFSM(new(MockFSM), nil, WithMaxChunks(len(logs)-1))
+	if err, _ := f.Apply(&logs[0]).(error); !errors.Is(err, ErrTooManyChunks) {
+		t.Fatalf("expected too many chunks, got %v", err)
+	}
+	f = NewChunkingFSM(new(MockFSM), nil, WithMaxChunks(-1))
+	var resp interface{}
+	for i := range logs {
+		resp = f.Apply(&logs[i])
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+}
+
+func TestFSM_ReassemblySize(t *testing.T) {
+	data := compressibleData(3*ChunkSize + 100)
+	kp := newTestKeyProvider(t)
+	for name, opts := range map[string][]Option{
+		"plain":      nil,
+		"encrypted":  {WithKeyProvider(kp)},
+		"compressed": {WithCompression(CompressionGzip), WithTotalSize()},
+	} {
+		logs, err := SplitIntoLogs(data, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil, opts...)
+		for i := range logs {
+			f.Apply(&logs[i])
+		}
+		// The payload is allocated once at its exact size
+		if len(m.logs) != 1 || !bytes.Equal(data, m.logs[0]) {
+			t.Fatalf("%s: expected the payload to be applied", name)
+		}
+		if cap(m.logs[0]) != len(data) {
+			t.Fatalf("%s: expected a buffer of %d bytes, got %d", name, len(data), cap(m.logs[0]))
+		}
+	}
+}
+
+type opApplierFSM struct {
+	*MockBatchFSM
+	infos []*OpInfo
+}
+
+func (o *opApplierFSM) ApplyOp(l *raft.Log, info OpInfo) interface{} {
+	o.infos = append(o.infos, &info)
+	return o.Apply(l)
+}
+
+func (o *opApplierFSM) ApplyOpBatch(logs []*raft.Log, infos []*OpInfo) []interface{} {
+	o.infos = append(o.infos, infos...)
+	return o.ApplyBatch(logs)
+}
+
+func TestFSM_OpApplier(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	logs, err := SplitIntoLogs(data, nil, WithContentType("application/json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opNum := logOpNum(t, &logs[0])
+	expected := []*OpInfo{{OpNum: opNum, ContentType: "application/json"}}
+
+	m := &opApplierFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	f := NewChunkingFSM(m, nil)
+	var resp interface{}
+	for i := range logs {
+		resp = f.Apply(&logs[i])
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if diff := deep.Equal(expected, m.infos); diff != nil {
+		t.Fatal(diff)
+	}
+
+	// In a batch, logs that weren't chunked get no info
+	m = &opApplierFSM{MockBatchFSM: &MockBatchFSM{MockFSM: new(MockFSM)}}
+	bf := NewChunkingBatchingFSM(m, nil)
+	batch := []*raft.Log{{Index: 1, Data: []byte("plain")}}
+	for i := range logs {
+		logs[i].Index = uint64(i + 2)
+		batch = append(batch, &logs[i])
+	}
+	bf.ApplyBatch(batch)
+	if diff := deep.Equal(append([]*OpInfo{nil}, expected...), m.infos); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestFSM_StrandedOp(t *testing.T) {
+	sink := new(recordingSink)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithAuditSink(sink))
+
+	// The follower is restored from a snapshot taken after the op's first
+	// chunk was applied, without the chunk state
+	logs := auditLogs(t, time.Now())
+	if err := f.Restore(io.NopCloser(bytes.NewReader(nil))); err != nil {
+		t.Fatal(err)
+	}
+
+	err, ok := f.Apply(logs[1]).(error)
+	var stranded *StrandedOpError
+	if !ok || !errors.As(err, &stranded) {
+		t.Fatalf("expected stranded op error, got %#v", err)
+	}
+	if stranded.OpNum != logOpNum(t, logs[0]) || stranded.FirstIndex != logs[1].Index {
+		t.Fatalf("unexpected error %#v", stranded)
+	}
+	for _, l := range logs[2:] {
+		if resp := f.Apply(l); resp != nil {
+			t.Fatalf("expected nil response, got %#v", resp)
+		}
+	}
+	if f.PendingOps() != 0 || len(m.logs) != 0 {
+		t.Fatalf("expected op to be discarded, have %d pending and %d applied", f.PendingOps(), len(m.logs))
+	}
+	if len(sink.records) != 1 || sink.records[0].Outcome != OpStranded {
+		t.Fatalf("expected a stranded record, got %#v", sink.records)
+	}
+
+	// Ops starting after the restore are unaffected
+	next := auditLogs(t, time.Now())
+	for i, l := range next {
+		l.Index = logs[len(logs)-1].Index + uint64(i+1)
+		f.Apply(l)
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected the next op to be applied, got %d", len(m.logs))
+	}
+}
+
+type wrappingFSM struct {
+	raft.FSM
+}
+
+func (w wrappingFSM) Unwrap() raft.FSM {
+	return w.FSM
+}
+
+func TestFSMAs(t *testing.T) {
+	m := &MockBatchFSM{MockFSM: new(MockFSM)}
+	f := NewChunkingBatchingFSM(m, nil)
+	var stack raft.FSM = wrappingFSM{f}
+
+	var cfsm *ChunkingFSM
+	if !FSMAs(stack, &cfsm) || cfsm != f.ChunkingFSM {
+		t.Fatal("expected to find the ChunkingFSM")
+	}
+	var bfsm raft.BatchingFSM
+	if !FSMAs(stack, &bfsm) || bfsm != raft.BatchingFSM(f) {
+		t.Fatal("expected to find the ChunkingBatchingFSM first")
+	}
+	var mock *MockBatchFSM
+	if !FSMAs(stack, &mock) || mock != m {
+		t.Fatal("expected to find the underlying FSM")
+	}
+	var store raft.ConfigurationStore
+	if FSMAs(stack, &store) {
+		t.Fatal("unexpected configuration store")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected panic for non-pointer target")
+		}
+	}()
+	FSMAs(stack, cfsm)
+}
+
+func TestFSM_ApplyError(t *testing.T) {
+	f := NewChunkingBatchingFSM(&MockBatchFSM{MockFSM: new(MockFSM)}, nil)
+
+	bad := &raft.Log{Index: 5, Term: 2, Type: raft.LogCommand, Data: []byte("foo"), Extensions: []byte{0xff}}
+	var applyErr *ApplyError
+	if err, ok := f.Apply(bad).(error); !ok || !errors.As(err, &applyErr) {
+		t.Fatalf("expected apply error, got %#v", err)
+	}
+	if applyErr.Index != 5 || applyErr.Term != 2 || applyErr.OpNum != 0 {
+		t.Fatalf("unexpected error context %#v", applyErr)
+	}
+
+	logs := auditLogs(t, time.Now(), WithHashAlgorithm(HashSHA256))
+	logs[0].Data[0] ^= 0xff
+	resps := f.ApplyBatch(logs)
+	last := len(logs) - 1
+	err, ok := resps[last].(error)
+	if !ok || !errors.As(err, &applyErr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum apply error, got %#v", resps[last])
+	}
+	expected := &ApplyError{
+		Index:       logs[last].Index,
+		Term:        logs[last].Term,
+		OpNum:       logOpNum(t, logs[0]),
+		SequenceNum: uint32(last),
+		Err:         applyErr.Err,
+	}
+	if diff := deep.Equal(expected, applyErr); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestFSM_Deadline(t *testing.T) {
+	sink := new(recordingSink)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithAuditSink(sink))
+
+	// Chunks are appended a second apart, so the deadline passes before the
+	// third one
+	start := time.Now()
+	logs := auditLogs(t, start, WithDeadline(start.Add(time.Second)))
+	f.Apply(logs[0])
+	f.Apply(logs[1])
+	if f.PendingOps() != 1 {
+		t.Fatalf("expected 1 pending op, got %d", f.PendingOps())
+	}
+	for _, l := range logs[2:] {
+		if resp := f.Apply(l); resp != nil {
+			t.Fatalf("expected nil response, got %#v", resp)
+		}
+	}
+	if f.PendingOps() != 0 || len(m.logs) != 0 {
+		t.Fatalf("expected op to be discarded, have %d pending and %d applied", f.PendingOps(), len(m.logs))
+	}
+	if len(sink.records) != 1 || sink.records[0].Outcome != OpExpired || sink.records[0].ChunksReceived != 2 {
+		t.Fatalf("expected an expired record, got %#v", sink.records)
+	}
+
+	// Other logs expire ops too
+	logs = auditLogs(t, start, WithDeadline(start.Add(time.Second)))
+	f.Apply(logs[0])
+	f.Apply(&raft.Log{Type: raft.LogCommand, Data: []byte("plain"), AppendedAt: start.Add(time.Minute)})
+	if f.PendingOps() != 0 || len(sink.records) != 2 || sink.records[1].Outcome != OpExpired {
+		t.Fatalf("expected op to expire, have %d pending and records %#v", f.PendingOps(), sink.records)
+	}
+
+	// Ops expiring together are dropped in op num order
+	sink.records = nil
+	var opNums []uint64
+	for i := 0; i < 5; i++ {
+		logs = auditLogs(t, start, WithDeadline(start.Add(time.Second)))
+		f.Apply(logs[0])
+		opNums = append(opNums, logOpNum(t, logs[0]))
+	}
+	sort.Slice(opNums, func(i, j int) bool { return opNums[i] < opNums[j] })
+	f.Apply(&raft.Log{Type: raft.LogCommand, Data: []byte("plain"), AppendedAt: start.Add(time.Minute)})
+	if len(sink.records) != len(opNums) {
+		t.Fatalf("expected %d ops to expire, got %d", len(opNums), len(sink.records))
+	}
+	for i, rec := range sink.records {
+		if rec.OpNum != opNums[i] {
+			t.Fatalf("expected op %d to expire at position %d, got %d", opNums[i], i, rec.OpNum)
+		}
+	}
+
+	// Ops that finish in time are applied
+	logs = auditLogs(t, start, WithDeadline(start.Add(time.Hour)))
+	for _, l := range logs {
+		f.Apply(l)
+	}
+	if len(m.logs) != 3 {
+		t.Fatalf("expected op to be applied, got %d logs", len(m.logs))
+	}
+}
+
+func TestFSM_ReorderWindow(t *testing.T) {
+	sink := new(recordingSink)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithAuditSink(sink), WithReorderWindow(2))
+
+	// Chunks are submitted out of order, but the logs are still applied in
+	// index order
+	var index uint64
+	apply := func(l *raft.Log) interface{} {
+		index++
+		l.Index = index
+		return f.Apply(l)
+	}
+
+	// Within the window the op completes as usual
+	logs := auditLogs(t, time.Now())
+	if len(logs) < 4 {
+		t.Fatalf("expected at least 4 chunks, got %d", len(logs))
+	}
+	for _, i := range []int{1, 0, 3, 2} {
+		if err, ok := apply(logs[i]).(error); ok {
+			t.Fatal(err)
+		}
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected op to be applied, got %d logs", len(m.logs))
+	}
+
+	// A chunk too far ahead fails the op
+	logs = auditLogs(t, time.Now())
+	apply(logs[0])
+	err, ok := apply(logs[3]).(error)
+	if !ok || !errors.Is(err, ErrOutOfOrder) {
+		t.Fatalf("expected out of order error, got %#v", err)
+	}
+	for _, l := range logs[1:3] {
+		if resp := apply(l); resp != nil {
+			t.Fatalf("expected nil response, got %#v", resp)
+		}
+	}
+	if f.PendingOps() != 0 || len(m.logs) != 1 {
+		t.Fatalf("expected op to be discarded, have %d pending and %d applied", f.PendingOps(), len(m.logs))
+	}
+	rec := sink.records[len(sink.records)-1]
+	if rec.Outcome != OpFailed || !errors.Is(rec.Err, ErrOutOfOrder) || rec.ChunksReceived != 1 {
+		t.Fatalf("expected failed record, got %#v", rec)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ErrStaleOp is returned, wrapped, for the final chunk of an op that was
+// discarded as stale; see WithStaleOpGC.
+var ErrStaleOp = errors.New("op went stale")
+
+// WithStaleOpGC makes the FSM discard incomplete ops whose latest chunk was
+// applied more than maxIndexes log indexes, or appended more than maxAge,
+// before the log being applied, such as those left behind by a client that
+// died partway through. Zero disables either check. Ops are otherwise kept
+// until the term changes. Their remaining chunks are ignored, and the final
+// one returns ErrStaleOp from Apply. Ops are checked as each log is applied,
+// chunked or not, against the log's index and append time, so every node must
+// be given the same limits or their states will diverge. If onDiscard is not
+// nil it is called with the record of each op discarded, with the FSM's state
+// locked, so it must not call back into the FSM; the op is also reported to
+// any audit sink, with the OpStale outcome. It is ignored by ChunkingApply.
+func WithStaleOpGC(maxIndexes uint64, maxAge time.Duration, onDiscard func(OpRecord)) Option {
+	return func(c *config) {
+		c.staleIndexes = maxIndexes
+		c.staleAge = maxAge
+		c.staleOpHook = onDiscard
+	}
+}
+
+// staleOpGC returns whether stale ops are collected.
+func (c *config) staleOpGC() bool {
+	return c.staleIndexes != 0 || c.staleAge > 0
+}
+
+// isStale returns whether op has gone stale as of log l.
+func (c *config) isStale(op *opState, l *raft.Log) bool {
+	return c.isStaleSince(op.last, op.lastAt, l)
+}
+
+// isStaleSince returns whether something last seen in the log with the given
+// index and append time has gone stale as of log l. Either being unknown, as
+// zero, skips its check.
+func (c *config) isStaleSince(last uint64, lastAt time.Time, l *raft.Log) bool {
+	if c.staleIndexes != 0 && last != 0 && l.Index > last && l.Index-last > c.staleIndexes {
+		return true
+	}
+	return c.staleAge > 0 && !lastAt.IsZero() && !l.AppendedAt.IsZero() && l.AppendedAt.Sub(lastAt) > c.staleAge
+}
+
+// collectStaleOps discards the ops that have gone stale as of log l, in op
+// num order so that every node reports them alike.
+func (c *ChunkingFSM) collectStaleOps(l *raft.Log) error {
+	if !c.conf.staleOpGC() || (len(c.ops) == 0 && len(c.reservations) == 0) {
+		return nil
+	}
+	c.dropReservations(func(r reservation) bool { return c.conf.isStaleSince(r.index, r.at, l) })
+
+	var stale []opKey
+	for key, op := range c.ops {
+		if c.conf.isStale(op, l) {
+			stale = append(stale, key)
+		}
+	}
+	sortKeys(stale)
+
+	for _, key := range stale {
+		if _, err := c.store.FinalizeOp(c.ops[key].storeNum); err != nil {
+			return err
+		}
+		op := c.untrackOp(key)
+		c.discardOp(key)
+		err := fmt.Errorf("op %d: %w", key.opNum, ErrStaleOp)
+		c.discarded[key] = err
+		c.abortStream(key.opNum, op, OpStale, err)
+		c.audit(key.opNum, op, OpStale, err, l.Index, l.Term, l.AppendedAt)
+		if c.conf.staleOpHook != nil {
+			c.conf.staleOpHook(opRecord(key.opNum, op, OpStale, err, l.Index, l.Term, l.AppendedAt))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestFSM_StaleOpGC(t *testing.T) {
+	sink := new(recordingSink)
+	var discarded []OpRecord
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithAuditSink(sink), WithStaleOpGC(10, 0, func(rec OpRecord) {
+		discarded = append(discarded, rec)
+	}))
+
+	logs, err := SplitIntoLogs(make([]byte, 3*ChunkSize), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opNum := logOpNum(t, &logs[0])
+	logs[0].Index = 1
+	if r := f.Apply(&logs[0]); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+
+	// The op is kept for as many indexes as allowed, chunked or not
+	index := uint64(2)
+	for ; index <= 11; index++ {
+		f.Apply(&raft.Log{Index: index, Data: []byte("plain")})
+	}
+	if f.PendingOps() != 1 || len(discarded) != 0 {
+		t.Fatalf("expected the op to be kept, got %d pending", f.PendingOps())
+	}
+	f.Apply(&raft.Log{Index: index, Data: []byte("plain")})
+	if f.PendingOps() != 0 || f.PendingBytes() != 0 {
+		t.Fatalf("expected the op to be discarded, got %d pending", f.PendingOps())
+	}
+	if len(discarded) != 1 || discarded[0].OpNum != opNum || discarded[0].Outcome != OpStale || discarded[0].Index != index || !errors.Is(discarded[0].Err, ErrStaleOp) {
+		t.Fatalf("unexpected discard records %#v", discarded)
+	}
+	if len(sink.records) != 1 || sink.records[0].Outcome != OpStale {
+		t.Fatalf("expected the discard to be audited, got %#v", sink.records)
+	}
+
+	// The op's remaining chunks are ignored, and the final one fails
+	for i := 1; i < len(logs); i++ {
+		index++
+		logs[i].Index = index
+		r := f.Apply(&logs[i])
+		if i < len(logs)-1 && r != nil {
+			t.Fatalf("unexpected response for chunk %d: %#v", i, r)
+		}
+		if err, ok := r.(error); i == len(logs)-1 && (!ok || !errors.Is(err, ErrStaleOp)) {
+			t.Fatalf("expected a stale op error, got %#v", r)
+		}
+	}
+	if f.PendingOps() != 0 || len(m.logs) != 11 {
+		t.Fatalf("expected only the plain logs to be applied, got %d pending and %d applied", f.PendingOps(), len(m.logs))
+	}
+}
+
+func TestFSM_StaleOpGCAge(t *testing.T) {
+	f := NewChunkingFSM(new(MockFSM), nil, WithStaleOpGC(0, time.Minute, nil))
+	start := time.Now()
+
+	split := func() []raft.Log {
+		logs, err := SplitIntoLogs(make([]byte, 3*ChunkSize), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return logs
+	}
+	idle, busy := split(), split()
+
+	// An op that keeps getting chunks is kept, while one that doesn't is
+	// discarded once a minute has passed since its last chunk
+	var index uint64
+	apply := func(l *raft.Log, at time.Time) interface{} {
+		index++
+		l.Index = index
+		l.AppendedAt = at
+		return f.Apply(l)
+	}
+	apply(&idle[0], start)
+	for i := 0; i < len(busy)-1; i++ {
+		apply(&busy[i], start.Add(time.Duration(i+1)*40*time.Second))
+	}
+	if f.PendingOps() != 1 {
+		t.Fatalf("expected only the busy op to be kept, got %d pending", f.PendingOps())
+	}
+	if _, ok := apply(&busy[len(busy)-1], start.Add(3*time.Minute)).(ChunkingSuccess); !ok {
+		t.Fatal("expected the busy op to complete")
+	}
+
+	// Ops are not aged without append times
+	other := split()
+	apply(&other[0], time.Time{})
+	apply(&raft.Log{Data: []byte("plain")}, start.Add(time.Hour))
+	if f.PendingOps() != 1 {
+		t.Fatalf("expected the op to be kept, got %d pending", f.PendingOps())
+	}
+}
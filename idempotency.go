@@ -0,0 +1,116 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+)
+
+// WithIdempotencyKey tags an op with a key chosen by the client, such as a
+// request ID, so that an FSM configured with WithIdempotencyWindow applies
+// only the first op with that key. A client that gets an ambiguous error,
+// such as a timeout, can then retry the op under the same key and be given
+// the response to the earlier op if it was in fact applied. Unlike
+// WithContentOpNum, retries may be encrypted afresh. Keys should be unique
+// to an op; a new op under an old key is not applied. It is ignored by the
+// FSM.
+func WithIdempotencyKey(key string) Option {
+	return func(c *config) {
+		c.idempotencyKey = key
+	}
+}
+
+// WithIdempotencyWindow makes the FSM remember the keys of the last n ops it
+// applied with WithIdempotencyKey, along with the underlying FSM's response
+// to each. A later op under one of those keys is not applied; its final
+// chunk is instead given the earlier response, in a ChunkingSuccess. The keys
+// are part of the state captured by CurrentState, but the responses are not,
+// so once the state is restored a repeated op is answered with an error
+// wrapping ErrDuplicateOp. Since the keys decide whether ops are applied,
+// every node must be given the same n. It is ignored by ChunkingApply.
+func WithIdempotencyWindow(n int) Option {
+	return func(c *config) {
+		c.idempotencyWindow = n
+	}
+}
+
+// keyResponse is the underlying FSM's response to an op with an idempotency
+// key, if known.
+type keyResponse struct {
+	resp  interface{}
+	known bool
+}
+
+// appliedKeys remembers the idempotency keys of the most recently applied
+// ops.
+type appliedKeys struct {
+	size      int
+	order     []string
+	responses map[string]*keyResponse
+}
+
+func newAppliedKeys(size int, keys []string) *appliedKeys {
+	if size <= 0 {
+		return nil
+	}
+	a := &appliedKeys{
+		size:      size,
+		responses: make(map[string]*keyResponse, size),
+	}
+	for _, key := range keys {
+		a.add(key)
+	}
+	return a
+}
+
+// add records that an op with the key has been applied, with its response
+// yet to be known.
+func (a *appliedKeys) add(key string) {
+	if a == nil || key == "" {
+		return
+	}
+	if _, ok := a.responses[key]; ok {
+		return
+	}
+	a.order = append(a.order, key)
+	a.responses[key] = new(keyResponse)
+	if len(a.order) > a.size {
+		delete(a.responses, a.order[0])
+		a.order = a.order[1:]
+	}
+}
+
+func (a *appliedKeys) has(key string) bool {
+	if a == nil || key == "" {
+		return false
+	}
+	_, ok := a.responses[key]
+	return ok
+}
+
+// setResponse records the response to the op with the key, if it is still
+// remembered.
+func (a *appliedKeys) setResponse(key string, resp interface{}) {
+	if a == nil || key == "" {
+		return
+	}
+	if r, ok := a.responses[key]; ok {
+		r.resp, r.known = resp, true
+	}
+}
+
+// response returns what to answer a repeat of the op with the key with.
+func (a *appliedKeys) response(key string, info *OpInfo) interface{} {
+	if r, ok := a.responses[key]; ok && r.known {
+		return ChunkingSuccess{Response: r.resp, Metadata: info.Metadata}
+	}
+	return fmt.Errorf("op %d with idempotency key %q: %w", info.OpNum, key, ErrDuplicateOp)
+}
+
+func (a *appliedKeys) list() []string {
+	if a == nil || len(a.order) == 0 {
+		return nil
+	}
+	return append([]string(nil), a.order...)
+}
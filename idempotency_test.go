@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// underlyingResponse returns the underlying FSM's response from a
+// ChunkingSuccess, or the response as it is if it isn't one.
+func underlyingResponse(resp interface{}) interface{} {
+	if cs, ok := resp.(ChunkingSuccess); ok {
+		return cs.Response
+	}
+	return resp
+}
+
+func TestIdempotencyWindow(t *testing.T) {
+	data := make([]byte, 2*ChunkSize)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithIdempotencyWindow(2))
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+	apply := func(key string) interface{} {
+		t.Helper()
+		future := ChunkingApply(data, nil, time.Second, applyFunc, WithIdempotencyKey(key))
+		if err := future.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return future.Response()
+	}
+
+	// A retry under the same key gets the first op's response
+	if resp := apply("a"); underlyingResponse(resp) != 1 {
+		t.Fatalf("unexpected response %#v", resp)
+	}
+	if resp := apply("a"); underlyingResponse(resp) != 1 {
+		t.Fatalf("expected the earlier response, got %#v", resp)
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected 1 applied op, got %d", len(m.logs))
+	}
+
+	// Ops without a key, or with others, are applied
+	if resp := apply(""); underlyingResponse(resp) != 2 {
+		t.Fatalf("unexpected response %#v", resp)
+	}
+	if resp := apply("b"); underlyingResponse(resp) != 3 {
+		t.Fatalf("unexpected response %#v", resp)
+	}
+
+	// The keys survive capturing and restoring the state, but not the
+	// responses
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.IdempotencyKeys) != 2 {
+		t.Fatalf("expected 2 keys in state, got %d", len(state.IdempotencyKeys))
+	}
+	f = NewChunkingFSM(m, nil, WithIdempotencyWindow(2))
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if resp, ok := apply("a").(error); !ok || !errors.Is(resp, ErrDuplicateOp) {
+		t.Fatalf("expected duplicate op error, got %#v", resp)
+	}
+
+	// Keys fall out of the window as others are applied
+	apply("c")
+	apply("d")
+	if resp := apply("a"); underlyingResponse(resp) != 6 {
+		t.Fatalf("expected op to be applied again, got %#v", resp)
+	}
+}
+
+func TestIdempotencyWindow_Batch(t *testing.T) {
+	data := make([]byte, 2*ChunkSize)
+	var logs []*raft.Log
+	for i := 0; i < 2; i++ {
+		split, err := SplitIntoLogs(data, nil, WithIdempotencyKey("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := range split {
+			split[j].Index = uint64(len(logs) + 1)
+			logs = append(logs, &split[j])
+		}
+	}
+
+	// An op repeated within the same batch gets the first one's response
+	m := &MockBatchFSM{MockFSM: new(MockFSM)}
+	f := NewChunkingBatchingFSM(m, nil, WithIdempotencyWindow(10))
+	responses := f.ApplyBatch(logs)
+	first, last := responses[len(logs)/2-1], responses[len(logs)-1]
+	if underlyingResponse(first) != 1 || underlyingResponse(last) != 1 {
+		t.Fatalf("expected both ops to get the same response, got %#v and %#v", first, last)
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected 1 applied op, got %d", len(m.logs))
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/hashicorp/go-raftchunking/internal/blake3"
+	"github.com/hashicorp/go-raftchunking/internal/xxhash"
+	"github.com/hashicorp/go-raftchunking/types"
+)
+
+// ErrChecksumMismatch is returned, wrapped, when chunk data fails an
+// integrity check.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// HashAlgorithm selects the hash used to check the integrity of chunked
+// payloads. The algorithm is recorded in the chunk headers, so the FSM does
+// not need to be configured with it.
+type HashAlgorithm int32
+
+const (
+	// HashNone disables integrity checks.
+	HashNone HashAlgorithm = HashAlgorithm(types.HashAlgorithm_HASH_ALGORITHM_UNSPECIFIED)
+
+	// HashCRC32C uses CRC-32 with the Castagnoli polynomial. It is the
+	// cheapest option and only guards against accidental corruption.
+	HashCRC32C HashAlgorithm = HashAlgorithm(types.HashAlgorithm_HASH_ALGORITHM_CRC32C)
+
+	// HashXXHash64 uses 64-bit xxHash, a fast non-cryptographic hash.
+	HashXXHash64 HashAlgorithm = HashAlgorithm(types.HashAlgorithm_HASH_ALGORITHM_XXHASH64)
+
+	// HashBLAKE3 uses BLAKE3, a cryptographic hash.
+	HashBLAKE3 HashAlgorithm = HashAlgorithm(types.HashAlgorithm_HASH_ALGORITHM_BLAKE3)
+
+	// HashSHA256 uses SHA-256.
+	HashSHA256 HashAlgorithm = HashAlgorithm(types.HashAlgorithm_HASH_ALGORITHM_SHA256)
+)
+
+func (h HashAlgorithm) String() string {
+	switch h {
+	case HashNone:
+		return "none"
+	case HashCRC32C:
+		return "crc32c"
+	case HashXXHash64:
+		return "xxhash64"
+	case HashBLAKE3:
+		return "blake3"
+	case HashSHA256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("HashAlgorithm(%d)", int32(h))
+	}
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newHash returns a hash for the algorithm, or nil for HashNone.
+func (h HashAlgorithm) newHash() (hash.Hash, error) {
+	switch h {
+	case HashNone:
+		return nil, nil
+	case HashCRC32C:
+		return crc32.New(crc32cTable), nil
+	case HashXXHash64:
+		return xxhash.New(), nil
+	case HashBLAKE3:
+		return blake3.New(), nil
+	case HashSHA256:
+		return sha256.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %v", h)
+	}
+}
+
+// digestSize returns the size of the digests produced by the algorithm.
+func (h HashAlgorithm) digestSize() int {
+	hasher, err := h.newHash()
+	if err != nil || hasher == nil {
+		return 0
+	}
+	return hasher.Size()
+}
+
+// WithHashAlgorithm enables an end-to-end integrity check of chunked payloads.
+// On the apply side the data of every chunk, as carried in the log, is fed to
+// the hash and the resulting digest is sent with the final chunk. On the FSM
+// side the digest is verified before the payload is handed on; the algorithm
+// is taken from the chunk headers, so this option is ignored there.
+func WithHashAlgorithm(alg HashAlgorithm) Option {
+	return func(c *config) {
+		c.hashAlgorithm = alg
+	}
+}
+
+// payloadHash hashes an op's chunks in sequence order as they arrive, so that
+// the payload digest is ready as soon as the op completes rather than having
+// to be computed over the whole payload at that point.
+type payloadHash struct {
+	alg    HashAlgorithm
+	hasher hash.Hash
+	next   uint32
+
+	// pending holds data for chunks that arrived ahead of next
+	pending map[uint32][]byte
+
+	// invalid is set if a chunk that had already been hashed was stored
+	// again; the digest is then computed from the stored chunks instead
+	invalid bool
+}
+
+// newPayloadHash returns a payloadHash for the algorithm, or nil if there is
+// nothing to hash.
+func newPayloadHash(alg HashAlgorithm) *payloadHash {
+	hasher, err := alg.newHash()
+	if err != nil || hasher == nil {
+		// Any error is reported when the digest is verified
+		return nil
+	}
+	return &payloadHash{
+		alg:     alg,
+		hasher:  hasher,
+		pending: make(map[uint32][]byte),
+	}
+}
+
+// add feeds a chunk's data into the hash, along with any chunks following it
+// that are waiting.
+func (p *payloadHash) add(seq uint32, data []byte) {
+	if p == nil || p.invalid {
+		return
+	}
+	if seq < p.next {
+		p.invalid = true
+		p.pending = nil
+		return
+	}
+	p.pending[seq] = data
+	for {
+		data, ok := p.pending[p.next]
+		if !ok {
+			return
+		}
+		p.hasher.Write(data)
+		delete(p.pending, p.next)
+		p.next++
+	}
+}
+
+// verify checks the digest in ci, the info of the chunk that completed the op.
+// If the incremental hash couldn't keep track of the op's chunks it falls
+// back to hashing the stored chunks.
+func (p *payloadHash) verify(ci *types.ChunkInfo, chunks []*ChunkInfo) error {
+	if p == nil || p.invalid || p.alg != HashAlgorithm(ci.HashAlgorithm) || p.next != uint32(len(chunks)) {
+		return verifyPayloadDigest(ci, chunks)
+	}
+	return checkDigest(ci.OpNum, p.alg, p.hasher, ci.PayloadDigest)
+}
+
+// verifyPayloadDigest checks the data of an op's chunks against the digest
+// recorded in the final chunk. Nothing is checked if the op was sent without
+// one.
+func verifyPayloadDigest(ci *types.ChunkInfo, chunks []*ChunkInfo) error {
+	alg := HashAlgorithm(ci.HashAlgorithm)
+	hasher, err := alg.newHash()
+	if err != nil || hasher == nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		hasher.Write(chunk.Data)
+	}
+	return checkDigest(ci.OpNum, alg, hasher, ci.PayloadDigest)
+}
+
+// checkDigest compares the sum of hasher against expected.
+func checkDigest(opNum uint64, alg HashAlgorithm, hasher hash.Hash, expected []byte) error {
+	if !bytes.Equal(hasher.Sum(nil), expected) {
+		return fmt.Errorf("%s payload digest of op %d did not match: %w", alg, opNum, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// chunkChecksumSize is the size of a chunk's CRC-32C checksum.
+const chunkChecksumSize = crc32.Size
+
+// WithChunkChecksums makes ChunkingApply record a CRC-32C of each chunk's
+// data, as carried in the log, in the chunk's header. Unlike the payload
+// digest, which is only checked once an op completes, each chunk is checked
+// as soon as it arrives, so that data mangled by a log store or middleware is
+// pinned to the chunk it was found in and never stored. The FSM and
+// Reassembler verify the checksums of any chunks that carry them, so it is
+// ignored by the FSM. Like HashCRC32C, it is not allowed with WithFIPSMode.
+func WithChunkChecksums() Option {
+	return func(c *config) {
+		c.chunkChecksums = true
+	}
+}
+
+// ChunkChecksumError is returned when a chunk's data does not match the
+// checksum in its header; the FSM returns it wrapped in an ApplyError. It
+// matches ErrChecksumMismatch with errors.Is.
+type ChunkChecksumError struct {
+	OpNum       uint64
+	SequenceNum uint32
+
+	// Expected is the checksum sent with the chunk, and Actual the one
+	// computed from the data received
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChunkChecksumError) Error() string {
+	return fmt.Sprintf("checksum of chunk %d of op %d did not match: expected %08x, got %08x",
+		e.SequenceNum, e.OpNum, e.Expected, e.Actual)
+}
+
+// Is makes the error match ErrChecksumMismatch.
+func (e *ChunkChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+// chunkChecksum returns the checksum to record for a chunk's data.
+func chunkChecksum(data []byte) []byte {
+	sum := make([]byte, chunkChecksumSize)
+	binary.BigEndian.PutUint32(sum, crc32.Checksum(data, crc32cTable))
+	return sum
+}
+
+// verifyChunkChecksum checks a chunk's data against the checksum in its
+// header. Nothing is checked if the chunk was sent without one.
+func verifyChunkChecksum(ci *types.ChunkInfo, data []byte) error {
+	if len(ci.ChunkChecksum) == 0 {
+		return nil
+	}
+	actual := crc32.Checksum(data, crc32cTable)
+	var expected uint32
+	if len(ci.ChunkChecksum) == chunkChecksumSize {
+		expected = binary.BigEndian.Uint32(ci.ChunkChecksum)
+		if expected == actual {
+			return nil
+		}
+	}
+	return &ChunkChecksumError{
+		OpNum:       ci.OpNum,
+		SequenceNum: ci.SequenceNum,
+		Expected:    expected,
+		Actual:      actual,
+	}
+}
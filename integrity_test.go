@@ -0,0 +1,367 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+var hashAlgorithms = []HashAlgorithm{HashCRC32C, HashXXHash64, HashBLAKE3, HashSHA256}
+
+// anyHash returns the algorithm for tests that need a payload digest but not
+// a particular one. CRC-32C isn't allowed in FIPS builds, so SHA-256 is used
+// there instead.
+func anyHash() HashAlgorithm {
+	if fipsBuild {
+		return HashSHA256
+	}
+	return HashCRC32C
+}
+
+// withChunkChecksums returns WithChunkChecksums for tests that check chunks
+// with them when they can, or no options in FIPS builds, which don't allow
+// them.
+func withChunkChecksums() []Option {
+	if fipsBuild {
+		return nil
+	}
+	return []Option{WithChunkChecksums()}
+}
+
+func hashedChunkData(t *testing.T, opts ...Option) ([]byte, []*raft.Log) {
+	data := make([]byte, 3*ChunkSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []*raft.Log
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		logs = append(logs, &l)
+		return errorFuture{}
+	}
+	if err := ChunkingApply(data, []byte("ext"), time.Second, applyFunc, opts...).Error(); err != nil {
+		t.Fatal(err)
+	}
+	return data, logs
+}
+
+func TestIntegrity_FSM(t *testing.T) {
+	for _, alg := range hashAlgorithms {
+		t.Run(alg.String(), func(t *testing.T) {
+			if fipsBuild && !alg.fipsApproved() {
+				t.Skip("algorithm not available in FIPS builds")
+			}
+			data, logs := hashedChunkData(t, WithHashAlgorithm(alg))
+
+			for i, l := range logs {
+				if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+					t.Fatalf("log entry of %d bytes exceeds chunk size %d", size, ChunkSize)
+				}
+				var ci types.ChunkInfo
+				if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+					t.Fatal(err)
+				}
+				if HashAlgorithm(ci.HashAlgorithm) != alg {
+					t.Fatalf("expected algorithm %v on chunk %d, got %v", alg, i, ci.HashAlgorithm)
+				}
+				if final := i == len(logs)-1; final != (len(ci.PayloadDigest) > 0) {
+					t.Fatalf("expected payload digest only on final chunk, chunk %d has %d bytes", i, len(ci.PayloadDigest))
+				}
+			}
+
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil)
+			var resp interface{}
+			for _, l := range logs {
+				resp = f.Apply(l)
+			}
+			if _, ok := resp.(ChunkingSuccess); !ok {
+				t.Fatalf("expected success, got %#v", resp)
+			}
+			if diff := deep.Equal(data, m.logs[0]); diff != nil {
+				t.Fatal(diff)
+			}
+
+			// Corrupted data must be detected
+			l := *logs[1]
+			l.Data = append([]byte(nil), l.Data...)
+			l.Data[0] ^= 0xff
+			m = new(MockFSM)
+			f = NewChunkingFSM(m, nil)
+			for _, log := range append([]*raft.Log{logs[0], &l}, logs[2:]...) {
+				resp = f.Apply(log)
+			}
+			if err, ok := resp.(error); !ok || !errors.Is(err, ErrChecksumMismatch) {
+				t.Fatalf("expected checksum mismatch, got %#v", resp)
+			}
+			if len(m.logs) != 0 {
+				t.Fatal("corrupted payload was applied")
+			}
+		})
+	}
+}
+
+func TestIntegrity_Reassembler(t *testing.T) {
+	data, logs := hashedChunkData(t, WithHashAlgorithm(HashSHA256))
+
+	var buf bytes.Buffer
+	r := NewReassembler(func(uint64) (io.Writer, error) {
+		return &buf, nil
+	})
+	for _, l := range logs {
+		if _, err := r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if diff := deep.Equal(data, buf.Bytes()); diff != nil {
+		t.Fatal(diff)
+	}
+
+	l := *logs[0]
+	l.Data = append([]byte(nil), l.Data...)
+	l.Data[0] ^= 0xff
+	var err error
+	for _, log := range append([]*raft.Log{&l}, logs[1:]...) {
+		_, err = r.Add(log)
+	}
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestIntegrity_Encrypted(t *testing.T) {
+	kp := newTestKeyProvider(t)
+	data, logs := hashedChunkData(t, WithHashAlgorithm(HashSHA256), WithKeyProvider(kp))
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithKeyProvider(kp))
+	var resp interface{}
+	for _, l := range logs {
+		resp = f.Apply(l)
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if diff := deep.Equal(data, m.logs[0]); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+func TestIntegrity_UnsupportedAlgorithm(t *testing.T) {
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		t.Fatal("unexpected apply")
+		return nil
+	}
+	if err := ChunkingApply([]byte("foo"), nil, time.Second, applyFunc, WithHashAlgorithm(HashAlgorithm(100))).Error(); err == nil {
+		t.Fatal("expected error for unsupported algorithm")
+	}
+}
+
+func TestIntegrity_Incremental(t *testing.T) {
+	data, logs := hashedChunkData(t, WithHashAlgorithm(HashSHA256))
+	opNum := logOpNum(t, logs[0])
+
+	apply := func(f *ChunkingFSM, logs []*raft.Log) interface{} {
+		var resp interface{}
+		for _, l := range logs {
+			resp = f.Apply(l)
+		}
+		return resp
+	}
+	checkSuccess := func(t *testing.T, m *MockFSM, resp interface{}) {
+		t.Helper()
+		if _, ok := resp.(ChunkingSuccess); !ok {
+			t.Fatalf("expected success, got %#v", resp)
+		}
+		if diff := deep.Equal(data, m.logs[0]); diff != nil {
+			t.Fatal(diff)
+		}
+	}
+
+	t.Run("in order", func(t *testing.T) {
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil)
+		apply(f, logs[:len(logs)-1])
+		if next := f.ops[opKey{opNum: opNum}].hash.next; next != uint32(len(logs)-1) {
+			t.Fatalf("expected %d chunks to be hashed, got %d", len(logs)-1, next)
+		}
+		checkSuccess(t, m, f.Apply(logs[len(logs)-1]))
+	})
+
+	t.Run("out of order", func(t *testing.T) {
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil)
+		apply(f, []*raft.Log{logs[1], logs[2]})
+		if next := f.ops[opKey{opNum: opNum}].hash.next; next != 0 {
+			t.Fatalf("expected nothing to be hashed, got %d", next)
+		}
+		apply(f, []*raft.Log{logs[0]})
+		if next := f.ops[opKey{opNum: opNum}].hash.next; next != 3 {
+			t.Fatalf("expected 3 chunks to be hashed, got %d", next)
+		}
+		checkSuccess(t, m, apply(f, logs[3:]))
+	})
+
+	t.Run("restored", func(t *testing.T) {
+		f := NewChunkingFSM(new(MockFSM), nil)
+		apply(f, logs[:2])
+		state, err := f.CurrentState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(MockFSM)
+		f = NewChunkingFSM(m, nil)
+		if err := f.RestoreState(state); err != nil {
+			t.Fatal(err)
+		}
+		checkSuccess(t, m, apply(f, logs[2:]))
+	})
+
+	t.Run("replaced chunk", func(t *testing.T) {
+		l := *logs[0]
+		l.Data = append([]byte(nil), l.Data...)
+		l.Data[0] ^= 0xff
+
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil)
+		apply(f, logs[:2])
+		resp := apply(f, append([]*raft.Log{&l}, logs[2:]...))
+		if err, ok := resp.(error); !ok || !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expected checksum mismatch, got %#v", resp)
+		}
+	})
+}
+
+func TestIntegrity_ChunkChecksums(t *testing.T) {
+	if fipsBuild {
+		t.Skip("chunk checksums not available in FIPS builds")
+	}
+	data, logs := hashedChunkData(t, WithChunkChecksums())
+	for i, l := range logs {
+		if size := len(l.Data) + len(l.Extensions); size > ChunkSize {
+			t.Fatalf("log entry of %d bytes exceeds chunk size %d", size, ChunkSize)
+		}
+		var ci types.ChunkInfo
+		if err := proto.Unmarshal(l.Extensions, &ci); err != nil {
+			t.Fatal(err)
+		}
+		if len(ci.ChunkChecksum) != chunkChecksumSize {
+			t.Fatalf("expected checksum on chunk %d, got %x", i, ci.ChunkChecksum)
+		}
+	}
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var resp interface{}
+	for _, l := range logs {
+		resp = f.Apply(l)
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", resp)
+	}
+	if !bytes.Equal(data, m.logs[0]) {
+		t.Fatal("reassembled payload does not match")
+	}
+
+	// A corrupted chunk fails the op as soon as it arrives, and the rest of
+	// the op is dropped
+	corrupted := *logs[1]
+	corrupted.Data = append([]byte(nil), corrupted.Data...)
+	corrupted.Data[10] ^= 0xff
+	m = new(MockFSM)
+	f = NewChunkingFSM(m, nil)
+	f.Apply(logs[0])
+	resp = f.Apply(&corrupted)
+	var cerr *ChunkChecksumError
+	if err, ok := resp.(error); !ok || !errors.As(err, &cerr) || !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected chunk checksum error, got %#v", resp)
+	}
+	if cerr.SequenceNum != 1 || cerr.Expected == cerr.Actual {
+		t.Fatalf("unexpected error %#v", cerr)
+	}
+	if f.PendingOps() != 0 {
+		t.Fatal("expected failed op to be dropped")
+	}
+	for _, l := range logs[2:] {
+		if resp := f.Apply(l); resp != nil {
+			t.Fatalf("expected remaining chunks to be ignored, got %#v", resp)
+		}
+	}
+	if len(m.logs) != 0 {
+		t.Fatal("expected corrupted op not to be applied")
+	}
+
+	// The Reassembler checks them too
+	r := NewReassembler(func(uint64) (io.Writer, error) { return io.Discard, nil })
+	r.Add(logs[0])
+	if _, err := r.Add(&corrupted); !errors.As(err, &cerr) {
+		t.Fatalf("expected chunk checksum error, got %v", err)
+	}
+}
+
+func TestIntegrity_TotalSize(t *testing.T) {
+	data := compressibleData(3*ChunkSize + 100)
+	for _, alg := range []Compression{CompressionNone, CompressionSnappy} {
+		logs, err := SplitIntoLogs(data, nil, WithTotalSize(), WithCompression(alg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ci types.ChunkInfo
+		for i := range logs {
+			if err := proto.Unmarshal(logs[i].Extensions, &ci); err != nil {
+				t.Fatal(err)
+			}
+			if ci.TotalSize != uint64(len(data)) {
+				t.Fatalf("%v: expected total size %d on chunk %d, got %d", alg, len(data), i, ci.TotalSize)
+			}
+		}
+
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil)
+		for i := range logs {
+			f.Apply(&logs[i])
+		}
+		if len(m.logs) != 1 || !bytes.Equal(m.logs[0], data) {
+			t.Fatalf("%v: expected op to be applied", alg)
+		}
+
+		// A payload that reassembles to another size is rejected
+		ci.TotalSize++
+		ext, err := proto.Marshal(&ci)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs[len(logs)-1].Extensions = ext
+		f = NewChunkingFSM(new(MockFSM), nil)
+		var resp interface{}
+		for i := range logs {
+			resp = f.Apply(&logs[i])
+		}
+		if _, ok := resp.(error); !ok {
+			t.Fatalf("%v: expected size mismatch to fail the op, got %#v", alg, resp)
+		}
+		if alg != CompressionNone {
+			continue
+		}
+		r := NewReassembler(func(uint64) (io.Writer, error) {
+			return new(bytes.Buffer), nil
+		})
+		for i := range logs {
+			_, err = r.Add(&logs[i])
+		}
+		if err == nil {
+			t.Fatal("expected size mismatch to fail the reassembled op")
+		}
+	}
+}
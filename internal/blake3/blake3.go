@@ -0,0 +1,283 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package blake3 implements the BLAKE3 hash function in its default (unkeyed)
+// hashing mode with a 32-byte output. It is a straightforward portable
+// implementation that follows the reference implementation, and exists so
+// that chunk integrity checks can offer BLAKE3 without adding a dependency.
+package blake3
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+const (
+	// Size is the size of a BLAKE3 checksum in bytes.
+	Size = 32
+
+	// BlockSize is the size of a BLAKE3 block in bytes.
+	BlockSize = 64
+
+	chunkLen = 1024
+)
+
+// Domain separation flags
+const (
+	flagChunkStart = 1 << 0
+	flagChunkEnd   = 1 << 1
+	flagParent     = 1 << 2
+	flagRoot       = 1 << 3
+)
+
+var iv = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+var msgPermutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func g(state *[16]uint32, a, b, c, d int, mx, my uint32) {
+	state[a] = state[a] + state[b] + mx
+	state[d] = bits.RotateLeft32(state[d]^state[a], -16)
+	state[c] = state[c] + state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -12)
+	state[a] = state[a] + state[b] + my
+	state[d] = bits.RotateLeft32(state[d]^state[a], -8)
+	state[c] = state[c] + state[d]
+	state[b] = bits.RotateLeft32(state[b]^state[c], -7)
+}
+
+func round(state *[16]uint32, m *[16]uint32) {
+	// Mix the columns
+	g(state, 0, 4, 8, 12, m[0], m[1])
+	g(state, 1, 5, 9, 13, m[2], m[3])
+	g(state, 2, 6, 10, 14, m[4], m[5])
+	g(state, 3, 7, 11, 15, m[6], m[7])
+	// Mix the diagonals
+	g(state, 0, 5, 10, 15, m[8], m[9])
+	g(state, 1, 6, 11, 12, m[10], m[11])
+	g(state, 2, 7, 8, 13, m[12], m[13])
+	g(state, 3, 4, 9, 14, m[14], m[15])
+}
+
+func permute(m *[16]uint32) {
+	var permuted [16]uint32
+	for i := range permuted {
+		permuted[i] = m[msgPermutation[i]]
+	}
+	*m = permuted
+}
+
+// compress runs the compression function and returns the first half of the
+// output, which is all that is needed for a 32-byte hash.
+func compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [8]uint32 {
+	state := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3],
+		cv[4], cv[5], cv[6], cv[7],
+		iv[0], iv[1], iv[2], iv[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for i := 0; i < 7; i++ {
+		round(&state, &m)
+		if i < 6 {
+			permute(&m)
+		}
+	}
+
+	var out [8]uint32
+	for i := range out {
+		out[i] = state[i] ^ state[i+8]
+	}
+	return out
+}
+
+func wordsFromBlock(b []byte) [16]uint32 {
+	var buf [BlockSize]byte
+	copy(buf[:], b)
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(buf[i*4:])
+	}
+	return words
+}
+
+// output holds everything needed to produce either a chaining value or the
+// root hash from a node.
+type output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *output) chainingValue() [8]uint32 {
+	return compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+}
+
+func (o *output) rootHash() [Size]byte {
+	words := compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var out [Size]byte
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(out[i*4:], w)
+	}
+	return out
+}
+
+type chunkState struct {
+	cv               [8]uint32
+	chunkCounter     uint64
+	block            [BlockSize]byte
+	blockLen         int
+	blocksCompressed int
+}
+
+func newChunkState(counter uint64) chunkState {
+	return chunkState{
+		cv:           iv,
+		chunkCounter: counter,
+	}
+}
+
+func (c *chunkState) len() int {
+	return BlockSize*c.blocksCompressed + c.blockLen
+}
+
+func (c *chunkState) startFlag() uint32 {
+	if c.blocksCompressed == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (c *chunkState) update(input []byte) {
+	for len(input) > 0 {
+		// If the block buffer is full, compress it and clear it. More input
+		// is coming, so this compression is not flagChunkEnd.
+		if c.blockLen == BlockSize {
+			words := wordsFromBlock(c.block[:])
+			c.cv = compress(&c.cv, &words, c.chunkCounter, BlockSize, c.startFlag())
+			c.blocksCompressed++
+			c.block = [BlockSize]byte{}
+			c.blockLen = 0
+		}
+
+		n := copy(c.block[c.blockLen:], input)
+		c.blockLen += n
+		input = input[n:]
+	}
+}
+
+func (c *chunkState) output() output {
+	return output{
+		cv:       c.cv,
+		block:    wordsFromBlock(c.block[:c.blockLen]),
+		counter:  c.chunkCounter,
+		blockLen: uint32(c.blockLen),
+		flags:    c.startFlag() | flagChunkEnd,
+	}
+}
+
+func parentOutput(left, right [8]uint32) output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return output{
+		cv:       iv,
+		block:    block,
+		blockLen: BlockSize,
+		flags:    flagParent,
+	}
+}
+
+// Hasher is an incremental BLAKE3 hasher. It implements hash.Hash.
+type Hasher struct {
+	chunk chunkState
+
+	// cvStack holds the chaining values of completed subtrees; its length
+	// never exceeds 54, enough for 2^64 bytes of input
+	cvStack [][8]uint32
+}
+
+var _ hash.Hash = (*Hasher)(nil)
+
+// New returns a new Hasher.
+func New() *Hasher {
+	return &Hasher{
+		chunk: newChunkState(0),
+	}
+}
+
+// Reset clears the Hasher's state so that it can be reused.
+func (h *Hasher) Reset() {
+	h.chunk = newChunkState(0)
+	h.cvStack = h.cvStack[:0]
+}
+
+// Size always returns 32 bytes.
+func (h *Hasher) Size() int { return Size }
+
+// BlockSize always returns 64 bytes.
+func (h *Hasher) BlockSize() int { return BlockSize }
+
+// addChunkChainingValue pushes the chaining value of a completed chunk,
+// merging completed subtrees first. The number of trailing zero bits in the
+// total number of chunks tells us how many subtrees are complete.
+func (h *Hasher) addChunkChainingValue(cv [8]uint32, totalChunks uint64) {
+	for totalChunks&1 == 0 {
+		left := h.cvStack[len(h.cvStack)-1]
+		h.cvStack = h.cvStack[:len(h.cvStack)-1]
+		parent := parentOutput(left, cv)
+		cv = parent.chainingValue()
+		totalChunks >>= 1
+	}
+	h.cvStack = append(h.cvStack, cv)
+}
+
+// Write adds more data to the running hash. It never returns an error.
+func (h *Hasher) Write(input []byte) (int, error) {
+	n := len(input)
+	for len(input) > 0 {
+		// If the current chunk is complete, finalize it and start a new one.
+		// More input is coming, so this chunk is not the root.
+		if h.chunk.len() == chunkLen {
+			out := h.chunk.output()
+			totalChunks := h.chunk.chunkCounter + 1
+			h.addChunkChainingValue(out.chainingValue(), totalChunks)
+			h.chunk = newChunkState(totalChunks)
+		}
+
+		want := chunkLen - h.chunk.len()
+		if want > len(input) {
+			want = len(input)
+		}
+		h.chunk.update(input[:want])
+		input = input[want:]
+	}
+	return n, nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice. It does
+// not change the underlying hash state.
+func (h *Hasher) Sum(b []byte) []byte {
+	// Starting with the output from the current chunk, compute all the parent
+	// chaining values along the right edge of the tree until we have the root
+	out := h.chunk.output()
+	for i := len(h.cvStack) - 1; i >= 0; i-- {
+		out = parentOutput(h.cvStack[i], out.chainingValue())
+	}
+	sum := out.rootHash()
+	return append(b, sum[:]...)
+}
+
+// Sum256 returns the BLAKE3 checksum of b.
+func Sum256(b []byte) [Size]byte {
+	h := New()
+	h.Write(b)
+	var sum [Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
@@ -0,0 +1,70 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package blake3
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// testInput returns the input used by the official BLAKE3 test vectors: a
+// repeating sequence of the bytes 0 through 250.
+func testInput(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// Taken from the default hash mode of the official test vectors, truncated to
+// 32 bytes. The lengths cover single blocks, chunk boundaries and multi-level
+// trees.
+var vectors = []struct {
+	inputLen int
+	hash     string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+	{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+	{3072, "b98cb0ff3623be03326b373de6b9095218513e64f1ee2edd2525c7ad1e5cffd2"},
+	{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+	{4096, "015094013f57a5277b59d8475c0501042c0b642e531b0a1c8f58d2163229e969"},
+	{4097, "9b4052b38f1c5fc8b1f9ff7ac7b27cd242487b3d890d15c96a1c25b8aa0fb995"},
+	{5120, "9cadc15fed8b5d854562b26a9536d9707cadeda9b143978f319ab34230535833"},
+	{8192, "aae792484c8efe4f19e2ca7d371d8c467ffb10748d8a5a1ae579948f718a2a63"},
+}
+
+func TestSum256(t *testing.T) {
+	for _, v := range vectors {
+		sum := Sum256(testInput(v.inputLen))
+		if got := hex.EncodeToString(sum[:]); got != v.hash {
+			t.Errorf("input length %d: got %s, want %s", v.inputLen, got, v.hash)
+		}
+	}
+}
+
+func TestHasher_Incremental(t *testing.T) {
+	for _, v := range vectors {
+		input := testInput(v.inputLen)
+		for _, step := range []int{1, 63, 64, 65, 1000} {
+			h := New()
+			for b := input; len(b) > 0; {
+				n := step
+				if n > len(b) {
+					n = len(b)
+				}
+				h.Write(b[:n])
+				b = b[n:]
+			}
+			if got := hex.EncodeToString(h.Sum(nil)); got != v.hash {
+				t.Errorf("input length %d in steps of %d: got %s, want %s", v.inputLen, step, got, v.hash)
+			}
+		}
+	}
+}
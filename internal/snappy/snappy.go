@@ -0,0 +1,271 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package snappy implements the Snappy block format. It exists so that
+// payloads can be compressed with a fast algorithm without adding a
+// dependency. Only the block format is supported, not the framing format.
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	// ErrCorrupt is returned when the input is not valid Snappy data.
+	ErrCorrupt = errors.New("snappy: corrupt input")
+
+	// ErrTooLarge is returned when the decoded length of the input is too
+	// large to decode on this platform.
+	ErrTooLarge = errors.New("snappy: decoded block is too large")
+)
+
+const (
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+)
+
+// maxBlockSize is the size of the blocks the input is encoded in. Copies never
+// reach back past the start of the block, so offsets always fit in 16 bits.
+const maxBlockSize = 65536
+
+// minMatchBlockSize is the smallest block that is searched for matches;
+// smaller ones are emitted as a single literal.
+const minMatchBlockSize = 17
+
+// inputMargin keeps the match search far enough from the end of a block that
+// four bytes can always be loaded.
+const inputMargin = 15
+
+// tableBits is the size, in bits, of the hash table used to find matches.
+const tableBits = 14
+
+// MaxEncodedLen returns the largest possible size of an encoding of n bytes.
+func MaxEncodedLen(n int) int {
+	return 32 + n + n/6
+}
+
+// Encode returns the encoding of src.
+func Encode(src []byte) []byte {
+	dst := make([]byte, MaxEncodedLen(len(src)))
+	d := binary.PutUvarint(dst, uint64(len(src)))
+	for len(src) > 0 {
+		block := src
+		if len(block) > maxBlockSize {
+			block = block[:maxBlockSize]
+		}
+		src = src[len(block):]
+		if len(block) < minMatchBlockSize {
+			d += emitLiteral(dst[d:], block)
+		} else {
+			d += encodeBlock(dst[d:], block)
+		}
+	}
+	return dst[:d]
+}
+
+func load32(b []byte, i int) uint32 {
+	return binary.LittleEndian.Uint32(b[i : i+4])
+}
+
+func hash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - tableBits)
+}
+
+// encodeBlock encodes a block of at least minMatchBlockSize and at most
+// maxBlockSize bytes into dst, returning the number of bytes written.
+func encodeBlock(dst, src []byte) int {
+	var table [1 << tableBits]uint16
+	var d int
+	sLimit := len(src) - inputMargin
+	nextEmit := 0
+	s := 1
+	for s < sLimit {
+		h := hash(load32(src, s))
+		candidate := int(table[h])
+		table[h] = uint16(s)
+		if load32(src, candidate) != load32(src, s) {
+			// Step further ahead the longer nothing has matched, so
+			// that incompressible data is skipped over quickly
+			s += 1 + (s-nextEmit)>>5
+			continue
+		}
+
+		if nextEmit < s {
+			d += emitLiteral(dst[d:], src[nextEmit:s])
+		}
+		base := s
+		s += 4
+		for i := candidate + 4; s < len(src) && src[s] == src[i]; i++ {
+			s++
+		}
+		d += emitCopy(dst[d:], base-candidate, s-base)
+		nextEmit = s
+	}
+	if nextEmit < len(src) {
+		d += emitLiteral(dst[d:], src[nextEmit:])
+	}
+	return d
+}
+
+// emitLiteral writes a literal of 1 to maxBlockSize bytes to dst, returning
+// the number of bytes written.
+func emitLiteral(dst, lit []byte) int {
+	var i int
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst[0] = byte(n)<<2 | tagLiteral
+		i = 1
+	case n < 1<<8:
+		dst[0] = 60<<2 | tagLiteral
+		dst[1] = byte(n)
+		i = 2
+	default:
+		dst[0] = 61<<2 | tagLiteral
+		dst[1] = byte(n)
+		dst[2] = byte(n >> 8)
+		i = 3
+	}
+	return i + copy(dst[i:], lit)
+}
+
+// emitCopy writes a copy of length bytes, at least 4, from offset bytes back
+// to dst, returning the number of bytes written.
+func emitCopy(dst []byte, offset, length int) int {
+	var d int
+	// A copy2 holds at most 64 bytes; leave at least 4 for the last copy
+	for length >= 68 {
+		dst[d] = 63<<2 | tagCopy2
+		binary.LittleEndian.PutUint16(dst[d+1:], uint16(offset))
+		d += 3
+		length -= 64
+	}
+	if length > 64 {
+		dst[d] = 59<<2 | tagCopy2
+		binary.LittleEndian.PutUint16(dst[d+1:], uint16(offset))
+		d += 3
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		dst[d] = byte(length-1)<<2 | tagCopy2
+		binary.LittleEndian.PutUint16(dst[d+1:], uint16(offset))
+		return d + 3
+	}
+	dst[d] = byte(offset>>8)<<5 | byte(length-4)<<2 | tagCopy1
+	dst[d+1] = byte(offset)
+	return d + 2
+}
+
+// DecodedLen returns the length of the decoding of src, without decoding it.
+func DecodedLen(src []byte) (int, error) {
+	n, _, err := decodedLen(src)
+	return n, err
+}
+
+func decodedLen(src []byte) (int, int, error) {
+	v, n := binary.Uvarint(src)
+	if n <= 0 || v > 0xffffffff {
+		return 0, 0, ErrCorrupt
+	}
+	if v > uint64(^uint(0)>>1) {
+		return 0, 0, ErrTooLarge
+	}
+	return int(v), n, nil
+}
+
+// Decode returns the decoding of src.
+func Decode(src []byte) ([]byte, error) {
+	dLen, s, err := decodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, dLen)
+	d := 0
+	for s < len(src) {
+		tag := src[s]
+		var length int
+		var offset uint32
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := uint32(tag >> 2)
+			switch {
+			case x < 60:
+				s++
+			case x == 60:
+				s += 2
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = uint32(src[s-1])
+			case x == 61:
+				s += 3
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = uint32(src[s-2]) | uint32(src[s-1])<<8
+			case x == 62:
+				s += 4
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = uint32(src[s-3]) | uint32(src[s-2])<<8 | uint32(src[s-1])<<16
+			default:
+				s += 5
+				if s > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = binary.LittleEndian.Uint32(src[s-4:])
+			}
+			if uint64(x) >= uint64(len(dst)-d) || uint64(x) >= uint64(len(src)-s) {
+				return nil, ErrCorrupt
+			}
+			length = int(x) + 1
+			copy(dst[d:], src[s:s+length])
+			d += length
+			s += length
+			continue
+
+		case tagCopy1:
+			s += 2
+			if s > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = uint32(tag&0xe0)<<3 | uint32(src[s-1])
+
+		case tagCopy2:
+			s += 3
+			if s > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = uint32(binary.LittleEndian.Uint16(src[s-2:]))
+
+		default:
+			s += 5
+			if s > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = binary.LittleEndian.Uint32(src[s-4:])
+		}
+
+		if offset == 0 || uint64(offset) > uint64(d) || length > len(dst)-d {
+			return nil, ErrCorrupt
+		}
+		// The source and destination may overlap, repeating a short run,
+		// so copy a byte at a time
+		from := d - int(offset)
+		for i := 0; i < length; i++ {
+			dst[d+i] = dst[from+i]
+		}
+		d += length
+	}
+	if d != len(dst) {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
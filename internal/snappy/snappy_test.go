@@ -0,0 +1,97 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package snappy
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []byte
+		want  string
+	}{
+		{"empty", []byte{0x00}, ""},
+		{"literal", []byte{0x03, 0x08, 'a', 'b', 'c'}, "abc"},
+		// A literal of "abc" followed by a copy1 of 9 bytes from 3 back
+		{"overlapping copy", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x03}, "abcabcabcabc"},
+		// The same with a copy2 and a copy4
+		{"copy2", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x22, 0x03, 0x00}, "abcabcabcabc"},
+		{"copy4", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x23, 0x03, 0x00, 0x00, 0x00}, "abcabcabcabc"},
+	} {
+		got, err := Decode(tc.input)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if string(got) != tc.want {
+			t.Fatalf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if n, err := DecodedLen(tc.input); err != nil || n != len(tc.want) {
+			t.Fatalf("%s: got decoded length %d (%v), want %d", tc.name, n, err, len(tc.want))
+		}
+	}
+}
+
+func TestDecode_Corrupt(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input []byte
+	}{
+		{"no header", nil},
+		{"short literal", []byte{0x03, 0x08, 'a', 'b'}},
+		{"long literal", []byte{0x02, 0x08, 'a', 'b', 'c'}},
+		{"truncated copy", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15}},
+		{"offset before start", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x04}},
+		{"zero offset", []byte{0x0c, 0x08, 'a', 'b', 'c', 0x15, 0x00}},
+		{"copy past end", []byte{0x05, 0x08, 'a', 'b', 'c', 0x15, 0x03}},
+		{"short output", []byte{0x04, 0x08, 'a', 'b', 'c'}},
+	} {
+		if _, err := Decode(tc.input); err != ErrCorrupt {
+			t.Fatalf("%s: expected ErrCorrupt, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestEncode_RoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*maxBlockSize+100)
+	rng.Read(random)
+	repetitive := []byte(strings.Repeat("Nobody inspects the spammish repetition", 5000))
+	runs := make([]byte, 200000)
+	for i := range runs {
+		runs[i] = byte(i / 1000)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		input []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"minimum match block", []byte(strings.Repeat("a", minMatchBlockSize))},
+		{"random", random},
+		{"repetitive", repetitive},
+		{"runs", runs},
+	} {
+		encoded := Encode(tc.input)
+		if len(encoded) > MaxEncodedLen(len(tc.input)) {
+			t.Fatalf("%s: encoded to %d bytes, more than the maximum of %d", tc.name, len(encoded), MaxEncodedLen(len(tc.input)))
+		}
+		decoded, err := Decode(encoded)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.Equal(decoded, tc.input) {
+			t.Fatalf("%s: round trip did not match", tc.name)
+		}
+	}
+
+	if n := len(Encode(repetitive)); n > len(repetitive)/10 {
+		t.Fatalf("expected repetitive input to compress well, got %d of %d bytes", n, len(repetitive))
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package xxhash implements the 64-bit xxHash algorithm (XXH64) with a seed of
+// zero. It exists so that chunk integrity checks can offer a fast
+// non-cryptographic hash without adding a dependency.
+package xxhash
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// The primes are variables rather than constants so that expressions such as
+// prime1 + prime2 are allowed to wrap around.
+var (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+// Size is the size of an XXH64 checksum in bytes.
+const Size = 8
+
+// BlockSize is the number of bytes the hash consumes at a time.
+const BlockSize = 32
+
+// Digest implements hash.Hash64.
+type Digest struct {
+	v1, v2, v3, v4 uint64
+	total          uint64
+	mem            [BlockSize]byte
+	n              int
+}
+
+var _ hash.Hash64 = (*Digest)(nil)
+
+// New returns a new Digest.
+func New() *Digest {
+	d := new(Digest)
+	d.Reset()
+	return d
+}
+
+// Reset clears the Digest's state so that it can be reused.
+func (d *Digest) Reset() {
+	d.v1 = prime1 + prime2
+	d.v2 = prime2
+	d.v3 = 0
+	d.v4 = -prime1
+	d.total = 0
+	d.n = 0
+}
+
+// Size always returns 8 bytes.
+func (d *Digest) Size() int { return Size }
+
+// BlockSize always returns 32 bytes.
+func (d *Digest) BlockSize() int { return BlockSize }
+
+// Write adds more data to the running hash. It never returns an error.
+func (d *Digest) Write(b []byte) (int, error) {
+	n := len(b)
+	d.total += uint64(n)
+
+	if d.n+n < BlockSize {
+		// Not enough for a full block yet
+		copy(d.mem[d.n:], b)
+		d.n += n
+		return n, nil
+	}
+
+	if d.n > 0 {
+		// Finish off the partially filled block first
+		c := copy(d.mem[d.n:], b)
+		d.v1 = round(d.v1, u64(d.mem[0:8]))
+		d.v2 = round(d.v2, u64(d.mem[8:16]))
+		d.v3 = round(d.v3, u64(d.mem[16:24]))
+		d.v4 = round(d.v4, u64(d.mem[24:32]))
+		b = b[c:]
+		d.n = 0
+	}
+
+	for len(b) >= BlockSize {
+		d.v1 = round(d.v1, u64(b[0:8]))
+		d.v2 = round(d.v2, u64(b[8:16]))
+		d.v3 = round(d.v3, u64(b[16:24]))
+		d.v4 = round(d.v4, u64(b[24:32]))
+		b = b[BlockSize:]
+	}
+
+	d.n = copy(d.mem[:], b)
+	return n, nil
+}
+
+// Sum appends the current hash to b and returns the resulting slice.
+func (d *Digest) Sum(b []byte) []byte {
+	var s [Size]byte
+	binary.BigEndian.PutUint64(s[:], d.Sum64())
+	return append(b, s[:]...)
+}
+
+// Sum64 returns the current hash.
+func (d *Digest) Sum64() uint64 {
+	var h uint64
+	if d.total >= BlockSize {
+		h = bits.RotateLeft64(d.v1, 1) + bits.RotateLeft64(d.v2, 7) +
+			bits.RotateLeft64(d.v3, 12) + bits.RotateLeft64(d.v4, 18)
+		h = mergeRound(h, d.v1)
+		h = mergeRound(h, d.v2)
+		h = mergeRound(h, d.v3)
+		h = mergeRound(h, d.v4)
+	} else {
+		h = d.v3 + prime5
+	}
+	h += d.total
+
+	b := d.mem[:d.n]
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= round(0, u64(b))
+		h = bits.RotateLeft64(h, 27)*prime1 + prime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime1
+		h = bits.RotateLeft64(h, 23)*prime2 + prime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime5
+		h = bits.RotateLeft64(h, 11) * prime1
+	}
+
+	h ^= h >> 33
+	h *= prime2
+	h ^= h >> 29
+	h *= prime3
+	h ^= h >> 32
+	return h
+}
+
+// Sum64 returns the XXH64 checksum of b.
+func Sum64(b []byte) uint64 {
+	d := New()
+	d.Write(b)
+	return d.Sum64()
+}
+
+func u64(b []byte) uint64 {
+	return binary.LittleEndian.Uint64(b)
+}
+
+func round(acc, input uint64) uint64 {
+	acc += input * prime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * prime1
+}
+
+func mergeRound(acc, val uint64) uint64 {
+	val = round(0, val)
+	acc ^= val
+	return acc*prime1 + prime4
+}
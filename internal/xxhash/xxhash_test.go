@@ -0,0 +1,40 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package xxhash
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSum64(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	} {
+		if got := Sum64([]byte(tc.input)); got != tc.want {
+			t.Errorf("Sum64(%q) = %016x, want %016x", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestDigest_Incremental(t *testing.T) {
+	input := []byte(strings.Repeat("Nobody inspects the spammish repetition", 10))
+	want := Sum64(input)
+
+	// Feed the input in every possible pair of pieces
+	for i := 0; i <= len(input); i++ {
+		d := New()
+		d.Write(input[:i])
+		d.Write(input[i:])
+		if got := d.Sum64(); got != want {
+			t.Fatalf("split at %d: got %016x, want %016x", i, got, want)
+		}
+	}
+}
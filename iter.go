@@ -0,0 +1,191 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build go1.23
+// +build go1.23
+
+package raftchunking
+
+import (
+	"iter"
+	"sort"
+)
+
+// ChunkIterator is an optional interface for a ChunkStorage that can walk its
+// contents without copying them all up front, the way GetChunks does. Chunks
+// yielded must not be modified.
+type ChunkIterator interface {
+	// AllOps yields the op number of every op with chunks in the store, in
+	// ascending order.
+	AllOps() iter.Seq[uint64]
+
+	// ChunksOf yields the chunks that have been received for an op, in
+	// sequence order.
+	ChunksOf(opNum uint64) iter.Seq[*ChunkInfo]
+}
+
+var (
+	_ ChunkIterator = (*InmemChunkStorage)(nil)
+	_ ChunkIterator = (*DiskChunkStorage)(nil)
+	_ ChunkIterator = (*SpillingChunkStorage)(nil)
+	_ ChunkIterator = ChunkMap(nil)
+)
+
+// AllOps yields the op numbers in the map.
+func (m ChunkMap) AllOps() iter.Seq[uint64] {
+	return sortedOpNums(m)
+}
+
+// sortedOpNums yields the keys of an op map in ascending order.
+func sortedOpNums[V any](m map[uint64]V) iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		opNums := make([]uint64, 0, len(m))
+		for opNum := range m {
+			opNums = append(opNums, opNum)
+		}
+		sort.Slice(opNums, func(i, j int) bool { return opNums[i] < opNums[j] })
+		for _, opNum := range opNums {
+			if !yield(opNum) {
+				return
+			}
+		}
+	}
+}
+
+// ChunksOf yields the chunks in the map for an op, skipping missing ones.
+func (m ChunkMap) ChunksOf(opNum uint64) iter.Seq[*ChunkInfo] {
+	return func(yield func(*ChunkInfo) bool) {
+		for _, chunk := range m[opNum] {
+			if chunk != nil && !yield(chunk) {
+				return
+			}
+		}
+	}
+}
+
+// AllOps yields the ops in the state; see ChunkMap.AllOps.
+func (s *State) AllOps() iter.Seq[uint64] {
+	return s.ChunkMap.AllOps()
+}
+
+// ChunksOf yields the chunks in the state for an op; see ChunkMap.ChunksOf.
+func (s *State) ChunksOf(opNum uint64) iter.Seq[*ChunkInfo] {
+	return s.ChunkMap.ChunksOf(opNum)
+}
+
+func (i *InmemChunkStorage) AllOps() iter.Seq[uint64] {
+	return i.chunks.AllOps()
+}
+
+func (i *InmemChunkStorage) ChunksOf(opNum uint64) iter.Seq[*ChunkInfo] {
+	return i.chunks.ChunksOf(opNum)
+}
+
+func (d *DiskChunkStorage) AllOps() iter.Seq[uint64] {
+	return sortedOpNums(d.ops)
+}
+
+// ChunksOf reads each chunk's data from the spill file as it is yielded.
+// Iteration stops early if reading fails.
+func (d *DiskChunkStorage) ChunksOf(opNum uint64) iter.Seq[*ChunkInfo] {
+	return func(yield func(*ChunkInfo) bool) {
+		op, ok := d.ops[opNum]
+		if !ok || op.size == 0 {
+			return
+		}
+		view, err := mapSpillFile(op.f, op.size)
+		if err != nil {
+			return
+		}
+		defer view.Close()
+
+		for _, c := range op.chunks {
+			if c == nil {
+				continue
+			}
+			info := c.info
+			info.Data = make([]byte, c.length)
+			if err := view.ReadAt(info.Data, c.offset); err != nil {
+				return
+			}
+			if !yield(&info) {
+				return
+			}
+		}
+	}
+}
+
+// AllOps yields the ops held in memory and those spilled to disk.
+func (s *SpillingChunkStorage) AllOps() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		ops := make(map[uint64]struct{}, len(s.mem.chunks)+len(s.disk.ops))
+		for opNum := range s.mem.chunks {
+			ops[opNum] = struct{}{}
+		}
+		for opNum := range s.disk.ops {
+			ops[opNum] = struct{}{}
+		}
+		for opNum := range sortedOpNums(ops) {
+			if !yield(opNum) {
+				return
+			}
+		}
+	}
+}
+
+func (s *SpillingChunkStorage) ChunksOf(opNum uint64) iter.Seq[*ChunkInfo] {
+	if s.spilled(opNum) {
+		return s.disk.ChunksOf(opNum)
+	}
+	return s.mem.ChunksOf(opNum)
+}
+
+// AllOps yields the op number of every op the FSM is currently holding chunks
+// for. The FSM's state is locked for the duration of the iteration, so
+// applying logs is blocked until it finishes; the loop body must not call back
+// into the FSM. If the store does not implement ChunkIterator its chunks are
+// copied up front.
+func (c *ChunkingFSM) AllOps() iter.Seq[uint64] {
+	return func(yield func(uint64) bool) {
+		c.stateLock.RLock()
+		defer c.stateLock.RUnlock()
+
+		it, err := c.chunkIterator()
+		if err != nil {
+			return
+		}
+		for opNum := range it.AllOps() {
+			if !yield(opNum) {
+				return
+			}
+		}
+	}
+}
+
+// ChunksOf yields the chunks the FSM holds for an op, in sequence order. As
+// with AllOps, the FSM's state is locked while iterating.
+func (c *ChunkingFSM) ChunksOf(opNum uint64) iter.Seq[*ChunkInfo] {
+	return func(yield func(*ChunkInfo) bool) {
+		c.stateLock.RLock()
+		defer c.stateLock.RUnlock()
+
+		it, err := c.chunkIterator()
+		if err != nil {
+			return
+		}
+		for chunk := range it.ChunksOf(opNum) {
+			if !yield(chunk) {
+				return
+			}
+		}
+	}
+}
+
+// chunkIterator returns the store as a ChunkIterator, falling back to a copy
+// of its chunks.
+func (c *ChunkingFSM) chunkIterator() (ChunkIterator, error) {
+	if it, ok := c.store.(ChunkIterator); ok {
+		return it, nil
+	}
+	return c.store.GetChunks()
+}
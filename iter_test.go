@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build go1.23
+// +build go1.23
+
+package raftchunking
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/raft"
+)
+
+func TestIterators(t *testing.T) {
+	// Leave two ops partially applied
+	_, logsA := chunkData(t)
+	_, logsB := chunkData(t)
+
+	disk, err := NewDiskChunkStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	// The first op stays in memory while the second is spilled
+	spilling, err := NewSpillingChunkStorage(t.TempDir(), uint64(3*ChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spilling.Close()
+
+	for name, store := range map[string]ChunkStorage{
+		"inmem":    NewInmemChunkStorage(),
+		"disk":     disk,
+		"spilling": spilling,
+		"copying":  copyingStorage{NewInmemChunkStorage()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := NewChunkingFSM(new(MockFSM), store)
+			for _, l := range append(append([]*raft.Log(nil), logsA[:2]...), logsB[:3]...) {
+				if r := f.Apply(l); r != nil {
+					t.Fatalf("unexpected response: %#v", r)
+				}
+			}
+			state, err := f.CurrentState()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ops []uint64
+			for opNum := range f.AllOps() {
+				ops = append(ops, opNum)
+			}
+			var expected []uint64
+			for opNum := range state.AllOps() {
+				expected = append(expected, opNum)
+			}
+			if len(expected) != 2 {
+				t.Fatalf("expected 2 ops in state, got %v", expected)
+			}
+			if diff := deep.Equal(expected, ops); diff != nil {
+				t.Fatal(diff)
+			}
+
+			for _, opNum := range ops {
+				var chunks, expected []*ChunkInfo
+				for chunk := range f.ChunksOf(opNum) {
+					chunks = append(chunks, chunk)
+				}
+				for chunk := range state.ChunksOf(opNum) {
+					expected = append(expected, chunk)
+				}
+				if diff := deep.Equal(expected, chunks); diff != nil {
+					t.Fatal(diff)
+				}
+			}
+
+			// Stopping early works
+			for range f.AllOps() {
+				break
+			}
+			for range f.ChunksOf(ops[0]) {
+				break
+			}
+		})
+	}
+}
+
+// copyingStorage hides the iterator methods of the wrapped store.
+type copyingStorage struct {
+	ChunkStorage
+}
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// lagPollInterval is how often the apply lag is checked while submission is
+// paused for it.
+const lagPollInterval = 5 * time.Millisecond
+
+// IndexReporter reports how far a node's FSM trails its log. It is
+// implemented by *raft.Raft.
+type IndexReporter interface {
+	// LastIndex returns the index of the node's latest log
+	LastIndex() uint64
+
+	// AppliedIndex returns the index of the latest log applied to the
+	// node's FSM
+	AppliedIndex() uint64
+}
+
+// WithApplyLag makes ChunkingApply pause before submitting each chunk while
+// the node's FSM, as reported by r, trails its log by more than maxLag
+// entries, so that huge ops don't balloon the in-flight log of a cluster that
+// is struggling to keep up. A chunk that can't be submitted within the apply
+// timeout, or before the op's deadline set with WithOpTimeout, fails with
+// raft.ErrEnqueueTimeout as it would had raft been unable to take it. It is
+// ignored by the FSM.
+func WithApplyLag(r IndexReporter, maxLag uint64) Option {
+	return func(c *config) {
+		c.lagReporter = r
+		c.maxLag = maxLag
+	}
+}
+
+// applyLag returns how many entries the FSM trails the log by.
+func applyLag(r IndexReporter) uint64 {
+	last, applied := r.LastIndex(), r.AppliedIndex()
+	if applied >= last {
+		return 0
+	}
+	return last - applied
+}
+
+// waitForLag waits until the apply lag is within the configured limit, for up
+// to timeout if that isn't zero.
+func (c *config) waitForLag(timeout time.Duration) error {
+	if c.lagReporter == nil {
+		return nil
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		lag := applyLag(c.lagReporter)
+		if lag <= c.maxLag {
+			return nil
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return fmt.Errorf("apply lag of %d entries is over the limit of %d: %w", lag, c.maxLag, raft.ErrEnqueueTimeout)
+		}
+		time.Sleep(lagPollInterval)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// testIndexReporter reports a fixed last index and an applied index that can
+// be moved.
+type testIndexReporter struct {
+	applied uint64
+}
+
+func (r *testIndexReporter) LastIndex() uint64 {
+	return 100
+}
+
+func (r *testIndexReporter) AppliedIndex() uint64 {
+	return atomic.LoadUint64(&r.applied)
+}
+
+func TestApplyChunking_ApplyLag(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	var sent int
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		sent++
+		return errorFuture{}
+	}
+
+	// Submission waits for the FSM to catch up
+	r := new(testIndexReporter)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreUint64(&r.applied, 95)
+	}()
+	start := time.Now()
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithApplyLag(r, 10)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("expected submission to wait for the lag, took %v", elapsed)
+	}
+	if n, _, err := EstimateChunks(len(data), 0); err != nil || sent != n {
+		t.Fatalf("expected all %d chunks to be sent, got %d", n, sent)
+	}
+
+	// A lag that doesn't recover times the chunk out
+	sent = 0
+	err := ChunkingApply(data, nil, 20*time.Millisecond, applyFunc, WithApplyLag(new(testIndexReporter), 10)).Error()
+	if !errors.Is(err, raft.ErrEnqueueTimeout) || ClassifyError(err) != ErrorClassTransient {
+		t.Fatalf("expected an enqueue timeout, got %v", err)
+	}
+	if sent != 0 {
+		t.Fatalf("expected no chunks to be sent, got %d", sent)
+	}
+}
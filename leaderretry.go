@@ -0,0 +1,156 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// WithLeadershipRetry makes ChunkingApply apply the op again, split afresh
+// under a new op number unless WithContentOpNum is given, when it fails
+// because leadership was lost or the node isn't leader, up to maxAttempts
+// attempts in all. It waits backoff before the first retry, doubling the wait
+// each time, to give the cluster a chance to elect a new leader.
+//
+// A chunk that fails with raft.ErrLeadershipLost may still have been
+// committed, so an op could have been applied even though its future failed.
+// Unless the op is sent with WithContentOpNum or WithIdempotencyKey, letting
+// an FSM with WithDedupWindow or WithIdempotencyWindow recognize a retry of an
+// applied op, it is only retried if no chunk can have been committed: the
+// leader check set with WithLeaderCheck failed, or every chunk submitted was
+// rejected with raft.ErrNotLeader or raft.ErrLeadershipTransferInProgress.
+//
+// The returned future's Error returns once an attempt succeeds or the last one
+// fails, while its other methods describe the latest attempt. Ops sent with
+// WithReservedOp aren't retried since their reservation is dropped along with
+// them. It is ignored by ChunkingApplyWithLogs, ChunkingResume and the FSM.
+func WithLeadershipRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(c *config) {
+		c.leadershipAttempts = maxAttempts
+		c.leadershipBackoff = backoff
+	}
+}
+
+// WithRetryApplyFunc sets the function that provides the apply function for
+// each retry made under WithLeadershipRetry, such as one that applies on
+// whichever node is now leader. Retries otherwise use the apply function
+// given to ChunkingApply. It is ignored by the FSM.
+func WithRetryApplyFunc(fn func() ApplyFunc) Option {
+	return func(c *config) {
+		c.retryApplyFunc = fn
+	}
+}
+
+// isLeadershipError returns whether err means the op failed because the node
+// wasn't, or stopped being, the leader.
+func isLeadershipError(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress)
+}
+
+// isRejectedError returns whether err means a log was refused by a node that
+// wasn't leader, so can't have been committed.
+func isRejectedError(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipTransferInProgress)
+}
+
+// canRetry returns whether an op that failed with err can be applied again
+// without risk of applying it twice.
+func canRetry(f ChunkingFuture, err error, conf *config) bool {
+	if !isLeadershipError(err) {
+		return false
+	}
+	if conf.contentOpNum || conf.idempotencyKey != "" {
+		// The FSM dedups the retry if the op was applied
+		return true
+	}
+	for _, chunk := range f.Futures() {
+		if isUnsent(chunk) {
+			continue
+		}
+		if err := chunk.Error(); !isRejectedError(err) {
+			return false
+		}
+	}
+	return true
+}
+
+// leadershipRetryFuture is the future for an op applied with
+// WithLeadershipRetry, which stands for the latest attempt.
+type leadershipRetryFuture struct {
+	done chan struct{}
+
+	l       sync.Mutex
+	current ChunkingFuture
+}
+
+var _ ChunkingFuture = (*leadershipRetryFuture)(nil)
+
+func applyWithLeadershipRetry(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config) *leadershipRetryFuture {
+	f := &leadershipRetryFuture{
+		done:    make(chan struct{}),
+		current: chunkingApply(cmd, extensions, timeout, applyFunc, conf),
+	}
+	go func() {
+		defer close(f.done)
+		backoff := conf.leadershipBackoff
+		for attempt := 1; attempt < conf.leadershipAttempts; attempt++ {
+			latest := f.latest()
+			if err := latest.Error(); err == nil || !canRetry(latest, err, conf) {
+				return
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+
+			apply := applyFunc
+			if conf.retryApplyFunc != nil {
+				apply = conf.retryApplyFunc()
+			}
+			next := chunkingApply(cmd, extensions, timeout, apply, conf)
+			f.l.Lock()
+			f.current = next
+			f.l.Unlock()
+		}
+	}()
+	return f
+}
+
+func (f *leadershipRetryFuture) latest() ChunkingFuture {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.current
+}
+
+func (f *leadershipRetryFuture) Error() error {
+	<-f.done
+	return f.latest().Error()
+}
+
+func (f *leadershipRetryFuture) Index() uint64 {
+	return f.latest().Index()
+}
+
+func (f *leadershipRetryFuture) Response() interface{} {
+	return f.latest().Response()
+}
+
+func (f *leadershipRetryFuture) Futures() []raft.ApplyFuture {
+	return f.latest().Futures()
+}
+
+func (f *leadershipRetryFuture) OpNum() uint64 {
+	return f.latest().OpNum()
+}
+
+func (f *leadershipRetryFuture) ResumeToken() []byte {
+	return f.latest().ResumeToken()
+}
+
+func (f *leadershipRetryFuture) Progress() Progress {
+	return f.latest().Progress()
+}
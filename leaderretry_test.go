@@ -0,0 +1,158 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestApplyChunking_LeadershipRetry(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var index, term uint64 = 0, 1
+	apply := func(l raft.Log) raft.ApplyFuture {
+		index++
+		l.Index, l.Term = index, term
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// The first attempt is rejected by a node that isn't leader, and the
+	// retry is made in a new term through the retry apply function
+	var attempts, chunks int
+	losingApply := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		chunks++
+		return errorFuture{err: &NotLeaderError{Err: raft.ErrNotLeader}}
+	}
+	retryApply := func() ApplyFunc {
+		attempts++
+		term++
+		return func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+			return apply(l)
+		}
+	}
+	future := ChunkingApply(data, nil, time.Second, losingApply,
+		WithLeadershipRetry(3, time.Millisecond), WithRetryApplyFunc(retryApply))
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected 1 retry, got %d", attempts)
+	}
+	if len(m.logs) != 1 || !bytes.Equal(m.logs[0], data) {
+		t.Fatalf("expected op to be applied once, got %d ops", len(m.logs))
+	}
+	waitForProgress(t, future.(ChunkingFuture), Progress.Done)
+
+	// Retries stop after the last attempt
+	chunks = 0
+	alwaysLosing := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		chunks++
+		return errorFuture{err: raft.ErrNotLeader}
+	}
+	err := ChunkingApply(data, nil, time.Second, alwaysLosing, WithLeadershipRetry(3, time.Millisecond)).Error()
+	if !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected not leader error, got %v", err)
+	}
+	if chunks != 12 {
+		t.Fatalf("expected 3 attempts of 4 chunks, got %d chunks", chunks)
+	}
+
+	// A failed leader check is retried, since nothing was submitted
+	chunks = 0
+	var checks int
+	check := func() error {
+		if checks++; checks == 1 {
+			return raft.ErrLeadershipLost
+		}
+		return nil
+	}
+	counting := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		chunks++
+		return apply(l)
+	}
+	if err := ChunkingApply(data, nil, time.Second, counting, WithLeaderCheck(check), WithLeadershipRetry(3, time.Millisecond)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if checks != 2 || chunks != 4 || len(m.logs) != 2 {
+		t.Fatalf("expected a retry after the leader check, got %d checks and %d chunks", checks, chunks)
+	}
+
+	// Other errors aren't retried
+	chunks = 0
+	errFailed := errors.New("failed")
+	failing := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		chunks++
+		return errorFuture{err: errFailed}
+	}
+	err = ChunkingApply(data, nil, time.Second, failing, WithLeadershipRetry(3, time.Millisecond)).Error()
+	if !errors.Is(err, errFailed) || chunks != 4 {
+		t.Fatalf("expected a single failed attempt, got %d chunks and %v", chunks, err)
+	}
+}
+
+func TestApplyChunking_LeadershipRetryCommitted(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dedup := range []bool{false, true} {
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil, WithDedupWindow(10))
+		var index, term uint64 = 0, 1
+		var attempts, chunks int
+
+		// Every chunk is committed, but leadership is lost before the final
+		// chunk's future returns
+		apply := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+			chunks++
+			index++
+			l.Index, l.Term = index, term
+			resp := f.Apply(&l)
+			if chunks == 4 {
+				return errorFuture{err: &NotLeaderError{Err: raft.ErrLeadershipLost}}
+			}
+			return appliedFuture{resp: resp}
+		}
+		retryApply := func() ApplyFunc {
+			attempts++
+			term++
+			return apply
+		}
+		opts := []Option{WithLeadershipRetry(3, time.Millisecond), WithRetryApplyFunc(retryApply)}
+		if dedup {
+			opts = append(opts, WithContentOpNum(nil))
+		}
+		err := ChunkingApply(data, nil, time.Second, apply, opts...).Error()
+		if len(m.logs) != 1 || !bytes.Equal(m.logs[0], data) {
+			t.Fatalf("expected op to be applied once, got %d ops", len(m.logs))
+		}
+		if !dedup {
+			// The op may have been applied, so isn't retried
+			if attempts != 0 || !errors.Is(err, raft.ErrLeadershipLost) {
+				t.Fatalf("expected no retry, got %d and %v", attempts, err)
+			}
+			continue
+		}
+
+		// The FSM recognizes the retry as the op already applied
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != 1 || chunks != 8 {
+			t.Fatalf("expected 1 retry, got %d with %d chunks", attempts, chunks)
+		}
+	}
+}
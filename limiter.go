@@ -0,0 +1,91 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrClientLimit is returned, wrapped, when an op is submitted for a client
+// that already has as many ops in flight as its ClientLimiter allows.
+var ErrClientLimit = errors.New("too many chunked ops in flight for client")
+
+// ClientLimiter caps how many chunked ops each client may have in flight at
+// once, so that a single bulk importer can't crowd out others on a shared
+// cluster. Clients are identified by an arbitrary string, such as a tenant
+// name, given with WithClientLimit; ops submitted without an identifier share
+// the empty one. An op is in flight from when it is submitted until all of
+// its chunk futures have returned. A ClientLimiter is safe for concurrent use
+// and should be shared by all submitters that are to be limited together.
+type ClientLimiter struct {
+	l        sync.Mutex
+	max      int
+	limits   map[string]int
+	inFlight map[string]int
+}
+
+// NewClientLimiter returns a ClientLimiter allowing each client max ops in
+// flight, unless changed for a client with SetLimit. A max of zero or less
+// means no limit.
+func NewClientLimiter(max int) *ClientLimiter {
+	return &ClientLimiter{
+		max:      max,
+		limits:   make(map[string]int),
+		inFlight: make(map[string]int),
+	}
+}
+
+// SetLimit overrides the number of ops in flight allowed for a client. A max
+// of zero or less means no limit. Ops already in flight are not affected.
+func (c *ClientLimiter) SetLimit(clientID string, max int) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.limits[clientID] = max
+}
+
+// InFlight returns the number of ops a client has in flight.
+func (c *ClientLimiter) InFlight(clientID string) int {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.inFlight[clientID]
+}
+
+// acquire takes an in-flight slot for the client, returning false if it has
+// none left.
+func (c *ClientLimiter) acquire(clientID string) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	max, ok := c.limits[clientID]
+	if !ok {
+		max = c.max
+	}
+	if max > 0 && c.inFlight[clientID] >= max {
+		return false
+	}
+	c.inFlight[clientID]++
+	return true
+}
+
+// release returns a slot taken with acquire.
+func (c *ClientLimiter) release(clientID string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.inFlight[clientID] <= 1 {
+		delete(c.inFlight, clientID)
+		return
+	}
+	c.inFlight[clientID]--
+}
+
+// WithClientLimit counts ops submitted with ChunkingApply, ChunkingResume or
+// ChunkingApplyWithLogs against clientID's allowance in limiter. An op is
+// failed with ErrClientLimit if the client has no allowance left. It is
+// ignored by the FSM.
+func WithClientLimit(limiter *ClientLimiter, clientID string) Option {
+	return func(c *config) {
+		c.clientLimiter = limiter
+		c.clientID = clientID
+	}
+}
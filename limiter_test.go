@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// pendingFuture is an ApplyFuture that doesn't return until done is closed.
+type pendingFuture struct {
+	done chan struct{}
+}
+
+func (p pendingFuture) Error() error {
+	<-p.done
+	return nil
+}
+
+func (p pendingFuture) Response() interface{} { return nil }
+
+func (p pendingFuture) Index() uint64 { return 0 }
+
+func TestClientLimiter(t *testing.T) {
+	done := make(chan struct{})
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		return pendingFuture{done: done}
+	}
+	data := make([]byte, 2*ChunkSize)
+	limiter := NewClientLimiter(1)
+	limiter.SetLimit("bulk", 2)
+	apply := func(clientID string) error {
+		f := ChunkingApply(data, nil, time.Second, applyFunc, WithClientLimit(limiter, clientID))
+		if ef, ok := f.(errorFuture); ok {
+			return ef.err
+		}
+		return nil
+	}
+
+	if err := apply("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply("a"); !errors.Is(err, ErrClientLimit) {
+		t.Fatalf("expected client limit error, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := apply("bulk"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := apply("bulk"); !errors.Is(err, ErrClientLimit) {
+		t.Fatalf("expected client limit error, got %v", err)
+	}
+	if n := limiter.InFlight("bulk"); n != 2 {
+		t.Fatalf("expected 2 ops in flight, got %d", n)
+	}
+
+	// Slots are released once the ops' futures return
+	close(done)
+	deadline := time.Now().Add(5 * time.Second)
+	for limiter.InFlight("a") != 0 || limiter.InFlight("bulk") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for ops to be released")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := apply("a"); err != nil {
+		t.Fatal(err)
+	}
+}
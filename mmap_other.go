@@ -0,0 +1,33 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package raftchunking
+
+import (
+	"io"
+	"os"
+)
+
+// fileView reads a spill file directly on platforms where it is not mapped.
+type fileView struct {
+	f *os.File
+}
+
+func mapSpillFile(f *os.File, size int64) (spillView, error) {
+	return fileView{f: f}, nil
+}
+
+func (v fileView) ReadAt(p []byte, off int64) error {
+	_, err := v.f.ReadAt(p, off)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (v fileView) Close() error {
+	return nil
+}
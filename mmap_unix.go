@@ -0,0 +1,43 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package raftchunking
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mmapView is a read-only mapping of a spill file.
+type mmapView struct {
+	data []byte
+}
+
+func mapSpillFile(f *os.File, size int64) (spillView, error) {
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapView{data: data}, nil
+}
+
+func (m *mmapView) ReadAt(p []byte, off int64) error {
+	if off < 0 || off+int64(len(p)) > int64(len(m.data)) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(p, m.data[off:])
+	return nil
+}
+
+func (m *mmapView) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
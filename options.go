@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"io"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Option configures optional chunking behavior. The same options are accepted
+// by ChunkingApply and by the FSM constructors so that settings which must
+// agree on both ends (such as encryption) can be shared; options that only
+// make sense on one side are ignored by the other.
+type Option func(*config)
+
+// config holds the settings built up from a set of Options.
+type config struct {
+	keyProvider   KeyProvider
+	keyID         string
+	keyRing       KeyRing
+	hashAlgorithm HashAlgorithm
+	compression   Compression
+	auditSink     AuditSink
+	metadata      map[string]string
+	traceContext  string
+	fips          bool
+	contentType   string
+	recentOps     int
+	deadline      time.Time
+	maxChunkSize  int
+	chunkSize     int
+	reorderWindow int
+	maxChunks     int
+	verifyLeader  bool
+	leaderCheck   func() error
+	barrier       func(timeout time.Duration) raft.Future
+	applyTimeout  time.Duration
+	chunkRetries  int
+	sequential    int
+	outstanding   int
+	rateLimit     int64
+	opTimeout     time.Duration
+	zeroCopy      bool
+	bufferPool    bool
+	passthrough   bool
+
+	chunkChecksums bool
+	maxPayloadSize int
+	totalSize      bool
+	adaptiveTarget time.Duration
+
+	encryptFunc     EncryptFunc
+	encryptOverhead int
+	decryptFunc     DecryptFunc
+
+	contentOpNum bool
+	opNumSalt    []byte
+	dedupWindow  int
+	origin       string
+
+	idempotencyKey    string
+	idempotencyWindow int
+
+	leadershipAttempts int
+	leadershipBackoff  time.Duration
+	retryApplyFunc     func() ApplyFunc
+
+	extensionsNamespace uint32
+	chunkExtensions     []byte
+	extensions          []byte
+
+	checkpointSink     CheckpointSink
+	checkpointInterval time.Duration
+
+	maxPendingOps   uint64
+	maxPendingBytes uint64
+
+	budgetOps      uint64
+	budgetBytes    uint64
+	evictionPolicy EvictionPolicy
+
+	duplicatePolicy DuplicatePolicy
+
+	staleIndexes uint64
+	staleAge     time.Duration
+	staleOpHook  func(OpRecord)
+
+	preservedOps bool
+
+	clientLimiter *ClientLimiter
+	clientID      string
+	scheduler     *Scheduler
+	opRegistry    *OpRegistry
+
+	lagReporter IndexReporter
+	maxLag      uint64
+
+	entropy     io.Reader
+	logTemplate *raft.Log
+
+	reservations        bool
+	reservationCapacity uint64
+	maxUnreserved       uint64
+	reservedOp          uint64
+}
+
+func newConfig(opts []Option) *config {
+	conf := new(config)
+	for _, opt := range opts {
+		if opt != nil {
+			opt(conf)
+		}
+	}
+	return conf
+}
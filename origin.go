@@ -0,0 +1,121 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-raftchunking/types"
+)
+
+// originCounter counts the op nums derived with WithOrigin. It starts at a
+// random value so that a restarted server doesn't reuse the op nums of ops it
+// may still have in flight.
+var originCounter uint32
+
+func init() {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err == nil {
+		originCounter = binary.BigEndian.Uint32(b[:])
+	}
+}
+
+// WithOrigin makes ChunkingApply derive op nums from serverID, the ID of the
+// local server, rather than choosing them at random: the top 32 bits are a
+// hash of the ID and the rest a counter. Ops sent from different servers then
+// can't share an op num unless their IDs hash alike, even when two leaders
+// are briefly active across a partition or a rapid failover. The ID is sent
+// with every chunk, and the FSM and the Reassembler tell ops apart by origin
+// as well as op num, so ops from different origins that do share an op num
+// are still reassembled separately. CancelChunkingOp must be given the same
+// option to cancel such an op. WithReservedOp and WithContentOpNum take
+// precedence over it. It is ignored by the FSM.
+func WithOrigin(serverID string) Option {
+	return func(c *config) {
+		c.origin = serverID
+	}
+}
+
+// originOpNum returns the next op num for an origin.
+func originOpNum(origin string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(origin))
+	for {
+		opNum := uint64(h.Sum32())<<32 | uint64(atomic.AddUint32(&originCounter, 1))
+		// Zero means no op
+		if opNum != 0 {
+			return opNum
+		}
+	}
+}
+
+// opKey identifies an op. Ops from different origins may share an op num, so
+// they are told apart by origin as well.
+type opKey struct {
+	origin string
+	opNum  uint64
+}
+
+// chunkKey returns the key of the op a chunk belongs to.
+func chunkKey(ci *types.ChunkInfo) opKey {
+	return opKey{origin: ci.Origin, opNum: ci.OpNum}
+}
+
+// key returns the key of the op a stored chunk belongs to.
+func (c *ChunkInfo) key() opKey {
+	if c.SentOpNum != 0 {
+		return opKey{origin: c.Origin, opNum: c.SentOpNum}
+	}
+	return opKey{origin: c.Origin, opNum: c.OpNum}
+}
+
+// less orders op keys by op num and then origin, so that ops are handled in
+// the same order on every node.
+func (k opKey) less(o opKey) bool {
+	if k.opNum != o.opNum {
+		return k.opNum < o.opNum
+	}
+	return k.origin < o.origin
+}
+
+// sortKeys sorts op keys as less orders them.
+func sortKeys(keys []opKey) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+}
+
+// opKeys returns the keys of the given ops, sorted.
+func opKeys(ops map[opKey]*opState) []opKey {
+	keys := make([]opKey, 0, len(ops))
+	for key := range ops {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+	return keys
+}
+
+// storeNum returns the op num that an op's chunks are stored under. It is the
+// op's own unless an op from another origin is already stored under it, in
+// which case one is derived from the origin that is not in use. Since it only
+// depends on the ops being tracked, every node picks the same one.
+func (c *ChunkingFSM) storeNum(key opKey) uint64 {
+	if op, ok := c.ops[key]; ok {
+		return op.storeNum
+	}
+	num := key.opNum
+	for {
+		if _, used := c.stored[num]; !used && num != 0 {
+			return num
+		}
+		h := fnv.New64a()
+		h.Write([]byte(key.origin))
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], num)
+		h.Write(b[:])
+		num = h.Sum64()
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOriginOpNum(t *testing.T) {
+	a1, a2, b := originOpNum("server-a"), originOpNum("server-a"), originOpNum("server-b")
+	if a1>>32 != a2>>32 || a1 == a2 {
+		t.Fatalf("expected distinct op nums with the same prefix, got %x and %x", a1, a2)
+	}
+	if a1>>32 == b>>32 {
+		t.Fatalf("expected different origins to get different prefixes, got %x and %x", a1, b)
+	}
+
+	var sent []raft.Log
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		sent = append(sent, l)
+		return errorFuture{}
+	}
+	future := ChunkingApply(make([]byte, 2*ChunkSize), nil, time.Second, applyFunc, WithOrigin("server-a")).(ChunkingFuture)
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if future.OpNum()>>32 != a1>>32 {
+		t.Fatalf("expected op num %x to be derived from the origin", future.OpNum())
+	}
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(sent[len(sent)-1].Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if ci.Origin != "server-a" {
+		t.Fatalf("expected the origin to be sent, got %q", ci.Origin)
+	}
+}
+
+func TestOrigin_SharedOpNum(t *testing.T) {
+	kp := newTestKeyProvider(t)
+	dataA := make([]byte, 3*ChunkSize)
+	dataB := make([]byte, 2*ChunkSize+100)
+	for _, data := range [][]byte{dataA, dataB} {
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Two leaders happen to pick the same op num, and their chunks are
+	// interleaved
+	opNum := originOpNum("server-a")
+	a, err := SplitIntoLogs(dataA, nil, WithReservedOp(opNum), WithOrigin("server-a"), WithKeyProvider(kp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SplitIntoLogs(dataB, nil, WithReservedOp(opNum), WithOrigin("server-b"), WithKeyProvider(kp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs []raft.Log
+	for i := range a {
+		logs = append(logs, a[i])
+		if i < len(b) {
+			logs = append(logs, b[i])
+		}
+	}
+	for i := range logs {
+		logs[i].Index, logs[i].Term = uint64(i+1), 1
+	}
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithKeyProvider(kp), WithDedupWindow(10))
+	var bufs []*bytes.Buffer
+	r := NewReassembler(func(uint64) (io.Writer, error) {
+		bufs = append(bufs, new(bytes.Buffer))
+		return bufs[len(bufs)-1], nil
+	}, WithKeyProvider(kp))
+	half := len(logs) / 2
+	for i := range logs[:half] {
+		if resp := f.Apply(&logs[i]); resp != nil {
+			t.Fatalf("unexpected response %#v", resp)
+		}
+		if _, err := r.Add(&logs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f.PendingOps() != 2 {
+		t.Fatalf("expected both ops to be pending, got %d", f.PendingOps())
+	}
+
+	// Both ops survive their state being captured and restored
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	for i := range logs[half:] {
+		l := &logs[half+i]
+		resp := f.Apply(l)
+		if _, ok := resp.(error); ok {
+			t.Fatalf("unexpected error %v", resp)
+		}
+		if _, err := r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(m.logs) != 2 || !bytes.Equal(m.logs[0], dataB) || !bytes.Equal(m.logs[1], dataA) {
+		t.Fatalf("expected both ops to be applied intact, got %d logs", len(m.logs))
+	}
+	if len(bufs) != 2 || !bytes.Equal(bufs[0].Bytes(), dataA) || !bytes.Equal(bufs[1].Bytes(), dataB) {
+		t.Fatal("expected both ops to be reassembled intact")
+	}
+	state, err = f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Completed) != 2 || len(state.CompletedOrigins) != 2 {
+		t.Fatalf("expected both ops to be remembered as completed, got %v and %v", state.Completed, state.CompletedOrigins)
+	}
+
+	// The op is only a duplicate under its own origin
+	c, err := SplitIntoLogs(make([]byte, 100), nil, WithReservedOp(opNum))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Apply(&c[0]).(ChunkingSuccess); !ok {
+		t.Fatal("expected an op with no origin to be applied")
+	}
+	resp := f.Apply(&b[len(b)-1])
+	if err, ok := resp.(error); !ok || !errors.Is(err, ErrDuplicateOp) {
+		t.Fatalf("expected a repeat from the same origin to be a duplicate, got %#v", resp)
+	}
+}
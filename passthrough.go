@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// WithPassthrough makes ChunkingApply apply payloads that fit in a single log
+// entry directly, with no chunk header, rather than as an op of one chunk.
+// The FSM hands such logs straight to the underlying FSM, so its response is
+// not wrapped in ChunkingSuccess, OpApplier is not used, and the op is not
+// reported to an audit sink. Payloads are still chunked when they have
+// extensions, which the FSM would take for a chunk header, unless an
+// extensions namespace is used, or when any option that is carried in the
+// chunk headers is given, such as encryption, compression, hashing, metadata,
+// a deadline or an idempotency key. Since a lone entry can't be resumed, the
+// future has no resume token. It is ignored by SplitIntoLogs and the FSM.
+func WithPassthrough() Option {
+	return func(c *config) {
+		c.passthrough = true
+	}
+}
+
+// needsHeader returns whether ops must carry a chunk header for the options
+// to take effect.
+func (c *config) needsHeader() bool {
+	return c.keyProvider != nil ||
+		c.encryptFunc != nil ||
+		c.hashAlgorithm != HashNone ||
+		c.compression != CompressionNone ||
+		c.chunkChecksums ||
+		!c.deadline.IsZero() ||
+		len(c.metadata) > 0 ||
+		c.traceContext != "" ||
+		c.contentType != "" ||
+		len(c.chunkExtensions) > 0 ||
+		c.reservedOp != 0 ||
+		c.contentOpNum ||
+		c.idempotencyKey != ""
+}
+
+// passThrough applies cmd and extensions as a single log with no chunk
+// header, if WithPassthrough allows it, returning false if the op must be
+// chunked.
+func passThrough(cmd, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config, op *opParams) (ChunkingFuture, bool) {
+	if !conf.passthrough || conf.needsHeader() || len(cmd) == 0 || len(cmd)+len(extensions) > op.chunkSize {
+		return nil, false
+	}
+	log := conf.newLog(cmd, nil)
+	if len(extensions) > 0 {
+		if conf.extensionsNamespace == 0 {
+			return nil, false
+		}
+		// The caller's extensions can't use the chunking namespace, or
+		// the FSM would take them for a chunk
+		if _, err := conf.otherExtensions(extensions); err != nil {
+			return errorFuture{err: err}, true
+		}
+		log.Extensions = extensions
+	}
+
+	mf, err := applyLogs([]raft.Log{log}, 0, timeout, applyFunc, conf)
+	if err != nil {
+		return errorFuture{err: err}, true
+	}
+	return &chunkingFuture{
+		multiFuture: mf,
+		submitted:   mf.submitted(),
+		seqs:        []uint32{0},
+	}, true
+}
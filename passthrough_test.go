@@ -0,0 +1,78 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestApplyChunking_Passthrough(t *testing.T) {
+	nsExt, err := Extensions{7: []byte("other")}.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := []byte("small")
+
+	for name, tc := range map[string]struct {
+		data        []byte
+		ext         []byte
+		opts        []Option
+		passthrough bool
+	}{
+		"small":        {data: small, passthrough: true},
+		"large":        {data: make([]byte, 2*ChunkSize)},
+		"empty":        {},
+		"extensions":   {data: small, ext: []byte("ext")},
+		"namespace":    {data: small, ext: nsExt, opts: []Option{WithExtensionsNamespace(3)}, passthrough: true},
+		"needs header": {data: small, opts: []Option{WithMetadata(map[string]string{"k": "v"})}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := new(extensionsFSM)
+			opts := append(tc.opts, WithPassthrough())
+			f := NewChunkingFSM(m, nil, opts...)
+			var logs []raft.Log
+			applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+				logs = append(logs, l)
+				return appliedFuture{resp: f.Apply(&l)}
+			}
+			future := ChunkingApply(tc.data, tc.ext, time.Second, applyFunc, opts...)
+			if err := future.Error(); err != nil {
+				t.Fatal(err)
+			}
+
+			if tc.passthrough {
+				if len(logs) != 1 || !bytes.Equal(logs[0].Data, tc.data) || !bytes.Equal(logs[0].Extensions, tc.ext) {
+					t.Fatalf("expected the payload to be applied as it is, got %#v", logs)
+				}
+				if _, ok := future.Response().(ChunkingSuccess); ok {
+					t.Fatal("expected the underlying FSM's response")
+				}
+			} else if len(tc.data) > 0 && len(logs) > 0 && bytes.Equal(logs[0].Extensions, tc.ext) {
+				t.Fatal("expected the payload to be chunked")
+			}
+			if len(tc.data) > 0 && (len(m.logs) != 1 || !bytes.Equal(m.logs[0].Data, tc.data)) {
+				t.Fatalf("expected op to be applied, got %d logs", len(m.logs))
+			}
+		})
+	}
+
+	// A failed lone entry has no resume token
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		return errorFuture{err: raft.ErrNotLeader}
+	}
+	future := ChunkingApply(small, nil, time.Second, applyFunc, WithPassthrough()).(ChunkingFuture)
+	if future.Error() == nil || future.ResumeToken() != nil {
+		t.Fatal("expected op to fail without a resume token")
+	}
+	if future.OpNum() != 0 {
+		t.Fatalf("expected no op num, got %d", future.OpNum())
+	}
+	if p := future.Progress(); p.TotalChunks != 1 || p.Submitted != 1 {
+		t.Fatalf("unexpected progress %#v", p)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"sync"
+)
+
+// headerBufferSize is the capacity of pooled header buffers, enough for the
+// chunk info of most chunks.
+const headerBufferSize = 256
+
+var (
+	// dataBuffers and headerBuffers hold *[]byte buffers for chunk data and
+	// chunk headers, shared by all ops using WithBufferPool
+	dataBuffers   sync.Pool
+	headerBuffers sync.Pool
+)
+
+// WithBufferPool makes ChunkingApply take the buffers for chunk data and
+// headers from a pool shared between ops, returning them once the op has been
+// applied, to cut allocations for applications doing sustained large writes.
+// Buffers of ops that fail are left to the garbage collector, since raft may
+// still be using them. Raft hands the logs it is given to the LogStore as they
+// are, so this must not be used with a store that keeps them in memory, such
+// as raft.InmemStore, or with raft.LogCache. It has no effect with
+// WithZeroCopy, except for headers, and is ignored by SplitIntoLogs,
+// ChunkingResume and the FSM.
+func WithBufferPool() Option {
+	return func(c *config) {
+		c.bufferPool = true
+	}
+}
+
+// bufferSet holds the pooled buffers taken for an op, so that they can be
+// returned together. A nil bufferSet allocates new buffers.
+type bufferSet struct {
+	chunkSize int
+	chunks    []*[]byte
+	headers   []*[]byte
+}
+
+// data returns a buffer of n bytes for chunk data.
+func (b *bufferSet) data(n int) []byte {
+	if b == nil {
+		return make([]byte, n)
+	}
+	p := takeBuffer(&dataBuffers, n, b.chunkSize)
+	b.chunks = append(b.chunks, p)
+	return (*p)[:n:n]
+}
+
+// header returns an empty buffer with room for n bytes of chunk header.
+func (b *bufferSet) header(n int) []byte {
+	if b == nil {
+		return make([]byte, 0, n)
+	}
+	p := takeBuffer(&headerBuffers, n, headerBufferSize)
+	b.headers = append(b.headers, p)
+	return (*p)[:0:n]
+}
+
+// release returns the buffers to their pools. They must no longer be in use.
+func (b *bufferSet) release() {
+	if b == nil {
+		return
+	}
+	for _, p := range b.chunks {
+		dataBuffers.Put(p)
+	}
+	for _, p := range b.headers {
+		headerBuffers.Put(p)
+	}
+	b.chunks, b.headers = nil, nil
+}
+
+// releaseWhenApplied returns the buffers once all of the futures have
+// returned, if the op was applied.
+func (b *bufferSet) releaseWhenApplied(mf multiFuture) {
+	if b == nil {
+		return
+	}
+	go func() {
+		if mf.Error() == nil {
+			b.release()
+		}
+	}()
+}
+
+// takeBuffer returns a buffer from pool with room for at least n bytes,
+// allocating one of at least size bytes if the pool has none large enough.
+// Buffers too small are dropped, so that a pool used with a smaller chunk
+// size drains rather than being allocated around forever.
+func takeBuffer(pool *sync.Pool, n, size int) *[]byte {
+	if p, ok := pool.Get().(*[]byte); ok && cap(*p) >= n {
+		return p
+	}
+	if size < n {
+		size = n
+	}
+	b := make([]byte, size)
+	return &b
+}
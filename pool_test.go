@@ -0,0 +1,75 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestBufferSet(t *testing.T) {
+	// A nil set allocates
+	var none *bufferSet
+	if b := none.data(10); len(b) != 10 {
+		t.Fatalf("expected 10 byte buffer, got %d", len(b))
+	}
+	none.release()
+
+	b := &bufferSet{chunkSize: 1000}
+	data := b.data(100)
+	if len(data) != 100 || cap(data) != 100 {
+		t.Fatalf("expected a 100 byte buffer, got %d with capacity %d", len(data), cap(data))
+	}
+	if header := b.header(50); len(header) != 0 || cap(header) != 50 {
+		t.Fatalf("expected an empty header buffer of capacity 50, got %d with capacity %d", len(header), cap(header))
+	}
+	if len(b.chunks) != 1 || cap(*b.chunks[0]) < 1000 || len(b.headers) != 1 {
+		t.Fatalf("expected a chunk sized buffer and a header buffer to be taken, got %d and %d", len(b.chunks), len(b.headers))
+	}
+	b.release()
+	if len(b.chunks) != 0 || len(b.headers) != 0 {
+		t.Fatal("expected buffers to be released")
+	}
+
+	// Buffers too small for the request are not handed out
+	small := make([]byte, 10)
+	dataBuffers.Put(&small)
+	if p := takeBuffer(&dataBuffers, 100, 50); cap(*p) < 100 {
+		t.Fatalf("expected a buffer of at least 100 bytes, got %d", cap(*p))
+	}
+}
+
+func TestApplyChunking_BufferPool(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// Each op reuses the buffers of the ones before it, which must not
+	// disturb what they applied
+	var payloads [][]byte
+	for i := 0; i < 5; i++ {
+		data := make([]byte, 3*ChunkSize+i)
+		if _, err := rand.Read(data); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, data)
+		if err := ChunkingApply(data, []byte("ext"), time.Second, applyFunc, WithBufferPool()).Error(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.logs) != len(payloads) {
+		t.Fatalf("expected %d ops to be applied, got %d", len(payloads), len(m.logs))
+	}
+	for i, data := range payloads {
+		if !bytes.Equal(data, m.logs[i]) {
+			t.Fatalf("op %d does not match", i)
+		}
+	}
+}
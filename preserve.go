@@ -0,0 +1,77 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// WithPreservedOps makes the FSM keep incomplete ops when the term changes,
+// rather than discarding them all, so that a client that resumes an op with
+// ChunkingResume after a re-election doesn't have to start it over. Each op
+// is tracked along with the term it originated in, the earliest term of its
+// chunks, and is only discarded when a leader of a later term invalidates it
+// with InvalidatePriorTermOps, or with CancelChunkingOp, or when it is
+// otherwise dropped, e.g. by WithStaleOpGC or PruneBefore. Every node must be
+// given the option or their states will diverge. It is ignored by
+// ChunkingApply and the Reassembler.
+func WithPreservedOps() Option {
+	return func(c *config) {
+		c.preservedOps = true
+	}
+}
+
+// InvalidatePriorTermOps applies a log through applyFunc that makes FSMs
+// drop the incomplete ops that originated in a term before the one the log
+// is applied in, and ignore any of their chunks that follow, as if the term
+// had changed without WithPreservedOps. A new leader can use it once it knows
+// which of the ops it inherited won't be resumed, or to discard them all. It
+// returns a future whose Error returns any error applying the log. The
+// options should include any WithExtensionsNamespace given to ChunkingApply.
+// Nodes that don't understand it ignore it.
+func InvalidatePriorTermOps(timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	conf := newConfig(opts)
+	others, err := conf.otherExtensions(nil)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	// A cancellation of no op stands for every op of an earlier term
+	ext, err := conf.marshalChunkExtensions(&types.ChunkInfo{
+		Cancel: true,
+	}, others, nil)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	return responseFuture{applyFunc(conf.newLog(nil, ext), timeout)}
+}
+
+// invalidatePriorTermOps handles an InvalidatePriorTermOps log, discarding
+// ops in op num order so that every node reports them alike.
+func (c *ChunkingFSM) invalidatePriorTermOps(l *raft.Log) error {
+	var invalid []opKey
+	for key, op := range c.ops {
+		if op.term < l.Term {
+			invalid = append(invalid, key)
+		}
+	}
+	sortKeys(invalid)
+
+	for _, key := range invalid {
+		if _, err := c.store.FinalizeOp(c.ops[key].storeNum); err != nil {
+			return err
+		}
+		op := c.untrackOp(key)
+		c.discardOp(key)
+		c.abortStream(key.opNum, op, OpAbortedTermChange, nil)
+		c.audit(key.opNum, op, OpAbortedTermChange, nil, l.Index, l.Term, l.AppendedAt)
+	}
+
+	// Reservations whose op never sent a chunk would otherwise be held
+	// forever
+	c.dropReservations(func(r reservation) bool { return r.term < l.Term })
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestFSM_PreservedOps(t *testing.T) {
+	data := make([]byte, 3*ChunkSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := SplitIntoLogs(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apply := func(f *ChunkingFSM, l *raft.Log, index, term uint64) interface{} {
+		l.Index, l.Term = index, term
+		return f.Apply(l)
+	}
+
+	for _, preserve := range []bool{false, true} {
+		var opts []Option
+		if preserve {
+			opts = append(opts, WithPreservedOps())
+		}
+		m := new(MockFSM)
+		f := NewChunkingFSM(m, nil, opts...)
+
+		// Half the op is applied before a re-election, and the rest after
+		var resp interface{}
+		for i := range logs {
+			term := uint64(1)
+			if i >= len(logs)/2 {
+				term = 2
+			}
+			resp = apply(f, &logs[i], uint64(i+1), term)
+		}
+		if !preserve {
+			if resp != nil || len(m.logs) != 0 {
+				t.Fatalf("expected the op to be discarded on the term change, got %#v", resp)
+			}
+			continue
+		}
+		if _, ok := resp.(ChunkingSuccess); !ok {
+			t.Fatalf("expected the op to complete across the term change, got %#v", resp)
+		}
+		if len(m.logs) != 1 || !bytes.Equal(m.logs[0], data) {
+			t.Fatal("reassembled payload does not match")
+		}
+	}
+}
+
+func TestFSM_InvalidatePriorTermOps(t *testing.T) {
+	sink := new(recordingSink)
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithPreservedOps(), WithAuditSink(sink))
+	var index uint64
+	apply := func(l *raft.Log, term uint64) interface{} {
+		index++
+		l.Index, l.Term = index, term
+		return f.Apply(l)
+	}
+	split := func() []raft.Log {
+		logs, err := SplitIntoLogs(make([]byte, 3*ChunkSize), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return logs
+	}
+
+	// One op from an earlier term, restored from a snapshot, and one from
+	// the current term
+	old, current := split(), split()
+	apply(&old[0], 1)
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	apply(&current[0], 2)
+
+	var term uint64 = 2
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		return appliedFuture{resp: apply(&l, term)}
+	}
+	if err := InvalidatePriorTermOps(time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if f.PendingOps() != 1 {
+		t.Fatalf("expected only the current term's op to be kept, got %d pending", f.PendingOps())
+	}
+	if len(sink.records) != 1 || sink.records[0].OpNum != logOpNum(t, &old[0]) || sink.records[0].Outcome != OpAbortedTermChange {
+		t.Fatalf("unexpected audit records %#v", sink.records)
+	}
+
+	// The invalidated op's remaining chunks are ignored, while the other
+	// op completes
+	for i := 1; i < len(old); i++ {
+		if r := apply(&old[i], 2); r != nil {
+			t.Fatalf("unexpected response for chunk %d: %#v", i, r)
+		}
+	}
+	var resp interface{}
+	for i := 1; i < len(current); i++ {
+		resp = apply(&current[i], 2)
+	}
+	if _, ok := resp.(ChunkingSuccess); !ok || len(m.logs) != 1 {
+		t.Fatalf("expected the current op to complete, got %#v", resp)
+	}
+
+	// Nothing is invalidated in the term after, with no ops pending
+	term = 3
+	if err := InvalidatePriorTermOps(time.Second, applyFunc).Error(); err != nil || f.PendingOps() != 0 {
+		t.Fatalf("expected nothing to invalidate, got %v with %d pending", err, f.PendingOps())
+	}
+}
+
+func TestFSM_DiscardedBounded(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithPreservedOps())
+	var index uint64
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		index++
+		l.Index, l.Term = index, 1
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// Each op is cancelled after its first chunk. The final chunk of every
+	// other op never arrives, so without a term change nothing else forgets
+	// them
+	var last raft.Log
+	for i := 0; i < 6*maxDiscarded; i++ {
+		logs, err := SplitIntoLogs(make([]byte, 2048), nil, WithChunkSize(1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyFunc(logs[0], 0)
+		if err := CancelChunkingOp(logOpNum(t, &logs[0]), time.Second, applyFunc).Error(); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			applyFunc(logs[1], 0)
+		}
+		last = logs[1]
+	}
+	if len(f.discarded) > maxDiscarded || len(f.discardOrder) > 2*maxDiscarded {
+		t.Fatalf("expected at most %d discarded ops, have %d in %d", maxDiscarded, len(f.discarded), len(f.discardOrder))
+	}
+
+	// The most recently discarded op is still remembered
+	if resp := applyFunc(last, 0).Response(); resp != nil || len(m.logs) != 0 || f.PendingOps() != 0 {
+		t.Fatalf("expected the final chunk of a discarded op to be ignored, got %#v", resp)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+)
+
+// Progress describes how far an op submitted with ChunkingApply or
+// ChunkingResume has got.
+type Progress struct {
+	// TotalChunks is the number of chunks in the op
+	TotalChunks int
+
+	// Submitted is the number of chunks that have been handed to the apply
+	// function, and Committed how many of those are known to be committed.
+	// For resumed ops both include the chunks committed by earlier attempts.
+	Submitted int
+	Committed int
+
+	// Failed is set once a chunk has failed, after which Committed stops
+	// increasing
+	Failed bool
+}
+
+// Done returns whether all of the op's chunks have been committed.
+func (p Progress) Done() bool {
+	return p.Committed == p.TotalChunks
+}
+
+// Progress reports a failed op since nothing was submitted.
+func (e errorFuture) Progress() Progress {
+	return Progress{Failed: true}
+}
+
+// Progress reports how far the op has got, without blocking. Chunks are
+// counted as committed in order, as raft commits them, by watching their
+// futures in the background from the first call on.
+func (c *chunkingFuture) Progress() Progress {
+	c.progressOnce.Do(func() {
+		go c.trackProgress()
+	})
+	total := len(c.multiFuture)
+	if c.token != nil {
+		total = int(c.token.NumChunks)
+	}
+	return Progress{
+		TotalChunks: total,
+		Submitted:   len(c.committed) + c.submitted,
+		Committed:   len(c.committed) + int(atomic.LoadInt64(&c.committedChunks)),
+		Failed:      atomic.LoadInt32(&c.failed) != 0,
+	}
+}
+
+func (c *chunkingFuture) trackProgress() {
+	for _, f := range c.multiFuture {
+		if f.Error() != nil {
+			atomic.StoreInt32(&c.failed, 1)
+			return
+		}
+		atomic.AddInt64(&c.committedChunks, 1)
+	}
+}
+
+// onceFuture makes a future's Error safe to call from several goroutines, as
+// on raft's own futures it isn't.
+type onceFuture struct {
+	raft.ApplyFuture
+	once sync.Once
+	err  error
+}
+
+func (o *onceFuture) Error() error {
+	o.once.Do(func() {
+		o.err = o.ApplyFuture.Error()
+	})
+	return o.err
+}
+
+// unsentFuture stands for a chunk that wasn't submitted because the op had
+// already failed.
+type unsentFuture struct {
+	errorFuture
+}
+
+func isUnsent(f raft.ApplyFuture) bool {
+	_, ok := f.(unsentFuture)
+	return ok
+}
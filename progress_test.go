@@ -0,0 +1,95 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// stepFuture returns err once its channel is closed.
+type stepFuture struct {
+	ch  chan struct{}
+	err error
+}
+
+func (s *stepFuture) Error() error {
+	<-s.ch
+	return s.err
+}
+
+func (s *stepFuture) Response() interface{} { return nil }
+
+func (s *stepFuture) Index() uint64 { return 0 }
+
+func waitForProgress(t *testing.T, f ChunkingFuture, ok func(Progress) bool) Progress {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p := f.Progress()
+		if ok(p) {
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for progress, have %#v", p)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestChunkingFuture_Progress(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var futures []*stepFuture
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		f := &stepFuture{ch: make(chan struct{})}
+		futures = append(futures, f)
+		return f
+	}
+
+	f := ChunkingApply(data, nil, time.Second, applyFunc).(ChunkingFuture)
+	p := f.Progress()
+	if p.TotalChunks != 4 || p.Submitted != 4 || p.Committed != 0 || p.Failed || p.Done() {
+		t.Fatalf("unexpected initial progress %#v", p)
+	}
+
+	close(futures[0].ch)
+	close(futures[1].ch)
+	waitForProgress(t, f, func(p Progress) bool { return p.Committed == 2 })
+
+	// A failed chunk stops progress, and Error is unaffected by the
+	// background tracking
+	errFailed := errors.New("failed")
+	futures[2].err = errFailed
+	close(futures[2].ch)
+	close(futures[3].ch)
+	p = waitForProgress(t, f, func(p Progress) bool { return p.Failed })
+	if p.Committed != 2 {
+		t.Fatalf("expected 2 committed chunks, got %d", p.Committed)
+	}
+	if err := f.Error(); !errors.Is(err, errFailed) {
+		t.Fatalf("expected chunk error, got %v", err)
+	}
+
+	// Resuming counts the chunks committed before, including the last one
+	// which went through after the failure
+	futures = nil
+	f = ChunkingResume(data, nil, f.ResumeToken(), time.Second, applyFunc).(ChunkingFuture)
+	if p := f.Progress(); p.Submitted != 4 || p.Committed != 3 || len(futures) != 1 {
+		t.Fatalf("unexpected resumed progress %#v", p)
+	}
+	for _, sf := range futures {
+		close(sf.ch)
+	}
+	waitForProgress(t, f, Progress.Done)
+	if err := f.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// NotLeaderError is returned by applies made through NewRaftApplyFunc when the
+// node isn't, or stops being, the leader. It wraps the error from raft, such
+// as raft.ErrNotLeader, and carries the current leader as far as the node
+// knows it so that the caller can redirect the op there.
+type NotLeaderError struct {
+	// LeaderAddr and LeaderID identify the leader; they are empty if no
+	// leader is known
+	LeaderAddr raft.ServerAddress
+	LeaderID   raft.ServerID
+
+	Err error
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAddr == "" {
+		return fmt.Sprintf("%v; no leader known", e.Err)
+	}
+	return fmt.Sprintf("%v; leader is %s at %s", e.Err, e.LeaderID, e.LeaderAddr)
+}
+
+func (e *NotLeaderError) Unwrap() error {
+	return e.Err
+}
+
+// WithVerifyLeader makes the apply function returned by NewRaftApplyFunc check
+// with a quorum that the node is still leader before the first chunk of each
+// op is applied, so that an op isn't started on a deposed leader that hasn't
+// noticed yet. It is ignored by ChunkingApply and the FSM.
+func WithVerifyLeader() Option {
+	return func(c *config) {
+		c.verifyLeader = true
+	}
+}
+
+// WithLeaderCheck makes ChunkingApply call check before submitting the first
+// chunk of an op, and fail the op with its error without submitting anything
+// if it returns one. For a raft node it would typically run
+// raft.Raft.VerifyLeader, so that an op on a node that isn't leader fails fast
+// rather than after every chunk has been sent and rejected. It is ignored by
+// the FSM.
+func WithLeaderCheck(check func() error) Option {
+	return func(c *config) {
+		c.leaderCheck = check
+	}
+}
+
+// WithBarrier makes ChunkingApply, ChunkingApplyMulti and ChunkingResume call
+// barrier once every chunk of an op has been applied, and wait for the future
+// it returns before reporting success, giving it the timeout each chunk is
+// given. For a raft node it would typically be raft.Raft.Barrier, so that the
+// reassembled op is known to have been applied to the leader's FSM even when
+// the apply function's futures return once the chunks are committed. If the
+// barrier fails the op's future returns its error, though the op may well
+// have been applied. It is ignored by the FSM.
+func WithBarrier(barrier func(timeout time.Duration) raft.Future) Option {
+	return func(c *config) {
+		c.barrier = barrier
+	}
+}
+
+// barrierFuture waits for the barrier configured with WithBarrier once an op's
+// chunks have all been applied.
+type barrierFuture struct {
+	ChunkingFuture
+	barrier func(timeout time.Duration) raft.Future
+	timeout time.Duration
+	once    sync.Once
+	err     error
+}
+
+// withBarrier returns f, waiting for the barrier if one is configured.
+func (c *config) withBarrier(f ChunkingFuture, timeout time.Duration) ChunkingFuture {
+	if c.barrier == nil {
+		return f
+	}
+	return &barrierFuture{ChunkingFuture: f, barrier: c.barrier, timeout: timeout}
+}
+
+func (b *barrierFuture) wait() {
+	if b.err = b.ChunkingFuture.Error(); b.err != nil {
+		return
+	}
+	if err := b.barrier(b.timeout).Error(); err != nil {
+		b.err = fmt.Errorf("error waiting for barrier: %w", err)
+	}
+}
+
+func (b *barrierFuture) Error() error {
+	b.once.Do(b.wait)
+	return b.err
+}
+
+func (b *barrierFuture) Response() interface{} {
+	b.once.Do(b.wait)
+	return b.ChunkingFuture.Response()
+}
+
+// NewRaftApplyFunc returns an ApplyFunc that applies logs to r with ApplyLog,
+// for use with ChunkingApply. Leadership errors are returned from the futures
+// as a *NotLeaderError. The options should include any WithExtensionsNamespace
+// given to ChunkingApply so that chunks can be recognized.
+func NewRaftApplyFunc(r *raft.Raft, opts ...Option) ApplyFunc {
+	conf := newConfig(opts)
+	return func(l raft.Log, timeout time.Duration) raft.ApplyFuture {
+		if conf.verifyLeader && opStart(conf, &l) {
+			if err := r.VerifyLeader().Error(); err != nil {
+				return errorFuture{err: notLeaderError(r, err)}
+			}
+		}
+		return raftApplyFuture{ApplyFuture: r.ApplyLog(l, timeout), r: r}
+	}
+}
+
+// WithApplyTimeout sets the timeout ChunkingApplyWithOptions, NewChunkedWriter
+// and a ChunkingApplier give raft for each chunk, as passed to ChunkingApply.
+// Zero, the default, means no timeout. It is ignored by everything else.
+func WithApplyTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.applyTimeout = d
+	}
+}
+
+// ChunkingApplier applies chunked ops to a raft node with a fixed set of
+// options, so that they don't have to be passed to every call.
+type ChunkingApplier struct {
+	applyFunc ApplyFunc
+	timeout   time.Duration
+	opts      []Option
+}
+
+// NewChunkingApplier returns a ChunkingApplier that applies ops to r through
+// NewRaftApplyFunc, with the given options.
+func NewChunkingApplier(r *raft.Raft, opts ...Option) *ChunkingApplier {
+	return &ChunkingApplier{
+		applyFunc: NewRaftApplyFunc(r, opts...),
+		timeout:   newConfig(opts).applyTimeout,
+		opts:      opts,
+	}
+}
+
+// Apply applies cmd as with ChunkingApply.
+func (a *ChunkingApplier) Apply(cmd, extensions []byte) raft.ApplyFuture {
+	return ChunkingApply(cmd, extensions, a.timeout, a.applyFunc, a.opts...)
+}
+
+// ApplyAsync applies cmd in the background as with ChunkingApplyAsync.
+func (a *ChunkingApplier) ApplyAsync(cmd, extensions []byte, done func(raft.ApplyFuture)) {
+	ChunkingApplyAsync(cmd, extensions, a.timeout, a.applyFunc, done, a.opts...)
+}
+
+// ApplyMulti applies each of cmds as with ChunkingApplyMulti.
+func (a *ChunkingApplier) ApplyMulti(cmds, extensions [][]byte) []raft.ApplyFuture {
+	return ChunkingApplyMulti(cmds, extensions, a.timeout, a.applyFunc, a.opts...)
+}
+
+// Resume continues a failed op as with ChunkingResume.
+func (a *ChunkingApplier) Resume(cmd, extensions, token []byte) raft.ApplyFuture {
+	return ChunkingResume(cmd, extensions, token, a.timeout, a.applyFunc, a.opts...)
+}
+
+// Cancel cancels an op as with CancelChunkingOp.
+func (a *ChunkingApplier) Cancel(opNum uint64) raft.ApplyFuture {
+	return CancelChunkingOp(opNum, a.timeout, a.applyFunc, a.opts...)
+}
+
+// opStart returns whether l is the first chunk of an op, or isn't a chunk at
+// all.
+func opStart(conf *config, l *raft.Log) bool {
+	if !conf.isChunk(l) {
+		return true
+	}
+	var ci types.ChunkInfo
+	if err := conf.unmarshalChunkInfo(l.Extensions, &ci); err != nil {
+		return true
+	}
+	return ci.SequenceNum == 0
+}
+
+// notLeaderError converts leadership errors from r into a NotLeaderError,
+// returning other errors as they are.
+func notLeaderError(r *raft.Raft, err error) error {
+	if !isLeadershipError(err) {
+		return err
+	}
+	addr, id := r.LeaderWithID()
+	return &NotLeaderError{
+		LeaderAddr: addr,
+		LeaderID:   id,
+		Err:        err,
+	}
+}
+
+// raftApplyFuture translates leadership errors from a raft future.
+type raftApplyFuture struct {
+	raft.ApplyFuture
+	r *raft.Raft
+}
+
+func (f raftApplyFuture) Error() error {
+	if err := f.ApplyFuture.Error(); err != nil {
+		return notLeaderError(f.r, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestNewRaftApplyFunc(t *testing.T) {
+	c := raft.MakeClusterCustom(t, &raft.MakeClusterOpts{
+		Peers:       3,
+		Bootstrap:   true,
+		Conf:        raft.DefaultConfig(),
+		MakeFSMFunc: func() raft.FSM { return NewChunkingFSM(&raft.MockFSM{}, nil) },
+	})
+	defer c.Close()
+
+	followers := c.Followers()
+	leader := c.Leader()
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range [][]Option{nil, {WithVerifyLeader()}} {
+		err := ChunkingApply(data, nil, 5*time.Second, NewRaftApplyFunc(leader, opts...)).Error()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ChunkingApply(data, nil, 5*time.Second, NewRaftApplyFunc(followers[0], opts...)).Error()
+		var nle *NotLeaderError
+		if !errors.As(err, &nle) || !errors.Is(err, raft.ErrNotLeader) {
+			t.Fatalf("expected not leader error, got %v", err)
+		}
+		if addr, id := leader.LeaderWithID(); nle.LeaderAddr != addr || nle.LeaderID != id {
+			t.Fatalf("expected leader %s at %s, got %s at %s", id, addr, nle.LeaderID, nle.LeaderAddr)
+		}
+	}
+	c.EnsureSame(t)
+}
+
+func TestApplyChunking_LeaderCheck(t *testing.T) {
+	var applied int
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		applied++
+		return errorFuture{}
+	}
+
+	var checks int
+	check := func() error {
+		checks++
+		if checks > 1 {
+			return raft.ErrNotLeader
+		}
+		return nil
+	}
+	data := make([]byte, 3*ChunkSize)
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithLeaderCheck(check)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if checks != 1 || applied != 4 {
+		t.Fatalf("expected one check and 4 chunks, got %d checks and %d chunks", checks, applied)
+	}
+
+	applied = 0
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithLeaderCheck(check)).Error(); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected not leader error, got %v", err)
+	}
+	if applied != 0 {
+		t.Fatalf("expected no chunks to be submitted, got %d", applied)
+	}
+}
+
+func TestApplyChunking_Barrier(t *testing.T) {
+	var applied, barriers int
+	var fail error
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		applied++
+		return errorFuture{err: fail}
+	}
+	var barrierErr error
+	barrier := func(timeout time.Duration) raft.Future {
+		if applied != 4 || timeout != time.Second {
+			t.Fatalf("expected barrier after 4 chunks with the chunk timeout, got %d chunks and %v", applied, timeout)
+		}
+		barriers++
+		return errorFuture{err: barrierErr}
+	}
+
+	data := make([]byte, 3*ChunkSize)
+	future := ChunkingApply(data, nil, time.Second, applyFunc, WithBarrier(barrier))
+	if err := future.Error(); err != nil {
+		t.Fatal(err)
+	}
+	future.Response()
+	if barriers != 1 {
+		t.Fatalf("expected one barrier, got %d", barriers)
+	}
+	if _, ok := future.(ChunkingFuture); !ok {
+		t.Fatal("expected a ChunkingFuture")
+	}
+
+	// A failed barrier fails the op
+	applied, barrierErr = 0, raft.ErrLeadershipLost
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithBarrier(barrier)).Error(); !errors.Is(err, raft.ErrLeadershipLost) {
+		t.Fatalf("expected barrier error, got %v", err)
+	}
+
+	// A failed op has no barrier
+	applied, barriers, fail = 0, 0, raft.ErrNotLeader
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithBarrier(barrier)).Error(); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected not leader error, got %v", err)
+	}
+	if barriers != 0 {
+		t.Fatalf("expected no barrier for a failed op, got %d", barriers)
+	}
+}
+
+func TestChunkingApplier(t *testing.T) {
+	c := raft.MakeClusterCustom(t, &raft.MakeClusterOpts{
+		Peers:       3,
+		Bootstrap:   true,
+		Conf:        raft.DefaultConfig(),
+		MakeFSMFunc: func() raft.FSM { return NewChunkingFSM(&raft.MockFSM{}, nil) },
+	})
+	defer c.Close()
+
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	a := NewChunkingApplier(c.Leader(), WithApplyTimeout(5*time.Second), WithMaxOutstanding(2))
+	if err := a.Apply(data, nil).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Apply(data, nil).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := NewChunkingApplier(c.Followers()[0]).Apply(data, nil).Error()
+	var nle *NotLeaderError
+	if !errors.As(err, &nle) {
+		t.Fatalf("expected not leader error, got %v", err)
+	}
+	c.EnsureSame(t)
+}
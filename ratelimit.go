@@ -0,0 +1,57 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import "time"
+
+// WithRateLimit paces the submission of an op's chunks to bytesPerSecond,
+// counting each log's data and extensions, so that a large op doesn't take
+// over the raft pipeline and starve ordinary writes. Up to a second's worth
+// of chunks, or a single chunk if that is larger, is sent without waiting.
+// The limit applies to each op separately. Zero or less means no limit. It is
+// ignored by the FSM.
+func WithRateLimit(bytesPerSecond int64) Option {
+	return func(c *config) {
+		c.rateLimit = bytesPerSecond
+	}
+}
+
+// tokenBucket paces submissions to a rate in bytes per second, allowing
+// bursts of up to capacity bytes.
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// newTokenBucket returns a full bucket.
+func newTokenBucket(rate int64, capacity int, now time.Time) *tokenBucket {
+	c := float64(capacity)
+	if r := float64(rate); r > c {
+		c = r
+	}
+	return &tokenBucket{
+		rate:     float64(rate),
+		capacity: c,
+		tokens:   c,
+		last:     now,
+	}
+}
+
+// take removes n bytes' worth of tokens from the bucket, returning how long to
+// wait before sending them. The bucket may be left in debt, delaying later
+// takes.
+func (b *tokenBucket) take(n int, now time.Time) time.Duration {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
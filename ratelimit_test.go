@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newTokenBucket(1000, 100, now)
+
+	// A second's worth goes out straight away
+	if wait := b.take(1000, now); wait != 0 {
+		t.Fatalf("expected no wait for a full bucket, got %v", wait)
+	}
+	if wait := b.take(500, now); wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v", wait)
+	}
+
+	// The debt is paid off as time passes
+	now = now.Add(500 * time.Millisecond)
+	if wait := b.take(250, now); wait != 250*time.Millisecond {
+		t.Fatalf("expected to wait 250ms, got %v", wait)
+	}
+
+	// Idle time refills no more than the bucket holds
+	now = now.Add(time.Hour)
+	if wait := b.take(1250, now); wait != 250*time.Millisecond {
+		t.Fatalf("expected to wait 250ms, got %v", wait)
+	}
+
+	// A chunk larger than the rate still fits in the bucket
+	b = newTokenBucket(10, 1000, now)
+	if wait := b.take(1000, now); wait != 0 {
+		t.Fatalf("expected no wait for a single chunk, got %v", wait)
+	}
+}
+
+func TestApplyChunking_RateLimit(t *testing.T) {
+	data := make([]byte, 30000)
+	var sent int
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		sent += len(l.Data) + len(l.Extensions)
+		return errorFuture{}
+	}
+
+	start := time.Now()
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithChunkSize(1000), WithRateLimit(20000)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	// The first 20000 bytes go out at once and the rest at the limit
+	if elapsed, min := time.Since(start), time.Duration(sent-20000)*time.Second/20000; elapsed < min {
+		t.Fatalf("expected op to take at least %v, took %v", min, elapsed)
+	}
+
+	// Ops that would run out of time waiting are cut short
+	sent = 0
+	err := ChunkingApply(data, nil, time.Second, applyFunc, WithChunkSize(1000), WithRateLimit(20000), WithOpTimeout(100*time.Millisecond)).Error()
+	if !errors.Is(err, ErrOpTimeout) {
+		t.Fatalf("expected op timeout, got %v", err)
+	}
+	if sent >= len(data) {
+		t.Fatalf("expected op to be cut short, sent %d bytes", sent)
+	}
+}
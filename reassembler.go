@@ -0,0 +1,340 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/cipher"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// ReassembledOp describes an op whose chunks have all been written out by a
+// Reassembler.
+type ReassembledOp struct {
+	// OpNum is the op number of the completed op
+	OpNum uint64
+
+	// Size is the total number of bytes written for the op
+	Size uint64
+
+	// Extensions holds the extensions that were passed to ChunkingApply, if
+	// any
+	Extensions []byte
+
+	// ContentType is the op's content type hint, if any
+	ContentType string
+
+	// Metadata is the op's metadata, if any
+	Metadata map[string]string
+
+	// TraceContext is the op's trace context, if any
+	TraceContext string
+
+	// Compression is the algorithm the op's payload was compressed with, if
+	// any. The data is written out as it was sent, so it must be read back
+	// through Compression.NewReader, and Size is the compressed size.
+	Compression Compression
+}
+
+// Reassembler reconstructs payloads produced by ChunkingApply by writing each
+// op's chunks, in order, to a writer supplied by the caller. Data is written
+// as soon as it is contiguous with what has been written before, so
+// applications that can consume a payload incrementally never need to hold it
+// in a single buffer. Chunks that arrive out of order are held in memory until
+// the gap before them is filled. Compressed payloads are written out as they
+// were sent; see ReassembledOp.Compression.
+//
+// Like ChunkingFSM, a Reassembler discards any partially written ops when the
+// term changes, and reports every op it finishes with to the sink given with
+// WithAuditSink, if any. It is not safe for concurrent use.
+type Reassembler struct {
+	newWriter func(opNum uint64) (io.Writer, error)
+	conf      *config
+	lastTerm  uint64
+	ops       map[opKey]*reassembly
+}
+
+type reassembly struct {
+	w         io.Writer
+	numChunks uint32
+	next      uint32
+	size      uint64
+	failed    bool
+	aead      cipher.AEAD
+	encrypted bool
+
+	// extChunks is the number of trailing chunks carrying the op's
+	// extensions, which are collected rather than written
+	extChunks uint32
+
+	// received and receivedBytes count the chunks that have arrived and
+	// their data as carried in the logs; started is when the leader
+	// appended the first of them, and metadata is the op's metadata
+	received      int
+	receivedBytes uint64
+	started       time.Time
+	metadata      map[string]string
+	traceContext  string
+
+	// hasher is fed chunk data as it is written out when the op carries a
+	// payload digest
+	hasher        hash.Hash
+	hashAlgorithm HashAlgorithm
+
+	// extensions, digest and contentType are taken from the final chunk,
+	// which may not be the last one to arrive
+	extensions  []byte
+	digest      []byte
+	contentType string
+	compression Compression
+
+	// pending holds data for chunks received ahead of next
+	pending map[uint32][]byte
+}
+
+// NewReassembler returns a Reassembler that calls newWriter when the first
+// chunk for an op is seen to obtain the writer that op's data is written to.
+// To reassemble into an io.WriterAt, wrap it with io.NewOffsetWriter. Options
+// are interpreted as for the FSM.
+func NewReassembler(newWriter func(opNum uint64) (io.Writer, error), opts ...Option) *Reassembler {
+	return &Reassembler{
+		newWriter: newWriter,
+		conf:      newConfig(opts),
+		ops:       make(map[opKey]*reassembly),
+	}
+}
+
+// Add processes a chunk log. When the log completes an op, a description of
+// the op is returned; otherwise the returned op is nil. If writing fails, a
+// chunk's checksum does not match or the op is cancelled, the op is abandoned
+// and the remaining chunks for it are discarded; a checksum mismatch returns a
+// *ChunkChecksumError. If the op was sent with a payload digest that does not
+// match, an error wrapping ErrChecksumMismatch is returned when it completes,
+// after its data has been written.
+func (r *Reassembler) Add(l *raft.Log) (*ReassembledOp, error) {
+	if !r.conf.isChunk(l) {
+		return nil, ErrNotChunk
+	}
+
+	if l.Term != r.lastTerm {
+		// Same logic as in ChunkingFSM; any in-progress ops will be retried
+		// by the client under a new op num
+		for key, op := range r.ops {
+			if !op.failed {
+				r.audit(key.opNum, op, OpAbortedTermChange, nil, l)
+			}
+		}
+		r.ops = make(map[opKey]*reassembly)
+		r.lastTerm = l.Term
+	}
+
+	var ci types.ChunkInfo
+	if err := r.conf.unmarshalChunkInfo(l.Extensions, &ci); err != nil {
+		return nil, err
+	}
+	key := chunkKey(&ci)
+	if ci.Cancel {
+		if op, ok := r.ops[key]; ok && !op.failed {
+			op.failed = true
+			op.pending = nil
+			r.audit(ci.OpNum, op, OpCancelled, nil, l)
+		}
+		return nil, nil
+	}
+	if ci.NumChunks == 0 {
+		// A reservation; there is no data to write
+		return nil, nil
+	}
+	if err := checkChunkBounds(&ci, r.conf); err != nil {
+		return nil, err
+	}
+
+	op, ok := r.ops[key]
+	if !ok {
+		op = &reassembly{
+			numChunks: ci.NumChunks,
+			pending:   make(map[uint32][]byte),
+			started:   l.AppendedAt,
+			encrypted: ci.Encrypted,
+			extChunks: ci.ExtensionsChunks,
+
+			hashAlgorithm: HashAlgorithm(ci.HashAlgorithm),
+			traceContext:  ci.TraceContext,
+		}
+		r.ops[key] = op
+
+		err := r.conf.checkFIPS(op.hashAlgorithm)
+		if err == nil {
+			op.hasher, err = op.hashAlgorithm.newHash()
+		}
+		if ci.ExtensionsChunks > ci.NumChunks {
+			err = fmt.Errorf("%d of %d chunks carry extensions", ci.ExtensionsChunks, ci.NumChunks)
+		}
+		if err == nil && ci.Encrypted && r.conf.decryptFunc == nil {
+			err = ErrNoDecryptFunc
+		}
+		if err == nil && len(ci.WrappedKey) > 0 {
+			op.aead, err = unwrapDataKey(r.conf, ci.KeyId, ci.WrappedKey)
+		}
+		if err == nil {
+			op.w, err = r.newWriter(ci.OpNum)
+		}
+		if err != nil {
+			err = fmt.Errorf("error setting up op %d: %w", ci.OpNum, err)
+			r.fail(ci.OpNum, op, err, l)
+			r.finishIfFailed(key, op, ci.SequenceNum)
+			return nil, err
+		}
+	}
+
+	if ci.NumChunks > op.numChunks {
+		// A streamed op, whose count grows as its chunks arrive
+		op.numChunks = ci.NumChunks
+	}
+
+	if op.failed {
+		r.finishIfFailed(key, op, ci.SequenceNum)
+		return nil, nil
+	}
+
+	if err := r.conf.checkChunkChecksum(&ci, l.Data); err != nil {
+		op.pending = nil
+		r.fail(ci.OpNum, op, err, l)
+		r.finishIfFailed(key, op, ci.SequenceNum)
+		return nil, err
+	}
+
+	if ci.SequenceNum == 0 {
+		op.metadata = ci.Metadata
+	}
+	op.traceContext = ci.TraceContext
+	if ci.SequenceNum == op.numChunks-1 {
+		if op.extChunks == 0 {
+			op.extensions = ci.NextExtensions
+		}
+		op.digest = ci.PayloadDigest
+		op.contentType = ci.ContentType
+		op.compression = Compression(ci.Compression)
+	}
+	if ci.SequenceNum < op.next {
+		// Already written; nothing to do
+		return nil, nil
+	}
+	if _, ok := op.pending[ci.SequenceNum]; !ok {
+		op.received++
+		op.receivedBytes += uint64(len(l.Data))
+	}
+	op.pending[ci.SequenceNum] = l.Data
+
+	// Write out everything that is now contiguous
+	for {
+		data, ok := op.pending[op.next]
+		if !ok {
+			break
+		}
+		if op.hasher != nil {
+			op.hasher.Write(data)
+		}
+		if op.next >= op.numChunks-op.extChunks {
+			op.extensions = append(op.extensions, data...)
+			delete(op.pending, op.next)
+			op.next++
+			continue
+		}
+		var err error
+		if op.encrypted {
+			data, err = r.conf.decryptChunk(ci.OpNum, op.next, data)
+		}
+		if err == nil && op.aead != nil {
+			data, err = openChunk(op.aead, ci.OpNum, op.next, data)
+		}
+		if err == nil {
+			_, err = op.w.Write(data)
+		}
+		if err != nil {
+			err = fmt.Errorf("error processing chunk %d of op %d: %w", op.next, ci.OpNum, err)
+			op.pending = nil
+			r.fail(ci.OpNum, op, err, l)
+			r.finishIfFailed(key, op, ci.SequenceNum)
+			return nil, err
+		}
+		delete(op.pending, op.next)
+		op.size += uint64(len(data))
+		op.next++
+	}
+
+	if op.next < op.numChunks {
+		return nil, nil
+	}
+
+	delete(r.ops, key)
+	if ci.TotalSize != 0 && op.compression == CompressionNone && op.size != ci.TotalSize {
+		// As with the digest, the data has already been written
+		err := fmt.Errorf("op %d reassembled to %d bytes but %d were sent", ci.OpNum, op.size, ci.TotalSize)
+		r.audit(ci.OpNum, op, OpFailed, err, l)
+		return nil, err
+	}
+	if op.hasher != nil {
+		// The data has already been written, so all that can be done is to
+		// report the problem
+		if err := checkDigest(ci.OpNum, op.hashAlgorithm, op.hasher, op.digest); err != nil {
+			r.audit(ci.OpNum, op, OpFailed, err, l)
+			return nil, err
+		}
+	}
+	r.audit(ci.OpNum, op, OpCompleted, nil, l)
+	return &ReassembledOp{
+		OpNum:        ci.OpNum,
+		Size:         op.size,
+		Extensions:   op.extensions,
+		ContentType:  op.contentType,
+		Compression:  op.compression,
+		Metadata:     op.metadata,
+		TraceContext: op.traceContext,
+	}, nil
+}
+
+// fail marks an op as failed with err and records it.
+func (r *Reassembler) fail(opNum uint64, op *reassembly, err error, l *raft.Log) {
+	op.failed = true
+	r.audit(opNum, op, OpFailed, err, l)
+}
+
+// audit sends a record for an op to the audit sink, if any. l is the log that
+// ended the op.
+func (r *Reassembler) audit(opNum uint64, op *reassembly, outcome OpOutcome, err error, l *raft.Log) {
+	if r.conf.auditSink == nil {
+		return
+	}
+	rec := OpRecord{
+		OpNum:          opNum,
+		Outcome:        outcome,
+		Err:            err,
+		Size:           op.receivedBytes,
+		NumChunks:      op.numChunks,
+		ChunksReceived: op.received,
+		Started:        op.started,
+		Index:          l.Index,
+		Term:           l.Term,
+		Metadata:       op.metadata,
+		TraceContext:   op.traceContext,
+	}
+	if !op.started.IsZero() && !l.AppendedAt.IsZero() {
+		rec.Duration = l.AppendedAt.Sub(op.started)
+	}
+	r.conf.auditSink.RecordOp(rec)
+}
+
+// finishIfFailed forgets a failed op once its final chunk has been seen, since
+// no more chunks for it are expected.
+func (r *Reassembler) finishIfFailed(key opKey, op *reassembly, seq uint32) {
+	if op.failed && seq+1 >= op.numChunks {
+		delete(r.ops, key)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/raft"
+)
+
+func TestReassembler(t *testing.T) {
+	data, logs := chunkData(t)
+
+	var buf bytes.Buffer
+	r := NewReassembler(func(opNum uint64) (io.Writer, error) {
+		return &buf, nil
+	})
+
+	// Shuffle everything but the first chunk to exercise buffering of out of
+	// order chunks
+	shuffled := append([]*raft.Log(nil), logs...)
+	rand.Shuffle(len(shuffled)-1, func(i, j int) {
+		shuffled[i+1], shuffled[j+1] = shuffled[j+1], shuffled[i+1]
+	})
+
+	for i, l := range shuffled {
+		op, err := r.Add(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < len(shuffled)-1 {
+			if op != nil {
+				t.Fatalf("unexpected completion at log %d", i)
+			}
+			continue
+		}
+		if op == nil {
+			t.Fatal("expected op to be complete")
+		}
+		if op.Size != uint64(len(data)) {
+			t.Fatalf("expected size %d, got %d", len(data), op.Size)
+		}
+	}
+
+	if diff := deep.Equal(data, buf.Bytes()); diff != nil {
+		t.Fatal(diff)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestReassembler_WriteError(t *testing.T) {
+	var logs []*raft.Log
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		logs = append(logs, &l)
+		return errorFuture{}
+	}
+	ChunkingApply(make([]byte, ChunkSize*3), []byte("ext"), time.Second, applyFunc)
+
+	r := NewReassembler(func(opNum uint64) (io.Writer, error) {
+		return failingWriter{}, nil
+	})
+	if _, err := r.Add(logs[0]); err == nil {
+		t.Fatal("expected write error")
+	}
+	for _, l := range logs[1:] {
+		op, err := r.Add(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != nil {
+			t.Fatal("failed op should not complete")
+		}
+	}
+	if len(r.ops) != 0 {
+		t.Fatalf("expected failed op to be forgotten, have %d ops", len(r.ops))
+	}
+}
+
+func TestReassembler_ContentType(t *testing.T) {
+	logs, err := SplitIntoLogs(make([]byte, ChunkSize*2), nil, WithContentType("application/x-tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReassembler(func(opNum uint64) (io.Writer, error) {
+		return io.Discard, nil
+	})
+	var op *ReassembledOp
+	for i := range logs {
+		if op, err = r.Add(&logs[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if op == nil || op.ContentType != "application/x-tar" {
+		t.Fatalf("expected content type on completed op, got %#v", op)
+	}
+}
+
+func TestReassembler_Audit(t *testing.T) {
+	sink := new(recordingSink)
+	r := NewReassembler(func(opNum uint64) (io.Writer, error) {
+		return ioutil.Discard, nil
+	}, WithAuditSink(sink))
+	start := time.Now()
+
+	logs := auditLogs(t, start)
+	for _, l := range logs {
+		if _, err := r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.records) != 1 || sink.records[0].Outcome != OpCompleted || sink.records[0].ChunksReceived != len(logs) {
+		t.Fatalf("expected completed record, got %#v", sink.records)
+	}
+
+	// A partial op is reported when the term change drops it
+	logs = auditLogs(t, start)
+	for _, l := range logs[:2] {
+		if _, err := r.Add(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := auditLogs(t, start.Add(time.Minute))[0]
+	next.Term = 2
+	if _, err := r.Add(next); err != nil {
+		t.Fatal(err)
+	}
+	expected := OpRecord{
+		OpNum:          logOpNum(t, logs[0]),
+		Outcome:        OpAbortedTermChange,
+		Size:           uint64(len(logs[0].Data) + len(logs[1].Data)),
+		NumChunks:      uint32(len(logs)),
+		ChunksReceived: 2,
+		Started:        start,
+		Duration:       time.Minute,
+		Index:          next.Index,
+		Term:           2,
+	}
+	if len(sink.records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(sink.records))
+	}
+	if diff := deep.Equal(expected, sink.records[1]); diff != nil {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrOpCancelled is returned, wrapped, for the chunks of an op that were not
+// submitted because the op was cancelled with OpRegistry.Cancel.
+var ErrOpCancelled = errors.New("op cancelled")
+
+// ActiveOpState describes how far an op listed by an OpRegistry has got.
+type ActiveOpState int
+
+const (
+	// ActiveOpSubmitting means the op's chunks are still being handed to
+	// the apply function.
+	ActiveOpSubmitting ActiveOpState = iota
+
+	// ActiveOpCommitting means all of the chunks that will be submitted
+	// have been, and the op is waiting on their futures.
+	ActiveOpCommitting
+
+	// ActiveOpCancelling means the op was cancelled while submitting and
+	// will stop before its next chunk.
+	ActiveOpCancelling
+)
+
+func (s ActiveOpState) String() string {
+	switch s {
+	case ActiveOpSubmitting:
+		return "submitting"
+	case ActiveOpCommitting:
+		return "committing"
+	case ActiveOpCancelling:
+		return "cancelling"
+	default:
+		return "unknown"
+	}
+}
+
+// ActiveOp describes an op in flight, as listed by OpRegistry.ListOps.
+type ActiveOp struct {
+	OpNum   uint64
+	Started time.Time
+	State   ActiveOpState
+
+	// Chunks and Bytes are the number of chunks handed to the apply
+	// function so far and the size of their data
+	Chunks int
+	Bytes  uint64
+}
+
+// OpRegistry tracks the chunked ops in flight from the submitters sharing it,
+// given with WithOpRegistry, so that applications can report large writes in
+// progress to operators and cancel them. An op is listed from when it is
+// submitted until all of its chunk futures have returned. Ops sent as a
+// single log under WithPassthrough have no op num and aren't listed. An
+// OpRegistry is safe for concurrent use.
+type OpRegistry struct {
+	l   sync.Mutex
+	ops map[uint64]*ActiveOp
+}
+
+// NewOpRegistry returns an OpRegistry with no ops in flight.
+func NewOpRegistry() *OpRegistry {
+	return &OpRegistry{ops: make(map[uint64]*ActiveOp)}
+}
+
+// WithOpRegistry makes ChunkingApply list its ops in r while they are in
+// flight. It is ignored by the FSM.
+func WithOpRegistry(r *OpRegistry) Option {
+	return func(c *config) {
+		c.opRegistry = r
+	}
+}
+
+// ListOps returns the ops in flight, oldest first.
+func (r *OpRegistry) ListOps() []ActiveOp {
+	r.l.Lock()
+	ops := make([]ActiveOp, 0, len(r.ops))
+	for _, op := range r.ops {
+		ops = append(ops, *op)
+	}
+	r.l.Unlock()
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Started.Before(ops[j].Started) })
+	return ops
+}
+
+// Cancel stops an op in flight from submitting any more chunks, failing its
+// remaining chunks with ErrOpCancelled, and returns whether the op was still
+// submitting. The chunks already submitted are left in the FSM, to be dropped
+// with CancelChunkingOp or when the term changes.
+func (r *OpRegistry) Cancel(opNum uint64) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	op, ok := r.ops[opNum]
+	if !ok || op.State != ActiveOpSubmitting {
+		return false
+	}
+	op.State = ActiveOpCancelling
+	return true
+}
+
+// add starts tracking an op, returning nil if it can't be, because it has no
+// op num or one in use by another op being tracked.
+func (r *OpRegistry) add(opNum uint64) *ActiveOp {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if _, ok := r.ops[opNum]; ok || opNum == 0 {
+		return nil
+	}
+	op := &ActiveOp{OpNum: opNum, Started: time.Now()}
+	r.ops[opNum] = op
+	return op
+}
+
+// submitted records a chunk of data bytes handed over for op.
+func (r *OpRegistry) submitted(op *ActiveOp, data int) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	op.Chunks++
+	op.Bytes += uint64(data)
+}
+
+// cancelled returns whether op has been cancelled.
+func (r *OpRegistry) cancelled(op *ActiveOp) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return op.State == ActiveOpCancelling
+}
+
+// committing records that op has nothing more to submit.
+func (r *OpRegistry) committing(op *ActiveOp) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	op.State = ActiveOpCommitting
+}
+
+// remove stops tracking op.
+func (r *OpRegistry) remove(op *ActiveOp) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.ops[op.OpNum] == op {
+		delete(r.ops, op.OpNum)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestOpRegistry(t *testing.T) {
+	registry := NewOpRegistry()
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+
+	// Follow the op as it is submitted, cancelling it on its third chunk
+	var seen []ActiveOp
+	var sent int
+	release := make(chan struct{})
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		seen = append(seen, registry.ListOps()...)
+		sent++
+		if sent == 3 {
+			if !registry.Cancel(seen[0].OpNum) {
+				t.Error("expected the op to be cancelled")
+			}
+		}
+		f.Apply(&l)
+		return pendingFuture{done: release}
+	}
+	data := make([]byte, 6*ChunkSize)
+	future := ChunkingApply(data, nil, time.Second, applyFunc, WithOpRegistry(registry)).(ChunkingFuture)
+
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 chunks to be submitted, got %d", len(seen))
+	}
+	for i, op := range seen {
+		if op.OpNum != future.OpNum() || op.Chunks != i || op.State != ActiveOpSubmitting || op.Started.IsZero() {
+			t.Fatalf("unexpected listing before chunk %d: %#v", i, op)
+		}
+		if i > 0 && op.Bytes <= seen[i-1].Bytes {
+			t.Fatalf("expected bytes submitted to grow, got %d after %d", op.Bytes, seen[i-1].Bytes)
+		}
+	}
+
+	// The op is listed until its futures return
+	ops := registry.ListOps()
+	if len(ops) != 1 || ops[0].State != ActiveOpCommitting || ops[0].Chunks != 3 {
+		t.Fatalf("expected the op to be committing, got %#v", ops)
+	}
+	if registry.Cancel(future.OpNum()) {
+		t.Fatal("expected an op that has stopped submitting not to be cancelled")
+	}
+	close(release)
+	if err := future.Error(); !errors.Is(err, ErrOpCancelled) {
+		t.Fatalf("expected the op to be cancelled, got %v", err)
+	}
+	for i := 0; i < 100 && len(registry.ListOps()) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if ops := registry.ListOps(); len(ops) != 0 {
+		t.Fatalf("expected no ops once the futures returned, got %#v", ops)
+	}
+	if f.PendingOps() != 1 || len(m.logs) != 0 {
+		t.Fatalf("expected the submitted chunks to be left pending, got %d pending and %d applied", f.PendingOps(), len(m.logs))
+	}
+	if registry.Cancel(future.OpNum()) {
+		t.Fatal("expected an unknown op not to be cancelled")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// Report returns a human-readable summary of the ops the FSM is holding chunks
+// for: how far along each is, how old and how big it is, and totals across
+// all of them. It is meant for support bundles and debug output; the format
+// is not stable and should not be parsed.
+func (c *ChunkingFSM) Report() string {
+	return c.report(time.Now())
+}
+
+func (c *ChunkingFSM) report(now time.Time) string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+
+	keys := make([]opKey, 0, len(c.ops))
+	for key := range c.ops {
+		keys = append(keys, key)
+	}
+	sortKeys(keys)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Pending ops: %d\n", len(keys))
+	fmt.Fprintf(&buf, "Pending bytes: %d\n", c.PendingBytes())
+	if len(keys) == 0 {
+		return buf.String()
+	}
+
+	buf.WriteString("\n")
+	w := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tCHUNKS\tCOMPLETE\tBYTES\tAGE")
+	for _, key := range keys {
+		op := c.ops[key]
+		var pct float64
+		if op.numChunks > 0 {
+			pct = 100 * float64(len(op.sizes)) / float64(op.numChunks)
+		}
+		age := "unknown"
+		if !op.started.IsZero() {
+			age = now.Sub(op.started).Truncate(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%d\t%d/%d\t%.1f%%\t%d\t%s\n", key.opNum, len(op.sizes), op.numChunks, pct, op.bytes, age)
+	}
+	w.Flush()
+	return buf.String()
+}
@@ -0,0 +1,39 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFSM_Report(t *testing.T) {
+	f := NewChunkingFSM(new(MockFSM), nil)
+	if report := f.Report(); !strings.Contains(report, "Pending ops: 0\n") {
+		t.Fatalf("unexpected empty report:\n%s", report)
+	}
+
+	start := time.Now()
+	logs := auditLogs(t, start)
+	f.Apply(logs[0])
+	f.Apply(logs[1])
+
+	report := f.report(start.Add(time.Minute))
+	opNum := logOpNum(t, logs[0])
+	size := len(logs[0].Data) + len(logs[1].Data)
+	for _, expected := range []string{
+		"Pending ops: 1\n",
+		fmt.Sprintf("Pending bytes: %d\n", size),
+		fmt.Sprintf("%d  2/%d", opNum, len(logs)),
+		fmt.Sprintf("%.1f%%", 200/float64(len(logs))),
+		fmt.Sprintf("%d", size),
+		"1m0s",
+	} {
+		if !strings.Contains(report, expected) {
+			t.Fatalf("expected report to contain %q:\n%s", expected, report)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+var (
+	// ErrReservationRefused is returned, wrapped, when a reservation would
+	// take the FSM over the capacity set with WithReservations.
+	ErrReservationRefused = errors.New("reservation refused")
+
+	// ErrOpTooLarge is returned, wrapped, when an op sends more data than it
+	// reserved, or more than WithReservations allows without a reservation.
+	ErrOpTooLarge = errors.New("op exceeds its allowed size")
+)
+
+// WithReservations makes the FSM enforce reservations made with Reserve. The
+// FSM holds at most capacity bytes of reservations at once and refuses any
+// that would exceed it, and fails ops that send more data than they reserved.
+// Ops without a reservation are failed once they send more than maxUnreserved
+// bytes. Zero means no limit for either. Since the limits decide whether ops
+// are applied, every node must be given the same ones. It is ignored by
+// ChunkingApply.
+func WithReservations(capacity, maxUnreserved uint64) Option {
+	return func(c *config) {
+		c.reservations = true
+		c.reservationCapacity = capacity
+		c.maxUnreserved = maxUnreserved
+	}
+}
+
+// WithReservedOp makes ChunkingApply send the op under opNum, as returned by
+// Reserve, so that the FSM counts it against that reservation. It is ignored
+// by the FSM.
+func WithReservedOp(opNum uint64) Option {
+	return func(c *config) {
+		c.reservedOp = opNum
+	}
+}
+
+// Reserve registers an op of up to size bytes with FSMs configured with
+// WithReservations, so that they set aside room for it ahead of time. It
+// applies a single log through applyFunc and returns the op number to give to
+// ChunkingApply with WithReservedOp, along with a future whose Error returns
+// any error applying the log, including a refused reservation. Size is the
+// size of the chunk data as carried in the logs, so it should allow for any
+// encryption overhead.
+//
+// Reservations are held in the FSM until the op completes or fails, and are
+// dropped along with partial ops when the term changes, so the op should be
+// sent right away. With WithPreservedOps they are instead dropped by
+// InvalidatePriorTermOps once their op has sent no chunks, and in either case
+// by WithStaleOpGC once they are older than the limits allow. All nodes must understand reservations before they are
+// used.
+func Reserve(size uint64, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) (uint64, raft.ApplyFuture) {
+	conf := newConfig(opts)
+	if size == 0 {
+		return 0, errorFuture{err: errors.New("reservation size must be positive")}
+	}
+	opNum, err := newOpNum(conf.random())
+	if err != nil {
+		return 0, errorFuture{err: err}
+	}
+	others, err := conf.otherExtensions(nil)
+	if err != nil {
+		return 0, errorFuture{err: err}
+	}
+	ext, err := conf.marshalChunkExtensions(&types.ChunkInfo{
+		OpNum:       opNum,
+		ReserveSize: size,
+	}, others, nil)
+	if err != nil {
+		return 0, errorFuture{err: err}
+	}
+	return opNum, responseFuture{applyFunc(conf.newLog(nil, ext), timeout)}
+}
+
+// responseFuture returns errors from the FSM's response to a control log, such
+// as a reservation, as well as from raft.
+type responseFuture struct {
+	raft.ApplyFuture
+}
+
+func (r responseFuture) Error() error {
+	if err := r.ApplyFuture.Error(); err != nil {
+		return err
+	}
+	if err, ok := r.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// reservation is the space reserved for an op, along with the term, index
+// and append time of the log that reserved it.
+type reservation struct {
+	size  uint64
+	term  uint64
+	index uint64
+	at    time.Time
+}
+
+// reserve handles a reservation log.
+func (c *ChunkingFSM) reserve(l *raft.Log, ci *types.ChunkInfo) error {
+	if !c.conf.reservations {
+		return nil
+	}
+	if _, ok := c.reservations[ci.OpNum]; ok {
+		return fmt.Errorf("op %d is already reserved: %w", ci.OpNum, ErrReservationRefused)
+	}
+	capacity := c.conf.reservationCapacity
+	if capacity != 0 && (ci.ReserveSize > capacity || c.reservedBytes > capacity-ci.ReserveSize) {
+		return fmt.Errorf("reserving %d bytes for op %d would exceed capacity of %d with %d reserved: %w",
+			ci.ReserveSize, ci.OpNum, capacity, c.reservedBytes, ErrReservationRefused)
+	}
+	if c.reservations == nil {
+		c.reservations = make(map[uint64]reservation)
+	}
+	c.reservations[ci.OpNum] = reservation{
+		size:  ci.ReserveSize,
+		term:  l.Term,
+		index: l.Index,
+		at:    l.AppendedAt,
+	}
+	c.reservedBytes += ci.ReserveSize
+	return nil
+}
+
+// releaseReservation drops an op's reservation, if it has one.
+func (c *ChunkingFSM) releaseReservation(opNum uint64) {
+	if r, ok := c.reservations[opNum]; ok {
+		delete(c.reservations, opNum)
+		c.reservedBytes -= r.size
+	}
+}
+
+// dropReservations drops the reservations for which drop returns true,
+// except those of ops that have sent chunks, which go with their op.
+func (c *ChunkingFSM) dropReservations(drop func(r reservation) bool) {
+	if len(c.reservations) == 0 {
+		return
+	}
+	tracked := make(map[uint64]bool, len(c.ops))
+	for key := range c.ops {
+		tracked[key.opNum] = true
+	}
+	for opNum, r := range c.reservations {
+		if !tracked[opNum] && drop(r) {
+			c.releaseReservation(opNum)
+		}
+	}
+}
+
+// resetReservations replaces all reservations, such as when the state is
+// restored. Reservations without a log, as in states from before logs were
+// recorded, are taken to be from term zero.
+func (c *ChunkingFSM) resetReservations(sizes map[uint64]uint64, logs map[uint64]ReservationLog) {
+	c.reservations = make(map[uint64]reservation, len(sizes))
+	c.reservedBytes = 0
+	for opNum, size := range sizes {
+		l := logs[opNum]
+		c.reservations[opNum] = reservation{
+			size:  size,
+			term:  l.Term,
+			index: l.Index,
+			at:    l.AppendedAt,
+		}
+		c.reservedBytes += size
+	}
+}
+
+// checkReservation checks that storing a chunk of size bytes keeps its op
+// within its reservation, or the limit for unreserved ops.
+func (c *ChunkingFSM) checkReservation(ci *types.ChunkInfo, size int) error {
+	if !c.conf.reservations {
+		return nil
+	}
+	r, reserved := c.reservations[ci.OpNum]
+	limit := r.size
+	if !reserved {
+		limit = c.conf.maxUnreserved
+		if limit == 0 {
+			return nil
+		}
+	}
+	total := uint64(size)
+	if op, ok := c.ops[chunkKey(ci)]; ok {
+		total += op.bytes - op.sizes[ci.SequenceNum]
+	}
+	if total <= limit {
+		return nil
+	}
+	if reserved {
+		return fmt.Errorf("op %d sent %d bytes but reserved %d: %w", ci.OpNum, total, limit, ErrOpTooLarge)
+	}
+	return fmt.Errorf("unreserved op %d sent %d bytes, more than the limit of %d: %w", ci.OpNum, total, limit, ErrOpTooLarge)
+}
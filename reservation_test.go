@@ -0,0 +1,205 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// appliedFuture is the future for a log applied directly to an FSM.
+type appliedFuture struct {
+	resp interface{}
+}
+
+func (a appliedFuture) Error() error { return nil }
+
+func (a appliedFuture) Response() interface{} { return a.resp }
+
+func (a appliedFuture) Index() uint64 { return 0 }
+
+func TestFSM_Reservations(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(len(data))
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil, WithReservations(2*size, uint64(ChunkSize)))
+	var index uint64
+	var responses []interface{}
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		index++
+		l.Index, l.Term = index, 1
+		resp := f.Apply(&l)
+		responses = append(responses, resp)
+		return appliedFuture{resp: resp}
+	}
+
+	// A reserved op goes through and releases its reservation
+	opNum, rf := Reserve(size, time.Second, applyFunc)
+	if err := rf.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, WithReservedOp(opNum)).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 1 {
+		t.Fatalf("expected op to be applied, got %d logs", len(m.logs))
+	}
+	if f.reservedBytes != 0 || len(f.reservations) != 0 {
+		t.Fatalf("expected reservation to be released, have %d bytes", f.reservedBytes)
+	}
+
+	// Reservations beyond capacity are refused
+	for i := 0; i < 2; i++ {
+		if _, rf := Reserve(size, time.Second, applyFunc); rf.Error() != nil {
+			t.Fatal(rf.Error())
+		}
+	}
+	if _, rf := Reserve(1, time.Second, applyFunc); !errors.Is(rf.Error(), ErrReservationRefused) {
+		t.Fatalf("expected refused reservation, got %v", rf.Error())
+	}
+
+	// Reservations survive capturing and restoring the state
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Reservations) != 2 {
+		t.Fatalf("expected 2 reservations in state, got %d", len(state.Reservations))
+	}
+	if err := f.RestoreState(nil); err != nil {
+		t.Fatal(err)
+	}
+	if f.reservedBytes != 0 {
+		t.Fatalf("expected reservations to be cleared, have %d bytes", f.reservedBytes)
+	}
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if f.reservedBytes != 2*size {
+		t.Fatalf("expected reservations to be restored, have %d bytes", f.reservedBytes)
+	}
+	if err := f.RestoreState(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ops sending more than they reserved fail
+	opNum, rf = Reserve(size/2, time.Second, applyFunc)
+	if err := rf.Error(); err != nil {
+		t.Fatal(err)
+	}
+	responses = nil
+	ChunkingApply(data, nil, time.Second, applyFunc, WithReservedOp(opNum))
+	if !failedWith(responses, ErrOpTooLarge) {
+		t.Fatalf("expected reserved op to be too large, got %v", responses)
+	}
+
+	// So do unreserved ops larger than the limit, while small ones are fine
+	responses = nil
+	ChunkingApply(data, nil, time.Second, applyFunc)
+	if !failedWith(responses, ErrOpTooLarge) {
+		t.Fatalf("expected unreserved op to be too large, got %v", responses)
+	}
+	if err := ChunkingApply(data[:ChunkSize/2], nil, time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 2 {
+		t.Fatalf("expected 2 applied ops, got %d", len(m.logs))
+	}
+}
+
+// failedWith returns whether any of the responses is an error wrapping target.
+func failedWith(responses []interface{}, target error) bool {
+	for _, resp := range responses {
+		if err, ok := resp.(error); ok && errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFSM_ReservationsDropped(t *testing.T) {
+	var index, term uint64
+	newApply := func(f *ChunkingFSM) ApplyFunc {
+		return func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+			index++
+			l.Index, l.Term = index, term
+			return appliedFuture{resp: f.Apply(&l)}
+		}
+	}
+
+	// Under WithPreservedOps a reservation whose op never sends a chunk is
+	// dropped when ops of its term are invalidated, surviving the state
+	// being captured and restored
+	f := NewChunkingFSM(new(MockFSM), nil, WithReservations(100, 0), WithPreservedOps())
+	applyFunc := newApply(f)
+	term = 1
+	if _, rf := Reserve(100, time.Second, applyFunc); rf.Error() != nil {
+		t.Fatal(rf.Error())
+	}
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := InvalidatePriorTermOps(time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if f.reservedBytes != 100 {
+		t.Fatalf("expected the current term's reservation to be kept, have %d bytes", f.reservedBytes)
+	}
+	term = 2
+	if err := InvalidatePriorTermOps(time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if f.reservedBytes != 0 || len(f.reservations) != 0 {
+		t.Fatalf("expected the reservation to be dropped, have %d bytes", f.reservedBytes)
+	}
+	if _, rf := Reserve(1, time.Second, applyFunc); rf.Error() != nil {
+		t.Fatalf("expected the capacity to be free, got %v", rf.Error())
+	}
+
+	// A reservation whose op has sent chunks goes with the op
+	opNum, rf := Reserve(50, time.Second, applyFunc)
+	if err := rf.Error(); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := SplitIntoLogs(make([]byte, 40), nil, WithReservedOp(opNum), WithChunkSize(32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index++
+	logs[0].Index, logs[0].Term = index, term
+	f.Apply(&logs[0])
+	term = 3
+	if _, ok := f.reservations[opNum]; !ok {
+		t.Fatal("expected the op's reservation to be held")
+	}
+	if err := InvalidatePriorTermOps(time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if f.reservedBytes != 0 || f.PendingOps() != 0 {
+		t.Fatalf("expected the op and reservations to be dropped, have %d bytes", f.reservedBytes)
+	}
+
+	// Stale reservations are dropped like stale ops
+	f = NewChunkingFSM(new(MockFSM), nil, WithReservations(100, 0), WithStaleOpGC(5, 0, nil))
+	applyFunc = newApply(f)
+	if _, rf := Reserve(100, time.Second, applyFunc); rf.Error() != nil {
+		t.Fatal(rf.Error())
+	}
+	index += 10
+	if _, rf := Reserve(100, time.Second, applyFunc); rf.Error() != nil {
+		t.Fatalf("expected the stale reservation to be dropped, got %v", rf.Error())
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// resumeTokenVersion is the current format version of resume tokens. Tokens
+// before version 2 did not record the op's chunk layout, and those before
+// version 3 its payload digest.
+const resumeTokenVersion = 3
+
+// ChunkingFuture is implemented by the futures returned from ChunkingApply and
+// ChunkingResume.
+type ChunkingFuture interface {
+	MultiFuture
+
+	// ResumeToken returns an opaque token recording which chunks of the op
+	// are known to have been committed, which can be stored and later
+	// passed to ChunkingResume to submit the rest. It is only meaningful
+	// once Error has returned, and is nil if the op succeeded or can't be
+	// resumed.
+	ResumeToken() []byte
+
+	// OpNum returns the op's number, as needed by CancelChunkingOp. It is
+	// zero if the op failed before any chunks were built.
+	OpNum() uint64
+
+	// Progress reports how far the op has got. Unlike the other methods it
+	// can be called at any time and doesn't block.
+	Progress() Progress
+}
+
+var (
+	_ ChunkingFuture = errorFuture{}
+	_ ChunkingFuture = (*chunkingFuture)(nil)
+)
+
+// ResumeToken returns nil since nothing was submitted.
+func (e errorFuture) ResumeToken() []byte {
+	return nil
+}
+
+// OpNum returns zero since there is no op.
+func (e errorFuture) OpNum() uint64 {
+	return 0
+}
+
+func (c *chunkingFuture) OpNum() uint64 {
+	if c.token == nil {
+		return c.opNum
+	}
+	return c.token.OpNum
+}
+
+// chunkingFuture is the multiFuture for an op along with what is needed to
+// build a resume token for it.
+type chunkingFuture struct {
+	multiFuture
+
+	// seqs holds the sequence number of the chunk behind each future
+	seqs []uint32
+
+	// committed holds chunks committed by earlier attempts
+	committed []uint32
+
+	token *types.ResumeToken
+
+	// opNum is the op's number when it has no resume token, as streamed
+	// ops don't
+	opNum uint64
+
+	// submitted is the number of chunks handed to the apply function; the
+	// rest were never sent. committedChunks and failed are updated
+	// atomically as Progress tracks the futures.
+	submitted       int
+	progressOnce    sync.Once
+	committedChunks int64
+	failed          int32
+}
+
+// Error returns the error of the op's chunks as multiFuture does, noting the
+// op num and any chunks committed by earlier attempts.
+func (c *chunkingFuture) Error() error {
+	err := c.multiFuture.Error()
+	if errs, ok := err.(*ChunkErrors); ok {
+		errs.OpNum = c.OpNum()
+		errs.Committed += len(c.committed)
+	}
+	return err
+}
+
+func (c *chunkingFuture) ResumeToken() []byte {
+	committed := append([]uint32(nil), c.committed...)
+	done := true
+	for i, f := range c.multiFuture {
+		if f.Error() != nil {
+			done = false
+			continue
+		}
+		committed = append(committed, c.seqs[i])
+	}
+	if done || c.token == nil {
+		return nil
+	}
+	sort.Slice(committed, func(i, j int) bool { return committed[i] < committed[j] })
+
+	token := proto.Clone(c.token).(*types.ResumeToken)
+	token.Committed = committed
+	b, err := proto.Marshal(token)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// resumeToken returns the template for the op's resume tokens.
+func (op *opParams) resumeToken(conf *config, payloadSize, numChunks int) *types.ResumeToken {
+	return &types.ResumeToken{
+		Version:       resumeTokenVersion,
+		OpNum:         op.opNum,
+		NumChunks:     uint32(numChunks),
+		ChunkSize:     uint64(op.chunkSize),
+		PayloadSize:   uint64(payloadSize),
+		WrappedKey:    op.wrappedKey,
+		KeyId:         op.keyID,
+		HashAlgorithm: types.HashAlgorithm(conf.hashAlgorithm),
+		Compression:   types.Compression(conf.compression),
+		Encrypted:     conf.encryptFunc != nil,
+		Origin:        conf.origin,
+		LayoutDigest:  op.layoutDigest(),
+		PayloadDigest: op.payloadDigest,
+	}
+}
+
+// digestPayload returns a SHA-256 digest of the op num, the data split into
+// the op's chunks, which is the payload after any compression, and the
+// extensions. Resuming with different data of the same length would seal it
+// under the op's data key with the nonces already used for the original, as
+// well as leaving the FSM to reassemble a mix of the two. The op num is
+// included so that tokens for different ops of the same payload don't match.
+func (op *opParams) digestPayload(segments [][]byte, extensions []byte) []byte {
+	h := sha256.New()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], op.opNum)
+	h.Write(buf[:])
+	for _, segment := range segments {
+		h.Write(segment)
+	}
+	// The extensions' length separates them from the payload
+	binary.BigEndian.PutUint64(buf[:], uint64(len(extensions)))
+	h.Write(buf[:])
+	h.Write(extensions)
+	return h.Sum(nil)
+}
+
+// layoutDigest returns a digest of the amount of data placed in each of the
+// op's chunks. Options that change the size of the chunk headers, such as
+// metadata or checksums, move the chunk boundaries without necessarily
+// changing the number of chunks.
+func (op *opParams) layoutDigest() []byte {
+	h := sha256.New()
+	var buf [8]byte
+	for _, n := range op.layout {
+		binary.BigEndian.PutUint64(buf[:], uint64(n))
+		h.Write(buf[:])
+	}
+	return h.Sum(nil)
+}
+
+// ChunkingResume continues an op started by ChunkingApply using a token
+// obtained from its future's ResumeToken. The payload and extensions must be
+// the same as originally given, which the token records a digest of; they are
+// split again exactly as before and only the chunks that were not known to be
+// committed are applied. Options
+// are handled as for ChunkingApply, except that the chunk size, encryption
+// key and ID, hash algorithm, compression and origin are taken from the token,
+// so a key provider or key ring able to unwrap the op's key must be given if
+// it was encrypted. An op encrypted with an EncryptFunc must be given it
+// again. Options that change the chunk headers, such as metadata, checksums
+// or a deadline, must also be the same, or the chunk boundaries move and the
+// token is rejected.
+//
+// Since the FSM discards partially received ops when the term changes, an op
+// can only be resumed while the term it was started in is still current;
+// otherwise it should be applied again from scratch. Resending a chunk that
+// was in fact committed is harmless.
+func ChunkingResume(cmd, extensions, token []byte, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	var rt types.ResumeToken
+	if err := proto.Unmarshal(token, &rt); err != nil {
+		return errorFuture{err: fmt.Errorf("%w: %v", ErrInvalidResumeToken, err)}
+	}
+	if rt.Version != resumeTokenVersion {
+		return errorFuture{err: fmt.Errorf("%w: unsupported version %d", ErrInvalidResumeToken, rt.Version)}
+	}
+	if rt.PayloadSize != uint64(len(cmd)) {
+		return errorFuture{err: fmt.Errorf("%w: payload of %d bytes does not match token for %d bytes", ErrInvalidResumeToken, len(cmd), rt.PayloadSize)}
+	}
+	if rt.ChunkSize == 0 {
+		return errorFuture{err: fmt.Errorf("%w: no chunk size", ErrInvalidResumeToken)}
+	}
+
+	chunkSize, err := checkedInt(rt.ChunkSize)
+	if err != nil {
+		return errorFuture{err: fmt.Errorf("%w: %v", ErrInvalidResumeToken, err)}
+	}
+
+	conf := newConfig(opts)
+	if err := checkChunkSize(chunkSize, conf); err != nil {
+		return errorFuture{err: err}
+	}
+	conf.hashAlgorithm = HashAlgorithm(rt.HashAlgorithm)
+	conf.compression = Compression(rt.Compression)
+	conf.origin = rt.Origin
+	if rt.Encrypted != (conf.encryptFunc != nil) {
+		return errorFuture{err: fmt.Errorf("%w: encrypt func must be given if and only if the op was encrypted with one", ErrInvalidResumeToken)}
+	}
+	op := &opParams{
+		opNum:      rt.OpNum,
+		chunkSize:  chunkSize,
+		wrappedKey: rt.WrappedKey,
+		keyID:      rt.KeyId,
+	}
+	if len(rt.WrappedKey) > 0 {
+		op.aead, err = unwrapDataKey(conf, rt.KeyId, rt.WrappedKey)
+		if err != nil {
+			return errorFuture{err: err}
+		}
+	}
+
+	logs, err := splitIntoLogs(cmd, extensions, conf, op)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	if len(logs) != int(rt.NumChunks) {
+		return errorFuture{err: fmt.Errorf("%w: payload split into %d chunks but token is for %d", ErrInvalidResumeToken, len(logs), rt.NumChunks)}
+	}
+	if !bytes.Equal(op.payloadDigest, rt.PayloadDigest) {
+		return errorFuture{err: fmt.Errorf("%w: payload or extensions differ from those the token is for", ErrInvalidResumeToken)}
+	}
+	if !bytes.Equal(op.layoutDigest(), rt.LayoutDigest) {
+		return errorFuture{err: fmt.Errorf("%w: payload split into chunks of different sizes than the token's, such as from different header options", ErrInvalidResumeToken)}
+	}
+
+	committed := make(map[uint32]bool, len(rt.Committed))
+	for _, seq := range rt.Committed {
+		committed[seq] = true
+	}
+	var remaining []raft.Log
+	var seqs []uint32
+	for i, l := range logs {
+		if committed[uint32(i)] {
+			continue
+		}
+		remaining = append(remaining, l)
+		seqs = append(seqs, uint32(i))
+	}
+
+	mf, err := applyLogs(remaining, rt.OpNum, timeout, applyFunc, conf)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	return conf.withBarrier(&chunkingFuture{
+		multiFuture: mf,
+		submitted:   mf.submitted(),
+		seqs:        seqs,
+		committed:   rt.Committed,
+		token:       op.resumeToken(conf, len(cmd), len(logs)),
+	}, timeout)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-test/deep"
+	"github.com/hashicorp/raft"
+)
+
+func TestChunkingResume(t *testing.T) {
+	kp := newTestKeyProvider(t)
+	for name, opts := range map[string][]Option{
+		"plain":     nil,
+		"encrypted": {WithKeyProvider(kp), WithHashAlgorithm(HashSHA256)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, 5*ChunkSize)
+			if _, err := rand.Read(data); err != nil {
+				t.Fatal(err)
+			}
+
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil, opts...)
+			var resp interface{}
+
+			// Fail the third chunk and everything after it
+			var applied int
+			failingApply := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+				applied++
+				if applied >= 3 {
+					return errorFuture{err: raft.ErrEnqueueTimeout}
+				}
+				resp = f.Apply(&l)
+				return errorFuture{}
+			}
+			future := ChunkingApply(data, []byte("ext"), time.Second, failingApply, opts...)
+			if err := future.Error(); !errors.Is(err, raft.ErrEnqueueTimeout) {
+				t.Fatalf("expected enqueue timeout, got %v", err)
+			}
+			token := future.(ChunkingFuture).ResumeToken()
+			if token == nil {
+				t.Fatal("expected resume token")
+			}
+
+			// Resume, failing once more part way through
+			applied = 0
+			future = ChunkingResume(data, []byte("ext"), token, time.Second, failingApply, opts...)
+			err := future.Error()
+			if !errors.Is(err, raft.ErrEnqueueTimeout) {
+				t.Fatalf("expected enqueue timeout, got %v", err)
+			}
+			// The chunks committed by the first attempt are counted too
+			var errs *ChunkErrors
+			if !errors.As(err, &errs) || errs.Committed != 4 {
+				t.Fatalf("expected 4 chunks to be committed, got %v", err)
+			}
+			token = future.(ChunkingFuture).ResumeToken()
+			if token == nil {
+				t.Fatal("expected resume token")
+			}
+
+			applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+				resp = f.Apply(&l)
+				return errorFuture{}
+			}
+			future = ChunkingResume(data, []byte("ext"), token, time.Second, applyFunc, opts...)
+			if err := future.Error(); err != nil {
+				t.Fatal(err)
+			}
+			if token := future.(ChunkingFuture).ResumeToken(); token != nil {
+				t.Fatal("expected no resume token after success")
+			}
+			if _, ok := resp.(ChunkingSuccess); !ok {
+				t.Fatalf("expected success, got %#v", resp)
+			}
+			if diff := deep.Equal(data, m.logs[0]); diff != nil {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestChunkingResume_Invalid(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		return errorFuture{err: errors.New("failed")}
+	}
+	token := ChunkingApply(data, nil, time.Second, applyFunc).(ChunkingFuture).ResumeToken()
+	if token == nil {
+		t.Fatal("expected resume token")
+	}
+
+	applyFunc = func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		t.Fatal("unexpected apply")
+		return nil
+	}
+	if err := ChunkingResume(data[1:], nil, token, time.Second, applyFunc).Error(); err == nil {
+		t.Fatal("expected error for mismatched payload")
+	}
+
+	// A different payload of the same length would be sealed with the
+	// nonces already used for the original
+	other := append([]byte(nil), data...)
+	other[len(other)-1] ^= 1
+	if err := ChunkingResume(other, nil, token, time.Second, applyFunc).Error(); !errors.Is(err, ErrInvalidResumeToken) {
+		t.Fatalf("expected error for different payload, got %v", err)
+	}
+	if err := ChunkingResume(data, []byte("ext"), token, time.Second, applyFunc).Error(); !errors.Is(err, ErrInvalidResumeToken) {
+		t.Fatalf("expected error for different extensions, got %v", err)
+	}
+	kp := newTestKeyProvider(t)
+	failing := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+		return errorFuture{err: errors.New("failed")}
+	}
+	sealed := ChunkingApply(data, nil, time.Second, failing, WithKeyProvider(kp)).(ChunkingFuture).ResumeToken()
+	if err := ChunkingResume(other, nil, sealed, time.Second, applyFunc, WithKeyProvider(kp)).Error(); !errors.Is(err, ErrInvalidResumeToken) {
+		t.Fatalf("expected error for different encrypted payload, got %v", err)
+	}
+	if err := ChunkingResume(data, nil, []byte("garbage"), time.Second, applyFunc).Error(); err == nil {
+		t.Fatal("expected error for bad token")
+	}
+	encrypt := func(_ uint64, _ uint32, data []byte) ([]byte, error) { return data, nil }
+	if err := ChunkingResume(data, nil, token, time.Second, applyFunc, WithEncryptFunc(encrypt, 0)).Error(); !errors.Is(err, ErrInvalidResumeToken) {
+		t.Fatalf("expected error for unexpected encrypt func, got %v", err)
+	}
+}
+
+func TestChunkingResume_HeaderOptions(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, opts := range map[string][]Option{
+		"metadata":         {WithMetadata(map[string]string{"k": "v"})},
+		"trace context":    {WithTraceContext("trace")},
+		"chunk extensions": {WithChunkExtensions([]byte("ext"))},
+		"checksums":        {WithChunkChecksums()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if fipsBuild && name == "checksums" {
+				t.Skip("chunk checksums not available in FIPS builds")
+			}
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil)
+
+			// Only the first chunk is committed
+			var applied int
+			failingApply := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+				applied++
+				if applied > 1 {
+					return errorFuture{err: raft.ErrEnqueueTimeout}
+				}
+				f.Apply(&l)
+				return errorFuture{}
+			}
+			future := ChunkingApply(data, nil, time.Second, failingApply)
+			if err := future.Error(); !errors.Is(err, raft.ErrEnqueueTimeout) {
+				t.Fatalf("expected enqueue timeout, got %v", err)
+			}
+			token := future.(ChunkingFuture).ResumeToken()
+
+			// The header options move the chunk boundaries, so the rest of
+			// the chunks would not follow on from the first
+			logs, err := SplitIntoLogs(data, nil, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) != len(future.(ChunkingFuture).Futures()) {
+				t.Fatalf("expected the same number of chunks, got %d", len(logs))
+			}
+			applyFunc := func(l raft.Log, d time.Duration) raft.ApplyFuture {
+				t.Fatal("unexpected apply")
+				return nil
+			}
+			err = ChunkingResume(data, nil, token, time.Second, applyFunc, opts...).Error()
+			if !errors.Is(err, ErrInvalidResumeToken) {
+				t.Fatalf("expected error for different header options, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Scheduler interleaves the chunks of ops submitted concurrently, so that one
+// giant op can't monopolize the apply function while smaller ones queue up
+// behind it. Ops sharing a Scheduler, given with WithScheduler, hand their
+// chunks to the apply function one at a time, and when several are waiting
+// the op that was served least recently goes first, so that concurrent ops
+// take turns chunk by chunk. An op that isn't waiting, such as one waiting on
+// its own futures, doesn't hold up the others. A Scheduler is safe for
+// concurrent use and should be shared by all submitters that are to take
+// turns.
+type Scheduler struct {
+	l       sync.Mutex
+	busy    bool
+	clock   uint64
+	waiting []*schedTurn
+}
+
+// schedTurn tracks an op's turns with a Scheduler.
+type schedTurn struct {
+	// served is the scheduler's clock when the op's last chunk was handed
+	// over, and ready is closed when it is granted a turn it waited for
+	served uint64
+	ready  chan struct{}
+}
+
+// NewScheduler returns a Scheduler with no ops waiting.
+func NewScheduler() *Scheduler {
+	return &Scheduler{}
+}
+
+// WithScheduler makes ChunkingApply take turns with the other ops using s
+// before handing each chunk to the apply function. A chunk that doesn't get
+// its turn within the apply timeout, or before the op's deadline set with
+// WithOpTimeout, fails with raft.ErrEnqueueTimeout as it would had raft been
+// unable to take it. It is ignored by the FSM.
+func WithScheduler(s *Scheduler) Option {
+	return func(c *config) {
+		c.scheduler = s
+	}
+}
+
+// acquire waits for a turn for t, for up to timeout if that isn't zero. The
+// turn must be given back with release once the chunk has been handed over.
+func (s *Scheduler) acquire(t *schedTurn, timeout time.Duration) error {
+	s.l.Lock()
+	if !s.busy {
+		s.busy = true
+		s.l.Unlock()
+		return nil
+	}
+	t.ready = make(chan struct{})
+	s.waiting = append(s.waiting, t)
+	s.l.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-t.ready:
+		return nil
+	case <-expired:
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	for i, w := range s.waiting {
+		if w == t {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			return fmt.Errorf("timed out waiting for a turn with the scheduler: %w", raft.ErrEnqueueTimeout)
+		}
+	}
+	// The turn was granted as the wait ran out
+	return nil
+}
+
+// release gives back t's turn, passing it to the waiting op served least
+// recently.
+func (s *Scheduler) release(t *schedTurn) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.clock++
+	t.served = s.clock
+	if len(s.waiting) == 0 {
+		s.busy = false
+		return
+	}
+	next := 0
+	for i, w := range s.waiting {
+		if w.served < s.waiting[next].served {
+			next = i
+		}
+	}
+	w := s.waiting[next]
+	s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+	close(w.ready)
+}
+
+// Waiting returns the number of ops waiting for a turn.
+func (s *Scheduler) Waiting() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.waiting)
+}
@@ -0,0 +1,100 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestScheduler(t *testing.T) {
+	sched := NewScheduler()
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+
+	var l sync.Mutex
+	var order []uint64
+	started := make(chan struct{})
+	applyFunc := func(log raft.Log, _ time.Duration) raft.ApplyFuture {
+		var ci types.ChunkInfo
+		if err := proto.Unmarshal(log.Extensions, &ci); err != nil {
+			t.Error(err)
+		}
+		l.Lock()
+		order = append(order, ci.OpNum)
+		n := len(order)
+		l.Unlock()
+		if n == 1 {
+			close(started)
+		}
+		// Hold the first chunks until the other op is waiting its turn
+		if n <= 4 {
+			for i := 0; i < 200 && sched.Waiting() == 0; i++ {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		l.Lock()
+		defer l.Unlock()
+		return appliedFuture{resp: f.Apply(&log)}
+	}
+
+	var big, small ChunkingFuture
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		big = ChunkingApply(make([]byte, 6*ChunkSize), nil, time.Second, applyFunc, WithScheduler(sched)).(ChunkingFuture)
+	}()
+	go func() {
+		defer wg.Done()
+		<-started
+		small = ChunkingApply(make([]byte, 2*ChunkSize), nil, time.Second, applyFunc, WithScheduler(sched)).(ChunkingFuture)
+	}()
+	wg.Wait()
+	if err := big.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := small.Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 2 {
+		t.Fatalf("expected both ops to be applied, got %d", len(m.logs))
+	}
+
+	// The ops take turns rather than the big one going first
+	want := []uint64{big.OpNum(), small.OpNum(), big.OpNum(), small.OpNum()}
+	for i, opNum := range want {
+		if order[i] != opNum {
+			t.Fatalf("expected chunk %d to be from op %d, got %d", i, opNum, order[i])
+		}
+	}
+	if sched.busy || sched.Waiting() != 0 {
+		t.Fatal("expected the scheduler to be idle")
+	}
+}
+
+func TestScheduler_Timeout(t *testing.T) {
+	sched := NewScheduler()
+	var a, b schedTurn
+	if err := sched.acquire(&a, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := sched.acquire(&b, 10*time.Millisecond); !errors.Is(err, raft.ErrEnqueueTimeout) {
+		t.Fatalf("expected enqueue timeout, got %v", err)
+	}
+	if sched.Waiting() != 0 {
+		t.Fatal("expected the timed out op to stop waiting")
+	}
+	sched.release(&a)
+	if err := sched.acquire(&b, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	sched.release(&b)
+}
@@ -0,0 +1,71 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// ChunkingApplySegments applies the concatenation of segments as a single op,
+// as ChunkingApply does with a payload, for applications that already hold
+// their data in pieces, such as the frames of a framing protocol. The
+// segments are copied straight into chunks, or with WithZeroCopy chunks lying
+// within a single segment are sliced out of it, rather than being joined
+// first. Options that need the payload whole, such as WithCompression,
+// WithContentOpNum, WithAdaptiveChunkSize and WithLeadershipRetry, make it
+// join them. The op is split exactly as the joined payload would be, so a
+// failed op can be resumed by passing the joined payload to ChunkingResume.
+func ChunkingApplySegments(segments [][]byte, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	conf := newConfig(opts)
+	if len(segments) == 1 || conf.needsWholePayload() {
+		return chunkingApplyConf(bytes.Join(segments, nil), extensions, timeout, applyFunc, conf)
+	}
+	return conf.withBarrier(applySegments(segments, extensions, timeout, applyFunc, conf), timeout)
+}
+
+// needsWholePayload returns whether the options need an op's payload in one
+// piece.
+func (c *config) needsWholePayload() bool {
+	return c.compression != CompressionNone ||
+		c.contentOpNum ||
+		c.adaptiveTarget > 0 ||
+		c.leadershipAttempts > 1
+}
+
+// applySegments does the work of ChunkingApplySegments for segments that
+// aren't joined.
+func applySegments(segments [][]byte, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config) ChunkingFuture {
+	var size int
+	for _, seg := range segments {
+		size += len(seg)
+	}
+	if err := checkPayloadSize(size, conf); err != nil {
+		return errorFuture{err: err}
+	}
+	op, err := newOpParams(conf, nil, extensions)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	if conf.passthrough && size <= op.chunkSize {
+		// Small enough that joining it costs little
+		if f, ok := passThrough(bytes.Join(segments, nil), extensions, timeout, applyFunc, conf, op); ok {
+			return f
+		}
+	}
+	if conf.totalSize {
+		op.totalSize = size
+	}
+	if conf.bufferPool {
+		op.buffers = &bufferSet{chunkSize: op.chunkSize}
+	}
+	logs, err := splitSegmentsIntoLogs(segments, size, extensions, conf, op)
+	if err != nil {
+		op.buffers.release()
+		return errorFuture{err: err}
+	}
+	return applyOpLogs(logs, size, timeout, applyFunc, conf, op)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestChunkingApplySegments(t *testing.T) {
+	data := make([]byte, 5*ChunkSize+123)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	segments := [][]byte{
+		data[:2*ChunkSize],
+		nil,
+		data[2*ChunkSize : 2*ChunkSize+10],
+		data[2*ChunkSize+10 : 4*ChunkSize],
+		data[4*ChunkSize:],
+	}
+	want, err := SplitIntoLogs(data, []byte("ext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, opts := range map[string][]Option{
+		"copied":     nil,
+		"zero copy":  {WithZeroCopy()},
+		"compressed": {WithCompression(CompressionSnappy)},
+		"integrity":  append([]Option{WithHashAlgorithm(anyHash()), WithTotalSize()}, withChunkChecksums()...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, nil)
+			var logs []raft.Log
+			applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+				logs = append(logs, l)
+				return appliedFuture{resp: f.Apply(&l)}
+			}
+			if err := ChunkingApplySegments(segments, []byte("ext"), time.Second, applyFunc, opts...).Error(); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.logs) != 1 || !bytes.Equal(data, m.logs[0]) {
+				t.Fatalf("expected the joined segments to be applied, got %d logs", len(m.logs))
+			}
+			if name == "copied" || name == "zero copy" {
+				// The op is split as the joined payload would be
+				var sent []byte
+				for _, l := range logs {
+					sent = append(sent, l.Data...)
+				}
+				if len(logs) != len(want) || !bytes.Equal(sent, data) {
+					t.Fatalf("expected %d chunks of the payload in order, got %d", len(want), len(logs))
+				}
+			}
+			if name == "zero copy" && &logs[0].Data[0] != &data[0] {
+				t.Fatal("expected the first chunk to be sliced out of its segment")
+			}
+			if name == "copied" && &logs[0].Data[0] == &data[0] {
+				t.Fatal("expected the first chunk to be copied")
+			}
+		})
+	}
+}
+
+func TestChunkingApplySegments_Resume(t *testing.T) {
+	data := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var sent int
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		sent++
+		if sent == 2 {
+			return errorFuture{err: raft.ErrNotLeader}
+		}
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	segments := [][]byte{data[:ChunkSize/2], data[ChunkSize/2:]}
+	future := ChunkingApplySegments(segments, nil, time.Second, applyFunc).(ChunkingFuture)
+	if future.Error() == nil {
+		t.Fatal("expected op to fail")
+	}
+	if err := ChunkingResume(data, nil, future.ResumeToken(), time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 1 || !bytes.Equal(data, m.logs[0]) {
+		t.Fatalf("expected resumed op to be applied, got %d logs", len(m.logs))
+	}
+}
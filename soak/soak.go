@@ -0,0 +1,447 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Package soak provides a long-running soak test harness for chunked applies.
+// It continuously applies randomly sized payloads through a real in-process
+// raft cluster whose nodes use ChunkingFSM, sampling memory use and chunk
+// backlog as it goes and checking that every node applied exactly the same
+// payloads. It is meant to be run from a downstream project's tests to
+// qualify the library (and its chosen options) before a production rollout:
+//
+//	func TestChunkingSoak(t *testing.T) {
+//		res := soak.Run(t, soak.Config{Duration: 4 * time.Hour})
+//		t.Logf("applied %d ops", res.Applied)
+//	}
+package soak
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+	"github.com/hashicorp/raft"
+)
+
+// Config configures a soak run. Zero values are replaced with defaults.
+type Config struct {
+	// Duration is how long to keep applying payloads. Defaults to one minute.
+	Duration time.Duration
+
+	// Peers is the number of nodes in the cluster. Defaults to 3.
+	Peers int
+
+	// Concurrency is the number of goroutines applying payloads at once.
+	// Defaults to 4.
+	Concurrency int
+
+	// MinPayloadSize and MaxPayloadSize bound the randomly chosen payload
+	// sizes. They default to 1KiB and 8MiB.
+	MinPayloadSize int
+	MaxPayloadSize int
+
+	// Seed seeds payload size and content generation. Defaults to the
+	// current time.
+	Seed int64
+
+	// SampleInterval is how often memory and backlog are sampled and
+	// divergence is checked. Defaults to 10 seconds.
+	SampleInterval time.Duration
+
+	// Timeout is the per-chunk apply timeout. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// MaxPendingBytes, if non-zero, fails the run if any node's chunk
+	// backlog is ever sampled above it.
+	MaxPendingBytes uint64
+
+	// Store, if set, is called to create the chunk storage for each node.
+	// Defaults to in-memory storage.
+	Store func() raftchunking.ChunkStorage
+
+	// Options are passed to both ChunkingApply and the FSMs.
+	Options []raftchunking.Option
+}
+
+// Sample is a point-in-time measurement taken during a run.
+type Sample struct {
+	Elapsed time.Duration
+
+	// HeapAlloc is the process heap size at sample time
+	HeapAlloc uint64
+
+	// PendingOps and PendingBytes are the largest chunk backlog among the
+	// nodes
+	PendingOps   uint64
+	PendingBytes uint64
+
+	// Applied is the number of ops successfully applied so far
+	Applied uint64
+}
+
+// Result summarizes a soak run.
+type Result struct {
+	// Applied and Failed count the ops whose futures succeeded or failed
+	Applied uint64
+	Failed  uint64
+
+	// NotLeader counts the attempts that failed because the node they were
+	// sent to wasn't, or stopped being, the leader. Such ops are sent again
+	// to the current leader and aren't counted in Failed.
+	NotLeader uint64
+
+	// Bytes is the total payload size of successfully applied ops
+	Bytes uint64
+
+	// Samples holds the periodic measurements in order
+	Samples []Sample
+
+	// Divergences counts the points at which nodes were found to have
+	// applied different payloads
+	Divergences int
+}
+
+func (c *Config) setDefaults() {
+	if c.Duration <= 0 {
+		c.Duration = time.Minute
+	}
+	if c.Peers <= 0 {
+		c.Peers = 3
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 4
+	}
+	if c.MinPayloadSize <= 0 {
+		c.MinPayloadSize = 1024
+	}
+	if c.MaxPayloadSize <= 0 {
+		c.MaxPayloadSize = 8 * 1024 * 1024
+	}
+	if c.MaxPayloadSize < c.MinPayloadSize {
+		c.MaxPayloadSize = c.MinPayloadSize
+	}
+	if c.Seed == 0 {
+		c.Seed = time.Now().UnixNano()
+	}
+	if c.SampleInterval <= 0 {
+		c.SampleInterval = 10 * time.Second
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+}
+
+// Run performs a soak run, failing t if any node diverges, the backlog limit
+// is exceeded, or ops with failed futures are left unaccounted for.
+func Run(t *testing.T, conf Config) *Result {
+	conf.setDefaults()
+	t.Logf("soak: running for %s with seed %d", conf.Duration, conf.Seed)
+
+	var fsmLock sync.Mutex
+	var fsms []*raftchunking.ChunkingFSM
+	var digests []*digestFSM
+	makeFSM := func() raft.FSM {
+		d := newDigestFSM()
+		var store raftchunking.ChunkStorage
+		if conf.Store != nil {
+			store = conf.Store()
+		}
+		f := raftchunking.NewChunkingFSM(d, store, conf.Options...)
+
+		fsmLock.Lock()
+		defer fsmLock.Unlock()
+		fsms = append(fsms, f)
+		digests = append(digests, d)
+		return f
+	}
+
+	c := raft.MakeClusterCustom(t, &raft.MakeClusterOpts{
+		Peers:           conf.Peers,
+		Bootstrap:       true,
+		MakeFSMFunc:     makeFSM,
+		LongstopTimeout: 30 * time.Second,
+	})
+	defer c.Close()
+	rafts := append([]*raft.Raft{c.Leader()}, c.Followers()...)
+
+	res := new(Result)
+	start := time.Now()
+	deadline := start.Add(conf.Duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Concurrency; i++ {
+		r := rand.New(rand.NewSource(conf.Seed + int64(i)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				size := conf.MinPayloadSize + r.Intn(conf.MaxPayloadSize-conf.MinPayloadSize+1)
+				data := make([]byte, size)
+				r.Read(data)
+				switch err := applyOnLeader(rafts, data, deadline, res, &conf); {
+				case err == nil:
+					atomic.AddUint64(&res.Applied, 1)
+					atomic.AddUint64(&res.Bytes, uint64(size))
+				case !isLeadershipError(err):
+					atomic.AddUint64(&res.Failed, 1)
+				}
+			}
+		}()
+	}
+
+	sample := func() {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		s := Sample{
+			Elapsed:   time.Since(start),
+			HeapAlloc: ms.HeapAlloc,
+			Applied:   atomic.LoadUint64(&res.Applied),
+		}
+		fsmLock.Lock()
+		for _, f := range fsms {
+			if n := f.PendingOps(); n > s.PendingOps {
+				s.PendingOps = n
+			}
+			if n := f.PendingBytes(); n > s.PendingBytes {
+				s.PendingBytes = n
+			}
+		}
+		diverged := !digestsAgree(digests)
+		fsmLock.Unlock()
+
+		res.Samples = append(res.Samples, s)
+		t.Logf("soak: %s elapsed, %d applied, heap %d bytes, backlog %d ops / %d bytes",
+			s.Elapsed.Round(time.Second), s.Applied, s.HeapAlloc, s.PendingOps, s.PendingBytes)
+		if diverged {
+			res.Divergences++
+			t.Errorf("soak: nodes diverged at %s", s.Elapsed)
+		}
+		if conf.MaxPendingBytes > 0 && s.PendingBytes > conf.MaxPendingBytes {
+			t.Errorf("soak: backlog of %d bytes exceeds limit of %d", s.PendingBytes, conf.MaxPendingBytes)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(conf.SampleInterval)
+	defer ticker.Stop()
+LOOP:
+	for {
+		select {
+		case <-ticker.C:
+			sample()
+		case <-done:
+			break LOOP
+		}
+	}
+
+	// Give followers a chance to catch up before the final comparison
+	if err := barrierOnLeader(rafts, time.Now().Add(30*time.Second), &conf); err != nil {
+		t.Errorf("soak: barrier failed: %v", err)
+	}
+	waitForCatchUp(digests, &fsmLock, 30*time.Second)
+	sample()
+
+	t.Logf("soak: finished; %d ops (%d bytes) applied, %d failed, %d attempts sent to a non-leader",
+		res.Applied, res.Bytes, res.Failed, res.NotLeader)
+	return res
+}
+
+// applyOnLeader applies data on whichever node is leader, sending it again to
+// the new leader each time an attempt fails for want of leadership, until one
+// succeeds, fails for another reason or the deadline passes.
+func applyOnLeader(rafts []*raft.Raft, data []byte, deadline time.Time, res *Result, conf *Config) error {
+	for {
+		leader := currentLeader(rafts)
+		if leader == nil {
+			if !time.Now().Before(deadline) {
+				return raft.ErrNotLeader
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		err := raftchunking.ChunkingApply(data, nil, conf.Timeout, leader.ApplyLog, conf.Options...).Error()
+		if !isLeadershipError(err) {
+			return err
+		}
+		atomic.AddUint64(&res.NotLeader, 1)
+		if !time.Now().Before(deadline) {
+			return err
+		}
+	}
+}
+
+// barrierOnLeader issues a barrier on whichever node is leader, trying again
+// on the new leader if leadership moves, until the deadline passes.
+func barrierOnLeader(rafts []*raft.Raft, deadline time.Time, conf *Config) error {
+	for {
+		err := raft.ErrNotLeader
+		if leader := currentLeader(rafts); leader != nil {
+			err = leader.Barrier(conf.Timeout).Error()
+		}
+		if !isLeadershipError(err) || !time.Now().Before(deadline) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// currentLeader returns the node that believes it is leader, or nil if none
+// does, such as during an election.
+func currentLeader(rafts []*raft.Raft) *raft.Raft {
+	for _, r := range rafts {
+		if r.State() == raft.Leader {
+			return r
+		}
+	}
+	return nil
+}
+
+// isLeadershipError returns whether err means an op or barrier failed because
+// the node wasn't, or stopped being, the leader.
+func isLeadershipError(err error) bool {
+	return errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) ||
+		errors.Is(err, raft.ErrLeadershipTransferInProgress)
+}
+
+// waitForCatchUp waits until every node has applied the same number of
+// payloads or the timeout expires.
+func waitForCatchUp(digests []*digestFSM, l *sync.Mutex, timeout time.Duration) {
+	limit := time.Now().Add(timeout)
+	for time.Now().Before(limit) {
+		l.Lock()
+		var counts []uint64
+		for _, d := range digests {
+			counts = append(counts, d.count())
+		}
+		l.Unlock()
+
+		same := true
+		for _, c := range counts {
+			if c != counts[0] {
+				same = false
+			}
+		}
+		if same {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// digestsAgree compares the nodes' digests at every count they have all
+// reached. Nodes may lag each other, so only common history is compared.
+func digestsAgree(digests []*digestFSM) bool {
+	if len(digests) < 2 {
+		return true
+	}
+	for _, d := range digests[1:] {
+		if !digests[0].agrees(d) {
+			return false
+		}
+	}
+	return true
+}
+
+// digestFSM folds every applied payload into a running SHA-256 chain instead
+// of keeping the payloads, so that it can run for hours in bounded memory.
+// Digests at regular counts are kept for comparison with other nodes.
+type digestFSM struct {
+	l       sync.Mutex
+	n       uint64
+	digest  [sha256.Size]byte
+	history map[uint64][sha256.Size]byte
+}
+
+// digestHistory is how many payloads apart retained digests are.
+const digestHistory = 16
+
+func newDigestFSM() *digestFSM {
+	return &digestFSM{
+		history: make(map[uint64][sha256.Size]byte),
+	}
+}
+
+func (d *digestFSM) Apply(l *raft.Log) interface{} {
+	d.l.Lock()
+	defer d.l.Unlock()
+	h := sha256.New()
+	h.Write(d.digest[:])
+	h.Write(l.Data)
+	copy(d.digest[:], h.Sum(nil))
+	d.n++
+	if d.n%digestHistory == 0 {
+		d.history[d.n] = d.digest
+	}
+	return d.n
+}
+
+func (d *digestFSM) count() uint64 {
+	d.l.Lock()
+	defer d.l.Unlock()
+	return d.n
+}
+
+func (d *digestFSM) agrees(other *digestFSM) bool {
+	d.l.Lock()
+	defer d.l.Unlock()
+	other.l.Lock()
+	defer other.l.Unlock()
+	for n, digest := range d.history {
+		if od, ok := other.history[n]; ok && od != digest {
+			return false
+		}
+	}
+	if d.n == other.n && d.digest != other.digest {
+		return false
+	}
+	return true
+}
+
+func (d *digestFSM) Snapshot() (raft.FSMSnapshot, error) {
+	d.l.Lock()
+	defer d.l.Unlock()
+	buf := make([]byte, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buf, d.n)
+	copy(buf[8:], d.digest[:])
+	return digestSnapshot(buf), nil
+}
+
+func (d *digestFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	buf, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if len(buf) != 8+sha256.Size {
+		return io.ErrUnexpectedEOF
+	}
+	d.l.Lock()
+	defer d.l.Unlock()
+	d.n = binary.BigEndian.Uint64(buf)
+	copy(d.digest[:], buf[8:])
+	return nil
+}
+
+type digestSnapshot []byte
+
+func (s digestSnapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := sink.Write(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s digestSnapshot) Release() {}
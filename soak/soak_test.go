@@ -0,0 +1,27 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package soak
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	res := Run(t, Config{
+		Duration:       2 * time.Second,
+		SampleInterval: 500 * time.Millisecond,
+		MaxPayloadSize: 2 * 1024 * 1024,
+		Seed:           1,
+	})
+	if res.Applied == 0 {
+		t.Fatal("expected some ops to be applied")
+	}
+	if res.Divergences != 0 {
+		t.Fatalf("unexpected divergences: %d", res.Divergences)
+	}
+	if len(res.Samples) < 2 {
+		t.Fatalf("expected several samples, got %d", len(res.Samples))
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+// SpillingChunkStorage satisfies ChunkStorage by keeping chunk data in memory
+// until the data held for in-flight ops passes a threshold, then spilling to
+// disk the op whose chunk would take it over. Once an op has been spilled its
+// chunks, including any still to arrive, are kept in a spill file managed as
+// with DiskChunkStorage, which is removed when the op completes, is cleared or
+// is discarded on a term change. Small ops never touch the disk, while large
+// ones don't hold the payload in memory while it arrives.
+//
+// Like InmemChunkStorage it is not safe for concurrent use on its own;
+// ChunkingFSM serializes access to its store.
+type SpillingChunkStorage struct {
+	mem       *InmemChunkStorage
+	disk      *DiskChunkStorage
+	threshold uint64
+
+	// memBytes is the chunk data held in memory, and opBytes how much of it
+	// belongs to each op
+	memBytes uint64
+	opBytes  map[uint64]uint64
+}
+
+var _ ChunkStorage = (*SpillingChunkStorage)(nil)
+
+// NewSpillingChunkStorage returns a SpillingChunkStorage that holds up to
+// threshold bytes of chunk data in memory and spills ops to files in dir,
+// creating the directory if needed and removing any spill files left behind
+// by a previous process. A threshold of zero spills every op.
+func NewSpillingChunkStorage(dir string, threshold uint64) (*SpillingChunkStorage, error) {
+	disk, err := NewDiskChunkStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &SpillingChunkStorage{
+		mem:       NewInmemChunkStorage(),
+		disk:      disk,
+		threshold: threshold,
+		opBytes:   make(map[uint64]uint64),
+	}, nil
+}
+
+func (s *SpillingChunkStorage) StoreChunk(chunk *ChunkInfo) (bool, error) {
+	if s.spilled(chunk.OpNum) {
+		return s.disk.StoreChunk(chunk)
+	}
+
+	// A chunk stored again replaces the earlier copy
+	var replaced uint64
+	if chunks := s.mem.chunks[chunk.OpNum]; int(chunk.SequenceNum) < len(chunks) && chunks[chunk.SequenceNum] != nil {
+		replaced = uint64(len(chunks[chunk.SequenceNum].Data))
+	}
+	size := uint64(len(chunk.Data))
+	if s.memBytes-replaced+size > s.threshold {
+		if err := s.spill(chunk.OpNum); err != nil {
+			return false, err
+		}
+		return s.disk.StoreChunk(chunk)
+	}
+
+	done, err := s.mem.StoreChunk(chunk)
+	if err != nil {
+		return false, err
+	}
+	s.memBytes = s.memBytes - replaced + size
+	s.opBytes[chunk.OpNum] = s.opBytes[chunk.OpNum] - replaced + size
+	return done, nil
+}
+
+// spilled returns whether the op's chunks are kept on disk.
+func (s *SpillingChunkStorage) spilled(opNum uint64) bool {
+	_, ok := s.disk.ops[opNum]
+	return ok
+}
+
+// spill moves the chunks held in memory for an op to disk.
+func (s *SpillingChunkStorage) spill(opNum uint64) error {
+	chunks, err := s.mem.FinalizeOp(opNum)
+	if err != nil {
+		return err
+	}
+	s.release(opNum)
+	for _, chunk := range chunks {
+		if chunk == nil {
+			continue
+		}
+		if _, err := s.disk.StoreChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release drops the accounting for an op no longer held in memory.
+func (s *SpillingChunkStorage) release(opNum uint64) {
+	s.memBytes -= s.opBytes[opNum]
+	delete(s.opBytes, opNum)
+}
+
+func (s *SpillingChunkStorage) FinalizeOp(opNum uint64) ([]*ChunkInfo, error) {
+	if s.spilled(opNum) {
+		return s.disk.FinalizeOp(opNum)
+	}
+	s.release(opNum)
+	return s.mem.FinalizeOp(opNum)
+}
+
+func (s *SpillingChunkStorage) GetChunks() (ChunkMap, error) {
+	ret, err := s.mem.GetChunks()
+	if err != nil {
+		return nil, err
+	}
+	spilled, err := s.disk.GetChunks()
+	if err != nil {
+		return nil, err
+	}
+	for opNum, chunks := range spilled {
+		ret[opNum] = chunks
+	}
+	return ret, nil
+}
+
+// RestoreChunks replaces the store's contents, spilling ops as StoreChunk
+// would if they don't fit under the threshold.
+func (s *SpillingChunkStorage) RestoreChunks(chunks ChunkMap) error {
+	if err := s.mem.RestoreChunks(nil); err != nil {
+		return err
+	}
+	s.memBytes = 0
+	s.opBytes = make(map[uint64]uint64)
+	if err := s.disk.RestoreChunks(nil); err != nil {
+		return err
+	}
+	for _, opChunks := range chunks {
+		for _, chunk := range opChunks {
+			if chunk == nil {
+				continue
+			}
+			// Chunks are copied so that the caller's map isn't held on to,
+			// as with InmemChunkStorage
+			c := *chunk
+			c.Data = append([]byte(nil), chunk.Data...)
+			if _, err := s.StoreChunk(&c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MemoryBytes returns how much chunk data is currently held in memory.
+func (s *SpillingChunkStorage) MemoryBytes() uint64 {
+	return s.memBytes
+}
+
+// Close removes all spill files and drops the chunks held in memory,
+// discarding any partial ops. The store can continue to be used afterwards.
+func (s *SpillingChunkStorage) Close() error {
+	if err := s.mem.RestoreChunks(nil); err != nil {
+		return err
+	}
+	s.memBytes = 0
+	s.opBytes = make(map[uint64]uint64)
+	return s.disk.Close()
+}
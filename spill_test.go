@@ -0,0 +1,108 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestSpillingChunkStorage_FSM(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSpillingChunkStorage(dir, uint64(2*ChunkSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, store)
+
+	// Ops under the threshold stay in memory
+	small, err := SplitIntoLogs(bytes.Repeat([]byte("a"), ChunkSize+10), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := f.Apply(&small[0]); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+	if store.MemoryBytes() != uint64(len(small[0].Data)) || len(spillFiles(t, dir)) != 0 {
+		t.Fatalf("expected the chunk to be held in memory, got %d bytes and %v", store.MemoryBytes(), spillFiles(t, dir))
+	}
+	if _, ok := f.Apply(&small[1]).(ChunkingSuccess); !ok {
+		t.Fatal("expected small op to succeed")
+	}
+	if store.MemoryBytes() != 0 {
+		t.Fatalf("expected memory to be released, got %d bytes", store.MemoryBytes())
+	}
+
+	// A large op is spilled once it passes the threshold
+	data, logs := chunkData(t)
+	for i, l := range logs[:len(logs)-1] {
+		if r := f.Apply(l); r != nil {
+			t.Fatalf("unexpected response for log %d: %#v", i, r)
+		}
+		if store.MemoryBytes() > uint64(2*ChunkSize) {
+			t.Fatalf("expected at most %d bytes in memory, got %d", 2*ChunkSize, store.MemoryBytes())
+		}
+	}
+	if files := spillFiles(t, dir); len(files) != 1 || store.MemoryBytes() != 0 {
+		t.Fatalf("expected the op to be spilled, got %v and %d bytes in memory", files, store.MemoryBytes())
+	}
+
+	// Snapshots see the spilled chunks, and restoring spills them again
+	state, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.RestoreState(state); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := f.CurrentState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(state, restored); diff != nil {
+		t.Fatal(diff)
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected the restored op to be spilled, got %v", files)
+	}
+
+	if _, ok := f.Apply(logs[len(logs)-1]).(ChunkingSuccess); !ok {
+		t.Fatal("expected final apply to succeed")
+	}
+	if !bytes.Equal(data, m.logs[1]) {
+		t.Fatal("reassembled payload does not match")
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill file to be removed, got %v", files)
+	}
+
+	// A term change discards a spilled op and its file
+	for _, l := range logs[:3] {
+		if r := f.Apply(l); r != nil {
+			t.Fatalf("unexpected response: %#v", r)
+		}
+	}
+	if files := spillFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected one spill file, got %v", files)
+	}
+	small[0].Term = logs[0].Term + 1
+	if r := f.Apply(&small[0]); r != nil {
+		t.Fatalf("unexpected response: %#v", r)
+	}
+	if files := spillFiles(t, dir); len(files) != 0 || store.MemoryBytes() != uint64(len(small[0].Data)) {
+		t.Fatalf("expected only the new op in memory, got %v and %d bytes", files, store.MemoryBytes())
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if store.MemoryBytes() != 0 || len(spillFiles(t, dir)) != 0 {
+		t.Fatal("expected the store to be emptied on close")
+	}
+}
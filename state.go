@@ -0,0 +1,146 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import "sort"
+
+// OpChange describes a single op in a StateDiff.
+type OpChange struct {
+	OpNum     uint64
+	NumChunks uint32
+
+	// ChunksBefore and ChunksAfter are the number of the op's chunks held
+	// in each state
+	ChunksBefore int
+	ChunksAfter  int
+}
+
+// StateDiff is the difference between two captured States, as returned by
+// DiffStates. Each list is sorted by op number.
+type StateDiff struct {
+	// Appeared holds ops that are only in the second state
+	Appeared []OpChange
+
+	// Progressed holds ops in both states for which the second state has
+	// received chunks that the first had not, without having all of them
+	Progressed []OpChange
+
+	// Completed holds ops whose chunks are all in the second state but not
+	// in the first. Ops are normally removed from the FSM's state as soon
+	// as they complete, so this is mostly seen when comparing states built
+	// by hand or restored from elsewhere.
+	Completed []OpChange
+
+	// Vanished holds ops that are only in the first state. A State does not
+	// record why an op left it, so these may have completed or been
+	// discarded.
+	Vanished []OpChange
+
+	// Regressed holds ops in both states for which the second state lacks
+	// chunks that the first had. This never happens between two states
+	// captured from the same FSM, so it points to divergence.
+	Regressed []OpChange
+}
+
+// Empty returns whether the two states held the same chunks.
+func (d *StateDiff) Empty() bool {
+	return len(d.Appeared) == 0 && len(d.Progressed) == 0 && len(d.Completed) == 0 &&
+		len(d.Vanished) == 0 && len(d.Regressed) == 0
+}
+
+// DiffStates compares the ops in two States, such as ones captured with
+// CurrentState at different times or on different nodes. Chunks are compared
+// by sequence number only; their data is not. A nil State is treated as
+// empty.
+func DiffStates(a, b *State) *StateDiff {
+	var before, after ChunkMap
+	if a != nil {
+		before = a.ChunkMap
+	}
+	if b != nil {
+		after = b.ChunkMap
+	}
+
+	diff := new(StateDiff)
+	for opNum, aChunks := range before {
+		bChunks, ok := after[opNum]
+		change := OpChange{
+			OpNum:        opNum,
+			NumChunks:    opNumChunks(aChunks),
+			ChunksBefore: countChunks(aChunks),
+			ChunksAfter:  countChunks(bChunks),
+		}
+		if !ok {
+			diff.Vanished = append(diff.Vanished, change)
+			continue
+		}
+		if n := opNumChunks(bChunks); n != 0 {
+			change.NumChunks = n
+		}
+
+		var gained, lost bool
+		for seq := 0; seq < len(aChunks) || seq < len(bChunks); seq++ {
+			had, has := hasChunk(aChunks, seq), hasChunk(bChunks, seq)
+			gained = gained || (has && !had)
+			lost = lost || (had && !has)
+		}
+		switch {
+		case lost:
+			diff.Regressed = append(diff.Regressed, change)
+		case !gained:
+		case change.ChunksAfter == int(change.NumChunks):
+			diff.Completed = append(diff.Completed, change)
+		default:
+			diff.Progressed = append(diff.Progressed, change)
+		}
+	}
+	for opNum, bChunks := range after {
+		if _, ok := before[opNum]; ok {
+			continue
+		}
+		change := OpChange{
+			OpNum:       opNum,
+			NumChunks:   opNumChunks(bChunks),
+			ChunksAfter: countChunks(bChunks),
+		}
+		if change.ChunksAfter == int(change.NumChunks) {
+			diff.Completed = append(diff.Completed, change)
+		} else {
+			diff.Appeared = append(diff.Appeared, change)
+		}
+	}
+
+	for _, changes := range [][]OpChange{diff.Appeared, diff.Progressed, diff.Completed, diff.Vanished, diff.Regressed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].OpNum < changes[j].OpNum })
+	}
+	return diff
+}
+
+// hasChunk returns whether the chunk with the given sequence number is
+// present. As in the stores, chunks without data don't count.
+func hasChunk(chunks []*ChunkInfo, seq int) bool {
+	return seq < len(chunks) && chunks[seq] != nil && len(chunks[seq].Data) > 0
+}
+
+// countChunks returns the number of chunks present.
+func countChunks(chunks []*ChunkInfo) int {
+	var n int
+	for seq := range chunks {
+		if hasChunk(chunks, seq) {
+			n++
+		}
+	}
+	return n
+}
+
+// opNumChunks returns the number of chunks in the op, as recorded by its
+// chunks. The latest chunk is used, as a streamed op's count grows.
+func opNumChunks(chunks []*ChunkInfo) uint32 {
+	for i := len(chunks) - 1; i >= 0; i-- {
+		if chunks[i] != nil {
+			return chunks[i].NumChunks
+		}
+	}
+	return uint32(len(chunks))
+}
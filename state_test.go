@@ -0,0 +1,64 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func diffTestChunks(opNum uint64, numChunks uint32, seqs ...uint32) []*ChunkInfo {
+	ret := make([]*ChunkInfo, numChunks)
+	for _, seq := range seqs {
+		ret[seq] = &ChunkInfo{
+			OpNum:       opNum,
+			SequenceNum: seq,
+			NumChunks:   numChunks,
+			Data:        []byte{byte(seq)},
+		}
+	}
+	return ret
+}
+
+func TestDiffStates(t *testing.T) {
+	a := &State{ChunkMap: ChunkMap{
+		1: diffTestChunks(1, 3, 0),
+		2: diffTestChunks(2, 3, 0),
+		3: diffTestChunks(3, 3, 0, 1),
+		4: diffTestChunks(4, 2, 0),
+		5: diffTestChunks(5, 2, 1),
+	}}
+	b := &State{ChunkMap: ChunkMap{
+		1: diffTestChunks(1, 3, 0),
+		2: diffTestChunks(2, 3, 0, 2),
+		3: diffTestChunks(3, 3, 0, 1, 2),
+		5: diffTestChunks(5, 2, 0),
+		6: diffTestChunks(6, 4, 1),
+	}}
+
+	expected := &StateDiff{
+		Appeared:   []OpChange{{OpNum: 6, NumChunks: 4, ChunksAfter: 1}},
+		Progressed: []OpChange{{OpNum: 2, NumChunks: 3, ChunksBefore: 1, ChunksAfter: 2}},
+		Completed:  []OpChange{{OpNum: 3, NumChunks: 3, ChunksBefore: 2, ChunksAfter: 3}},
+		Vanished:   []OpChange{{OpNum: 4, NumChunks: 2, ChunksBefore: 1}},
+		Regressed:  []OpChange{{OpNum: 5, NumChunks: 2, ChunksBefore: 1, ChunksAfter: 1}},
+	}
+	diff := DiffStates(a, b)
+	if d := deep.Equal(expected, diff); d != nil {
+		t.Fatal(d)
+	}
+	if diff.Empty() {
+		t.Fatal("expected non-empty diff")
+	}
+
+	if diff := DiffStates(a, a); !diff.Empty() {
+		t.Fatalf("expected empty diff, got %#v", diff)
+	}
+
+	diff = DiffStates(nil, b)
+	if len(diff.Appeared) != 4 || len(diff.Completed) != 1 {
+		t.Fatalf("unexpected diff from nil state %#v", diff)
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+)
+
+// ChunkingApplyReader applies the data read from r until io.EOF as a single
+// op, as ChunkingApply does with a payload, for sources whose length isn't
+// known up front, such as pipes and network connections. Chunks are submitted
+// as they are read, so the payload is never held in memory as a whole, and
+// the number of chunks is only given with the final one. Each chunk has room
+// for the final chunk's header, so chunks are slightly smaller than with
+// ChunkingApply. If reading fails the op fails with the error, leaving any
+// chunks already submitted to be cancelled with CancelChunkingOp. Compression,
+// WithTotalSize and WithContentOpNum need the whole payload and can't be
+// used, and streamed ops can't be resumed. Since nodes that don't understand
+// streaming can't track an op's growing chunk count, all nodes must understand
+// it before it is used.
+func ChunkingApplyReader(r io.Reader, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, opts ...Option) raft.ApplyFuture {
+	conf := newConfig(opts)
+	return conf.withBarrier(applyReader(r, extensions, timeout, applyFunc, conf), timeout)
+}
+
+// applyReader does the work of ChunkingApplyReader.
+func applyReader(r io.Reader, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config) ChunkingFuture {
+	switch {
+	case conf.compression != CompressionNone:
+		return errorFuture{err: errors.New("streamed ops can't be compressed")}
+	case conf.totalSize:
+		return errorFuture{err: errors.New("WithTotalSize can't be used with streamed ops")}
+	case conf.contentOpNum:
+		return errorFuture{err: errors.New("WithContentOpNum can't be used with streamed ops")}
+	}
+	op, err := newOpParams(conf, nil, extensions)
+	if err != nil {
+		return errorFuture{err: err}
+	}
+	return applyStream(r, extensions, timeout, applyFunc, conf, op)
+}
+
+// applyStream submits the chunks of an op read from r as they are read.
+func applyStream(r io.Reader, extensions []byte, timeout time.Duration, applyFunc ApplyFunc, conf *config, op *opParams) ChunkingFuture {
+	if conf.bufferPool {
+		op.buffers = &bufferSet{chunkSize: op.chunkSize}
+	}
+	st, err := newStream(r, extensions, conf, op)
+	if err != nil {
+		op.buffers.release()
+		return errorFuture{err: err}
+	}
+	var sent time.Time
+	if conf.adaptiveTarget > 0 {
+		// Note when each chunk is handed over, to time how long it takes
+		// to apply
+		next := applyFunc
+		applyFunc = func(l raft.Log, timeout time.Duration) raft.ApplyFuture {
+			sent = time.Now()
+			return next(l, timeout)
+		}
+	}
+	s, err := newSubmitter(op.opNum, 0, st.maxChunkSize, timeout, applyFunc, conf)
+	if err != nil {
+		// Nothing was submitted
+		op.buffers.release()
+		return errorFuture{err: err}
+	}
+
+	var seqs []uint32
+	for {
+		log, done, err := st.next()
+		if err != nil {
+			s.err = err
+			break
+		}
+		if done {
+			break
+		}
+		if !s.submit(log) {
+			break
+		}
+		seqs = append(seqs, uint32(len(seqs)))
+		if conf.adaptiveTarget > 0 {
+			if err := s.mf[len(s.mf)-1].Error(); err != nil {
+				s.err = err
+				break
+			}
+			st.adapt(time.Since(sent))
+		}
+	}
+
+	// Only the chunk that failed is known to be missing
+	var unsent int
+	if s.err != nil && len(s.mf) == len(seqs) {
+		unsent = 1
+	}
+	mf := s.finish(unsent)
+	op.buffers.releaseWhenApplied(mf)
+	for len(seqs) < len(mf) {
+		seqs = append(seqs, uint32(len(seqs)))
+	}
+	return &chunkingFuture{
+		multiFuture: mf,
+		submitted:   mf.submitted(),
+		seqs:        seqs,
+		opNum:       op.opNum,
+	}
+}
+
+// stream builds the logs of a streamed op as its data is read.
+type stream struct {
+	r        io.Reader
+	conf     *config
+	op       *opParams
+	overhead int
+	others   Extensions
+	hasher   hash.Hash
+
+	// chunkSize is the size of the chunks being read, which only changes
+	// with WithAdaptiveChunkSize, up to maxChunkSize
+	chunkSize    int
+	maxChunkSize int
+
+	chunkHeader func(seq, numChunks int) *types.ChunkInfo
+
+	// pending is the data read for chunk seq, eof whether the reader has
+	// nothing after it and read how much has been read in all
+	seq     int
+	pending []byte
+	eof     bool
+	read    int
+}
+
+func newStream(r io.Reader, extensions []byte, conf *config, op *opParams) (*stream, error) {
+	st := &stream{r: r, conf: conf, op: op, chunkSize: op.chunkSize, maxChunkSize: op.chunkSize}
+	if conf.adaptiveTarget > 0 && conf.maxChunkSize > op.chunkSize {
+		st.maxChunkSize = conf.maxChunkSize
+	}
+	if op.aead != nil {
+		st.overhead = op.aead.Overhead()
+	}
+	if conf.encryptFunc != nil {
+		if conf.encryptOverhead < 0 {
+			return nil, fmt.Errorf("encryption overhead must not be negative, got %d", conf.encryptOverhead)
+		}
+		st.overhead += conf.encryptOverhead
+	}
+	if err := conf.checkFIPS(conf.hashAlgorithm); err != nil {
+		return nil, err
+	}
+	var err error
+	if st.hasher, err = conf.hashAlgorithm.newHash(); err != nil {
+		return nil, err
+	}
+	if st.others, err = conf.otherExtensions(extensions); err != nil {
+		return nil, err
+	}
+	st.chunkHeader, _ = op.chunkHeaders(conf, extensions, st.others)
+
+	// Read the first chunk, so that the reader's end can be seen
+	if err := st.fill(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// header returns the header for chunk seq, which is final if the reader has
+// nothing after it.
+func (st *stream) header(seq int, final bool) *types.ChunkInfo {
+	if !final {
+		return st.chunkHeader(seq, seq+2)
+	}
+	ci := st.chunkHeader(seq, seq+1)
+	ci.IsFinal = true
+	return ci
+}
+
+// budget returns how much data chunk seq can hold, leaving room for its
+// header whether or not it turns out to be the final chunk.
+func (st *stream) budget(seq int) (int, error) {
+	if uint64(seq)+2 > math.MaxUint32 {
+		return 0, fmt.Errorf("streamed op needs more than %d chunks of size %d", uint64(math.MaxUint32), st.chunkSize)
+	}
+	size := st.conf.chunkExtensionsSize(st.header(seq, false), st.others)
+	if final := st.conf.chunkExtensionsSize(st.header(seq, true), st.others); final > size {
+		size = final
+	}
+	b := st.chunkSize - size - st.overhead
+	if b <= 0 {
+		return 0, fmt.Errorf("%w: %d is too small to hold the header of a streamed chunk", ErrInvalidChunkSize, st.chunkSize)
+	}
+	return b, nil
+}
+
+// fill reads the data for chunk st.seq into st.pending.
+func (st *stream) fill() error {
+	if st.eof {
+		st.pending = nil
+		return nil
+	}
+	b, err := st.budget(st.seq)
+	if err != nil {
+		return err
+	}
+	buf := st.op.buffers.data(b)
+	n, err := io.ReadFull(st.r, buf)
+	switch err {
+	case nil:
+	case io.EOF, io.ErrUnexpectedEOF:
+		st.eof = true
+	default:
+		return fmt.Errorf("error reading payload: %w", err)
+	}
+	st.read += n
+	if err := checkPayloadSize(st.read, st.conf); err != nil {
+		return err
+	}
+	st.pending = buf[:n]
+	return nil
+}
+
+// next returns the log for the next chunk, or done once there are no more.
+func (st *stream) next() (raft.Log, bool, error) {
+	data, seq := st.pending, st.seq
+	if len(data) == 0 {
+		return raft.Log{}, true, nil
+	}
+
+	// Chunks without data are not considered received, so the final chunk
+	// is the last one with any
+	st.seq++
+	if err := st.fill(); err != nil {
+		return raft.Log{}, false, err
+	}
+	final := len(st.pending) == 0
+
+	if st.op.aead != nil {
+		data = sealChunk(st.op.aead, st.op.opNum, uint32(seq), data)
+	}
+	if st.conf.encryptFunc != nil {
+		var err error
+		if data, err = st.conf.encryptChunk(st.op.opNum, uint32(seq), data); err != nil {
+			return raft.Log{}, false, err
+		}
+	}
+	if st.hasher != nil {
+		st.hasher.Write(data)
+	}
+
+	ci := st.header(seq, final)
+	if st.conf.chunkChecksums {
+		ci.ChunkChecksum = chunkChecksum(data)
+	}
+	if final {
+		ci.PayloadDigest = nil
+		if st.hasher != nil {
+			ci.PayloadDigest = st.hasher.Sum(nil)
+		}
+	}
+	ext, err := st.conf.marshalChunkExtensions(ci, st.others, st.op.buffers)
+	if err != nil {
+		return raft.Log{}, false, err
+	}
+	return st.conf.newLog(data, ext), false, nil
+}
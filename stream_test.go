@@ -0,0 +1,202 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/hashicorp/go-raftchunking/types"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestChunkingApplyReader(t *testing.T) {
+	data := make([]byte, 3*ChunkSize+17)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	disk, err := NewDiskChunkStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	kp := newTestKeyProvider(t)
+
+	for name, tc := range map[string]struct {
+		size      int
+		chunkSize int
+		store     ChunkStorage
+		opts      []Option
+	}{
+		"one chunk": {size: 100},
+		"many":      {size: len(data)},
+		"disk":      {size: len(data), store: disk},
+		"encrypted": {size: len(data), opts: []Option{WithKeyProvider(kp)}},
+		"integrity": {size: len(data), opts: append([]Option{WithHashAlgorithm(anyHash())}, withChunkChecksums()...)},
+		"namespace": {size: len(data), opts: []Option{WithExtensionsNamespace(3)}},
+		"small":     {size: 5000, chunkSize: 1024, opts: []Option{WithChunkSize(1024)}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := new(MockFSM)
+			f := NewChunkingFSM(m, tc.store, tc.opts...)
+			var logs []raft.Log
+			applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+				logs = append(logs, l)
+				return appliedFuture{resp: f.Apply(&l)}
+			}
+
+			ext := []byte("ext")
+			if name == "namespace" {
+				if ext, err = (Extensions{7: []byte("other")}).Marshal(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r := iotest.HalfReader(bytes.NewReader(data[:tc.size]))
+			future := ChunkingApplyReader(r, ext, time.Second, applyFunc, tc.opts...)
+			if err := future.Error(); err != nil {
+				t.Fatal(err)
+			}
+			if len(m.logs) != 1 || !bytes.Equal(m.logs[0], data[:tc.size]) {
+				t.Fatalf("expected the streamed payload to be applied, got %d logs", len(m.logs))
+			}
+			if _, ok := future.Response().(ChunkingSuccess); !ok {
+				t.Fatalf("expected success, got %#v", future.Response())
+			}
+
+			// The chunk count is only known from the final chunk
+			for i, l := range logs {
+				var ci types.ChunkInfo
+				b := l.Extensions
+				if name == "namespace" {
+					nsExt, err := ParseExtensions(b)
+					if err != nil {
+						t.Fatal(err)
+					}
+					b = nsExt[3]
+				}
+				if err := proto.Unmarshal(b, &ci); err != nil {
+					t.Fatal(err)
+				}
+				final := i == len(logs)-1
+				want := uint32(i + 2)
+				if final {
+					want = uint32(len(logs))
+				}
+				if ci.IsFinal != final || ci.NumChunks != want {
+					t.Fatalf("chunk %d of %d: got final %v and %d chunks", i, len(logs), ci.IsFinal, ci.NumChunks)
+				}
+				chunkSize := ChunkSize
+				if tc.chunkSize != 0 {
+					chunkSize = tc.chunkSize
+				}
+				if len(l.Data)+len(l.Extensions) > chunkSize {
+					t.Fatalf("chunk %d is %d bytes, over the chunk size", i, len(l.Data)+len(l.Extensions))
+				}
+			}
+			if future.(ChunkingFuture).ResumeToken() != nil {
+				t.Fatal("expected no resume token")
+			}
+		})
+	}
+	if files := spillFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected spill files to be removed, got %v", files)
+	}
+}
+
+func TestChunkingApplyReader_Reassembler(t *testing.T) {
+	data := make([]byte, 2*ChunkSize+100)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	var logs []raft.Log
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		logs = append(logs, l)
+		return appliedFuture{}
+	}
+	if err := ChunkingApplyReader(bytes.NewReader(data), []byte("ext"), time.Second, applyFunc, WithHashAlgorithm(anyHash())).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	r := NewReassembler(func(opNum uint64) (io.Writer, error) {
+		return &buf, nil
+	}, WithHashAlgorithm(anyHash()))
+	var op *ReassembledOp
+	for i := range logs {
+		var err error
+		if op, err = r.Add(&logs[i]); err != nil {
+			t.Fatal(err)
+		}
+		if op != nil && i != len(logs)-1 {
+			t.Fatalf("op completed early, on chunk %d of %d", i, len(logs))
+		}
+	}
+	if op == nil || op.Size != uint64(len(data)) || string(op.Extensions) != "ext" {
+		t.Fatalf("unexpected completed op %#v", op)
+	}
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Fatal("reassembled payload does not match")
+	}
+}
+
+func TestChunkingApplyReader_Errors(t *testing.T) {
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// Nothing is applied for an empty reader
+	if err := ChunkingApplyReader(bytes.NewReader(nil), nil, time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed read fails the op, leaving the chunks sent to be cancelled
+	errRead := errors.New("read failed")
+	r := io.MultiReader(bytes.NewReader(make([]byte, 3*ChunkSize)), iotest.ErrReader(errRead))
+	future := ChunkingApplyReader(r, nil, time.Second, applyFunc).(ChunkingFuture)
+	if err := future.Error(); !errors.Is(err, errRead) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if f.PendingOps() != 1 {
+		t.Fatalf("expected the partial op to be pending, got %d", f.PendingOps())
+	}
+	if err := CancelChunkingOp(future.OpNum(), time.Second, applyFunc).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if f.PendingOps() != 0 || len(m.logs) != 0 {
+		t.Fatalf("expected the op to be cancelled, got %d pending and %d applied", f.PendingOps(), len(m.logs))
+	}
+
+	// Options needing the whole payload are rejected
+	for _, opt := range []Option{WithCompression(CompressionSnappy), WithTotalSize(), WithContentOpNum(nil)} {
+		if err := ChunkingApplyReader(bytes.NewReader([]byte("data")), nil, time.Second, applyFunc, opt).Error(); err == nil {
+			t.Fatal("expected option to be rejected")
+		}
+	}
+
+	// A final chunk must give the actual chunk count
+	logs, err := SplitIntoLogs(make([]byte, 2*ChunkSize), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ci types.ChunkInfo
+	if err := proto.Unmarshal(logs[0].Extensions, &ci); err != nil {
+		t.Fatal(err)
+	}
+	ci.IsFinal = true
+	if logs[0].Extensions, err = proto.Marshal(&ci); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Apply(&logs[0]).(error); !ok {
+		t.Fatal("expected a final chunk with the wrong count to fail the op")
+	}
+}
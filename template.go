@@ -0,0 +1,32 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"github.com/hashicorp/raft"
+)
+
+// WithLogTemplate makes ChunkingApply, SplitIntoLogs and the other functions
+// building logs start each log they hand to the apply function as a copy of
+// l, with Data and Extensions replaced, so that the log Type, AppendedAt and
+// any other fields set on l reach middleware wrapping the apply function the
+// same way on every chunk. ApplyLog on a raft.Raft only carries Data and
+// Extensions, so the fields only matter to apply functions that look at them,
+// and raft only hands LogCommand logs to the FSM. It is ignored by the FSM.
+func WithLogTemplate(l raft.Log) Option {
+	return func(c *config) {
+		c.logTemplate = &l
+	}
+}
+
+// newLog returns a log carrying data and extensions, built from the template
+// set with WithLogTemplate if there is one.
+func (c *config) newLog(data, extensions []byte) raft.Log {
+	var l raft.Log
+	if c.logTemplate != nil {
+		l = *c.logTemplate
+	}
+	l.Data, l.Extensions = data, extensions
+	return l
+}
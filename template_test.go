@@ -0,0 +1,62 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestWithLogTemplate(t *testing.T) {
+	data := compressibleData(3 * ChunkSize)
+	appendedAt := time.Unix(1700000000, 0)
+	tmpl := WithLogTemplate(raft.Log{Type: raft.LogCommand, AppendedAt: appendedAt, Data: []byte("ignored")})
+
+	m := new(MockFSM)
+	f := NewChunkingFSM(m, nil)
+	var logs []raft.Log
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		logs = append(logs, l)
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// Every chunk carries the template's fields, however it was built
+	if err := ChunkingApply(data, nil, time.Second, applyFunc, tmpl).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChunkingApplyReader(bytes.NewReader(data), nil, time.Second, applyFunc, tmpl).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if err := CancelChunkingOp(1, time.Second, applyFunc, tmpl).Error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.logs) != 2 || !bytes.Equal(data, m.logs[0]) || !bytes.Equal(data, m.logs[1]) {
+		t.Fatalf("expected both ops to be applied, got %d", len(m.logs))
+	}
+	for i, l := range logs {
+		if !l.AppendedAt.Equal(appendedAt) || bytes.Equal(l.Data, []byte("ignored")) {
+			t.Fatalf("log %d does not match the template: %#v", i, l)
+		}
+	}
+
+	// The type can be set too
+	split, err := SplitIntoLogs(data, nil, WithLogTemplate(raft.Log{Type: raft.LogNoop}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, l := range split {
+		if l.Type != raft.LogNoop || len(l.Extensions) == 0 {
+			t.Fatalf("expected chunk %d to be a noop log with a chunk header, got %#v", i, l)
+		}
+	}
+	if split, err = SplitIntoLogs(data, nil); err != nil {
+		t.Fatal(err)
+	}
+	if split[0].Type != raft.LogCommand || !split[0].AppendedAt.IsZero() {
+		t.Fatalf("expected a plain command log without a template, got %#v", split[0])
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/hashicorp/go-raftchunking/testdata/compat/gen
+
+go 1.12
+
+require (
+	// The commit introducing the original wire format, whose chunk streams
+	// the v1 fixtures hold; it must stay pinned there.
+	github.com/hashicorp/go-raftchunking v0.0.0-20261014045951-74f2b6ffc347
+	github.com/hashicorp/raft v1.3.11
+)
@@ -0,0 +1,135 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+// Command gen records the v1 compatibility fixtures in testdata/compat. It is
+// built against the version that introduced the original wire format, pinned
+// in go.mod, so the fixtures hold chunk streams produced by that version's
+// ChunkingApply rather than by the current code. See compat_test.go for how
+// to run it.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"time"
+
+	raftchunking "github.com/hashicorp/go-raftchunking"
+	"github.com/hashicorp/raft"
+)
+
+// The fixture layout matches compatFixture in compat_test.go.
+type compatLog struct {
+	Index      uint64 `json:"index"`
+	Term       uint64 `json:"term"`
+	Data       []byte `json:"data"`
+	Extensions []byte `json:"extensions,omitempty"`
+}
+
+type compatOp struct {
+	Payload    []byte `json:"payload"`
+	Extensions []byte `json:"extensions,omitempty"`
+}
+
+type compatFixture struct {
+	Description string      `json:"description"`
+	Format      string      `json:"format"`
+	Logs        []compatLog `json:"logs"`
+	Completed   []compatOp  `json:"completed"`
+}
+
+// appliedFuture is returned for every chunk, which is only recorded.
+type appliedFuture struct{}
+
+func (appliedFuture) Error() error          { return nil }
+func (appliedFuture) Response() interface{} { return nil }
+func (appliedFuture) Index() uint64         { return 0 }
+
+// termLog is a chunk along with the term to record it in.
+type termLog struct {
+	raft.Log
+	term uint64
+}
+
+func main() {
+	out := flag.String("out", "..", "directory to write the fixtures to")
+	seed := flag.Int64("seed", 1, "seed for the payload contents")
+	flag.Parse()
+
+	raftchunking.ChunkSize = 1024
+	r := rand.New(rand.NewSource(*seed))
+	chunk := func(size int, ext []byte) ([]raft.Log, compatOp) {
+		data := make([]byte, size)
+		r.Read(data)
+		var logs []raft.Log
+		f := raftchunking.ChunkingApply(data, ext, time.Second, func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+			logs = append(logs, l)
+			return appliedFuture{}
+		})
+		if err := f.Error(); err != nil {
+			log.Fatal(err)
+		}
+		return logs, compatOp{Payload: data, Extensions: ext}
+	}
+	inTerm := func(term uint64, logs ...raft.Log) []termLog {
+		ret := make([]termLog, 0, len(logs))
+		for _, l := range logs {
+			ret = append(ret, termLog{Log: l, term: term})
+		}
+		return ret
+	}
+
+	fixtures := make(map[string]*compatFixture)
+	build := func(name, desc string, logs []termLog, ops ...compatOp) {
+		fx := &compatFixture{Description: desc, Format: "v1", Completed: ops}
+		for i, l := range logs {
+			fx.Logs = append(fx.Logs, compatLog{Index: uint64(i + 1), Term: l.term, Data: l.Data, Extensions: l.Extensions})
+		}
+		fixtures[name] = fx
+	}
+
+	logs, op := chunk(100, nil)
+	build("single", "single chunk op", inTerm(1, logs...), op)
+
+	logs, op = chunk(10000, []byte("compat-ext"))
+	build("multi", "multi chunk op with extensions", inTerm(1, logs...), op)
+
+	// The chunks of the two ops alternate until the first runs out
+	first, firstOp := chunk(5000, nil)
+	second, secondOp := chunk(3000, []byte("a"))
+	var interleaved []termLog
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, inTerm(1, first[i])...)
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, inTerm(1, second[i])...)
+		}
+	}
+	build("interleaved", "two interleaved ops", interleaved, secondOp, firstOp)
+
+	// The rest of the dropped op's chunks arrive after another op completes in
+	// the new term, so it never does
+	dropped, _ := chunk(5000, nil)
+	logs, op = chunk(4000, []byte("b"))
+	var termChange []termLog
+	termChange = append(termChange, inTerm(1, dropped[:3]...)...)
+	termChange = append(termChange, inTerm(2, logs...)...)
+	termChange = append(termChange, inTerm(2, dropped[3:]...)...)
+	build("term-change", "partial op dropped on term change", termChange, op)
+
+	for name, fx := range fixtures {
+		b, err := json.MarshalIndent(fx, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		file := filepath.Join(*out, fmt.Sprintf("v1-%s.json", name))
+		if err := ioutil.WriteFile(file, append(b, '\n'), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"io"
+
+	"github.com/hashicorp/raft"
+)
+
+// ChunkedWriter applies everything written to it as a single op, so that
+// encoders such as json.Encoder or gzip.Writer can stream straight into raft.
+// Chunks are submitted as soon as enough has been written to fill them, and
+// the final chunk when the writer is closed. The op is sent as
+// ChunkingApplyReader sends it, with the same limitations.
+type ChunkedWriter struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+
+	// future and err are the op's future and its error, set once the op has
+	// finished
+	future raft.ApplyFuture
+	err    error
+}
+
+var _ io.WriteCloser = (*ChunkedWriter)(nil)
+
+// NewChunkedWriter returns a writer whose output is applied through
+// applyFunc, taking the extensions from WithExtensions and the timeout for
+// each chunk from WithApplyTimeout, as ChunkingApplyWithOptions does.
+func NewChunkedWriter(applyFunc ApplyFunc, opts ...Option) *ChunkedWriter {
+	conf := newConfig(opts)
+	pr, pw := io.Pipe()
+	w := &ChunkedWriter{
+		pw:   pw,
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(w.done)
+		f := conf.withBarrier(applyReader(pr, conf.extensions, conf.applyTimeout, applyFunc, conf), conf.applyTimeout)
+		w.future, w.err = f, f.Error()
+
+		// Fail any further writes, which would otherwise block now that
+		// nothing is reading them
+		if w.err != nil {
+			pr.CloseWithError(w.err)
+		} else {
+			pr.Close()
+		}
+	}()
+	return w
+}
+
+// Write writes p to the op, blocking until it has been taken into chunks. It
+// returns the op's error if the op has failed.
+func (w *ChunkedWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close submits the final chunk and waits for the op to finish, returning its
+// error. Closing the writer again returns the same error.
+func (w *ChunkedWriter) Close() error {
+	w.pw.Close()
+	<-w.done
+	return w.err
+}
+
+// Future returns the op's future, giving the FSM's response. It is only
+// meaningful once Close has returned.
+func (w *ChunkedWriter) Future() raft.ApplyFuture {
+	<-w.done
+	return w.future
+}
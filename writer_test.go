@@ -0,0 +1,94 @@
+// Copyright (c) HashiCorp, Inc.
+// SPDX-License-Identifier: MPL-2.0
+
+package raftchunking
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+func TestChunkedWriter(t *testing.T) {
+	m := new(extensionsFSM)
+	f := NewChunkingFSM(m, nil)
+	var sent int32
+	applyFunc := func(l raft.Log, _ time.Duration) raft.ApplyFuture {
+		atomic.AddInt32(&sent, 1)
+		return appliedFuture{resp: f.Apply(&l)}
+	}
+
+	// Encoders can write straight into the op
+	payload := make([]byte, 3*ChunkSize)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatal(err)
+	}
+	value := map[string][]byte{"payload": payload}
+	w := NewChunkedWriter(applyFunc, WithExtensions([]byte("ext")), WithApplyTimeout(time.Second))
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(value); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&sent) == 0 {
+		t.Fatal("expected chunks to be submitted before the writer is closed")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.Future().Response().(ChunkingSuccess); !ok {
+		t.Fatalf("expected success, got %#v", w.Future().Response())
+	}
+	if len(m.logs) != 1 || string(m.logs[0].Extensions) != "ext" {
+		t.Fatalf("expected the op to be applied, got %d logs", len(m.logs))
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(m.logs[0].Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string][]byte
+	if err := json.NewDecoder(zr).Decode(&got); err != nil || !bytes.Equal(got["payload"], payload) {
+		t.Fatalf("decoded payload does not match: %v", err)
+	}
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Fatal("expected writes after close to fail")
+	}
+}
+
+func TestChunkedWriter_Failure(t *testing.T) {
+	applyFunc := func(raft.Log, time.Duration) raft.ApplyFuture {
+		return errorFuture{err: raft.ErrNotLeader}
+	}
+
+	// Writes fail once the op has, rather than blocking
+	w := NewChunkedWriter(applyFunc, WithSequentialApply())
+	data := make([]byte, ChunkSize)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = w.Write(data)
+	}
+	if !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected writes to fail with the op's error, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, raft.ErrNotLeader) {
+		t.Fatalf("expected close to return the op's error, got %v", err)
+	}
+
+	// Options that can't be streamed fail the first write
+	w = NewChunkedWriter(applyFunc, WithCompression(CompressionGzip))
+	if _, err := w.Write([]byte("data")); err == nil {
+		t.Fatal("expected write to fail")
+	}
+	if err := w.Close(); err == nil {
+		t.Fatal("expected close to fail")
+	}
+}